@@ -0,0 +1,212 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// API keys are long-lived credentials for services that call the REST API as a user, so they
+// needn't embed the user's password. A user can have several, each revoked on its own, so they
+// can be rotated without downtime. A key looks like "<id>.<secret>"; the bucket stores only a
+// hash of the secret, in a "_sync:apikey:<id>" doc, plus a list of each user's key IDs in a
+// "_sync:apikeys:<username>" doc.
+
+// Scheme of an Authorization header carrying an API key: "Authorization: APIKey <key>"
+const APIKeyAuthScheme = "APIKey"
+
+const APIKeyPrefix = "_sync:apikey:"
+const kUserAPIKeysPrefix = "_sync:apikeys:"
+
+// An API key, as stored in the bucket.
+type APIKey struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Label      string    `json:"label,omitempty"` // What the key is for, e.g. the service using it
+	Created    time.Time `json:"created"`
+	SecretHash string    `json:"secret_hash,omitempty"`
+}
+
+func docIDForAPIKey(id string) string {
+	return APIKeyPrefix + id
+}
+
+func docIDForUserAPIKeys(username string) string {
+	return kUserAPIKeysPrefix + username
+}
+
+func hashAPIKeySecret(secret string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))
+}
+
+// Returns the API key given in a request's Authorization header, or "" if there isn't one.
+func APIKeyFromHeader(rq *http.Request) string {
+	header := rq.Header.Get("Authorization")
+	if strings.HasPrefix(header, APIKeyAuthScheme+" ") {
+		return strings.TrimSpace(header[len(APIKeyAuthScheme)+1:])
+	}
+	return ""
+}
+
+// Creates a new API key for a user. Returns the stored key and the key string to give to the
+// client; the latter can't be recovered later.
+func (auth *Authenticator) CreateAPIKey(username string, label string) (*APIKey, string, error) {
+	secret := base.GenerateRandomSecret()
+	apiKey := &APIKey{
+		ID:         base.GenerateRandomSecret()[0:16],
+		Username:   username,
+		Label:      label,
+		Created:    time.Now(),
+		SecretHash: hashAPIKeySecret(secret),
+	}
+	if err := auth.bucket.Set(docIDForAPIKey(apiKey.ID), 0, apiKey); err != nil {
+		return nil, "", err
+	}
+	err := auth.updateUserAPIKeys(username, func(ids []string) []string {
+		return append(ids, apiKey.ID)
+	})
+	if err != nil {
+		auth.bucket.Delete(docIDForAPIKey(apiKey.ID))
+		return nil, "", err
+	}
+	base.LogTo("Auth", "Created API key %s for user %q", apiKey.ID, username)
+	return apiKey, apiKey.ID + "." + secret, nil
+}
+
+// Returns a user's API keys (without their secret hashes.)
+func (auth *Authenticator) GetAPIKeys(username string) ([]*APIKey, error) {
+	ids, err := auth.userAPIKeyIDs(username)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*APIKey{}
+	for _, id := range ids {
+		apiKey, err := auth.getAPIKey(id)
+		if err != nil {
+			return nil, err
+		} else if apiKey != nil {
+			apiKey.SecretHash = ""
+			keys = append(keys, apiKey)
+		}
+	}
+	return keys, nil
+}
+
+// Revokes one of a user's API keys. Returns a 404 error if the user has no such key.
+func (auth *Authenticator) RevokeAPIKey(username string, id string) error {
+	apiKey, err := auth.getAPIKey(id)
+	if err != nil {
+		return err
+	} else if apiKey == nil || apiKey.Username != username {
+		return base.HTTPErrorf(http.StatusNotFound, "No such API key")
+	}
+	if err := auth.bucket.Delete(docIDForAPIKey(id)); err != nil {
+		return err
+	}
+	base.LogTo("Auth", "Revoked API key %s of user %q", id, username)
+	return auth.updateUserAPIKeys(username, func(ids []string) []string {
+		for i, existing := range ids {
+			if existing == id {
+				return append(ids[:i], ids[i+1:]...)
+			}
+		}
+		return ids
+	})
+}
+
+// Revokes all of a user's API keys, e.g. when the user is deleted.
+func (auth *Authenticator) RevokeAllAPIKeys(username string) error {
+	ids, err := auth.userAPIKeyIDs(username)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := auth.bucket.Delete(docIDForAPIKey(id)); err != nil && !base.IsDocNotFoundError(err) {
+			return err
+		}
+	}
+	err = auth.bucket.Delete(docIDForUserAPIKeys(username))
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// Authenticates a request by the API key in its Authorization header. Returns a nil user if
+// there's no such header, or the key is invalid or revoked, or its user is disabled.
+func (auth *Authenticator) AuthenticateAPIKey(rq *http.Request) (User, error) {
+	key := APIKeyFromHeader(rq)
+	dot := strings.Index(key, ".")
+	if dot < 0 {
+		return nil, nil
+	}
+	apiKey, err := auth.getAPIKey(key[0:dot])
+	if apiKey == nil || err != nil {
+		return nil, err
+	}
+	hash := hashAPIKeySecret(key[dot+1:])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(apiKey.SecretHash)) != 1 {
+		return nil, nil
+	}
+	user, err := auth.GetUser(apiKey.Username)
+	if user != nil && user.Disabled() {
+		user = nil
+	}
+	return user, err
+}
+
+func (auth *Authenticator) getAPIKey(id string) (*APIKey, error) {
+	var apiKey APIKey
+	if err := auth.bucket.Get(docIDForAPIKey(id), &apiKey); err != nil {
+		if base.IsDocNotFoundError(err) {
+			err = nil
+		}
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+func (auth *Authenticator) userAPIKeyIDs(username string) (ids []string, err error) {
+	if err = auth.bucket.Get(docIDForUserAPIKeys(username), &ids); base.IsDocNotFoundError(err) {
+		err = nil
+	}
+	return
+}
+
+func (auth *Authenticator) updateUserAPIKeys(username string, fn func([]string) []string) error {
+	err := auth.bucket.Update(docIDForUserAPIKeys(username), 0, func(currentValue []byte) ([]byte, error) {
+		var ids []string
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &ids); err != nil {
+				return nil, err
+			}
+		}
+		count := len(ids)
+		ids = fn(ids)
+		if len(ids) == count && currentValue != nil {
+			return nil, couchbase.UpdateCancel
+		}
+		return json.Marshal(ids)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
@@ -11,6 +11,7 @@ package auth
 
 import (
 	"encoding/json"
+	"net/http"
 
 	"github.com/couchbaselabs/go-couchbase"
 
@@ -22,6 +23,7 @@ import (
 type Authenticator struct {
 	bucket          base.Bucket
 	channelComputer ChannelComputer
+	deferred        *InvalidationCache // In-memory deferred invalidations, if any
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
@@ -90,6 +92,7 @@ func (auth *Authenticator) GetRole(name string) (Role, error) {
 // Common implementation of GetUser and GetRole. factory() parameter returns a new empty instance.
 func (auth *Authenticator) getPrincipal(docID string, factory func() Principal) (Principal, error) {
 	var princ Principal
+	invalSeq, deferredInval := auth.deferredInvalidation(docID)
 
 	err := auth.bucket.Update(docID, 0, func(currentValue []byte) ([]byte, error) {
 		// Be careful: this block can be invoked multiple times if there are races!
@@ -101,6 +104,11 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 		if err := json.Unmarshal(currentValue, princ); err != nil {
 			return nil, err
 		}
+		if deferredInval && princ.Channels() != nil {
+			base.LogTo("Access", "Applying deferred invalidation of %q", princ.Name())
+			princ.setInvalidatedAt(invalSeq)
+			princ.setChannels(nil)
+		}
 		changed := false
 		if princ.Channels() == nil {
 			// Channel list has been invalidated by a doc update -- rebuild it:
@@ -108,6 +116,11 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 				return nil, err
 			}
 			changed = true
+		} else if !princ.Channels().Contains(ch.DocumentStarChannel) {
+			// Saved before the public channel was granted to everyone (e.g. a guest user that
+			// was enabled from the default one) -- add it now:
+			princ.Channels().AddChannel(ch.DocumentStarChannel, 1)
+			changed = true
 		}
 		if user, ok := princ.(User); ok {
 			if user.RoleNames() == nil {
@@ -130,6 +143,9 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 	if err != nil && err != couchbase.UpdateCancel {
 		return nil, err
 	}
+	if deferredInval {
+		auth.clearDeferredInvalidation(docID, invalSeq)
+	}
 	return princ, nil
 }
 
@@ -212,10 +228,51 @@ func (auth *Authenticator) Save(p Principal) error {
 	return nil
 }
 
+// Atomically modifies a user or role: loads it, passes it to the callback, and saves it if the
+// callback returns true. If another update races with this one, the callback is called again
+// with the newer principal. Returns a 404 error if the user or role doesn't exist.
+func (auth *Authenticator) ModifyPrincipal(name string, isUser bool, callback func(Principal) (bool, error)) error {
+	docID, factory := docIDForRole(name), func() Principal { return &roleImpl{} }
+	if isUser {
+		docID, factory = docIDForUser(name), func() Principal { return &userImpl{auth: auth} }
+	}
+	err := auth.bucket.Update(docID, 0, func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		if currentValue == nil {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+		princ := factory()
+		if err := json.Unmarshal(currentValue, princ); err != nil {
+			return nil, err
+		}
+		if changed, err := callback(princ); err != nil {
+			return nil, err
+		} else if !changed {
+			return nil, couchbase.UpdateCancel
+		} else if err := princ.validate(); err != nil {
+			return nil, err
+		}
+		return json.Marshal(princ)
+	})
+	if err == couchbase.UpdateCancel {
+		return nil
+	} else if err == nil {
+		base.LogTo("Auth", "Modified %s", docID)
+	}
+	return err
+}
+
 // Invalidates the channel list of a user/role by saving its Channels() property as nil.
 func (auth *Authenticator) InvalidateChannels(p Principal) error {
+	return auth.InvalidateChannelsAt(p, 0)
+}
+
+// Like InvalidateChannels, but records the sequence of the document change that caused it, for
+// the principal's ChannelHistory.
+func (auth *Authenticator) InvalidateChannelsAt(p Principal, sequence uint64) error {
 	if p != nil && p.Channels() != nil {
 		base.LogTo("Access", "Invalidate access of %q", p.Name())
+		p.setInvalidatedAt(sequence)
 		p.setChannels(nil)
 		if err := auth.Save(p); err != nil {
 			return err
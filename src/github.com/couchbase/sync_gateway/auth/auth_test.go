@@ -13,6 +13,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -260,6 +262,23 @@ func TestGetGuestUser(t *testing.T) {
 
 }
 
+func TestGuestCanSeePublicChannel(t *testing.T) {
+	auth := NewAuthenticator(gTestBucket, nil)
+	guest, err := auth.GetUser("")
+	assert.Equals(t, err, nil)
+	assert.True(t, guest.CanSeeChannel(ch.DocumentStarChannel))
+
+	// Enable the guest and reload it; it should keep access to the public channel:
+	guest.SetDisabled(false)
+	assert.Equals(t, auth.Save(guest), nil)
+	guest, err = auth.GetUser("")
+	assert.Equals(t, err, nil)
+	assert.False(t, guest.Disabled())
+	assert.True(t, guest.CanSeeChannel(ch.DocumentStarChannel))
+	assert.Equals(t, guest.AuthorizeAnyChannel(ch.SetOf(ch.DocumentStarChannel)), nil)
+	assert.Equals(t, auth.Delete(guest), nil)
+}
+
 func TestSaveUsers(t *testing.T) {
 	auth := NewAuthenticator(gTestBucket, nil)
 	user, _ := auth.NewUser("testUser", "password", ch.SetOf("test"))
@@ -373,6 +392,9 @@ func TestRoleInheritance(t *testing.T) {
 	assert.True(t, user2.CanSeeChannel("britain"))
 	assert.True(t, user2.CanSeeChannel("duller"))
 	assert.True(t, user2.CanSeeChannel("hoopy"))
+	assert.Equals(t, user2.CanSeeChannelSince("britain"), uint64(1))
+	assert.Equals(t, user2.CanSeeChannelSince("duller"), uint64(3))
+	assert.Equals(t, user2.CanSeeChannelSince("hoopy"), uint64(4))
 	assert.Equals(t, user2.AuthorizeAllChannels(ch.SetOf("britain", "dull", "hoopiest")), nil)
 }
 
@@ -408,3 +430,192 @@ func TestRegisterUser(t *testing.T) {
 	assert.Equals(t, user.Name(), "bar@example.com")
 	assert.Equals(t, err, nil)
 }
+
+func TestSessions(t *testing.T) {
+	auth := NewAuthenticator(gTestBucket, nil)
+	user, _ := auth.NewUser("sessionUser", "password", ch.SetOf("test"))
+	assert.Equals(t, auth.Save(user), nil)
+
+	session, err := auth.CreateSession("sessionUser", time.Hour)
+	assert.Equals(t, err, nil)
+	cookie := auth.MakeSessionCookie(session)
+	assert.True(t, cookie.HttpOnly)
+
+	rq, _ := http.NewRequest("GET", "/db/", nil)
+	rq.AddCookie(cookie)
+	authUser, err := auth.AuthenticateCookie(rq, httptest.NewRecorder())
+	assert.Equals(t, err, nil)
+	assert.Equals(t, authUser.Name(), "sessionUser")
+
+	// An expired session is rejected even if the bucket hasn't removed it yet:
+	session.Expiration = time.Now().Add(-time.Minute)
+	assert.Equals(t, gTestBucket.Set(docIDForSession(session.ID), 0, session), nil)
+	authUser, err = auth.AuthenticateCookie(rq, httptest.NewRecorder())
+	assert.Equals(t, err, nil)
+	assert.Equals(t, authUser, nil)
+	expired, _ := auth.GetSession(session.ID)
+	assert.True(t, expired == nil)
+}
+
+func TestSessionsInvalidatedByCredentialChange(t *testing.T) {
+	auth := NewAuthenticator(gTestBucket, nil)
+	user, _ := auth.NewUser("sessionUser3", "password", ch.SetOf("test"))
+	assert.Equals(t, auth.Save(user), nil)
+
+	session, err := auth.CreateSession("sessionUser3", time.Hour)
+	assert.Equals(t, err, nil)
+	authUser, _, err := auth.authenticateSession(session.ID)
+	assert.Equals(t, authUser.Name(), "sessionUser3")
+
+	// Changing the password invalidates the session, and deletes it:
+	user.SetPassword("new password")
+	assert.Equals(t, auth.Save(user), nil)
+	authUser, _, err = auth.authenticateSession(session.ID)
+	assert.Equals(t, err, nil)
+	assert.True(t, authUser == nil)
+	deleted, _ := auth.GetSession(session.ID)
+	assert.True(t, deleted == nil)
+
+	// New sessions work; disabling the account invalidates them too, even once re-enabled:
+	session, err = auth.CreateSession("sessionUser3", time.Hour)
+	assert.Equals(t, err, nil)
+	authUser, _, err = auth.authenticateSession(session.ID)
+	assert.Equals(t, authUser.Name(), "sessionUser3")
+	user.SetDisabled(true)
+	assert.Equals(t, auth.Save(user), nil)
+	user.SetDisabled(false)
+	assert.Equals(t, auth.Save(user), nil)
+	authUser, _, err = auth.authenticateSession(session.ID)
+	assert.True(t, authUser == nil)
+
+	// Other changes don't affect sessions, nor does setting the same password again:
+	session, err = auth.CreateSession("sessionUser3", time.Hour)
+	assert.Equals(t, err, nil)
+	user.SetEmail("user3@example.com")
+	user.SetPassword("new password")
+	assert.Equals(t, auth.Save(user), nil)
+	authUser, _, err = auth.authenticateSession(session.ID)
+	assert.Equals(t, authUser.Name(), "sessionUser3")
+}
+
+func TestSessionOptions(t *testing.T) {
+	auth := NewAuthenticator(gTestBucket, nil)
+	user, _ := auth.NewUser("sessionUser2", "password", ch.SetOf("test"))
+	assert.Equals(t, auth.Save(user), nil)
+
+	// A non-sliding session keeps its original expiration when used:
+	session, err := auth.CreateSessionWithOptions("sessionUser2", SessionOptions{TTL: time.Hour})
+	assert.Equals(t, err, nil)
+	session.Expiration = time.Now().Add(10 * time.Minute)
+	assert.Equals(t, gTestBucket.Set(docIDForSession(session.ID), 0, session), nil)
+	authUser, refreshed, err := auth.authenticateSession(session.ID)
+	assert.Equals(t, authUser.Name(), "sessionUser2")
+	assert.True(t, refreshed == nil)
+	loaded, _ := auth.GetSession(session.ID)
+	assert.True(t, loaded.Expiration.Before(time.Now().Add(11*time.Minute)))
+
+	// A sliding one is extended:
+	session.Fixed = false
+	assert.Equals(t, gTestBucket.Set(docIDForSession(session.ID), 0, session), nil)
+	_, refreshed, err = auth.authenticateSession(session.ID)
+	assert.True(t, refreshed != nil && refreshed.Expiration.After(time.Now().Add(59*time.Minute)))
+
+	// A session that's been idle too long is rejected, and can be garbage-collected:
+	session, err = auth.CreateSessionWithOptions("sessionUser2",
+		SessionOptions{TTL: time.Hour, IdleTimeout: time.Minute, Sliding: true})
+	assert.Equals(t, err, nil)
+	deleted, err := auth.DeleteSessionIfExpired(session.ID)
+	assert.Equals(t, err, nil)
+	assert.False(t, deleted)
+	idleSince := time.Now().Add(-2 * time.Minute)
+	session.LastUsed = &idleSince
+	assert.Equals(t, gTestBucket.Set(docIDForSession(session.ID), 0, session), nil)
+	loaded, _ = auth.GetSession(session.ID)
+	assert.True(t, loaded == nil)
+	deleted, err = auth.DeleteSessionIfExpired(session.ID)
+	assert.Equals(t, err, nil)
+	assert.True(t, deleted)
+	authUser, _, err = auth.authenticateSession(session.ID)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, authUser, nil)
+}
+
+func TestRoleLoadError(t *testing.T) {
+	bucket := base.NewChaosBucket(gTestBucket, 1)
+	auth := NewAuthenticator(bucket, nil)
+	role, _ := auth.NewRole("editors", ch.SetOf("drafts"))
+	assert.Equals(t, auth.Save(role), nil)
+	user, _ := auth.NewUser("ford", "password", ch.SetOf("towels"))
+	user.(*userImpl).setRolesSince(ch.TimedSet{"editors": 0x2})
+	assert.Equals(t, auth.Save(user), nil)
+
+	// If the role can't be read, the user just lacks its channels for now:
+	user, _ = auth.GetUser("ford")
+	bucket.AddRule(base.ChaosRule{Ops: []string{"Update"}, KeyPrefix: RoleKeyPrefix, Rate: 1.0,
+		Err: base.ErrChaosInjected})
+	assert.True(t, user.CanSeeChannel("towels"))
+	assert.False(t, user.CanSeeChannel("drafts"))
+
+	// ...and gets them once it can be read again:
+	bucket.ClearRules()
+	assert.True(t, user.CanSeeChannel("drafts"))
+}
+
+func TestChannelHistory(t *testing.T) {
+	computer := mockComputer{channels: ch.TimedSet{"derived1": 5, "derived2": 5}}
+	auth := NewAuthenticator(gTestBucket, &computer)
+	user, _ := auth.NewUser("historian", "letmein", ch.SetOf("explicit"))
+	assert.Equals(t, auth.Save(user), nil)
+	user, _ = auth.GetUser("historian")
+	assert.Equals(t, len(user.ChannelHistory()), 0) // first computation isn't a change
+
+	// A doc at sequence 10 revokes derived2 and grants derived3:
+	computer.channels = ch.TimedSet{"derived1": 5, "derived3": 10}
+	assert.Equals(t, auth.InvalidateChannelsAt(user, 10), nil)
+	user, _ = auth.GetUser("historian")
+	assert.DeepEquals(t, user.ChannelHistory(), []ChannelChange{
+		{Sequence: 10, Gained: ch.TimedSet{"derived3": 10}, Lost: []string{"derived2"}},
+	})
+
+	// Recomputing without any change doesn't add to the history:
+	assert.Equals(t, auth.InvalidateChannelsAt(user, 11), nil)
+	user, _ = auth.GetUser("historian")
+	assert.Equals(t, len(user.ChannelHistory()), 1)
+
+	// An admin change is recorded without a sequence, and the history is bounded:
+	for i := 0; i < MaxChannelHistory+5; i++ {
+		user.SetExplicitChannels(ch.AtSequence(ch.SetOf(fmt.Sprintf("x%d", i)), uint64(20+i)))
+		assert.Equals(t, auth.Save(user), nil)
+		user, _ = auth.GetUser("historian")
+	}
+	history := user.ChannelHistory()
+	assert.Equals(t, len(history), MaxChannelHistory)
+	last := history[len(history)-1]
+	assert.Equals(t, last.Sequence, uint64(0))
+	assert.DeepEquals(t, last.Lost, []string{fmt.Sprintf("x%d", MaxChannelHistory+3)})
+}
+
+func TestInvalidationCache(t *testing.T) {
+	auth := NewAuthenticator(gTestBucket, nil)
+	cache := NewInvalidationCache(gTestBucket)
+	auth.UseInvalidationCache(cache)
+	err := auth.DeferChannelInvalidations([]string{"deferredUser", "role:deferredRole"}, 5)
+	assert.Equals(t, err, nil)
+
+	// It's seen without reading the bucket, and by a cache loaded later:
+	seq, found := auth.deferredInvalidation(docIDForUser("deferredUser"))
+	assert.True(t, found)
+	assert.Equals(t, seq, uint64(5))
+	seq, found = NewInvalidationCache(gTestBucket).get(docIDForRole("deferredRole"))
+	assert.True(t, found)
+	assert.Equals(t, seq, uint64(5))
+
+	// Updates report which principals were newly invalidated:
+	key := deferredInvalKey(docIDForUser("deferredUser"))
+	raw, _ := gTestBucket.GetRaw(key)
+	assert.Equals(t, len(cache.Update(key, raw)), 0)
+	auth.clearDeferredInvalidation(docIDForUser("deferredUser"), 5)
+	_, found = auth.deferredInvalidation(docIDForUser("deferredUser"))
+	assert.False(t, found)
+	assert.DeepEquals(t, cache.Update(key, raw), base.SetOf(docIDForUser("deferredUser")))
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"sort"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// A principal's computed channels are only recomputed after they've been invalidated by a
+// document that changed its access grants (or by an admin changing its explicit channels.)
+// The channels it had before are kept until then, so the recomputation can record exactly
+// which channels were gained, with the sequences they were granted at, and which were lost,
+// with the sequence of the change that revoked them. Channels gained are backfilled by the
+// changes feed from the sequence they were granted at (which is also kept in the principal's
+// Channels); channels lost are reported to the client by ChannelsLostSince, so it can purge
+// the documents it can no longer see.
+
+// Max number of ChannelChanges kept per principal.
+const MaxChannelHistory = 20
+
+// A change to a principal's computed channels.
+type ChannelChange struct {
+	Sequence uint64      `json:"seq,omitempty"`    // Sequence of the change that caused it (0 if unknown)
+	Gained   ch.TimedSet `json:"gained,omitempty"` // Channels granted, and the sequences they were granted at
+	Lost     []string    `json:"lost,omitempty"`   // Channels revoked
+}
+
+// Computes the difference between a principal's old and new channels.
+func diffChannels(oldChannels, newChannels ch.TimedSet, sequence uint64) *ChannelChange {
+	change := ChannelChange{Sequence: sequence}
+	for channel, seq := range newChannels {
+		if _, found := oldChannels[channel]; !found {
+			if change.Gained == nil {
+				change.Gained = ch.TimedSet{}
+			}
+			change.Gained[channel] = seq
+		}
+	}
+	for channel := range oldChannels {
+		if _, found := newChannels[channel]; !found {
+			change.Lost = append(change.Lost, channel)
+		}
+	}
+	if change.Gained == nil && change.Lost == nil {
+		return nil
+	}
+	sort.Strings(change.Lost)
+	return &change
+}
+
+func (role *roleImpl) ChannelHistory() []ChannelChange {
+	return role.ChannelHistory_
+}
+
+func (user *userImpl) ChannelsLostSince(since uint64) (lost base.Set, lastSeq uint64) {
+	histories := [][]ChannelChange{user.ChannelHistory_}
+	for _, role := range user.GetRoles() {
+		histories = append(histories, role.ChannelHistory())
+	}
+	var available ch.TimedSet
+	var names []string
+	for _, history := range histories {
+		for _, change := range history {
+			if change.Sequence <= since || len(change.Lost) == 0 {
+				continue
+			}
+			if available == nil {
+				available = user.InheritedChannels()
+			}
+			for _, channel := range change.Lost {
+				if _, found := available[channel]; !found {
+					names = append(names, channel)
+					if change.Sequence > lastSeq {
+						lastSeq = change.Sequence
+					}
+				}
+			}
+		}
+	}
+	if names != nil {
+		lost = base.SetFromArray(names)
+	}
+	return
+}
+
+func (role *roleImpl) setInvalidatedAt(sequence uint64) {
+	if role.InvalidatedAt_ == 0 {
+		role.InvalidatedAt_ = sequence
+	}
+}
+
+// Called by setChannels. Invalidating the channels saves the current ones; recomputing them
+// records what changed since then.
+func (role *roleImpl) noteChannelsChanged(newChannels ch.TimedSet) {
+	if newChannels == nil {
+		if role.Channels_ != nil {
+			role.PreviousChannels_ = role.Channels_
+		}
+		return
+	}
+	if role.PreviousChannels_ != nil {
+		sequence := role.InvalidatedAt_
+		if sequence == 0 {
+			// Not invalidated by a doc, so it was an admin change, which updated the sequence:
+			sequence = role.Sequence_
+		}
+		if change := diffChannels(role.PreviousChannels_, newChannels, sequence); change != nil {
+			base.LogTo("Access", "Channels of %q changed at seq %d: gained %s, lost %v",
+				role.Name_, change.Sequence, change.Gained, change.Lost)
+			role.ChannelHistory_ = append(role.ChannelHistory_, *change)
+			if n := len(role.ChannelHistory_); n > MaxChannelHistory {
+				role.ChannelHistory_ = role.ChannelHistory_[n-MaxChannelHistory:]
+			}
+		}
+	}
+	role.PreviousChannels_ = nil
+	role.InvalidatedAt_ = 0
+}
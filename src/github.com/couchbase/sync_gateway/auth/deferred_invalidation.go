@@ -0,0 +1,189 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"sync"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Invalidating a principal's channels means rewriting its doc, which is fine for the few
+// principals a typical doc grants access to. But a doc that grants a channel to thousands of
+// users (a "public event" everyone's invited to) would cost thousands of reads and writes on
+// every update. Instead, such invalidations are deferred: they're recorded in a fixed number of
+// shared "_sync:inval:XX" docs, each a map from principal doc ID to the sequence that
+// invalidated it, and applied lazily the next time each principal is loaded. So that loading a
+// principal doesn't cost an extra read, each database keeps an InvalidationCache: an
+// in-memory copy of those docs, kept up to date from the bucket's tap feed (which also wakes up
+// the affected users' changes feeds, as a change to their own docs would.)
+
+// Prefix of the keys of the docs that record deferred invalidations.
+const DeferredInvalKeyPrefix = "_sync:inval:"
+
+// Number of docs deferred invalidations are spread across, to limit their size and contention.
+const kDeferredInvalShards = 64
+
+func deferredInvalKey(docID string) string {
+	shard := crc32.ChecksumIEEE([]byte(docID)) % kDeferredInvalShards
+	return fmt.Sprintf("%s%02x", DeferredInvalKeyPrefix, shard)
+}
+
+// An in-memory copy of a bucket's deferred invalidations. It's loaded when created and then
+// kept current by passing it every change to a deferred invalidation doc (see Update.)
+type InvalidationCache struct {
+	lock   sync.RWMutex
+	shards map[string]map[string]uint64 // Shard doc key -> principal doc ID -> sequence
+}
+
+// Loads a bucket's deferred invalidations.
+func NewInvalidationCache(bucket base.Bucket) *InvalidationCache {
+	d := &InvalidationCache{shards: map[string]map[string]uint64{}}
+	for shard := 0; shard < kDeferredInvalShards; shard++ {
+		key := fmt.Sprintf("%s%02x", DeferredInvalKeyPrefix, shard)
+		if raw, err := bucket.GetRaw(key); err == nil {
+			d.Update(key, raw)
+		}
+	}
+	return d
+}
+
+// Records the new contents of a deferred invalidation doc (nil if it was deleted.) Returns the
+// doc IDs of the principals that have been newly invalidated.
+func (d *InvalidationCache) Update(key string, value []byte) base.Set {
+	var pending map[string]uint64
+	if len(value) > 0 && json.Unmarshal(value, &pending) != nil {
+		base.Warn("Invalid deferred invalidations doc %q", key)
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	old := d.shards[key]
+	var changed []string
+	for docID, seq := range pending {
+		if oldSeq, found := old[docID]; !found || seq > oldSeq {
+			changed = append(changed, docID)
+		}
+	}
+	if len(pending) == 0 {
+		delete(d.shards, key)
+	} else {
+		d.shards[key] = pending
+	}
+	return base.SetFromArray(changed)
+}
+
+// Returns the sequence of a deferred invalidation of a principal, if there is one.
+func (d *InvalidationCache) get(docID string) (sequence uint64, found bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	sequence, found = d.shards[deferredInvalKey(docID)][docID]
+	return
+}
+
+// Makes the Authenticator look up deferred invalidations in memory instead of in the bucket.
+func (auth *Authenticator) UseInvalidationCache(d *InvalidationCache) {
+	auth.deferred = d
+}
+
+// Records that the channels of the named principals were invalidated by the doc change with the
+// given sequence, without loading or saving the principals themselves. Names are as in an access
+// map: user names, or role names prefixed with "role:". Each principal's channels will be
+// recomputed the next time it's loaded. Costs one write per shard touched, however many names.
+func (auth *Authenticator) DeferChannelInvalidations(names []string, sequence uint64) error {
+	byKey := map[string][]string{}
+	for _, name := range names {
+		var docID string
+		if strings.HasPrefix(name, "role:") {
+			docID = docIDForRole(name[5:])
+		} else {
+			docID = docIDForUser(name)
+		}
+		key := deferredInvalKey(docID)
+		byKey[key] = append(byKey[key], docID)
+	}
+
+	for key, docIDs := range byKey {
+		var newValue []byte
+		err := auth.bucket.Update(key, 0, func(currentValue []byte) (_ []byte, err error) {
+			pending := map[string]uint64{}
+			if currentValue != nil {
+				if err := json.Unmarshal(currentValue, &pending); err != nil {
+					base.Warn("Invalid deferred invalidations doc %q; replacing it", key)
+					pending = map[string]uint64{}
+				}
+			}
+			for _, docID := range docIDs {
+				if seq, found := pending[docID]; !found || sequence > seq {
+					pending[docID] = sequence
+				}
+			}
+			newValue, err = json.Marshal(pending)
+			return newValue, err
+		})
+		if err != nil {
+			return err
+		}
+		if auth.deferred != nil {
+			// Don't wait for the tap feed, so this node's next load of them applies it:
+			auth.deferred.Update(key, newValue)
+		}
+	}
+	base.LogTo("Access", "Deferred invalidation of %d principals' channels, at seq %d",
+		len(names), sequence)
+	return nil
+}
+
+// Returns the sequence of a deferred invalidation of a principal, if there is one.
+func (auth *Authenticator) deferredInvalidation(docID string) (sequence uint64, found bool) {
+	if auth.deferred != nil {
+		return auth.deferred.get(docID)
+	}
+	raw, err := auth.bucket.GetRaw(deferredInvalKey(docID))
+	if err != nil {
+		return 0, false
+	}
+	var pending map[string]uint64
+	if json.Unmarshal(raw, &pending) != nil {
+		return 0, false
+	}
+	sequence, found = pending[docID]
+	return
+}
+
+// Removes a principal's deferred invalidation once it's been applied, unless another one has
+// been recorded since.
+func (auth *Authenticator) clearDeferredInvalidation(docID string, sequence uint64) {
+	key := deferredInvalKey(docID)
+	var newValue []byte
+	err := auth.bucket.Update(key, 0, func(currentValue []byte) (_ []byte, err error) {
+		var pending map[string]uint64
+		if currentValue == nil || json.Unmarshal(currentValue, &pending) != nil {
+			return nil, couchbase.UpdateCancel
+		}
+		if seq, found := pending[docID]; !found || seq != sequence {
+			return nil, couchbase.UpdateCancel
+		}
+		delete(pending, docID)
+		newValue, err = json.Marshal(pending)
+		return newValue, err
+	})
+	if err != nil && err != couchbase.UpdateCancel {
+		base.Warn("Couldn't clear deferred invalidation of %q: %v", docID, err)
+	} else if err == nil && auth.deferred != nil {
+		auth.deferred.Update(key, newValue)
+	}
+}
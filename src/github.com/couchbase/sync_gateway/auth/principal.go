@@ -32,6 +32,9 @@ type Principal interface {
 	// Sets the explicit channels the Principal has access to.
 	SetExplicitChannels(ch.TimedSet)
 
+	// Recent changes to the Principal's channels, oldest first.
+	ChannelHistory() []ChannelChange
+
 	// Returns true if the Principal has access to the given channel.
 	CanSeeChannel(channel string) bool
 
@@ -53,6 +56,7 @@ type Principal interface {
 	accessViewKey() string
 	validate() error
 	setChannels(ch.TimedSet)
+	setInvalidatedAt(sequence uint64)
 }
 
 // Role is basically the same as Principal, just concrete. Users can inherit channels from Roles.
@@ -82,6 +86,10 @@ type User interface {
 	// Changes the user's password.
 	SetPassword(password string)
 
+	// Incremented whenever the user's password is changed or the account is disabled; login
+	// sessions created before then are no longer valid.
+	SessionVersion() uint64
+
 	// The set of Roles the user belongs to (including ones given to it by the sync function)
 	RoleNames() ch.TimedSet
 
@@ -102,5 +110,10 @@ type User interface {
 	// to, annotated with the sequence number at which access was granted.
 	FilterToAvailableChannels(channels base.Set) ch.TimedSet
 
+	// Returns the channels the user lost access to after the given sequence, directly or through
+	// a role, and hasn't regained; and the latest sequence at which one of them was lost. Only
+	// revocations still in the (bounded) ChannelHistory are found.
+	ChannelsLostSince(since uint64) (lost base.Set, lastSeq uint64)
+
 	setRolesSince(ch.TimedSet)
 }
@@ -21,10 +21,13 @@ import (
 
 /** A group that users can belong to, with associated channel permisisons. */
 type roleImpl struct {
-	Name_             string      `json:"name,omitempty"`
-	ExplicitChannels_ ch.TimedSet `json:"admin_channels,omitempty"`
-	Channels_         ch.TimedSet `json:"all_channels"`
-	Sequence_         uint64      `json:"sequence"`
+	Name_             string          `json:"name,omitempty"`
+	ExplicitChannels_ ch.TimedSet     `json:"admin_channels,omitempty"`
+	Channels_         ch.TimedSet     `json:"all_channels"`
+	Sequence_         uint64          `json:"sequence"`
+	PreviousChannels_ ch.TimedSet     `json:"previous_channels,omitempty"` // Channels before invalidation
+	InvalidatedAt_    uint64          `json:"invalidated_at,omitempty"`    // Sequence that invalidated them
+	ChannelHistory_   []ChannelChange `json:"channel_history,omitempty"`   // Recent channel changes
 }
 
 var kValidNameRegexp *regexp.Regexp
@@ -114,6 +117,7 @@ func (role *roleImpl) Channels() ch.TimedSet {
 }
 
 func (role *roleImpl) setChannels(channels ch.TimedSet) {
+	role.noteChannelsChanged(channels)
 	role.Channels_ = channels
 }
 
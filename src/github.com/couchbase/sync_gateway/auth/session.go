@@ -11,6 +11,7 @@ package auth
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -18,16 +19,54 @@ import (
 
 const kDefaultSessionTTL = 24 * time.Hour
 
+// How a login session expires.
+type SessionOptions struct {
+	TTL         time.Duration // How long it lasts; if Sliding, how long since it was last extended
+	IdleTimeout time.Duration // It expires if unused for this long, even within its TTL (0 = never)
+	Sliding     bool          // If true, using it extends its expiration to TTL from then
+}
+
+// Sessions last for a day after they were last used.
+var DefaultSessionOptions = SessionOptions{TTL: kDefaultSessionTTL, Sliding: true}
+
 // A user login session (used with cookie-based auth.)
 type LoginSession struct {
-	ID         string        `json:"id"`
-	Username   string        `json:"username"`
-	Expiration time.Time     `json:"expiration"`
-	Ttl        time.Duration `json:"ttl"`
+	ID          string        `json:"id"`
+	Username    string        `json:"username"`
+	Expiration  time.Time     `json:"expiration"`
+	Ttl         time.Duration `json:"ttl"`
+	Fixed       bool          `json:"fixed,omitempty"`        // If true, Expiration isn't extended on use
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"` // Expires if unused for this long
+	LastUsed    *time.Time    `json:"last_used,omitempty"`    // Only tracked if IdleTimeout is set
+	UserVersion uint64        `json:"user_version,omitempty"` // User's SessionVersion when created
+}
+
+// Returns true if the session has expired, or has been idle for too long.
+func (session *LoginSession) expired(now time.Time) bool {
+	if now.After(session.Expiration) {
+		return true
+	}
+	return session.IdleTimeout > 0 && session.LastUsed != nil &&
+		now.Sub(*session.LastUsed) > session.IdleTimeout
+}
+
+// Seconds from now until the session expires, to use as its doc's expiry in the bucket.
+func (session *LoginSession) expirySecs(now time.Time) int {
+	expiration := session.Expiration
+	if session.IdleTimeout > 0 && session.LastUsed != nil {
+		if idleExpiration := session.LastUsed.Add(session.IdleTimeout); idleExpiration.Before(expiration) {
+			expiration = idleExpiration
+		}
+	}
+	return int(expiration.Sub(now)/time.Second) + 1
 }
 
 const CookieName = "SyncGatewaySession"
 
+// Scheme of an Authorization header carrying a session ID, for clients that can't keep cookies:
+// "Authorization: SyncGatewaySession <session_id>"
+const SessionAuthScheme = "SyncGatewaySession"
+
 const SessionKeyPrefix = "_sync:session:"
 
 func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.ResponseWriter) (User, error) {
@@ -35,16 +74,60 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 	if cookie == nil {
 		return nil, nil
 	}
+	user, session, err := auth.authenticateSession(cookie.Value)
+	if session != nil {
+		cookie.Expires = session.Expiration
+		http.SetCookie(response, cookie)
+	}
+	return user, err
+}
 
+// Returns the session ID given in a request's Authorization header, or "" if there isn't one.
+func SessionIDFromHeader(rq *http.Request) string {
+	header := rq.Header.Get("Authorization")
+	if strings.HasPrefix(header, SessionAuthScheme+" ") {
+		return strings.TrimSpace(header[len(SessionAuthScheme)+1:])
+	}
+	return ""
+}
+
+// Authenticates a request by the session ID in its Authorization header. Returns a nil user if
+// there's no such header, or if the session doesn't exist (or has expired.)
+func (auth *Authenticator) AuthenticateSessionHeader(rq *http.Request) (User, error) {
+	sessionID := SessionIDFromHeader(rq)
+	if sessionID == "" {
+		return nil, nil
+	}
+	user, _, err := auth.authenticateSession(sessionID)
+	return user, err
+}
+
+// Looks up a session and returns its user. If the session's expiration had to be extended,
+// the updated session is returned too.
+func (auth *Authenticator) authenticateSession(sessionID string) (User, *LoginSession, error) {
 	var session LoginSession
-	err := auth.bucket.Get(docIDForSession(cookie.Value), &session)
+	err := auth.bucket.Get(docIDForSession(sessionID), &session)
 	if err != nil {
 		if base.IsDocNotFoundError(err) {
 			err = nil
 		}
-		return nil, err
+		return nil, nil, err
+	}
+	// Couchbase will have nuked the document when it expired, but not every bucket (e.g. walrus)
+	// supports expiration, so check it anyway:
+	now := time.Now()
+	if session.expired(now) {
+		auth.bucket.Delete(docIDForSession(sessionID))
+		return nil, nil, nil
+	}
+	user, err := auth.GetUser(session.Username)
+	if err != nil {
+		return nil, nil, err
+	} else if user != nil && user.SessionVersion() != session.UserVersion {
+		// The user's password has changed, or the account was disabled, since the session began:
+		auth.bucket.Delete(docIDForSession(sessionID))
+		return nil, nil, nil
 	}
-	// Don't need to check session.Expiration, because Couchbase will have nuked the document.
 	//update the session Expiration if 10% or more of the current expiration time has elapsed
 	//if the session does not contain a Ttl (probably created prior to upgrading SG), use
 	//default value of 24Hours
@@ -52,37 +135,63 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 		session.Ttl = kDefaultSessionTTL
 	}
 	duration := session.Ttl
-	sessionTimeElapsed := int((time.Now().Add(duration).Sub(session.Expiration)).Seconds())
-	tenPercentOfTtl := int(duration.Seconds()) / 10
-	if sessionTimeElapsed > tenPercentOfTtl {
-		session.Expiration = time.Now().Add(duration)
-		ttlSec := int(duration.Seconds())
-		if err = auth.bucket.Set(docIDForSession(session.ID), ttlSec, session); err != nil {
-			return nil, err
+	var refreshed *LoginSession
+	changed := false
+	if !session.Fixed {
+		sessionTimeElapsed := int((now.Add(duration).Sub(session.Expiration)).Seconds())
+		tenPercentOfTtl := int(duration.Seconds()) / 10
+		if sessionTimeElapsed > tenPercentOfTtl {
+			session.Expiration = now.Add(duration)
+			refreshed = &session
+			changed = true
+		}
+	}
+	// Likewise only record the time of use if 10% or more of the idle timeout has elapsed:
+	if session.IdleTimeout > 0 && (session.LastUsed == nil || now.Sub(*session.LastUsed) > session.IdleTimeout/10) {
+		session.LastUsed = &now
+		changed = true
+	}
+	if changed {
+		if err = auth.bucket.Set(docIDForSession(session.ID), session.expirySecs(now), session); err != nil {
+			return nil, nil, err
 		}
-
-		cookie.Expires = session.Expiration
-		http.SetCookie(response, cookie)
 	}
-	user, err := auth.GetUser(session.Username)
 	if user != nil && user.Disabled() {
 		user = nil
 	}
-	return user, err
+	return user, refreshed, nil
 }
 
+// Creates a session for a user that lasts for the given TTL after it was last used.
 func (auth *Authenticator) CreateSession(username string, ttl time.Duration) (*LoginSession, error) {
-	ttlSec := int(ttl.Seconds())
-	if ttlSec <= 0 {
+	return auth.CreateSessionWithOptions(username, SessionOptions{TTL: ttl, Sliding: true})
+}
+
+// Creates a session for a user, which will expire as the options specify.
+func (auth *Authenticator) CreateSessionWithOptions(username string, options SessionOptions) (*LoginSession, error) {
+	if int(options.TTL.Seconds()) <= 0 || options.IdleTimeout < 0 {
 		return nil, base.HTTPErrorf(400, "Invalid session time-to-live")
 	}
+	user, err := auth.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
 	session := &LoginSession{
-		ID:         base.GenerateRandomSecret(),
-		Username:   username,
-		Expiration: time.Now().Add(ttl),
-		Ttl:        ttl,
+		ID:          base.GenerateRandomSecret(),
+		Username:    username,
+		Expiration:  now.Add(options.TTL),
+		Ttl:         options.TTL,
+		Fixed:       !options.Sliding,
+		IdleTimeout: options.IdleTimeout,
+	}
+	if options.IdleTimeout > 0 {
+		session.LastUsed = &now
 	}
-	if err := auth.bucket.Set(docIDForSession(session.ID), ttlSec, session); err != nil {
+	if user != nil {
+		session.UserVersion = user.SessionVersion()
+	}
+	if err := auth.bucket.Set(docIDForSession(session.ID), session.expirySecs(now), session); err != nil {
 		return nil, err
 	}
 	return session, nil
@@ -97,17 +206,39 @@ func (auth *Authenticator) GetSession(sessionid string) (*LoginSession, error) {
 		}
 		return nil, err
 	}
+	if session.expired(time.Now()) {
+		return nil, nil
+	}
 	return &session, nil
 }
 
+// Deletes a session if it's expired, since not every bucket (e.g. walrus) deletes expired docs by
+// itself. Returns true if it was deleted.
+func (auth *Authenticator) DeleteSessionIfExpired(sessionID string) (bool, error) {
+	var session LoginSession
+	if err := auth.bucket.Get(docIDForSession(sessionID), &session); err != nil {
+		if base.IsDocNotFoundError(err) {
+			err = nil
+		}
+		return false, err
+	}
+	if !session.expired(time.Now()) {
+		return false, nil
+	}
+	return true, auth.bucket.Delete(docIDForSession(sessionID))
+}
+
 func (auth *Authenticator) MakeSessionCookie(session *LoginSession) *http.Cookie {
 	if session == nil {
 		return nil
 	}
+	// The cookie is HttpOnly since scripts in web pages have no need to read it; they're
+	// already authenticated by it.
 	return &http.Cookie{
-		Name:    CookieName,
-		Value:   session.ID,
-		Expires: session.Expiration,
+		Name:     CookieName,
+		Value:    session.ID,
+		Expires:  session.Expiration,
+		HttpOnly: true,
 	}
 }
 
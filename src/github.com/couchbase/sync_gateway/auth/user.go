@@ -41,6 +41,7 @@ type userImplBody struct {
 	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
 	ExplicitRoles_   ch.TimedSet `json:"explicit_roles,omitempty"`
 	RolesSince_      ch.TimedSet `json:"rolesSince"`
+	SessionVersion_  uint64      `json:"session_version,omitempty"`
 
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
@@ -70,6 +71,8 @@ func (auth *Authenticator) defaultGuestUser() User {
 		auth: auth,
 	}
 	user.Channels_ = user.ExplicitChannels_.Copy()
+	// Like every other principal, the guest can see the public document channel:
+	user.Channels_.AddChannel(ch.DocumentStarChannel, 1)
 	return user
 }
 
@@ -151,9 +154,16 @@ func (user *userImpl) Disabled() bool {
 }
 
 func (user *userImpl) SetDisabled(disabled bool) {
+	if disabled && !user.Disabled_ {
+		user.SessionVersion_++
+	}
 	user.Disabled_ = disabled
 }
 
+func (user *userImpl) SessionVersion() uint64 {
+	return user.SessionVersion_
+}
+
 func (user *userImpl) Email() string {
 	return user.Email_
 }
@@ -201,8 +211,15 @@ func (user *userImpl) Authenticate(password string) bool {
 	return !user.Disabled_
 }
 
-// Changes a user's password to the given string.
+// Changes a user's password to the given string. Setting the password it already has does
+// nothing, and in particular doesn't invalidate the user's sessions.
 func (user *userImpl) SetPassword(password string) {
+	if password == "" && user.PasswordHash_ == nil {
+		return
+	} else if password != "" && user.PasswordHash_ != nil &&
+		compareHashAndPassword(user.PasswordHash_, []byte(password)) {
+		return
+	}
 	if password == "" {
 		user.PasswordHash_ = nil
 	} else {
@@ -212,22 +229,31 @@ func (user *userImpl) SetPassword(password string) {
 		}
 		user.PasswordHash_ = hash
 	}
+	user.SessionVersion_++
 }
 
 //////// CHANNEL ACCESS:
 
+// Returns the Roles the user has. If a role can't be loaded (other than because it's been
+// deleted) it's left out, so the user temporarily lacks the access it grants; the roles aren't
+// cached in that case, so the next call tries again.
 func (user *userImpl) GetRoles() []Role {
 	if user.roles == nil {
 		roles := make([]Role, 0, len(user.RolesSince_))
+		complete := true
 		for name, _ := range user.RolesSince_ {
 			role, err := user.auth.GetRole(name)
 			//base.LogTo("Access", "User %s role %q = %v", user.Name_, name, role)
 			if err != nil {
-				panic(fmt.Sprintf("Error getting user role %q: %v", name, err))
+				base.Warn("Error getting role %q of user %q: %v", name, user.Name_, err)
+				complete = false
 			} else if role != nil {
 				roles = append(roles, role)
 			}
 		}
+		if !complete {
+			return roles
+		}
 		user.roles = roles
 	}
 	return user.roles
@@ -248,7 +274,12 @@ func (user *userImpl) CanSeeChannel(channel string) bool {
 func (user *userImpl) CanSeeChannelSince(channel string) uint64 {
 	minSeq := user.roleImpl.CanSeeChannelSince(channel)
 	for _, role := range user.GetRoles() {
-		if seq := role.CanSeeChannelSince(channel); seq > 0 && (seq < minSeq || minSeq == 0) {
+		seq := role.CanSeeChannelSince(channel)
+		if roleSince := user.RolesSince_[role.Name()]; seq > 0 && roleSince > seq {
+			// The channel is only visible since the user was granted the role:
+			seq = roleSince
+		}
+		if seq > 0 && (seq < minSeq || minSeq == 0) {
 			minSeq = seq
 		}
 	}
@@ -0,0 +1,103 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The audit log is a record of security-relevant events -- logins, sessions, access denials and
+// admin operations -- kept apart from the regular log so it can be shipped to a SIEM or retained
+// for compliance review without the noise. Each event is written as one line of JSON.
+
+// Types of audit events.
+const (
+	AuditLoginSuccess   = "login_success"   // A request authenticated with credentials
+	AuditLoginFailure   = "login_failure"   // A request's credentials were rejected
+	AuditSessionCreated = "session_created" // A login session was created
+	AuditAccessDenied   = "access_denied"   // An authenticated request was refused (403)
+	AuditAdminOperation = "admin_operation" // A change made through the admin API
+)
+
+// An entry in the audit log.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`               // One of the Audit... constants
+	DB       string    `json:"db,omitempty"`        // Database name
+	User     string    `json:"user,omitempty"`      // Name of the user, or the name they tried to log in as
+	Admin    bool      `json:"admin,omitempty"`     // True if the request came through the admin API
+	ClientIP string    `json:"client_ip,omitempty"` // Address of the client
+	Method   string    `json:"method,omitempty"`    // HTTP method
+	Path     string    `json:"path,omitempty"`      // URL path, without the query
+	DocID    string    `json:"docid,omitempty"`     // Document ID, if the request was for a document
+	Status   int       `json:"status,omitempty"`    // HTTP status of the response
+	Message  string    `json:"message,omitempty"`   // Details, e.g. the authentication method
+}
+
+var auditLock sync.Mutex
+var auditWriter io.Writer
+var auditFile *os.File
+
+// Returns true if audit events are being recorded.
+func AuditEnabled() bool {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	return auditWriter != nil
+}
+
+// Records an event in the audit log, if there is one. Time is filled in if it's zero.
+func Audit(event AuditEvent) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditWriter == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		Warn("Couldn't encode audit event %+v: %v", event, err)
+		return
+	}
+	if _, err = auditWriter.Write(append(data, '\n')); err != nil {
+		Warn("Couldn't write to audit log: %v", err)
+	}
+}
+
+// Writes audit events to a writer; nil disables the audit log.
+func SetAuditWriter(w io.Writer) {
+	setAuditWriter(w, nil)
+}
+
+// Writes audit events to a file, appending to it if it exists. Like UpdateLogger, calling this
+// again with the same path reopens the file, to allow for log rotation.
+func UpdateAuditLogger(auditFilePath string) {
+	fo, err := os.OpenFile(auditFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		LogFatal("unable to open audit log for write: %s", auditFilePath)
+	}
+	setAuditWriter(fo, fo)
+}
+
+func setAuditWriter(w io.Writer, file *os.File) {
+	auditLock.Lock()
+	oldFile := auditFile
+	auditWriter = w
+	auditFile = file
+	auditLock.Unlock()
+	if oldFile != nil {
+		oldFile.Close()
+	}
+}
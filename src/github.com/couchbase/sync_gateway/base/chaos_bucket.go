@@ -0,0 +1,251 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/walrus"
+)
+
+// The error returned by a ChaosBucket operation that's been made to fail.
+var ErrChaosInjected = errors.New("chaos: injected failure")
+
+// Describes a fault for a ChaosBucket to inject into matching operations.
+type ChaosRule struct {
+	Ops         []string      // Operation names, e.g. "Get", "WriteUpdate"; empty matches all
+	KeyPrefix   string        // Only matches keys (or design doc names) with this prefix
+	Rate        float64       // Probability (0..1) that a matching call is affected
+	Latency     time.Duration // Delay to add before the call
+	Err         error         // Error to fail the call with (nil means don't fail)
+	CASConflict bool          // Simulate a lost CAS race in Update/WriteUpdate
+}
+
+func (rule *ChaosRule) matches(op, key string) bool {
+	if !strings.HasPrefix(key, rule.KeyPrefix) {
+		return false
+	}
+	if len(rule.Ops) == 0 {
+		return true
+	}
+	for _, o := range rule.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// A wrapper around a Bucket that injects latency, errors and CAS conflicts according to a set of
+// rules. It's intended for tests: the random decisions come from a seeded generator, so a given
+// seed and sequence of calls reproduces the same failures.
+type ChaosBucket struct {
+	bucket Bucket
+	lock   sync.Mutex
+	rules  []ChaosRule
+	random *rand.Rand
+}
+
+func NewChaosBucket(bucket Bucket, seed int64) *ChaosBucket {
+	return &ChaosBucket{bucket: bucket, random: rand.New(rand.NewSource(seed))}
+}
+
+// Adds a fault-injection rule. Rules are checked in the order they were added.
+func (b *ChaosBucket) AddRule(rule ChaosRule) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rules = append(b.rules, rule)
+}
+
+// Removes all rules, so the bucket behaves normally again.
+func (b *ChaosBucket) ClearRules() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rules = nil
+}
+
+// Returns the rules that fire for this call.
+func (b *ChaosBucket) firingRules(op, key string) (firing []ChaosRule) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, rule := range b.rules {
+		if rule.matches(op, key) && b.random.Float64() < rule.Rate {
+			firing = append(firing, rule)
+		}
+	}
+	return
+}
+
+// Applies latency and error rules to a call; a non-nil result should be returned to the caller.
+func (b *ChaosBucket) inject(op, key string) error {
+	for _, rule := range b.firingRules(op, key) {
+		if rule.Latency > 0 {
+			time.Sleep(rule.Latency)
+		}
+		if rule.Err != nil {
+			LogTo("Chaos", "%s(%q) --> injected %v", op, key, rule.Err)
+			return rule.Err
+		}
+	}
+	return nil
+}
+
+// Returns true if an Update-style call should simulate losing a CAS race.
+func (b *ChaosBucket) injectCASConflict(op, key string) bool {
+	for _, rule := range b.firingRules(op, key) {
+		if rule.CASConflict {
+			LogTo("Chaos", "%s(%q) --> injected CAS conflict", op, key)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *ChaosBucket) GetName() string {
+	return b.bucket.GetName()
+}
+func (b *ChaosBucket) Get(k string, rv interface{}) error {
+	if err := b.inject("Get", k); err != nil {
+		return err
+	}
+	return b.bucket.Get(k, rv)
+}
+func (b *ChaosBucket) GetRaw(k string) ([]byte, error) {
+	if err := b.inject("GetRaw", k); err != nil {
+		return nil, err
+	}
+	return b.bucket.GetRaw(k)
+}
+func (b *ChaosBucket) Add(k string, exp int, v interface{}) (added bool, err error) {
+	if err := b.inject("Add", k); err != nil {
+		return false, err
+	}
+	return b.bucket.Add(k, exp, v)
+}
+func (b *ChaosBucket) AddRaw(k string, exp int, v []byte) (added bool, err error) {
+	if err := b.inject("AddRaw", k); err != nil {
+		return false, err
+	}
+	return b.bucket.AddRaw(k, exp, v)
+}
+func (b *ChaosBucket) Append(k string, data []byte) error {
+	if err := b.inject("Append", k); err != nil {
+		return err
+	}
+	return b.bucket.Append(k, data)
+}
+func (b *ChaosBucket) Set(k string, exp int, v interface{}) error {
+	if err := b.inject("Set", k); err != nil {
+		return err
+	}
+	return b.bucket.Set(k, exp, v)
+}
+func (b *ChaosBucket) SetRaw(k string, exp int, v []byte) error {
+	if err := b.inject("SetRaw", k); err != nil {
+		return err
+	}
+	return b.bucket.SetRaw(k, exp, v)
+}
+func (b *ChaosBucket) Delete(k string) error {
+	if err := b.inject("Delete", k); err != nil {
+		return err
+	}
+	return b.bucket.Delete(k)
+}
+func (b *ChaosBucket) Write(k string, flags int, exp int, v interface{}, opt walrus.WriteOptions) error {
+	if err := b.inject("Write", k); err != nil {
+		return err
+	}
+	return b.bucket.Write(k, flags, exp, v, opt)
+}
+
+// A simulated CAS conflict runs the callback an extra time and throws away its result, just as
+// happens when another writer updates the doc between the read and the CAS write.
+func (b *ChaosBucket) Update(k string, exp int, callback walrus.UpdateFunc) error {
+	if err := b.inject("Update", k); err != nil {
+		return err
+	}
+	conflicted := false
+	return b.bucket.Update(k, exp, func(current []byte) ([]byte, error) {
+		if !conflicted && b.injectCASConflict("Update", k) {
+			conflicted = true
+			callback(current)
+		}
+		return callback(current)
+	})
+}
+func (b *ChaosBucket) WriteUpdate(k string, exp int, callback walrus.WriteUpdateFunc) error {
+	if err := b.inject("WriteUpdate", k); err != nil {
+		return err
+	}
+	conflicted := false
+	return b.bucket.WriteUpdate(k, exp, func(current []byte) ([]byte, walrus.WriteOptions, error) {
+		if !conflicted && b.injectCASConflict("WriteUpdate", k) {
+			conflicted = true
+			callback(current)
+		}
+		return callback(current)
+	})
+}
+func (b *ChaosBucket) Incr(k string, amt, def uint64, exp int) (uint64, error) {
+	if err := b.inject("Incr", k); err != nil {
+		return 0, err
+	}
+	return b.bucket.Incr(k, amt, def, exp)
+}
+func (b *ChaosBucket) GetDDoc(docname string, value interface{}) error {
+	if err := b.inject("GetDDoc", docname); err != nil {
+		return err
+	}
+	return b.bucket.GetDDoc(docname, value)
+}
+func (b *ChaosBucket) PutDDoc(docname string, value interface{}) error {
+	if err := b.inject("PutDDoc", docname); err != nil {
+		return err
+	}
+	return b.bucket.PutDDoc(docname, value)
+}
+func (b *ChaosBucket) DeleteDDoc(docname string) error {
+	if err := b.inject("DeleteDDoc", docname); err != nil {
+		return err
+	}
+	return b.bucket.DeleteDDoc(docname)
+}
+func (b *ChaosBucket) View(ddoc, name string, params map[string]interface{}) (walrus.ViewResult, error) {
+	if err := b.inject("View", ddoc); err != nil {
+		return walrus.ViewResult{}, err
+	}
+	return b.bucket.View(ddoc, name, params)
+}
+func (b *ChaosBucket) ViewCustom(ddoc, name string, params map[string]interface{}, vres interface{}) error {
+	if err := b.inject("ViewCustom", ddoc); err != nil {
+		return err
+	}
+	return b.bucket.ViewCustom(ddoc, name, params, vres)
+}
+func (b *ChaosBucket) StartTapFeed(args walrus.TapArguments) (walrus.TapFeed, error) {
+	if err := b.inject("StartTapFeed", ""); err != nil {
+		return nil, err
+	}
+	return b.bucket.StartTapFeed(args)
+}
+func (b *ChaosBucket) Close() {
+	b.bucket.Close()
+}
+func (b *ChaosBucket) Dump() {
+	b.bucket.Dump()
+}
+func (b *ChaosBucket) VBHash(docID string) uint32 {
+	return b.bucket.VBHash(docID)
+}
@@ -0,0 +1,65 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestChaosBucket(t *testing.T) *ChaosBucket {
+	bucket, err := GetBucket(BucketSpec{Server: "walrus:", BucketName: "chaos_test"})
+	assert.Equals(t, err, nil)
+	return NewChaosBucket(bucket, 1)
+}
+
+func TestChaosBucketErrors(t *testing.T) {
+	bucket := newTestChaosBucket(t)
+	assert.Equals(t, bucket.SetRaw("doc", 0, []byte(`{}`)), nil)
+
+	bucket.AddRule(ChaosRule{Ops: []string{"GetRaw"}, KeyPrefix: "do", Rate: 1, Err: ErrChaosInjected})
+	_, err := bucket.GetRaw("doc")
+	assert.Equals(t, err, ErrChaosInjected)
+	assert.Equals(t, bucket.SetRaw("doc", 0, []byte(`{"x":1}`)), nil) // other ops unaffected
+
+	bucket.ClearRules()
+	value, err := bucket.GetRaw("doc")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, string(value), `{"x":1}`)
+}
+
+func TestChaosBucketRateIsReproducible(t *testing.T) {
+	failures := func() (count int) {
+		bucket := newTestChaosBucket(t)
+		bucket.AddRule(ChaosRule{Rate: 0.5, Err: ErrChaosInjected})
+		for i := 0; i < 100; i++ {
+			if bucket.SetRaw("doc", 0, []byte(`{}`)) != nil {
+				count++
+			}
+		}
+		return
+	}
+	count := failures()
+	assert.True(t, count > 0 && count < 100)
+	assert.Equals(t, failures(), count)
+}
+
+func TestChaosBucketCASConflict(t *testing.T) {
+	bucket := newTestChaosBucket(t)
+	bucket.AddRule(ChaosRule{Ops: []string{"Update"}, Rate: 1, CASConflict: true})
+	calls := 0
+	err := bucket.Update("counter", 0, func(current []byte) ([]byte, error) {
+		calls++
+		return []byte(`1`), nil
+	})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, calls, 2)
+}
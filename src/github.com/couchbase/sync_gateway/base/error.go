@@ -32,6 +32,12 @@ func HTTPErrorf(status int, format string, args ...interface{}) *HTTPError {
 	return &HTTPError{status, fmt.Sprintf(format, args...)}
 }
 
+// An HTTPError whose response should also challenge the client to authenticate, i.e. come with
+// a WWW-Authenticate header.
+type AuthChallengeError struct {
+	HTTPError
+}
+
 // Attempts to map an error to an HTTP status code and message.
 // Defaults to 500 if it doesn't recognize the error. Returns 200 for a nil error.
 func ErrorAsHTTPStatus(err error) (int, string) {
@@ -41,6 +47,8 @@ func ErrorAsHTTPStatus(err error) (int, string) {
 	switch err := err.(type) {
 	case *HTTPError:
 		return err.Status, err.Message
+	case *AuthChallengeError:
+		return err.Status, err.Message
 	case *gomemcached.MCResponse:
 		switch err.Status {
 		case gomemcached.KEY_ENOENT:
@@ -2,7 +2,10 @@ package base
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"expvar"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"sync"
@@ -21,6 +24,25 @@ func init() {
 // This is like a combination of http.ListenAndServe and http.ListenAndServeTLS, which also
 // uses ThrottledListen to limit the number of open HTTP connections.
 func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, handler http.Handler, readTimeout *int, writeTimeout *int) error {
+	listener, err := ListenHTTP(addr, connLimit, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return ServeHTTP(listener, handler, readTimeout, writeTimeout)
+}
+
+// The listening half of ListenAndServeHTTP: opens a (throttled, and if certFile is given, TLS)
+// listener on the address, without serving anything on it yet. An address with port 0 will
+// listen on any free port; call the listener's Addr method to find out which.
+func ListenHTTP(addr string, connLimit int, certFile *string, keyFile *string) (net.Listener, error) {
+	return ListenHTTPWithClientCerts(addr, connLimit, certFile, keyFile, "", false)
+}
+
+// Like ListenHTTP, but if clientCAFile is non-empty, TLS clients are also asked for a certificate,
+// which must be signed by one of the CA certificates in that PEM file. If requireClientCert is
+// true, connections that don't present a valid one are refused.
+func ListenHTTPWithClientCerts(addr string, connLimit int, certFile *string, keyFile *string, clientCAFile string, requireClientCert bool) (net.Listener, error) {
 	var config *tls.Config
 	if certFile != nil {
 		config = &tls.Config{}
@@ -30,25 +52,54 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 		var err error
 		config.Certificates[0], err = tls.LoadX509KeyPair(*certFile, *keyFile)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if clientCAFile != "" {
+			if config.ClientCAs, err = LoadCertPool(clientCAFile); err != nil {
+				return nil, err
+			}
+			if requireClientCert {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			} else {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
 		}
+	} else if clientCAFile != "" {
+		return nil, fmt.Errorf("Client certificates require TLS; no server certificate given")
 	}
 	listener, err := ThrottledListen("tcp", addr, connLimit)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	listener = &trackingListener{listener}
 	if config != nil {
 		listener = tls.NewListener(listener, config)
 	}
-	defer listener.Close()
-	server := &http.Server{Addr: addr, Handler: handler}
+	return listener, nil
+}
+
+// Reads a PEM file of certificates into a CertPool.
+func LoadCertPool(pemFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", pemFile)
+	}
+	return pool, nil
+}
+
+// The serving half of ListenAndServeHTTP. Returns when the listener fails or is closed.
+func ServeHTTP(listener net.Listener, handler http.Handler, readTimeout *int, writeTimeout *int) error {
+	server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
 	if readTimeout != nil {
 		server.ReadTimeout = time.Duration(*readTimeout) * time.Second
 	}
 	if writeTimeout != nil {
 		server.WriteTimeout = time.Duration(*writeTimeout) * time.Second
 	}
-
 	return server.Serve(listener)
 }
 
@@ -113,3 +164,50 @@ func (conn *throttleConn) Close() error {
 	conn.listener.connFinished()
 	return err
 }
+
+// Open HTTP connections, by their remote address. (Keyed the same way as http.Request.RemoteAddr,
+// so that a handler can find its client's connection; see SetHTTPWriteDeadline.)
+var openConns = map[string]net.Conn{}
+var openConnsLock sync.Mutex
+
+// Sets a write deadline on the open HTTP connection from remoteAddr (a request's RemoteAddr.) This
+// makes a write to a client that's stopped reading fail, instead of blocking indefinitely.
+// Returns false if there's no such connection.
+func SetHTTPWriteDeadline(remoteAddr string, deadline time.Time) bool {
+	openConnsLock.Lock()
+	conn := openConns[remoteAddr]
+	openConnsLock.Unlock()
+	return conn != nil && conn.SetWriteDeadline(deadline) == nil
+}
+
+// Listener that records its open connections in openConns.
+type trackingListener struct {
+	net.Listener
+}
+
+func (tl *trackingListener) Accept() (net.Conn, error) {
+	conn, err := tl.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	tracked := &trackedConn{Conn: conn, addr: conn.RemoteAddr().String()}
+	openConnsLock.Lock()
+	openConns[tracked.addr] = tracked
+	openConnsLock.Unlock()
+	return tracked, nil
+}
+
+// Wrapper for net.Conn that removes itself from openConns when it's closed
+type trackedConn struct {
+	net.Conn
+	addr string
+}
+
+func (conn *trackedConn) Close() error {
+	openConnsLock.Lock()
+	if openConns[conn.addr] == conn {
+		delete(openConns, conn.addr)
+	}
+	openConnsLock.Unlock()
+	return conn.Conn.Close()
+}
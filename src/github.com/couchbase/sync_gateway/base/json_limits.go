@@ -0,0 +1,72 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"net/http"
+)
+
+// Default maximum nesting depth of arrays & objects in JSON received from clients.
+const DefaultMaxJSONDepth = 100
+
+// Structural limits on JSON, to protect against pathological documents that could exhaust the
+// stack or take forever to process in the sync function or canonicalization.
+type JSONLimits struct {
+	MaxDepth    int // Max nesting depth of arrays & objects (0 = unlimited)
+	MaxElements int // Max number of items in any one array or object (0 = unlimited)
+}
+
+// The limits applied to JSON request bodies. Set from the server config at startup.
+var RequestJSONLimits = JSONLimits{MaxDepth: DefaultMaxJSONDepth}
+
+// Scans JSON data and returns a 400 error if it exceeds the limits. This doesn't validate the
+// JSON, which the parser will do anyway; it only has to be good enough to count brackets.
+func (limits JSONLimits) Check(data []byte) error {
+	if limits.MaxDepth <= 0 && limits.MaxElements <= 0 {
+		return nil
+	}
+	var counts []int // Number of items in each enclosing array/object
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			if c == '\\' {
+				i++ // skip escaped char
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			counts = append(counts, 0)
+			if limits.MaxDepth > 0 && len(counts) > limits.MaxDepth {
+				return HTTPErrorf(http.StatusBadRequest,
+					"JSON is nested too deeply (limit is %d)", limits.MaxDepth)
+			}
+		case ']', '}':
+			if len(counts) > 0 {
+				counts = counts[:len(counts)-1]
+			}
+		case ',':
+			if len(counts) > 0 {
+				counts[len(counts)-1]++
+				// n commas means n+1 items:
+				if limits.MaxElements > 0 && counts[len(counts)-1] >= limits.MaxElements {
+					return HTTPErrorf(http.StatusBadRequest,
+						"JSON array or object has too many items (limit is %d)", limits.MaxElements)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestJSONLimits(t *testing.T) {
+	limits := JSONLimits{MaxDepth: 3, MaxElements: 3}
+	assert.Equals(t, limits.Check([]byte(`{"a": [1, 2, {"b": "c"}]}`)), nil)
+	assert.Equals(t, limits.Check([]byte(`[1, 2, 3]`)), nil)
+	assert.Equals(t, limits.Check([]byte(`"just a string"`)), nil)
+
+	// Brackets and commas inside strings don't count:
+	assert.Equals(t, limits.Check([]byte(`{"a": "[[[[,,,,\"[[[["}`)), nil)
+
+	err := limits.Check([]byte(`{"a": [1, 2, {"b": [4]}]}`))
+	assert.True(t, err != nil)
+	assert.Equals(t, err.(*HTTPError).Status, 400)
+	err = limits.Check([]byte(`[1, 2, 3, 4]`))
+	assert.True(t, err != nil)
+	assert.Equals(t, err.(*HTTPError).Status, 400)
+
+	deep := []byte(strings.Repeat("[", 10000) + strings.Repeat("]", 10000))
+	assert.True(t, RequestJSONLimits.Check(deep) != nil)
+	assert.Equals(t, JSONLimits{}.Check(deep), nil)
+}
@@ -129,6 +129,32 @@ func UpdateLogKeys(keys map[string]bool, replace bool) {
 
 }
 
+// Per-database log keys, which enable logging for a single database in addition to LogKeys.
+var dbLogKeys = map[string]map[string]bool{}
+
+func GetDbLogKeys(dbName string) map[string]bool {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	keys := map[string]bool{}
+	for k, v := range dbLogKeys[dbName] {
+		keys[k] = v
+	}
+	return keys
+}
+
+func UpdateDbLogKeys(dbName string, keys map[string]bool, replace bool) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	dbKeys := dbLogKeys[dbName]
+	if replace || dbKeys == nil {
+		dbKeys = map[string]bool{}
+		dbLogKeys[dbName] = dbKeys
+	}
+	for k, v := range keys {
+		dbKeys[k] = v
+	}
+}
+
 // Returns a string identifying a function on the call stack.
 // Use depth=1 for the caller of the function that calls GetCallersName, etc.
 func GetCallersName(depth int) string {
@@ -156,6 +182,19 @@ func LogTo(key string, format string, args ...interface{}) {
 	}
 }
 
+// Logs a message about a specific database to the console, if the key is enabled either
+// globally in LogKeys or for that database via UpdateDbLogKeys.
+func LogToDb(dbName string, key string, format string, args ...interface{}) {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	dbKeys := dbLogKeys[dbName]
+	ok := logLevel <= 1 && (logStar || LogKeys[key] || dbKeys[key] || dbKeys["*"])
+
+	if ok {
+		printf(fgYellow+key+": "+reset+format, args...)
+	}
+}
+
 // Logs a message to the console.
 func Log(message string) {
 	logLock.RLock()
@@ -0,0 +1,100 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Names of the supported UUID algorithms; these match the ones CouchDB supports.
+const (
+	UUIDRandom     = "random"     // 128 random bits (the default)
+	UUIDSequential = "sequential" // Random prefix plus an increasing suffix
+	UUIDUTCRandom  = "utc_random" // Microseconds since the epoch plus 72 random bits
+)
+
+// A function that returns a new unique ID each time it's called.
+type UUIDGenerator func() string
+
+// Returns a UUIDGenerator implementing the named algorithm. An empty name means UUIDRandom.
+func NewUUIDGenerator(algorithm string) (UUIDGenerator, error) {
+	switch algorithm {
+	case "", UUIDRandom:
+		return CreateUUID, nil
+	case UUIDSequential:
+		return newSequentialUUIDGenerator(), nil
+	case UUIDUTCRandom:
+		return createUTCRandomUUID, nil
+	default:
+		return nil, fmt.Errorf("Unknown UUID algorithm %q", algorithm)
+	}
+}
+
+// Time-ordered IDs: 14 hex digits of microseconds since the epoch, then 18 random hex digits.
+func createUTCRandomUUID() string {
+	bytes := make([]byte, 9)
+	if n, err := rand.Read(bytes); n < len(bytes) {
+		LogPanic("Failed to generate random ID: %s", err)
+	}
+	return fmt.Sprintf("%014x%x", time.Now().UnixNano()/1000, bytes)
+}
+
+const (
+	kSequentialUUIDSuffixMax  = 0xfff000 // Roll over to a new prefix past this suffix
+	kSequentialUUIDMaxStep    = 0xffe    // Max amount to advance the suffix by
+	kSequentialUUIDPrefixSize = 13       // Bytes in the random prefix (26 hex digits)
+)
+
+type sequentialUUIDGenerator struct {
+	lock   sync.Mutex
+	prefix string
+	suffix int64
+}
+
+// Sequential IDs share a 26-hex-digit random prefix, followed by a 6-hex-digit suffix that
+// increases by a random amount each time. Consecutive IDs therefore sort together, which keeps
+// them clustered in views and indexes.
+func newSequentialUUIDGenerator() UUIDGenerator {
+	gen := &sequentialUUIDGenerator{}
+	gen.newPrefix()
+	return gen.next
+}
+
+func (gen *sequentialUUIDGenerator) newPrefix() {
+	bytes := make([]byte, kSequentialUUIDPrefixSize)
+	if n, err := rand.Read(bytes); n < len(bytes) {
+		LogPanic("Failed to generate random ID: %s", err)
+	}
+	gen.prefix = fmt.Sprintf("%x", bytes)
+	gen.suffix = randomInt64(kSequentialUUIDMaxStep)
+}
+
+func (gen *sequentialUUIDGenerator) next() string {
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	gen.suffix += 1 + randomInt64(kSequentialUUIDMaxStep)
+	if gen.suffix >= kSequentialUUIDSuffixMax {
+		gen.newPrefix()
+	}
+	return fmt.Sprintf("%s%06x", gen.prefix, gen.suffix)
+}
+
+// Returns a cryptographically-random integer in the range [0, max).
+func randomInt64(max int64) int64 {
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		LogPanic("Failed to generate random number: %s", err)
+	}
+	return n.Int64()
+}
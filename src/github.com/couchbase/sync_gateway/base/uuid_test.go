@@ -0,0 +1,45 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestUUIDGenerators(t *testing.T) {
+	for _, algorithm := range []string{"", UUIDRandom, UUIDSequential, UUIDUTCRandom} {
+		generate, err := NewUUIDGenerator(algorithm)
+		assert.Equals(t, err, nil)
+		seen := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			uuid := generate()
+			assert.Equals(t, len(uuid), 32)
+			assert.False(t, seen[uuid])
+			seen[uuid] = true
+		}
+	}
+
+	_, err := NewUUIDGenerator("bogus")
+	assert.True(t, err != nil)
+}
+
+func TestSequentialUUIDsAreOrdered(t *testing.T) {
+	generate, _ := NewUUIDGenerator(UUIDSequential)
+	last := generate()
+	for i := 0; i < 1000; i++ {
+		uuid := generate()
+		if uuid[:26] == last[:26] {
+			assert.True(t, uuid > last)
+		}
+		last = uuid
+	}
+}
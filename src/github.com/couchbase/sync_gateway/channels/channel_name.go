@@ -0,0 +1,130 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Channel name rules:
+// * A name consists of Unicode letters and digits, and the punctuation characters "-+=/_.@".
+// * The names "*" and "!" are reserved (see UserStarChannel and DocumentStarChannel); "*" and
+//   "!" can't appear anywhere else in a name.
+// * A newly assigned name can't be longer than MaxChannelNameLength bytes (in UTF-8). Longer
+//   names assigned before there was a limit are still accepted in stored docs and principals.
+// Strings that don't follow these rules, such as user-entered text, can be turned into valid
+// channel names with EscapeChannelName.
+
+// Maximum length in bytes of a channel name assigned by the sync function or the admin API.
+const MaxChannelNameLength = 250
+
+// Character that starts an escape sequence in an escaped channel name.
+const kChannelEscapeChar = '='
+
+var kValidChannelRegexp = regexp.MustCompile(`^([-+=/_.@\p{L}\p{Nd}]+|[\*\!])$`)
+
+// Returns true if a string is a legal channel name. (This doesn't check the length limit on
+// new names; see ValidateNewChannelName.)
+func IsValidChannel(channel string) bool {
+	return kValidChannelRegexp.MatchString(channel)
+}
+
+// Returns nil if a string is a legal channel name, else a 400 error explaining why not.
+func ValidateChannelName(name string) error {
+	if IsValidChannel(name) {
+		return nil
+	}
+	var reason string
+	if name == "" {
+		reason = "empty name"
+	} else if strings.ContainsAny(name, "*!") {
+		reason = `"*" and "!" are reserved, and can only be used by themselves`
+	} else {
+		for _, c := range name {
+			if !isChannelNameChar(c) {
+				reason = fmt.Sprintf("illegal character %q", c)
+				break
+			}
+		}
+	}
+	return base.HTTPErrorf(http.StatusBadRequest, "Illegal channel name %q: %s", name, reason)
+}
+
+// Like ValidateChannelName, but also enforces MaxChannelNameLength. Call this on names that are
+// being newly assigned to a document or principal, not on ones that are already stored.
+func ValidateNewChannelName(name string) error {
+	if len(name) > MaxChannelNameLength {
+		return base.HTTPErrorf(http.StatusBadRequest, "Illegal channel name %q: longer than %d bytes",
+			name, MaxChannelNameLength)
+	}
+	return ValidateChannelName(name)
+}
+
+func isChannelNameChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.Is(unicode.Nd, c) || strings.ContainsRune("-+=/_.@", c)
+}
+
+// Turns an arbitrary non-empty string into a valid channel name (as long as the result isn't
+// too long.) Characters that aren't allowed in channel names, and the escape character "=",
+// are replaced by "=" followed by the two hex digits of each byte of their UTF-8 encoding.
+// The sync function can call this as escapeChannel().
+func EscapeChannelName(str string) string {
+	var escaped []byte
+	for i := 0; i < len(str); {
+		c, size := utf8.DecodeRuneInString(str[i:])
+		if c == kChannelEscapeChar || c == utf8.RuneError || !isChannelNameChar(c) {
+			if escaped == nil {
+				escaped = append(make([]byte, 0, len(str)+8), str[:i]...)
+			}
+			for _, b := range []byte(str[i : i+size]) {
+				escaped = append(escaped, fmt.Sprintf("%c%02X", kChannelEscapeChar, b)...)
+			}
+		} else if escaped != nil {
+			escaped = append(escaped, str[i:i+size]...)
+		}
+		i += size
+	}
+	if escaped == nil {
+		return str
+	}
+	return string(escaped)
+}
+
+// Reverses EscapeChannelName. Returns an error if the name contains an invalid escape sequence.
+func UnescapeChannelName(name string) (string, error) {
+	if !strings.ContainsRune(name, kChannelEscapeChar) {
+		return name, nil
+	}
+	unescaped := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != kChannelEscapeChar {
+			unescaped = append(unescaped, name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("Invalid escape sequence in channel name %q", name)
+		}
+		b, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("Invalid escape sequence in channel name %q", name)
+		}
+		unescaped = append(unescaped, byte(b))
+		i += 2
+	}
+	return string(unescaped), nil
+}
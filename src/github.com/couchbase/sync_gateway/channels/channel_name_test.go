@@ -0,0 +1,75 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+func TestValidateChannelName(t *testing.T) {
+	assertNoError(t, ValidateChannelName("foo"), "foo should be valid")
+	assertNoError(t, ValidateChannelName(strings.Repeat("x", MaxChannelNameLength)), "max length")
+	reasons := map[string]string{
+		"":    "empty name",
+		"a*":  "reserved",
+		"!!":  "reserved",
+		"a b": `illegal character ' '`,
+		"50%": `illegal character '%'`,
+		"Z∫•": `illegal character '∫'`,
+	}
+	for name, reason := range reasons {
+		err := ValidateChannelName(name)
+		status, message := base.ErrorAsHTTPStatus(err)
+		assert.Equals(t, status, 400)
+		assert.True(t, strings.Contains(message, reason))
+	}
+
+	// Only new names are limited in length, so that already-stored ones stay valid:
+	long := strings.Repeat("x", MaxChannelNameLength+1)
+	assertNoError(t, ValidateChannelName(long), "stored long name")
+	assertNoError(t, ValidateNewChannelName(strings.Repeat("x", MaxChannelNameLength)), "max length")
+	status, message := base.ErrorAsHTTPStatus(ValidateNewChannelName(long))
+	assert.Equals(t, status, 400)
+	assert.True(t, strings.Contains(message, "longer than"))
+	status, _ = base.ErrorAsHTTPStatus(ValidateNewChannelName("a b"))
+	assert.Equals(t, status, 400)
+}
+
+func TestEscapeChannelName(t *testing.T) {
+	cases := map[string]string{
+		"foo":            "foo",
+		"Éclær":          "Éclær",
+		"a b":            "a=20b",
+		"x=y":            "x=3Dy",
+		"*":              "=2A",
+		"50% off!":       "50=25=20off=21",
+		"Z∫":             "Z=E2=88=AB",
+		"bad\xffutf8":    "bad=FFutf8",
+		"user@host.com/": "user@host.com/",
+	}
+	for str, expected := range cases {
+		escaped := EscapeChannelName(str)
+		assert.Equals(t, escaped, expected)
+		assert.True(t, IsValidChannel(escaped))
+		unescaped, err := UnescapeChannelName(escaped)
+		assertNoError(t, err, "UnescapeChannelName failed")
+		assert.Equals(t, unescaped, str)
+	}
+
+	for _, bad := range []string{"=", "a=2", "=ZZ", "=-1"} {
+		_, err := UnescapeChannelName(bad)
+		assert.True(t, err != nil)
+	}
+}
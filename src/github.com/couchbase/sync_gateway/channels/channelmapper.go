@@ -10,6 +10,11 @@
 package channels
 
 import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
 	"github.com/couchbaselabs/walrus"
 	_ "github.com/robertkrimen/otto/underscore"
 
@@ -26,8 +31,25 @@ type ChannelMapperOutput struct {
 
 type ChannelMapper struct {
 	*walrus.JSServer // "Superclass"
+	limits           SyncFnLimits
+	abandoned        int32 // Number of timed-out calls still running; accessed atomically
+}
+
+// Limits on running a sync function. The zero value means no limits. There's no limit on the
+// memory a call uses, since Otto has no way to measure or cap it; MaxInputSize, which bounds
+// the documents the function is given, is the nearest substitute.
+type SyncFnLimits struct {
+	Timeout      time.Duration // Max time a call can run before failing with ErrSyncFnTimeout
+	MaxInputSize int           // Max bytes of JSON (new + old doc) a call can be given
+	Runtimes     int           // JS runtimes kept for concurrent calls; default kTaskCacheSize
 }
 
+// Returned by MapToChannelsAndAccess when a call exceeds its SyncFnLimits.
+var (
+	ErrSyncFnTimeout       error = base.HTTPErrorf(http.StatusServiceUnavailable, "Sync function timed out")
+	ErrSyncFnInputTooLarge error = base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Document too large for sync function")
+)
+
 // Maps user names (or role names prefixed with "role:") to arrays of channel or role names
 type AccessMap map[string]base.Set
 
@@ -35,11 +57,27 @@ type AccessMap map[string]base.Set
 const kTaskCacheSize = 4
 
 func NewChannelMapper(fnSource string) *ChannelMapper {
+	return NewLimitedChannelMapper(fnSource, SyncFnLimits{})
+}
+
+// Creates a ChannelMapper whose calls are subject to limits. Calls run concurrently, each in
+// its own JS runtime; up to limits.Runtimes of those are kept around for reuse. The runtimes
+// can't be reached to interrupt a running script, so a call that times out is abandoned: it
+// keeps its goroutine and runtime busy until it returns, while later calls use other runtimes.
+// So that a function that never returns can't pile up runtimes without bound, once as many
+// calls as there are runtimes have been abandoned, new calls fail with ErrSyncFnTimeout
+// straight away until some of them finish.
+func NewLimitedChannelMapper(fnSource string, limits SyncFnLimits) *ChannelMapper {
+	runtimes := limits.Runtimes
+	if runtimes <= 0 {
+		runtimes = kTaskCacheSize
+	}
 	return &ChannelMapper{
-		JSServer: walrus.NewJSServer(fnSource, kTaskCacheSize,
+		JSServer: walrus.NewJSServer(fnSource, runtimes,
 			func(fnSource string) (walrus.JSServerTask, error) {
 				return NewSyncRunner(fnSource)
 			}),
+		limits: limits,
 	}
 }
 
@@ -48,7 +86,17 @@ func NewDefaultChannelMapper() *ChannelMapper {
 }
 
 func (mapper *ChannelMapper) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
-	result1, err := mapper.Call(body, walrus.JSONString(oldBodyJSON), userCtx)
+	var newDoc interface{} = body
+	if mapper.limits.MaxInputSize > 0 {
+		bodyJSON, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		} else if len(bodyJSON)+len(oldBodyJSON) > mapper.limits.MaxInputSize {
+			return nil, ErrSyncFnInputTooLarge
+		}
+		newDoc = walrus.JSONString(bodyJSON)
+	}
+	result1, err := mapper.callWithTimeout(newDoc, walrus.JSONString(oldBodyJSON), userCtx)
 	if err != nil {
 		return nil, err
 	}
@@ -56,6 +104,57 @@ func (mapper *ChannelMapper) MapToChannelsAndAccess(body map[string]interface{},
 	return output, nil
 }
 
+// Calls the function, giving up with ErrSyncFnTimeout if it runs longer than the time limit.
+func (mapper *ChannelMapper) callWithTimeout(inputs ...interface{}) (interface{}, error) {
+	if mapper.limits.Timeout <= 0 {
+		return mapper.Call(inputs...)
+	}
+	maxAbandoned := mapper.limits.Runtimes
+	if maxAbandoned <= 0 {
+		maxAbandoned = kTaskCacheSize
+	}
+	if abandoned := atomic.LoadInt32(&mapper.abandoned); int(abandoned) >= maxAbandoned {
+		base.Warn("Sync function still running %d timed-out calls; failing new call", abandoned)
+		return nil, ErrSyncFnTimeout
+	}
+
+	type callResult struct {
+		output interface{}
+		err    error
+	}
+	done := make(chan callResult, 1)
+	var state int32 // callRunning, callFinished or callAbandoned; accessed atomically
+	go func() {
+		output, err := mapper.Call(inputs...)
+		if !atomic.CompareAndSwapInt32(&state, callRunning, callFinished) {
+			atomic.AddInt32(&mapper.abandoned, -1)
+			base.Logf("Timed-out sync function call finished")
+		}
+		done <- callResult{output, err}
+	}()
+	timer := time.NewTimer(mapper.limits.Timeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.output, result.err
+	case <-timer.C:
+		if atomic.CompareAndSwapInt32(&state, callRunning, callAbandoned) {
+			atomic.AddInt32(&mapper.abandoned, 1)
+			base.Warn("Sync function timed out after %v", mapper.limits.Timeout)
+			return nil, ErrSyncFnTimeout
+		}
+		result := <-done // It finished just as the timer fired
+		return result.output, result.err
+	}
+}
+
+// States of a call made by callWithTimeout.
+const (
+	callRunning = int32(iota)
+	callFinished
+	callAbandoned
+)
+
 //////// UTILITY FUNCTIONS:
 
 // Calls the function for each user whose access is different between the two AccessMaps
@@ -12,7 +12,10 @@ package channels
 import (
 	"encoding/json"
 	"github.com/couchbaselabs/go.assert"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/robertkrimen/otto"
@@ -38,6 +41,15 @@ func TestOttoValueToStringArray(t *testing.T) {
 	assert.DeepEquals(t, strings, []string{"foo", "bar", "baz"})
 }
 
+// Numbers are converted to strings, and nested arrays are flattened.
+func TestSyncFunctionNumbersAndNestedArrays(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {channel(doc.year, [doc.ids, "x"], null, {}); access(doc.owner, doc.ids)}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"year": 2014, "ids": [7, 8.5, true], "owner": 42}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, SetOf("2014", "7", "8.5", "x"))
+	assert.DeepEquals(t, res.Access, AccessMap{"42": SetOf("7", "8.5")})
+}
+
 // verify that our version of Otto treats JSON parsed arrays like real arrays
 func TestJavaScriptWorks(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.x.concat(doc.y));}`)
@@ -77,6 +89,22 @@ func TestSyncFunctionRejectsInvalidChannels(t *testing.T) {
 	assert.True(t, err != nil)
 }
 
+// The sync function can't assign channel names longer than MaxChannelNameLength.
+func TestSyncFunctionRejectsLongChannels(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {channel(doc.ch); access("foo", doc.ch)}`)
+	long := strings.Repeat("x", MaxChannelNameLength+1)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"ch": "`+long+`"}`), `{}`, noUser)
+	assert.True(t, err != nil)
+}
+
+// escapeChannel() turns arbitrary strings into valid channel names.
+func TestSyncFunctionEscapeChannel(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {channel(escapeChannel(doc.title))}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"title": "What's up?"}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, SetOf("What=27s=20up=3F"))
+}
+
 // Calling access() with an invalid channel name should return an error.
 func TestAccessFunctionRejectsInvalidChannels(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("foo", "bad name");}`)
@@ -159,6 +187,15 @@ func TestRoleFunction(t *testing.T) {
 	assert.DeepEquals(t, res.Roles, AccessMap{"bar": SetOf("froods"), "baz": SetOf("froods"), "foo": SetOf("froods")})
 }
 
+// Invalid role() calls are reported as bad output, saying what's wrong with them.
+func TestRoleFunctionErrors(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {role(doc.user, doc.role)}`)
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"user": "foo", "role": "froods"}`), `{}`, noUser)
+	assert.DeepEquals(t, err, base.HTTPErrorf(400, `Role name "froods" does not begin with "role:"`))
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"user": "role:foo", "role": "role:froods"}`), `{}`, noUser)
+	assert.DeepEquals(t, err, base.HTTPErrorf(400, `Roles can only be granted to users, not to "role:foo"`))
+}
+
 // Now just make sure the input comes through intact
 func TestInputParse(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channel);}`)
@@ -386,3 +423,78 @@ func assertTrue(t *testing.T, success bool, message string) {
 		t.Fatalf("%s", message)
 	}
 }
+
+func TestRequireAccessWithStarChannel(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc) {
+		requireAccess(doc.channel)
+	}`)
+	var sally = map[string]interface{}{"name": "sally", "channels": []string{"!", "*"}}
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"channel": "party"}`), `{}`, sally)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+}
+
+func TestRequireAdmin(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc) {
+		requireAdmin()
+	}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, nil)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, nil)
+
+	var sally = map[string]interface{}{"name": "sally", "channels": []string{"*"}}
+	res, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, sally)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "admin required"))
+}
+
+// A guest who fails a require* check is told to log in, rather than forbidden.
+func TestRequireUserAsGuest(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc, oldDoc) {
+		requireUser(doc.owner)
+	}`)
+	var guest = map[string]interface{}{"name": "", "channels": []string{"!"}}
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, guest)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(401, "login required"))
+}
+
+// Test the time and input size limits
+func TestChannelMapperLimits(t *testing.T) {
+	mapper := NewLimitedChannelMapper(`function(doc) {
+			var end = Date.now() + doc.wait;
+			while (Date.now() < end) {}
+			channel(doc.channel);
+		}`, SyncFnLimits{Timeout: 100 * time.Millisecond, MaxInputSize: 100})
+	output, err := mapper.MapToChannelsAndAccess(parse(`{"wait": 0, "channel": "foo"}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, output.Channels, SetOf("foo"))
+
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"wait": 500, "channel": "foo"}`), `{}`, noUser)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+	assert.Equals(t, atomic.LoadInt32(&mapper.abandoned), int32(1))
+
+	big := `{"wait": 0, "channel": "foo", "filler": "` + strings.Repeat("x", 100) + `"}`
+	_, err = mapper.MapToChannelsAndAccess(parse(big), `{}`, noUser)
+	assert.Equals(t, err, ErrSyncFnInputTooLarge)
+
+	// The old revision counts towards the input size too:
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"wait": 0, "channel": "foo"}`), big, noUser)
+	assert.Equals(t, err, ErrSyncFnInputTooLarge)
+
+	// Once the timed-out call finishes it no longer counts as abandoned:
+	time.Sleep(500 * time.Millisecond)
+	assert.Equals(t, atomic.LoadInt32(&mapper.abandoned), int32(0))
+
+	// Once as many calls as there are runtimes are stuck, new calls fail right away:
+	mapper = NewLimitedChannelMapper(`function(doc) {
+			var end = Date.now() + doc.wait;
+			while (Date.now() < end) {}
+		}`, SyncFnLimits{Timeout: 50 * time.Millisecond, Runtimes: 1})
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"wait": 300}`), `{}`, noUser)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+	start := time.Now()
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"wait": 0}`), `{}`, noUser)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+}
@@ -11,7 +11,6 @@ package channels
 
 import (
 	"fmt"
-	"regexp"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -29,29 +28,11 @@ const UserStarChannel = "*"     // user channel for "can access all docs"
 const DocumentStarChannel = "!" // doc channel for "visible to all users"
 const AllChannelWildcard = "*"  // wildcard for 'all channels'
 
-var kValidChannelRegexp *regexp.Regexp
-
-func init() {
-	var err error
-	kValidChannelRegexp, err = regexp.Compile(`^([-+=/_.@\p{L}\p{Nd}]+|[\*\!])$`)
-	if err != nil {
-		panic("Bad IsValidChannel regexp")
-	}
-}
-
-func illegalChannelError(name string) error {
-	return base.HTTPErrorf(400, "Illegal channel name %q", name)
-}
-
-func IsValidChannel(channel string) bool {
-	return kValidChannelRegexp.MatchString(channel)
-}
-
 // Creates a new Set from an array of strings. Returns an error if any names are invalid.
 func SetFromArray(names []string, mode StarMode) (base.Set, error) {
 	for _, name := range names {
-		if !IsValidChannel(name) {
-			return nil, illegalChannelError(name)
+		if err := ValidateChannelName(name); err != nil {
+			return nil, err
 		}
 	}
 	result := base.SetFromArray(names)
@@ -66,10 +47,20 @@ func SetFromArray(names []string, mode StarMode) (base.Set, error) {
 	return result, nil
 }
 
+// Like SetFromArray, but for newly assigned names, which also have to obey MaxChannelNameLength.
+func newSetFromArray(names []string, mode StarMode) (base.Set, error) {
+	for _, name := range names {
+		if err := ValidateNewChannelName(name); err != nil {
+			return nil, err
+		}
+	}
+	return SetFromArray(names, mode)
+}
+
 func ValidateChannelSet(set base.Set) error {
 	for name, _ := range set {
-		if !IsValidChannel(name) {
-			return illegalChannelError(name)
+		if err := ValidateChannelName(name); err != nil {
+			return err
 		}
 	}
 	return nil
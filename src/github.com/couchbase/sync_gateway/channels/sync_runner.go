@@ -11,6 +11,8 @@ package channels
 
 import (
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/couchbaselabs/walrus"
@@ -60,25 +62,37 @@ const funcWrapper = `
 		// Proxy userCtx that allows queries but not direct access to user/roles:
 		var shouldValidate = (realUserCtx != null && realUserCtx.name != null);
 
+		// A guest (not logged in) is told to log in; anyone else is forbidden.
+		function deny(message) {
+				if (realUserCtx.name === "")
+					throw({unauthorized: "login required"});
+				throw({forbidden: message});
+		}
+
 		function requireUser(names) {
 				if (!shouldValidate) return;
 				names = makeArray(names);
 				if (!inArray(realUserCtx.name, names))
-					throw({forbidden: "wrong user"});
+					deny("wrong user");
 		}
 
 		function requireRole(roles) {
 				if (!shouldValidate) return;
 				roles = makeArray(roles);
 				if (!anyKeysInArray(realUserCtx.roles, roles))
-					throw({forbidden: "missing role"});
+					deny("missing role");
 		}
 
 		function requireAccess(channels) {
 				if (!shouldValidate) return;
 				channels = makeArray(channels);
-				if (!anyInArray(realUserCtx.channels, channels))
-					throw({forbidden: "missing channel access"});
+				if (!inArray("*", realUserCtx.channels) && !anyInArray(realUserCtx.channels, channels))
+					deny("missing channel access");
+		}
+
+		function requireAdmin() {
+				if (shouldValidate)
+					deny("admin required");
 		}
 
 		try {
@@ -130,6 +144,12 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.roles)
 	})
 
+	// Implementation of the 'escapeChannel()' function (see EscapeChannelName):
+	runner.DefineNativeFunction("escapeChannel", func(call otto.FunctionCall) otto.Value {
+		result, _ := otto.ToValue(EscapeChannelName(call.Argument(0).String()))
+		return result
+	})
+
 	// Implementation of the 'reject()' callback:
 	runner.DefineNativeFunction("reject", func(call otto.FunctionCall) otto.Value {
 		if runner.output.Rejection == nil {
@@ -154,7 +174,7 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 		output := runner.output
 		runner.output = nil
 		if err == nil {
-			output.Channels, err = SetFromArray(runner.channels, ExpandStar)
+			output.Channels, err = newSetFromArray(runner.channels, ExpandStar)
 			if err == nil {
 				output.Access, err = compileAccessMap(runner.access, "")
 				if err == nil {
@@ -186,44 +206,65 @@ func (runner *SyncRunner) addValueForUser(user otto.Value, value otto.Value, map
 func compileAccessMap(input map[string][]string, prefix string) (AccessMap, error) {
 	access := make(AccessMap, len(input))
 	for name, values := range input {
-		// If a prefix is specified, strip it from all values or return error if missing:
+		// If a prefix is specified, strip it from all values or return error if missing. (The
+		// prefix is only used for roles, which can't themselves be granted roles.)
 		if prefix != "" {
+			if strings.HasPrefix(name, prefix) {
+				return nil, base.HTTPErrorf(http.StatusBadRequest,
+					"Roles can only be granted to users, not to %q", name)
+			}
 			for i, value := range values {
 				if strings.HasPrefix(value, prefix) {
 					values[i] = value[len(prefix):]
 				} else {
-					return nil, fmt.Errorf("Value %q does not begin with %q", value, prefix)
+					return nil, base.HTTPErrorf(http.StatusBadRequest,
+						"Role name %q does not begin with %q", value, prefix)
 				}
 			}
 		}
 		var err error
-		if access[name], err = SetFromArray(values, RemoveStar); err != nil {
+		if access[name], err = newSetFromArray(values, RemoveStar); err != nil {
 			return nil, err
 		}
 	}
 	return access, nil
 }
 
-// Converts a JS string or array into a Go string array.
+// Converts a JS string or array into a Go string array. Numbers are converted to strings, since
+// functions often use numeric properties like IDs as channel or user names, and nested arrays
+// are flattened.
 func ottoValueToStringArray(value otto.Value) []string {
 	nativeValue, _ := value.Export()
-	switch nativeValue := nativeValue.(type) {
+	if result, ok := nativeToStringArray(nativeValue, nil); ok {
+		return result
+	}
+	if !value.IsNull() && !value.IsUndefined() {
+		base.Warn("SyncRunner: Non-string, non-array passed to JS callback: %s", value)
+	}
+	return nil
+}
+
+// Appends the string(s) a native value exported from JS stands for to result. Returns false if
+// the value isn't a string, number or array.
+func nativeToStringArray(value interface{}, result []string) ([]string, bool) {
+	switch value := value.(type) {
 	case string:
-		return []string{nativeValue}
+		return append(result, value), true
+	case float64:
+		return append(result, strconv.FormatFloat(value, 'f', -1, 64)), true
+	case int64:
+		return append(result, strconv.FormatInt(value, 10)), true
 	case []string:
-		return nativeValue
+		return append(result, value...), true
 	case []interface{}:
-		result := make([]string, 0, len(nativeValue))
-		for _, item := range nativeValue {
-			if str, ok := item.(string); ok {
-				result = append(result, str)
-			}
+		if result == nil {
+			result = make([]string, 0, len(value))
 		}
-		return result
-	default:
-		if !value.IsNull() && !value.IsUndefined() {
-			base.Warn("SyncRunner: Non-string, non-array passed to JS callback: %s", value)
+		for _, item := range value {
+			result, _ = nativeToStringArray(item, result) // skip items that aren't strings
 		}
-		return nil
+		return result, true
+	default:
+		return result, false
 	}
 }
@@ -46,8 +46,8 @@ func (set TimedSet) AsSet() base.Set {
 
 func (set TimedSet) Validate() error {
 	for name, _ := range set {
-		if !IsValidChannel(name) {
-			return illegalChannelError(name)
+		if err := ValidateChannelName(name); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -0,0 +1,99 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"fmt"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/robertkrimen/otto"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Wraps a CouchDB-style validate_doc_update function. Throwing {forbidden:...} or
+// {unauthorized:...} rejects the write with a 403 or 401 respectively.
+const validatorWrapper = `
+	function(newDoc, oldDoc, userCtx) {
+		var v = %s;
+
+		if (oldDoc) {
+			oldDoc._id = newDoc._id;
+		}
+
+		try {
+			v(newDoc, oldDoc, userCtx);
+		} catch(x) {
+			if (x.forbidden)
+				reject(403, x.forbidden);
+			else if (x.unauthorized)
+				reject(401, x.unauthorized);
+			else
+				throw(x);
+		}
+	}`
+
+// An object that runs a specific JS validation function. Not thread-safe!
+type validatorRunner struct {
+	walrus.JSRunner       // "Superclass"
+	rejection       error // Set if the function rejects the document
+}
+
+func newValidatorRunner(funcSource string) (*validatorRunner, error) {
+	runner := &validatorRunner{}
+	if err := runner.Init(fmt.Sprintf(validatorWrapper, funcSource)); err != nil {
+		return nil, err
+	}
+
+	runner.DefineNativeFunction("reject", func(call otto.FunctionCall) otto.Value {
+		if runner.rejection == nil {
+			status, _ := call.Argument(0).ToInteger()
+			runner.rejection = base.HTTPErrorf(int(status), call.Argument(1).String())
+		}
+		return otto.UndefinedValue()
+	})
+
+	runner.Before = func() {
+		runner.rejection = nil
+	}
+	runner.After = func(result otto.Value, err error) (interface{}, error) {
+		if err == nil {
+			err = runner.rejection
+		}
+		return nil, err
+	}
+	return runner, nil
+}
+
+// A thread-safe wrapper around a validate_doc_update function, which gets the final say on
+// whether a document revision may be saved.
+type DocValidator struct {
+	*walrus.JSServer // "Superclass"
+}
+
+// Compiles a validation function. Returns an error if the source isn't a valid JS function.
+func NewDocValidator(fnSource string) (*DocValidator, error) {
+	if _, err := newValidatorRunner(fnSource); err != nil {
+		return nil, err
+	}
+	return &DocValidator{
+		JSServer: walrus.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				return newValidatorRunner(fnSource)
+			}),
+	}, nil
+}
+
+// Runs the validation function on a new revision. Returns nil if it's accepted, or the
+// *base.HTTPError the function rejected it with. userCtx is nil for admin requests.
+func (validator *DocValidator) Validate(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) error {
+	_, err := validator.Call(body, walrus.JSONString(oldBodyJSON), userCtx)
+	return err
+}
@@ -0,0 +1,52 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const kTestValidator = `function(newDoc, oldDoc, userCtx) {
+	if (!newDoc.title)
+		throw({forbidden: "missing title"});
+	if (oldDoc && userCtx && oldDoc.owner != userCtx.name)
+		throw({unauthorized: "not the owner"});
+}`
+
+func TestDocValidator(t *testing.T) {
+	validator, err := NewDocValidator(kTestValidator)
+	assertNoError(t, err, "NewDocValidator failed")
+
+	alice := map[string]interface{}{"name": "alice", "channels": []string{}}
+	assertNoError(t, validator.Validate(parse(`{"title": "x", "owner": "alice"}`), `null`, alice),
+		"Validate rejected a valid doc")
+	assert.DeepEquals(t, validator.Validate(parse(`{}`), `null`, alice),
+		base.HTTPErrorf(403, "missing title"))
+	assert.DeepEquals(t, validator.Validate(parse(`{"title": "x"}`), `{"owner": "bob"}`, alice),
+		base.HTTPErrorf(401, "not the owner"))
+
+	// Admin requests have no userCtx:
+	assertNoError(t, validator.Validate(parse(`{"title": "x"}`), `{"owner": "bob"}`, nil),
+		"Validate rejected an admin update")
+}
+
+func TestDocValidatorErrors(t *testing.T) {
+	_, err := NewDocValidator(`function(doc) {`)
+	assert.True(t, err != nil)
+
+	validator, _ := NewDocValidator(`function(doc) {throw("oops");}`)
+	err = validator.Validate(parse(`{}`), `null`, nil)
+	_, isHTTPErr := err.(*base.HTTPError)
+	assert.True(t, err != nil && !isHTTPErr)
+}
@@ -0,0 +1,203 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A sequence ID from a changes feed. The gateway sends simple sequences as JSON numbers and
+// compound ones (like "12:34") as strings; either way it should be treated as opaque, and only
+// passed back as ChangesOptions.Since. The zero value means the start of the feed.
+type Sequence string
+
+func (seq *Sequence) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		err := json.Unmarshal(data, &str)
+		*seq = Sequence(str)
+		return err
+	}
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*seq = Sequence(num.String())
+	return nil
+}
+
+// One entry of a changes feed.
+type ChangeEntry struct {
+	Seq     Sequence    `json:"seq"`
+	ID      string      `json:"id"`
+	Deleted bool        `json:"deleted,omitempty"`
+	Removed []string    `json:"removed,omitempty"` // Channels the doc was removed from
+	Doc     Body        `json:"doc,omitempty"`     // Only with ChangesOptions.IncludeDocs
+	Changes []ChangeRev `json:"changes"`
+}
+
+// A revision in a ChangeEntry.
+type ChangeRev struct {
+	Rev string `json:"rev"`
+}
+
+// Options for GetChanges and FollowChanges.
+type ChangesOptions struct {
+	Since       Sequence // Only return changes after this sequence
+	Limit       int      // Max number of entries per response (0 = unlimited)
+	IncludeDocs bool     // Include document bodies
+	Conflicts   bool     // Include all leaf revisions of conflicted docs, not just the winner
+	Channels    []string // Only return changes in these channels (nil = all the user can see)
+}
+
+func (options ChangesOptions) query() url.Values {
+	query := url.Values{}
+	if options.Since != "" {
+		query.Set("since", string(options.Since))
+	}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.IncludeDocs {
+		query.Set("include_docs", "true")
+	}
+	if options.Conflicts {
+		query.Set("style", "all_docs")
+	}
+	if options.Channels != nil {
+		query.Set("filter", "sync_gateway/bychannel")
+		query.Set("channels", strings.Join(options.Channels, ","))
+	}
+	return query
+}
+
+// Returns the changes since options.Since that are available now, and the sequence to pass as
+// Since to get the changes after them.
+func (c *Client) GetChanges(options ChangesOptions) (entries []ChangeEntry, lastSeq Sequence, err error) {
+	return c.getChanges(options.query(), nil)
+}
+
+func (c *Client) getChanges(query url.Values, cancel <-chan struct{}) ([]ChangeEntry, Sequence, error) {
+	response, err := c.send("GET", "_changes", query, nil, cancel)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	var changes struct {
+		Results []ChangeEntry `json:"results"`
+		LastSeq Sequence      `json:"last_seq"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&changes); err != nil {
+		return nil, "", fmt.Errorf("Invalid _changes response: %v", err)
+	}
+	return changes.Results, changes.LastSeq, nil
+}
+
+//////// FOLLOWING THE FEED:
+
+// How long a ChangesFeed waits before retrying after a failed request; the delay doubles after
+// each consecutive failure, up to MaxChangesRetryDelay.
+var MinChangesRetryDelay = time.Second
+var MaxChangesRetryDelay = time.Minute
+
+// A changes feed that stays open, delivering entries as documents change. It reconnects by
+// itself after network errors and server errors, resuming from the last sequence it delivered.
+type ChangesFeed struct {
+	// Receives the feed's entries. It's closed when the feed stops, either because Close was
+	// called or because of an error that retrying won't fix (see Err.)
+	Changes <-chan ChangeEntry
+
+	client   *Client
+	query    url.Values
+	changes  chan ChangeEntry
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+}
+
+// Starts following the changes feed from options.Since.
+func (c *Client) FollowChanges(options ChangesOptions) *ChangesFeed {
+	query := options.query()
+	query.Set("feed", "longpoll")
+	feed := &ChangesFeed{
+		client:  c,
+		query:   query,
+		changes: make(chan ChangeEntry),
+		stop:    make(chan struct{}),
+	}
+	feed.Changes = feed.changes
+	go feed.run()
+	return feed
+}
+
+// Stops the feed, aborting any request in progress. Changes will be closed soon after.
+func (feed *ChangesFeed) Close() {
+	feed.stopOnce.Do(func() { close(feed.stop) })
+}
+
+// Returns the error that stopped the feed, or nil if it was stopped by Close. Only valid once
+// Changes has been closed.
+func (feed *ChangesFeed) Err() error {
+	return feed.err
+}
+
+func (feed *ChangesFeed) run() {
+	defer close(feed.changes)
+	retryDelay := MinChangesRetryDelay
+	for {
+		entries, lastSeq, err := feed.client.getChanges(feed.query, feed.stop)
+		select {
+		case <-feed.stop:
+			return
+		default:
+		}
+		if err != nil {
+			if !isRetryable(err) {
+				feed.err = err
+				return
+			}
+			select {
+			case <-time.After(retryDelay):
+			case <-feed.stop:
+				return
+			}
+			if retryDelay *= 2; retryDelay > MaxChangesRetryDelay {
+				retryDelay = MaxChangesRetryDelay
+			}
+			continue
+		}
+		retryDelay = MinChangesRetryDelay
+
+		for _, entry := range entries {
+			select {
+			case feed.changes <- entry:
+			case <-feed.stop:
+				return
+			}
+		}
+		if lastSeq != "" {
+			feed.query.Set("since", string(lastSeq))
+		}
+	}
+}
+
+// Client errors (like a 401 or 404) won't go away by retrying, except for these.
+func isRetryable(err error) bool {
+	status := StatusOf(err)
+	return status == 0 || status >= 500 || status == http.StatusRequestTimeout ||
+		status == http.StatusTooManyRequests
+}
@@ -0,0 +1,288 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+/*
+Package client is a Go client for Sync Gateway's public REST API: document CRUD, bulk
+operations, changes feeds (including one that follows the feed and reconnects by itself), and
+session-based login. It only depends on the standard library, so it can be used without pulling
+in the rest of the gateway.
+
+	c, err := client.New("http://localhost:4984/db/")
+	err = c.Login("pupshaw", "letmein")
+	rev, err := c.PutDoc("doc1", client.Body{"greeting": "hi"})
+*/
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A document body, or any other JSON object.
+type Body map[string]interface{}
+
+// An error response from the gateway.
+type Error struct {
+	StatusCode int    `json:"-"`      // HTTP status code
+	Name       string `json:"error"`  // CouchDB-style error name, e.g. "not_found"
+	Reason     string `json:"reason"` // Human-readable explanation
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", err.StatusCode, err.Name, err.Reason)
+}
+
+// Returns the HTTP status of an error returned by a Client, or 0 if it isn't an HTTP error
+// (for instance if the server couldn't be reached.)
+func StatusOf(err error) int {
+	if httpErr, ok := err.(*Error); ok {
+		return httpErr.StatusCode
+	}
+	return 0
+}
+
+// A connection to one database on a Sync Gateway. It's safe to use from multiple goroutines,
+// except that the login methods shouldn't be called while other requests are in progress.
+type Client struct {
+	HTTPClient *http.Client // The HTTP client to send requests with
+	dbURL      *url.URL     // The database's URL, ending with a "/"
+	username   string       // Basic auth credentials, if set
+	password   string
+	sessionID  string // Session ID from Login, if any
+}
+
+// Creates a client for the database at the given URL, e.g. "http://localhost:4984/db/".
+func New(dbURL string) (*Client, error) {
+	if !strings.HasSuffix(dbURL, "/") {
+		dbURL += "/"
+	}
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Database URL must be http or https: %q", dbURL)
+	}
+	return &Client{HTTPClient: http.DefaultClient, dbURL: u}, nil
+}
+
+// Authenticates every request with HTTP Basic auth.
+func (c *Client) SetBasicAuth(username, password string) {
+	c.username = username
+	c.password = password
+}
+
+// Logs in by creating a session on the gateway, whose ID is then sent with every request
+// instead of the password.
+func (c *Client) Login(username, password string) error {
+	var response struct {
+		SessionID string `json:"session_id"`
+	}
+	err := c.do("POST", "_session", nil, Body{"name": username, "password": password}, &response)
+	if err != nil {
+		return err
+	} else if response.SessionID == "" {
+		return fmt.Errorf("Server didn't return a session ID")
+	}
+	c.sessionID = response.SessionID
+	return nil
+}
+
+// Deletes the session created by Login.
+func (c *Client) Logout() error {
+	if c.sessionID == "" {
+		return nil
+	}
+	err := c.do("DELETE", "_session", nil, nil, nil)
+	c.sessionID = ""
+	return err
+}
+
+// Returns info about the current user, as returned by GET /db/_session.
+func (c *Client) Session() (Body, error) {
+	var response Body
+	err := c.do("GET", "_session", nil, nil, &response)
+	return response, err
+}
+
+//////// DOCUMENTS:
+
+// Gets the current revision of a document.
+func (c *Client) GetDoc(docid string) (Body, error) {
+	return c.GetDocRev(docid, "")
+}
+
+// Gets a specific revision of a document; if revid is "" gets the current revision.
+func (c *Client) GetDocRev(docid, revid string) (Body, error) {
+	var query url.Values
+	if revid != "" {
+		query = url.Values{"rev": {revid}}
+	}
+	var body Body
+	err := c.do("GET", docPath(docid), query, nil, &body)
+	return body, err
+}
+
+// Creates or updates a document. To update, the body's "_rev" must be the current revision ID.
+// Returns the new revision ID.
+func (c *Client) PutDoc(docid string, body Body) (revid string, err error) {
+	var response struct {
+		Rev string `json:"rev"`
+	}
+	err = c.do("PUT", docPath(docid), nil, body, &response)
+	return response.Rev, err
+}
+
+// Creates a document with a server-generated ID. Returns the new ID and revision ID.
+func (c *Client) PostDoc(body Body) (docid, revid string, err error) {
+	var response struct {
+		ID  string `json:"id"`
+		Rev string `json:"rev"`
+	}
+	err = c.do("POST", "", nil, body, &response)
+	return response.ID, response.Rev, err
+}
+
+// Deletes a document, given its current revision ID. Returns the revision ID of the tombstone.
+func (c *Client) DeleteDoc(docid, revid string) (string, error) {
+	var response struct {
+		Rev string `json:"rev"`
+	}
+	err := c.do("DELETE", docPath(docid), url.Values{"rev": {revid}}, nil, &response)
+	return response.Rev, err
+}
+
+//////// BULK OPERATIONS:
+
+// The outcome of saving one document in BulkDocs.
+type BulkDocsResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Status int    `json:"status,omitempty"` // HTTP status if there was an error
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Saves multiple documents in one request. Each doc can be saved or fail independently, so
+// the results, in the same order as the docs, have to be checked. If newEdits is false the
+// docs are stored as-is, as a replicator does; they then need "_rev" and "_revisions".
+func (c *Client) BulkDocs(docs []Body, newEdits bool) ([]BulkDocsResult, error) {
+	var results []BulkDocsResult
+	err := c.do("POST", "_bulk_docs", nil, Body{"docs": docs, "new_edits": newEdits}, &results)
+	return results, err
+}
+
+// Gets the current revisions of multiple documents in one request. The result maps each doc ID
+// to its body; documents that are missing or not readable by the user are left out.
+func (c *Client) GetDocs(docids []string) (map[string]Body, error) {
+	var response struct {
+		Rows []struct {
+			Key    string `json:"key"`
+			Doc    Body   `json:"doc"`
+			Status int    `json:"status"`
+		} `json:"rows"`
+	}
+	query := url.Values{"include_docs": {"true"}}
+	if err := c.do("POST", "_all_docs", query, Body{"keys": docids}, &response); err != nil {
+		return nil, err
+	}
+	docs := make(map[string]Body, len(response.Rows))
+	for _, row := range response.Rows {
+		if row.Status == 0 && row.Doc != nil {
+			docs[row.Key] = row.Doc
+		}
+	}
+	return docs, nil
+}
+
+//////// HTTP:
+
+// Doc IDs can contain "/" (and design docs' IDs have to), so escape everything but that prefix.
+func docPath(docid string) string {
+	if strings.HasPrefix(docid, "_design/") {
+		return "_design/" + escapePathComponent(docid[len("_design/"):])
+	}
+	return escapePathComponent(docid)
+}
+
+// Like url.QueryEscape, but a space becomes "%20" since "+" is literal in a URL path.
+func escapePathComponent(str string) string {
+	return strings.Replace(url.QueryEscape(str), "+", "%20", -1)
+}
+
+// Sends a request to a path relative to the database URL, JSON-encoding the input (if not nil)
+// and decoding the response body into the output (if not nil.)
+func (c *Client) do(method, path string, query url.Values, input interface{}, output interface{}) error {
+	response, err := c.send(method, path, query, input, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if output == nil {
+		return nil
+	}
+	if err = json.NewDecoder(response.Body).Decode(output); err != nil {
+		return fmt.Errorf("Invalid JSON response from %s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+// Sends a request and returns the response, or an *Error if it had an error status. The caller
+// must close the response body. Closing the cancel channel, if given, aborts the request.
+func (c *Client) send(method, path string, query url.Values, input interface{}, cancel <-chan struct{}) (*http.Response, error) {
+	// The path is already escaped, so append it to the URL string rather than to its Path:
+	urlStr := c.dbURL.String() + path
+	if len(query) > 0 {
+		urlStr += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if input != nil {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	rq, err := http.NewRequest(method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	if input != nil {
+		rq.Header.Set("Content-Type", "application/json")
+	}
+	rq.Header.Set("Accept", "application/json")
+	if c.sessionID != "" {
+		rq.Header.Set("Authorization", "SyncGatewaySession "+c.sessionID)
+	} else if c.username != "" {
+		rq.SetBasicAuth(c.username, c.password)
+	}
+	rq.Cancel = cancel
+
+	response, err := c.HTTPClient.Do(rq)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		httpErr := &Error{StatusCode: response.StatusCode}
+		data, _ := ioutil.ReadAll(response.Body)
+		if json.Unmarshal(data, httpErr) != nil || httpErr.Name == "" {
+			httpErr.Name = http.StatusText(response.StatusCode)
+			httpErr.Reason = strings.TrimSpace(string(data))
+		}
+		return nil, httpErr
+	}
+	return response, nil
+}
@@ -0,0 +1,136 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package client
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbase/sync_gateway/rest"
+)
+
+// Starts a gateway serving a database "db" with a user "pupshaw", password "letmein".
+func startTestServer(t *testing.T) *httptest.Server {
+	server := "walrus:"
+	bucketName := "sync_gateway_client_test"
+	sc := rest.NewServerContext(&rest.ServerConfig{})
+	_, err := sc.AddDatabaseFromConfig(&rest.DbConfig{Server: &server, Bucket: &bucketName, Name: "db"})
+	assert.Equals(t, err, nil)
+	dbcontext, err := sc.GetDatabase("db")
+	assert.Equals(t, err, nil)
+	authenticator := dbcontext.Authenticator()
+	user, err := authenticator.NewUser("pupshaw", "letmein", channels.SetOf("*"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, authenticator.Save(user), nil)
+	return httptest.NewServer(rest.CreatePublicHandler(sc))
+}
+
+func TestClient(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	c, err := New(server.URL + "/db")
+	assert.Equals(t, err, nil)
+
+	// Without credentials:
+	_, err = c.GetDoc("doc1")
+	assert.Equals(t, StatusOf(err), 401)
+
+	assert.Equals(t, StatusOf(c.Login("pupshaw", "wrong")), 401)
+	assert.Equals(t, c.Login("pupshaw", "letmein"), nil)
+	session, err := c.Session()
+	assert.Equals(t, err, nil)
+	assert.Equals(t, session["userCtx"].(map[string]interface{})["name"], "pupshaw")
+
+	// Document CRUD:
+	_, err = c.GetDoc("my doc")
+	assert.Equals(t, StatusOf(err), 404)
+	rev1, err := c.PutDoc("my doc", Body{"n": 1})
+	assert.Equals(t, err, nil)
+	doc, err := c.GetDoc("my doc")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, doc["_rev"], rev1)
+	assert.Equals(t, doc["n"], 1.0)
+
+	_, err = c.PutDoc("my doc", Body{"n": 2})
+	assert.Equals(t, StatusOf(err), 409)
+	rev2, err := c.PutDoc("my doc", Body{"_rev": rev1, "n": 2})
+	assert.Equals(t, err, nil)
+	doc, err = c.GetDocRev("my doc", rev1)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, doc["n"], 1.0)
+
+	docid, _, err := c.PostDoc(Body{"posted": true})
+	assert.Equals(t, err, nil)
+	assert.True(t, docid != "")
+
+	_, err = c.DeleteDoc("my doc", rev2)
+	assert.Equals(t, err, nil)
+	_, err = c.GetDoc("my doc")
+	assert.Equals(t, StatusOf(err), 404)
+
+	// Bulk operations:
+	results, err := c.BulkDocs([]Body{{"_id": "bulk1"}, {"_id": "bulk2"}, {"_id": docid}}, true)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(results), 3)
+	assert.True(t, results[0].Rev != "")
+	assert.Equals(t, results[2].Status, 409)
+
+	docs, err := c.GetDocs([]string{"bulk1", "bulk2", "nosuchdoc"})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(docs), 2)
+	assert.Equals(t, docs["bulk2"]["_id"], "bulk2")
+
+	assert.Equals(t, c.Logout(), nil)
+	_, err = c.GetDoc("bulk1")
+	assert.Equals(t, StatusOf(err), 401)
+}
+
+func TestChanges(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	c, _ := New(server.URL + "/db/")
+	c.SetBasicAuth("pupshaw", "letmein")
+
+	_, err := c.PutDoc("doc1", Body{})
+	assert.Equals(t, err, nil)
+	entries, lastSeq, err := c.GetChanges(ChangesOptions{IncludeDocs: true})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(entries), 1)
+	assert.Equals(t, entries[0].ID, "doc1")
+	assert.Equals(t, entries[0].Doc["_id"], "doc1")
+	assert.Equals(t, lastSeq, "v1."+entries[0].Seq)
+
+	// Follow the feed, and make sure it delivers changes made after it started:
+	feed := c.FollowChanges(ChangesOptions{Since: lastSeq})
+	_, err = c.PutDoc("doc2", Body{})
+	assert.Equals(t, err, nil)
+	select {
+	case entry := <-feed.Changes:
+		assert.Equals(t, entry.ID, "doc2")
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Feed didn't deliver the change")
+	}
+
+	feed.Close()
+	for _ = range feed.Changes {
+	}
+	assert.Equals(t, feed.Err(), nil)
+
+	// A feed with bad credentials gives up:
+	c.SetBasicAuth("pupshaw", "wrong")
+	feed = c.FollowChanges(ChangesOptions{})
+	for _ = range feed.Changes {
+	}
+	assert.Equals(t, StatusOf(feed.Err()), 401)
+}
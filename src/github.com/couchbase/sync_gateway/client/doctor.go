@@ -0,0 +1,197 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The doctor is a smoke test to run against a live deployment, e.g. right after it's deployed or
+// upgraded. It logs in as a test user, writes a doc to a test channel, reads it back, watches it
+// arrive on the changes feed, deletes it, and checks that unauthenticated clients can't read it.
+
+// Default channel the doctor's test document is written to.
+const DefaultDoctorChannel = "sync_gateway_doctor"
+
+// How long the doctor waits for its test document to appear on the changes feed.
+var DoctorChangesTimeout = 30 * time.Second
+
+// Options for RunDoctor.
+type DoctorOptions struct {
+	DBURL    string // Public URL of the database, e.g. "http://localhost:4984/db/"
+	Username string // A user that can write to and read from Channel
+	Password string
+	Channel  string // Channel to write the test doc to; default is DefaultDoctorChannel
+}
+
+// The outcome of one of the doctor's checks.
+type DoctorCheck struct {
+	Name string
+	Err  error // nil if the check passed
+}
+
+// The results of RunDoctor, in the order the checks ran.
+type DoctorReport struct {
+	Checks []DoctorCheck
+}
+
+// Returns true if every check passed.
+func (report *DoctorReport) Passed() bool {
+	for _, check := range report.Checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+	return len(report.Checks) > 0
+}
+
+// Writes a human-readable pass/fail line for each check, then a summary.
+func (report *DoctorReport) Write(w io.Writer) {
+	failed := 0
+	for _, check := range report.Checks {
+		if check.Err == nil {
+			fmt.Fprintf(w, "PASS  %s\n", check.Name)
+		} else {
+			fmt.Fprintf(w, "FAIL  %s: %v\n", check.Name, check.Err)
+			failed++
+		}
+	}
+	if failed == 0 {
+		fmt.Fprintf(w, "All %d checks passed\n", len(report.Checks))
+	} else {
+		fmt.Fprintf(w, "%d of %d checks failed\n", failed, len(report.Checks))
+	}
+}
+
+func (report *DoctorReport) add(name string, err error) bool {
+	report.Checks = append(report.Checks, DoctorCheck{Name: name, Err: err})
+	return err == nil
+}
+
+// Runs the doctor's checks against a gateway. It stops at the first failure that keeps the later
+// checks from running, and always tries to delete the test document it created.
+func RunDoctor(options DoctorOptions) *DoctorReport {
+	report := &DoctorReport{}
+	channel := options.Channel
+	if channel == "" {
+		channel = DefaultDoctorChannel
+	}
+
+	c, err := New(options.DBURL)
+	if !report.add("Parse database URL", err) {
+		return report
+	}
+	_, err = c.Session()
+	if !report.add("Connect to database", err) {
+		return report
+	}
+
+	// Bad credentials must be rejected:
+	err = c.Login(options.Username, options.Password+"-wrong")
+	if err == nil {
+		err = fmt.Errorf("Logged in with a wrong password")
+		c.Logout()
+	} else if StatusOf(err) == 401 {
+		err = nil
+	}
+	report.add("Reject wrong password", err)
+
+	err = c.Login(options.Username, options.Password)
+	if !report.add("Log in", err) {
+		return report
+	}
+	defer c.Logout()
+
+	// Note where the test channel's feed is now, so only the new doc will come after it:
+	_, since, err := c.GetChanges(ChangesOptions{Channels: []string{channel}})
+	if !report.add("Read changes feed", err) {
+		return report
+	}
+	feed := c.FollowChanges(ChangesOptions{Since: since, Channels: []string{channel}})
+	defer feed.Close()
+
+	docid := "sync_gateway_doctor_" + randomHex(8)
+	revid, err := c.PutDoc(docid, Body{
+		"channels": []string{channel},
+		"doctor":   true,
+		"time":     time.Now().Format(time.RFC3339),
+	})
+	if !report.add("Write document "+docid, err) {
+		return report
+	}
+	deleted := false
+	defer func() {
+		if !deleted {
+			c.DeleteDoc(docid, revid)
+		}
+	}()
+
+	doc, err := c.GetDoc(docid)
+	if err == nil && doc["_rev"] != revid {
+		err = fmt.Errorf("Read revision %v, expected %s", doc["_rev"], revid)
+	}
+	report.add("Read document", err)
+
+	report.add("Receive document on changes feed", waitForChange(feed, docid))
+
+	// An unauthenticated client must not be able to read the doc:
+	anon, _ := New(options.DBURL)
+	anon.HTTPClient = c.HTTPClient
+	_, err = anon.GetDoc(docid)
+	if err == nil {
+		err = fmt.Errorf("Unauthenticated client could read the document")
+	} else if status := StatusOf(err); status == 401 || status == 403 {
+		err = nil
+	}
+	report.add("Deny unauthenticated read", err)
+
+	_, err = c.DeleteDoc(docid, revid)
+	if report.add("Delete document", err) {
+		deleted = true
+		_, err = c.GetDoc(docid)
+		if err == nil {
+			err = fmt.Errorf("Document is still readable")
+		} else if StatusOf(err) == 404 {
+			err = nil
+		}
+		report.add("Confirm deletion", err)
+	}
+	return report
+}
+
+func waitForChange(feed *ChangesFeed, docid string) error {
+	timeout := time.After(DoctorChangesTimeout)
+	for {
+		select {
+		case entry, ok := <-feed.Changes:
+			if !ok {
+				if err := feed.Err(); err != nil {
+					return err
+				}
+				return fmt.Errorf("Changes feed closed")
+			} else if entry.ID == docid {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("Document didn't appear within %v", DoctorChangesTimeout)
+		}
+	}
+}
+
+func randomHex(n int) string {
+	bytes := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, bytes); err != nil {
+		panic("Couldn't read random bytes: " + err.Error())
+	}
+	return fmt.Sprintf("%x", bytes)
+}
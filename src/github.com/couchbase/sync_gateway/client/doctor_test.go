@@ -0,0 +1,46 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDoctor(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+
+	report := RunDoctor(DoctorOptions{DBURL: server.URL + "/db/", Username: "pupshaw", Password: "letmein"})
+	var out bytes.Buffer
+	report.Write(&out)
+	t.Logf("Doctor report:\n%s", out.String())
+	assert.True(t, report.Passed())
+	assert.Equals(t, len(report.Checks), 11)
+	assert.True(t, strings.HasSuffix(out.String(), "All 11 checks passed\n"))
+
+	// The test doc should have been cleaned up:
+	c, _ := New(server.URL + "/db/")
+	c.SetBasicAuth("pupshaw", "letmein")
+	entries, _, err := c.GetChanges(ChangesOptions{})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(entries), 1)
+	assert.True(t, entries[0].Deleted)
+
+	// With the wrong password it stops after failing to log in:
+	report = RunDoctor(DoctorOptions{DBURL: server.URL + "/db/", Username: "pupshaw", Password: "wrong"})
+	assert.False(t, report.Passed())
+	last := report.Checks[len(report.Checks)-1]
+	assert.Equals(t, last.Name, "Log in")
+	assert.Equals(t, StatusOf(last.Err), 401)
+}
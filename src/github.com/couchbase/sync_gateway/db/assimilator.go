@@ -14,7 +14,7 @@ func (c *DatabaseContext) watchDocChanges() {
 	}
 	base.LogTo("Shadow", "Watching doc changes...")
 	for event := range c.tapListener.DocChannel {
-		doc, err := unmarshalDocument(string(event.Key), event.Value)
+		doc, err := unmarshalDocument(docIDForKey(string(event.Key)), event.Value)
 		if err == nil {
 			if doc.hasValidSyncData() {
 				if c.Shadower != nil {
@@ -36,6 +36,8 @@ func (c *DatabaseContext) assimilate(docid string) {
 	_, err := db.updateDoc(docid, true, func(doc *document) (Body, error) {
 		if doc.hasValidSyncData() {
 			return nil, couchbase.UpdateCancel // someone beat me to it
+		} else if !c.shouldImport(doc) {
+			return nil, couchbase.UpdateCancel
 		}
 		if err := db.initializeSyncData(doc); err != nil {
 			return nil, err
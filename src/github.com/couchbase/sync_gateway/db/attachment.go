@@ -22,6 +22,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"sort"
 	"strings"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -34,18 +35,61 @@ const kMaxInlineAttachmentSize = 200
 // JSON bodies smaller than this won't be GZip-encoded.
 const kMinCompressedJSONSize = 300
 
+// Attachments smaller than this won't be GZip-encoded.
+const kMinCompressedAttachmentSize = 300
+
+// Prefix of the bucket keys of attachment blobs.
+const kAttachmentKeyPrefix = "_sync:att:"
+
 // Key for retrieving an attachment from Couchbase.
 type AttachmentKey string
 
+// Restrictions on the attachments a document may have, and how they're stored. The zero value
+// allows anything and stores attachments as-is.
+type AttachmentRestrictions struct {
+	AllowedContentTypes []string // MIME types allowed for new attachments ("type/*" is a wildcard)
+	MaxCount            int      // Max number of attachments per document (0 = unlimited)
+	Compress            bool     // GZip-encode new attachments of compressible types?
+}
+
+// Checks whether a new attachment's content type is allowed.
+func (r *AttachmentRestrictions) allowsContentType(contentType string) bool {
+	if len(r.AllowedContentTypes) == 0 {
+		return true
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i] // Ignore parameters like "; charset=utf-8"
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, allowed := range r.AllowedContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == contentType || allowed == "*/*" {
+			return true
+		} else if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
 // Given a CouchDB document body about to be stored in the database, goes through the _attachments
 // dict, finds attachments with inline bodies, copies the bodies into the Couchbase db, and replaces
 // the bodies with the 'digest' attributes which are the keys to retrieving them.
 func (db *Database) storeAttachments(doc *document, body Body, generation int, parentRev string) error {
 	var parentAttachments map[string]interface{}
+	var missing []string // Descriptions of stubs whose attachments don't exist
 	atts := BodyAttachments(body)
 	if atts == nil && body["_attachments"] != nil {
 		return base.HTTPErrorf(400, "Invalid _attachments")
 	}
+	restrictions := db.Attachments
+	if restrictions.MaxCount > 0 && len(atts) > restrictions.MaxCount {
+		return base.HTTPErrorf(http.StatusForbidden, "Too many attachments (%d); the maximum is %d",
+			len(atts), restrictions.MaxCount)
+	}
 	for name, value := range atts {
 		meta, ok := value.(map[string]interface{})
 		if !ok {
@@ -53,11 +97,40 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 		}
 		data, exists := meta["data"]
 		if exists {
+			// Only new attachments are checked, so docs stay editable if the allowed types change:
+			contentType, _ := meta["content_type"].(string)
+			if !restrictions.allowsContentType(contentType) {
+				return base.HTTPErrorf(http.StatusUnsupportedMediaType,
+					"Attachment %q has disallowed content type %q", name, contentType)
+			}
 			// Attachment contains data, so store it in the db:
 			attachment, err := decodeAttachment(data)
 			if err != nil {
 				return err
 			}
+			if digest, ok := meta["digest"].(string); ok {
+				if err := verifyAttachmentDigest(attachment, digest); err != nil {
+					// It may be an attachment that was stored compressed, being sent back with
+					// the decoded data it was served with (see loadBodyAttachments):
+					if compressed := compressAttachment(attachment); compressed == nil ||
+						verifyAttachmentDigest(compressed, digest) != nil {
+						base.Warn("Attachment %q of doc %q: %v", name, doc.ID, err)
+						return err
+					}
+				}
+			}
+			encoding := meta["encoding"]
+			if encoding != nil && encoding != "gzip" {
+				return base.HTTPErrorf(http.StatusUnsupportedMediaType,
+					"Attachment %q has unsupported encoding %v; use gzip", name, encoding)
+			}
+			length := len(attachment)
+			if encoding == nil && restrictions.Compress && isCompressibleContentType(contentType) {
+				if compressed := compressAttachment(attachment); compressed != nil {
+					attachment = compressed
+					encoding = "gzip"
+				}
+			}
 			key, err := db.setAttachment(attachment)
 			if err != nil {
 				return err
@@ -71,14 +144,16 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 			if contentType, ok := meta["content_type"].(string); ok {
 				newMeta["content_type"] = contentType
 			}
-			if encoding := meta["encoding"]; encoding != nil {
+			if encoding == nil {
+				newMeta["length"] = length
+			} else {
 				newMeta["encoding"] = encoding
 				newMeta["encoded_length"] = len(attachment)
-				if length, ok := meta["length"].(float64); ok {
+				if meta["encoding"] == nil {
+					newMeta["length"] = length // we compressed it
+				} else if length, ok := meta["length"].(float64); ok {
 					newMeta["length"] = length
 				}
-			} else {
-				newMeta["length"] = len(attachment)
 			}
 			atts[name] = newMeta
 
@@ -87,30 +162,49 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 			if meta["stub"] != true {
 				return base.HTTPErrorf(400, "Missing data of attachment %q", name)
 			}
-			if revpos, ok := base.ToInt64(meta["revpos"]); !ok || revpos < 1 {
+			if revpos, ok := base.ToInt64(meta["revpos"]); !ok || revpos < 1 || revpos > int64(generation) {
 				return base.HTTPErrorf(400, "Missing/invalid revpos in stub attachment %q", name)
 			}
 			// Try to look up the attachment in the parent revision:
 			if parentAttachments == nil {
 				if parent, _ := db.getAvailableRev(doc, parentRev); parent != nil {
 					parentAttachments, _ = parent["_attachments"].(map[string]interface{})
+				} else {
+					// The parent's body is gone (e.g. compacted), so fall back to the
+					// attachments of the doc's current revision:
+					parentAttachments = BodyAttachments(doc.body)
 				}
 			}
-			if parentAttachments != nil {
-				if parentAttachment := parentAttachments[name]; parentAttachment != nil {
-					atts[name] = parentAttachment
-				}
-			} else if meta["digest"] == nil {
+			parentAttachment, _ := parentAttachments[name].(map[string]interface{})
+			digest, hasDigest := meta["digest"].(string)
+			if parentAttachment != nil && (!hasDigest || digest == parentAttachment["digest"]) {
+				atts[name] = parentAttachment
+			} else if !hasDigest {
 				return base.HTTPErrorf(400, "Missing digest in stub attachment %q", name)
+			} else if renamed := findAttachmentByDigest(parentAttachments, digest); renamed != nil {
+				atts[name] = renamed
+			} else {
+				// A stub can only refer to an attachment of the parent revision, even though
+				// attachments are stored by digest; otherwise anyone who knew (or guessed) the
+				// digest of another doc's attachment could read it. So the client has to upload
+				// it; tell it all the ones it needs to send.
+				missing = append(missing, fmt.Sprintf("%q (%s)", name, digest))
 			}
 		}
 	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return base.HTTPErrorf(http.StatusPreconditionFailed,
+			"Unknown digests of stub attachments, whose data must be uploaded: %s",
+			strings.Join(missing, ", "))
+	}
 	return nil
 }
 
 // Goes through a revisions '_attachments' map, loads attachments (by their 'digest' properties)
 // and adds 'data' properties containing the data. The data is added as raw []byte; the JSON
-// marshaler will convert that to base64.
+// marshaler will convert that to base64. Data stored with an "encoding" (i.e. gzipped) is
+// decoded, since the client may not understand it.
 // If minRevpos is > 0, then only attachments that have been changed in a revision of that
 // generation or later are loaded.
 func (db *Database) loadBodyAttachments(body Body, minRevpos int) (Body, error) {
@@ -125,6 +219,14 @@ func (db *Database) loadBodyAttachments(body Body, minRevpos int) (Body, error)
 			if err != nil {
 				return nil, err
 			}
+			if encoding, _ := meta["encoding"].(string); encoding != "" {
+				if data, err = DecodeAttachmentEncoding(data, encoding); err != nil {
+					return nil, err
+				}
+				delete(meta, "encoding")
+				delete(meta, "encoded_length")
+				meta["length"] = len(data)
+			}
 			meta["data"] = data
 			delete(meta, "stub")
 		}
@@ -132,21 +234,100 @@ func (db *Database) loadBodyAttachments(body Body, minRevpos int) (Body, error)
 	return body, nil
 }
 
-// Retrieves an attachment, base64-encoded, given its key.
+// Retrieves an attachment's data given its key.
 func (db *Database) GetAttachment(key AttachmentKey) ([]byte, error) {
-	return db.Bucket.GetRaw(attachmentKeyToString(key))
+	return db.AttachmentStore.GetAttachment(key)
 }
 
-// Stores a base64-encoded attachment and returns the key to get it by.
+// Stores an attachment and returns the key to get it by. Attachments are keyed by the SHA-1
+// digest of their contents, so identical data in any number of docs & revisions is only
+// stored once; document metadata just refers to the digest.
 func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
 	key := AttachmentKey(sha1DigestKey(attachment))
-	_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, attachment)
+	added, err := db.AttachmentStore.AddAttachment(key, attachment)
 	if err == nil {
-		base.LogTo("Attach", "\tAdded attachment %q", key)
+		if added {
+			base.LogTo("Attach", "\tAdded attachment %q", key)
+		} else {
+			base.LogTo("Attach", "\tAttachment %q is already stored", key)
+			dbExpvars.Add("attachments_deduplicated", 1)
+		}
 	}
 	return key, err
 }
 
+// Returns the metadata of the attachment in an _attachments map with the given digest, if any.
+func findAttachmentByDigest(attachments map[string]interface{}, digest string) map[string]interface{} {
+	for _, value := range attachments {
+		if meta, ok := value.(map[string]interface{}); ok && meta["digest"] == digest {
+			return meta
+		}
+	}
+	return nil
+}
+
+//////// ENCODING:
+
+// Content types that are worth GZip-compressing (most other types, like images, already are.)
+var kCompressibleContentTypes = []string{
+	"text/*", "application/json", "application/javascript", "application/xml", "*+json", "*+xml",
+}
+
+// Returns true if attachments with this content type should be compressed.
+func isCompressibleContentType(contentType string) bool {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, pattern := range kCompressibleContentTypes {
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, pattern[:len(pattern)-1]) {
+			return true
+		} else if strings.HasPrefix(pattern, "*") && strings.HasSuffix(contentType, pattern[1:]) {
+			return true
+		} else if contentType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// GZip-compresses attachment data. Returns nil if it's too small to bother with, or if
+// compressing it doesn't save any space.
+func compressAttachment(data []byte) []byte {
+	if len(data) < kMinCompressedAttachmentSize {
+		return nil
+	}
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	if _, err := gz.Write(data); err != nil {
+		return nil
+	} else if err = gz.Close(); err != nil {
+		return nil
+	}
+	if buffer.Len() >= len(data) {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// Decodes attachment data stored with the given encoding (the "encoding" property of its
+// metadata), returning the original content.
+func DecodeAttachmentEncoding(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	default:
+		return nil, base.HTTPErrorf(http.StatusNotImplemented, "Unknown attachment encoding %q", encoding)
+	}
+}
+
 //////// MIME MULTIPART:
 
 // Parses a JSON MIME body, unmarshaling it into "into".
@@ -168,7 +349,14 @@ func ReadJSONFromMIME(headers http.Header, input io.Reader, into interface{}) er
 		return base.HTTPErrorf(http.StatusUnsupportedMediaType, "Unsupported Content-Encoding; use gzip")
 	}
 
-	decoder := json.NewDecoder(input)
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	} else if err = base.RequestJSONLimits.Check(data); err != nil {
+		base.Warn("Rejected JSON in HTTP request: %v", err)
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
 	if err := decoder.Decode(into); err != nil {
 		base.Warn("Couldn't parse JSON in HTTP request: %v", err)
 		return base.HTTPErrorf(http.StatusBadRequest, "Bad JSON")
@@ -182,6 +370,12 @@ type attInfo struct {
 	data        []byte
 }
 
+type attInfoList []attInfo
+
+func (l attInfoList) Len() int           { return len(l) }
+func (l attInfoList) Less(i, j int) bool { return l[i].name < l[j].name }
+func (l attInfoList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
 func writeJSONPart(writer *multipart.Writer, contentType string, body Body, compressed bool) (err error) {
 	bytes, err := json.Marshal(body)
 	if err != nil {
@@ -235,6 +429,10 @@ func (db *Database) WriteMultipartDocument(body Body, writer *multipart.Writer,
 		}
 	}
 
+	// The parts have to be in the same order as the attachments in the JSON, which the
+	// marshaler sorts by key (name); some clients match them up by order, not filename.
+	sort.Sort(attInfoList(following))
+
 	// Write the main JSON body:
 	writeJSONPart(writer, "application/json", body, compress)
 
@@ -407,8 +605,24 @@ func hasInlineAttachments(body Body) bool {
 	return false
 }
 
-func attachmentKeyToString(key AttachmentKey) string {
-	return "_sync:att:" + string(key)
+// Checks attachment data against a digest declared by the client ("sha1-..." or "md5-...", of
+// the data as sent, i.e. before decoding any "encoding".) Returns a 400 error on a mismatch.
+// Digests using other algorithms can't be checked, so they're accepted.
+func verifyAttachmentDigest(data []byte, digest string) error {
+	var actual string
+	if strings.HasPrefix(digest, "sha1-") {
+		actual = sha1DigestKey(data)
+	} else if strings.HasPrefix(digest, "md5-") {
+		actual = md5DigestKey(data)
+	} else {
+		base.LogTo("Attach", "Can't verify attachment digest %q of unknown type", digest)
+		return nil
+	}
+	if actual != digest {
+		return base.HTTPErrorf(http.StatusBadRequest,
+			"Attachment data doesn't match its digest (declared %s, actual %s)", digest, actual)
+	}
+	return nil
 }
 
 func decodeAttachment(att interface{}) ([]byte, error) {
@@ -416,7 +630,11 @@ func decodeAttachment(att interface{}) ([]byte, error) {
 	case []byte:
 		return att, nil
 	case string:
-		return base64.StdEncoding.DecodeString(att)
+		data, err := base64.StdEncoding.DecodeString(att)
+		if err != nil {
+			return nil, base.HTTPErrorf(400, "invalid base64 in attachment data")
+		}
+		return data, nil
 	default:
 		return nil, base.HTTPErrorf(400, "invalid attachment data (type %T)", att)
 	}
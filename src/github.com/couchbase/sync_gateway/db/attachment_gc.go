@@ -0,0 +1,141 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Attachment blobs are shared by every revision that has the same data, so they can't be
+// deleted when a revision goes away; instead VacuumAttachments sweeps the bucket for blobs that
+// no document or stored revision refers to any more.
+//
+// A blob that looks orphaned might be about to be used by a revision that's being saved right
+// now (the blob is stored, or found to exist already, before the doc is updated.) So a sweep
+// only records orphans, with the time they were first found, and a blob is deleted by a later
+// sweep if it's still unreferenced after AttachmentGCGracePeriod. Finding the references takes
+// a while, during which a save could start using an orphan again, so the references are found
+// once more just before the expired orphans are deleted, and any that are used again are kept.
+
+// How long an attachment has to stay unreferenced before a vacuum deletes it.
+var AttachmentGCGracePeriod = time.Hour
+
+// Key of the bucket doc that records orphaned attachments found by previous vacuums.
+const kAttachmentGCKey = "_sync:attgc"
+
+// Matches attachment digests anywhere in raw document data, including escaped JSON of stored
+// revision bodies. This errs on the side of finding too many references, which only means a
+// blob is kept around longer.
+var kAttachmentDigestRegexp = regexp.MustCompile(`(sha1|md5)-[A-Za-z0-9+/]+=*`)
+
+// Deletes orphaned attachments not used by any documents or revisions. Returns the number of
+// attachments deleted and the number of bytes reclaimed.
+func (context *DatabaseContext) VacuumAttachments() (count int, bytes int64, err error) {
+	// Find all the attachments, and all the digests referenced by anything else:
+	attachments := map[AttachmentKey]bool{}
+	err = context.AttachmentStore.ForEachAttachment(func(key AttachmentKey) {
+		attachments[key] = true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	referenced, err := context.findAttachmentReferences()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Update the set of known orphans, and delete those whose grace period has expired:
+	orphans := map[AttachmentKey]int64{}
+	if raw, err := context.Bucket.GetRaw(kAttachmentGCKey); err == nil {
+		if err := json.Unmarshal(raw, &orphans); err != nil {
+			base.Warn("Invalid %s doc: %v", kAttachmentGCKey, err)
+		}
+	}
+	now := time.Now()
+	cutoff := now.Add(-AttachmentGCGracePeriod).Unix()
+	newOrphans := map[AttachmentKey]int64{}
+	var expired []AttachmentKey
+	for key := range attachments {
+		if referenced[key] {
+			continue
+		}
+		foundAt, known := orphans[key]
+		if !known {
+			foundAt = now.Unix()
+		}
+		if foundAt > cutoff {
+			newOrphans[key] = foundAt
+		} else {
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) > 0 {
+		if referenced, err = context.findAttachmentReferences(); err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, key := range expired {
+		if referenced[key] {
+			base.LogTo("Attach", "\tOrphaned attachment %q is in use again", key)
+			continue
+		}
+		data, err := context.AttachmentStore.GetAttachment(key)
+		if err != nil {
+			continue
+		}
+		base.LogTo("Attach", "\tDeleting orphaned attachment %q", key)
+		if err := context.AttachmentStore.DeleteAttachment(key); err != nil {
+			base.Warn("Error deleting attachment %q: %v", key, err)
+			continue
+		}
+		count++
+		bytes += int64(len(data))
+	}
+
+	if len(newOrphans) > 0 {
+		if err = context.Bucket.Set(kAttachmentGCKey, 0, newOrphans); err != nil {
+			return count, bytes, err
+		}
+	} else if len(orphans) > 0 {
+		context.Bucket.Delete(kAttachmentGCKey)
+	}
+	base.Logf("Vacuumed %d attachments (%d bytes) of %q; %d more unused attachments pending",
+		count, bytes, context.Name, len(newOrphans))
+	return count, bytes, nil
+}
+
+// Returns the set of attachment digests referenced by any document or stored revision.
+func (context *DatabaseContext) findAttachmentReferences() (map[AttachmentKey]bool, error) {
+	opts := Body{"stale": false}
+	vres, err := context.Bucket.View(DesignDocSyncHousekeeping, ViewAllBits, opts)
+	if err != nil {
+		base.Warn("all_bits view returned %v", err)
+		return nil, err
+	}
+	referenced := map[AttachmentKey]bool{}
+	for _, row := range vres.Rows {
+		key := row.ID
+		if !strings.HasPrefix(key, kAttachmentKeyPrefix) && key != kAttachmentGCKey {
+			raw, err := context.Bucket.GetRaw(key)
+			if err != nil {
+				continue // deleted since the view was indexed
+			}
+			for _, digest := range kAttachmentDigestRegexp.FindAll(raw, -1) {
+				referenced[AttachmentKey(digest)] = true
+			}
+		}
+	}
+	return referenced, nil
+}
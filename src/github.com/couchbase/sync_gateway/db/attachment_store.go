@@ -0,0 +1,230 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Stores the data of attachments, keyed by their digests. The attachments' metadata always
+// stays in their documents, but the data can live outside the bucket -- for instance on a
+// filesystem, for deployments with large media libraries. Only the bucket and file stores are
+// built in; other kinds of blob stores (such as S3) can be plugged in by setting a
+// DatabaseContext's AttachmentStore.
+type AttachmentStore interface {
+	// Returns an attachment's data, or a 404 error if it doesn't exist.
+	GetAttachment(key AttachmentKey) ([]byte, error)
+	// Stores an attachment's data unless it already exists; returns true if it was added.
+	AddAttachment(key AttachmentKey, data []byte) (added bool, err error)
+	// Deletes an attachment's data.
+	DeleteAttachment(key AttachmentKey) error
+	// Calls the callback with the key of every stored attachment.
+	ForEachAttachment(callback func(AttachmentKey)) error
+}
+
+// Creates an AttachmentStore given a config string: "" (or "bucket") stores attachments in the
+// bucket, and "file:" followed by a directory path stores them as files in that directory.
+// Every node serving the database must see the same files, so with more than one node the
+// directory has to be on shared storage (such as an NFS mount); see NewFileAttachmentStore.
+func NewAttachmentStore(spec string, bucket base.Bucket) (AttachmentStore, error) {
+	if spec == "" || spec == "bucket" {
+		return &bucketAttachmentStore{bucket: bucket}, nil
+	} else if strings.HasPrefix(spec, "file:") {
+		return NewFileAttachmentStore(strings.TrimPrefix(strings.TrimPrefix(spec, "file:"), "//"), bucket)
+	}
+	return nil, fmt.Errorf("Unsupported attachment store %q", spec)
+}
+
+//////// BUCKET STORE:
+
+// The default AttachmentStore, which stores attachments as raw docs in the bucket.
+type bucketAttachmentStore struct {
+	bucket base.Bucket
+}
+
+func attachmentKeyToString(key AttachmentKey) string {
+	return kAttachmentKeyPrefix + string(key)
+}
+
+func (store *bucketAttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	return store.bucket.GetRaw(attachmentKeyToString(key))
+}
+
+func (store *bucketAttachmentStore) AddAttachment(key AttachmentKey, data []byte) (bool, error) {
+	return store.bucket.AddRaw(attachmentKeyToString(key), 0, data)
+}
+
+func (store *bucketAttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	return store.bucket.Delete(attachmentKeyToString(key))
+}
+
+func (store *bucketAttachmentStore) ForEachAttachment(callback func(AttachmentKey)) error {
+	opts := Body{"stale": false, "startkey": kAttachmentKeyPrefix,
+		"endkey": strings.TrimSuffix(kAttachmentKeyPrefix, ":") + "~", "inclusive_end": false}
+	vres, err := store.bucket.View(DesignDocSyncHousekeeping, ViewAllBits, opts)
+	if err != nil {
+		base.Warn("all_bits view returned %v", err)
+		return err
+	}
+	for _, row := range vres.Rows {
+		if strings.HasPrefix(row.ID, kAttachmentKeyPrefix) {
+			callback(AttachmentKey(row.ID[len(kAttachmentKeyPrefix):]))
+		}
+	}
+	return nil
+}
+
+//////// FILE STORE:
+
+// An AttachmentStore that keeps each attachment in a file in a directory. The filename is the
+// digest, with the base64 characters that aren't filename-safe replaced.
+type fileAttachmentStore struct {
+	dir string
+}
+
+// Key of the bucket doc recording the ID of the directory a file attachment store uses.
+const kFileAttachmentStoreKey = "_sync:attstore"
+
+// Name of the file, in a file attachment store's directory, that holds the directory's ID.
+const kFileAttachmentStoreIDFile = ".sg_attachment_store"
+
+// Creates an AttachmentStore that stores attachments in a directory, creating it if necessary.
+//
+// The directory is shared by every node serving the bucket's database, so it must be on storage
+// they all mount. To catch a node that's been given a local directory instead, the first store
+// opened writes a random ID into the directory and records it in the bucket; opening a store
+// whose directory doesn't hold the recorded ID fails.
+func NewFileAttachmentStore(dir string, bucket base.Bucket) (AttachmentStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("No directory given for file attachment store")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := checkSharedAttachmentDir(dir, bucket); err != nil {
+		return nil, err
+	}
+	return &fileAttachmentStore{dir: dir}, nil
+}
+
+// Verifies that dir is the same directory that other nodes using the bucket store attachments
+// in, by comparing the ID file in it with the one recorded in the bucket.
+func checkSharedAttachmentDir(dir string, bucket base.Bucket) error {
+	idPath := filepath.Join(dir, kFileAttachmentStoreIDFile)
+	var dirID string
+	if data, err := ioutil.ReadFile(idPath); err == nil {
+		dirID = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var recorded struct {
+		ID string `json:"id"`
+	}
+	err := bucket.Get(kFileAttachmentStoreKey, &recorded)
+	if base.IsDocNotFoundError(err) {
+		// First store opened on this bucket: record this directory's ID, creating it if needed.
+		if dirID == "" {
+			dirID = base.CreateUUID()
+			if err := ioutil.WriteFile(idPath, []byte(dirID), 0600); err != nil {
+				return err
+			}
+		}
+		recorded.ID = dirID
+		added, err := bucket.Add(kFileAttachmentStoreKey, 0, recorded)
+		if err != nil {
+			return err
+		} else if added {
+			return nil
+		}
+		// Another node recorded its directory first; check against that one instead.
+		err = bucket.Get(kFileAttachmentStoreKey, &recorded)
+	}
+	if err != nil {
+		return err
+	}
+	if dirID != recorded.ID {
+		return fmt.Errorf("Attachment directory %q is not the one other nodes of this database use; "+
+			"a file attachment store must be on storage shared by all nodes", dir)
+	}
+	return nil
+}
+
+var kFilenameEscaper = strings.NewReplacer("/", "_", "+", "-")
+var kFilenameUnescaper = strings.NewReplacer("_", "/", "-", "+")
+
+func (store *fileAttachmentStore) path(key AttachmentKey) string {
+	return filepath.Join(store.dir, kFilenameEscaper.Replace(string(key)))
+}
+
+func (store *fileAttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	data, err := ioutil.ReadFile(store.path(key))
+	if os.IsNotExist(err) {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return data, err
+}
+
+func (store *fileAttachmentStore) AddAttachment(key AttachmentKey, data []byte) (bool, error) {
+	path := store.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+	// Write to a temporary file and then rename it, so no one can read a partial attachment:
+	tempFile, err := ioutil.TempFile(store.dir, ".tmp-")
+	if err != nil {
+		return false, err
+	}
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *fileAttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	err := os.Remove(store.path(key))
+	if os.IsNotExist(err) {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return err
+}
+
+func (store *fileAttachmentStore) ForEachAttachment(callback func(AttachmentKey)) error {
+	infos, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if i := strings.Index(name, "-"); i > 0 {
+			// The digest type prefix (e.g. "sha1-") isn't escaped, only the base64 part is:
+			callback(AttachmentKey(name[:i+1] + kFilenameUnescaper.Replace(name[i+1:])))
+		}
+	}
+	return nil
+}
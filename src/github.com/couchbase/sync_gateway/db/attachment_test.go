@@ -10,10 +10,15 @@
 package db
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/couchbaselabs/go.assert"
 )
@@ -101,3 +106,271 @@ func TestAttachments(t *testing.T) {
 	err = db.PutExistingRev("doc1", body2B, []string{"2-f000", rev1id})
 	assertNoError(t, err, "Couldn't update document")
 }
+
+func TestAttachmentRestrictions(t *testing.T) {
+	context, err := NewDatabaseContext("db", testBucket(), false, CacheOptions{})
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	defer context.Close()
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	db.Attachments = AttachmentRestrictions{
+		AllowedContentTypes: []string{"image/*", "text/plain"},
+		MaxCount:            2,
+	}
+
+	rev1id, err := db.Put("doc1", unjson(`{"_attachments": {
+		"hello.txt": {"data":"aGVsbG8gd29ybGQ=", "content_type":"text/plain; charset=utf-8"},
+		"pic.png": {"data":"aGVsbG8gd29ybGQ=", "content_type":"image/png"}}}`))
+	assertNoError(t, err, "Couldn't create document")
+
+	_, err = db.Put("doc2", unjson(`{"_attachments": {
+		"evil.exe": {"data":"aGVsbG8gd29ybGQ=", "content_type":"application/x-msdownload"}}}`))
+	assertHTTPError(t, err, 415)
+	_, err = db.Put("doc2", unjson(`{"_attachments": {"untyped": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertHTTPError(t, err, 415)
+
+	body := unjson(`{"_attachments": {
+		"hello.txt": {"stub":true, "revpos":1},
+		"pic.png": {"stub":true, "revpos":1},
+		"more.txt": {"data":"aGVsbG8gd29ybGQ=", "content_type":"text/plain"}}}`)
+	body["_rev"] = rev1id
+	_, err = db.Put("doc1", body)
+	assertHTTPError(t, err, 403)
+
+	// Existing attachments aren't re-checked if the allowed types change:
+	db.Attachments.AllowedContentTypes = []string{"text/plain"}
+	body = unjson(`{"_attachments": {"pic.png": {"stub":true, "revpos":1}}}`)
+	body["_rev"] = rev1id
+	_, err = db.Put("doc1", body)
+	assertNoError(t, err, "Couldn't update document")
+}
+
+func TestAttachmentDeduplication(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Two docs with the same attachment share one stored copy:
+	_, err := db.Put("doc1", unjson(`{"_attachments": {"a.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertNoError(t, err, "Couldn't create doc1")
+	_, err = db.Put("doc2", unjson(`{"_attachments": {"b.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertNoError(t, err, "Couldn't create doc2")
+	digest := "sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0="
+	for _, docid := range []string{"doc1", "doc2"} {
+		body, err := db.Get(docid)
+		assertNoError(t, err, "Couldn't get doc")
+		for _, meta := range BodyAttachments(body) {
+			assert.Equals(t, meta.(map[string]interface{})["digest"], digest)
+		}
+	}
+	data, err := db.GetAttachment(AttachmentKey(digest))
+	assertNoError(t, err, "Couldn't get attachment")
+	assert.Equals(t, string(data), "hello world")
+
+	// A new doc can't refer to another doc's attachment by digest alone; it has to upload it:
+	_, err = db.Put("doc3", unjson(`{"_attachments": {"c.txt": {"stub":true, "revpos":1, "digest":"`+digest+`"}}}`))
+	assertHTTPError(t, err, 412)
+	_, err = db.Put("doc4", unjson(`{"_attachments": {"d.txt": {"stub":true, "revpos":1, "digest":"sha1-nope"}}}`))
+	assertHTTPError(t, err, 412)
+
+	// But a revision can rename one of its parent's attachments:
+	rev1id, err := db.Put("doc5", unjson(`{"_attachments": {"e.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertNoError(t, err, "Couldn't create doc5")
+	body := unjson(`{"_attachments": {"f.txt": {"stub":true, "revpos":1, "digest":"` + digest + `"}}}`)
+	body["_rev"] = rev1id
+	_, err = db.Put("doc5", body)
+	assertNoError(t, err, "Couldn't rename attachment")
+	body, err = db.GetRev("doc5", "", false, []string{})
+	assertNoError(t, err, "Couldn't get doc5")
+	meta := BodyAttachments(body)["f.txt"].(map[string]interface{})
+	assert.Equals(t, string(meta["data"].([]byte)), "hello world")
+
+	_, err = db.Put("doc4", unjson(`{"_attachments": {"d.txt": {"stub":true, "revpos":1}}}`))
+	assertHTTPError(t, err, 400)
+}
+
+func TestPushedAttachmentStubs(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", unjson(`{"_attachments": {"a.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertNoError(t, err, "Couldn't create doc1")
+	const digest = "sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0="
+
+	// A pushed revision whose stubs refer to unknown attachments is rejected, listing them all:
+	err = db.PutExistingRev("doc1", unjson(`{"_rev":"2-abc", "_attachments": {
+		"a.txt": {"stub":true, "revpos":1, "digest":"`+digest+`"},
+		"b.txt": {"stub":true, "revpos":2, "digest":"sha1-nope"},
+		"c.txt": {"stub":true, "revpos":1, "digest":"md5-nope"}}}`), []string{"2-abc", rev1id})
+	assertHTTPError(t, err, 412)
+	assert.True(t, strings.Contains(err.Error(), `"b.txt" (sha1-nope), "c.txt" (md5-nope)`))
+	assert.False(t, strings.Contains(err.Error(), "a.txt"))
+
+	// A stub can't claim to come from a later revision:
+	err = db.PutExistingRev("doc1", unjson(`{"_rev":"2-abc", "_attachments": {
+		"a.txt": {"stub":true, "revpos":3, "digest":"`+digest+`"}}}`), []string{"2-abc", rev1id})
+	assertHTTPError(t, err, 400)
+
+	// A stub whose digest differs from the parent's attachment of that name has to exist:
+	err = db.PutExistingRev("doc1", unjson(`{"_rev":"2-abc", "_attachments": {
+		"a.txt": {"stub":true, "revpos":1, "digest":"sha1-nope"}}}`), []string{"2-abc", rev1id})
+	assertHTTPError(t, err, 412)
+
+	err = db.PutExistingRev("doc1", unjson(`{"_rev":"2-abc", "_attachments": {
+		"a.txt": {"stub":true, "revpos":1, "digest":"`+digest+`"}}}`), []string{"2-abc", rev1id})
+	assertNoError(t, err, "Valid stub was rejected")
+}
+
+func TestAttachmentDigestVerification(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Correct SHA-1 and MD5 digests are accepted, as are ones that can't be checked:
+	_, err := db.Put("doc1", unjson(`{"_attachments": {
+		"a.txt": {"data":"aGVsbG8gd29ybGQ=", "digest":"sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0="},
+		"b.txt": {"data":"aGVsbG8gd29ybGQ=", "digest":"md5-XrY7u+Ae7tCTyyK7j1rNww=="},
+		"c.txt": {"data":"aGVsbG8gd29ybGQ=", "digest":"crc32-whatever"}}}`))
+	assertNoError(t, err, "Couldn't create document")
+
+	// Mismatches are rejected:
+	_, err = db.Put("doc2", unjson(`{"_attachments": {
+		"a.txt": {"data":"aGVsbG8gd29ybGQ=", "digest":"sha1-gwwPApfQR9bzBKpqoEYwFmKp98A="}}}`))
+	assertHTTPError(t, err, 400)
+	_, err = db.Put("doc2", unjson(`{"_attachments": {
+		"b.txt": {"data":"aGVsbG8gd29ybGQh", "digest":"md5-XrY7u+Ae7tCTyyK7j1rNww=="}}}`))
+	assertHTTPError(t, err, 400)
+}
+
+func TestVacuumAttachments(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	defer func(period time.Duration) { AttachmentGCGracePeriod = period }(AttachmentGCGracePeriod)
+	AttachmentGCGracePeriod = time.Hour
+
+	_, err := db.Put("doc1", unjson(`{"_attachments": {
+		"a.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("doc2", unjson(`{"_attachments": {
+		"b.txt": {"data":"aGVsbG8gd29ybGQh"}}}`))
+	assertNoError(t, err, "Couldn't create document")
+
+	// Nothing to vacuum while both attachments are in use:
+	count, bytes, err := db.VacuumAttachments()
+	assertNoError(t, err, "Vacuum failed")
+	assert.Equals(t, count, 0)
+	assert.Equals(t, bytes, int64(0))
+
+	// Remove doc1 out from under the gateway, orphaning its attachment:
+	assertNoError(t, db.Bucket.Delete("doc1"), "Couldn't delete doc1")
+	_, err = db.Compact()
+	assertNoError(t, err, "Compact failed")
+
+	// The orphan isn't deleted until it's been unused for the grace period:
+	count, bytes, err = db.VacuumAttachments()
+	assertNoError(t, err, "Vacuum failed")
+	assert.Equals(t, count, 0)
+	_, err = db.GetAttachment("sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+	assertNoError(t, err, "Orphaned attachment was vacuumed too soon")
+
+	AttachmentGCGracePeriod = 0
+	count, bytes, err = db.VacuumAttachments()
+	assertNoError(t, err, "Vacuum failed")
+	assert.Equals(t, count, 1)
+	assert.Equals(t, bytes, int64(len("hello world")))
+
+	_, err = db.GetAttachment("sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+	assert.True(t, err != nil)
+	_, err = db.GetAttachment("sha1-QwzjTQIHJO11oZbfwq1nx3dy0Wk=")
+	assertNoError(t, err, "Referenced attachment was vacuumed")
+}
+
+func TestFileAttachmentStore(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	dir, err := ioutil.TempDir("", "attachments")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(dir)
+	db.AttachmentStore, err = NewAttachmentStore("file:"+dir, db.Bucket)
+	assertNoError(t, err, "Couldn't create attachment store")
+
+	// "bye" has a "/" in its digest, which can't be used as-is in a filename:
+	const digest = "sha1-eMmlPi8otUPqYsgmas/fNtXGPmE="
+	_, err = db.Put("doc1", unjson(`{"_attachments": {"a.txt": {"data":"Ynll"}}}`))
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Bucket.GetRaw(kAttachmentKeyPrefix + digest)
+	assert.True(t, err != nil)
+	data, err := db.GetAttachment(digest)
+	assertNoError(t, err, "Couldn't get attachment")
+	assert.Equals(t, string(data), "bye")
+
+	var keys []AttachmentKey
+	err = db.AttachmentStore.ForEachAttachment(func(key AttachmentKey) { keys = append(keys, key) })
+	assertNoError(t, err, "ForEachAttachment failed")
+	assert.DeepEquals(t, keys, []AttachmentKey{digest})
+
+	added, err := db.AttachmentStore.AddAttachment(digest, data)
+	assertNoError(t, err, "AddAttachment failed")
+	assert.False(t, added)
+	assertNoError(t, db.AttachmentStore.DeleteAttachment(digest), "DeleteAttachment failed")
+	_, err = db.GetAttachment(digest)
+	assertHTTPError(t, err, 404)
+
+	// Another node using the same directory is fine, but one with a different (local) one isn't:
+	_, err = NewAttachmentStore("file:"+dir, db.Bucket)
+	assertNoError(t, err, "Couldn't reopen attachment store")
+	otherDir, err := ioutil.TempDir("", "attachments")
+	assertNoError(t, err, "Couldn't create temp dir")
+	defer os.RemoveAll(otherDir)
+	_, err = NewAttachmentStore("file:"+otherDir, db.Bucket)
+	assert.True(t, err != nil)
+
+	_, err = NewAttachmentStore("s3://bucket", db.Bucket)
+	assert.True(t, err != nil)
+}
+
+func TestAttachmentCompression(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Attachments.Compress = true
+
+	text := strings.Repeat("hello world ", 100)
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	_, err := db.Put("doc1", unjson(`{"_attachments": {
+		"big.txt": {"data":"`+encoded+`", "content_type":"text/plain"},
+		"small.txt": {"data":"aGVsbG8gd29ybGQ=", "content_type":"text/plain"},
+		"big.bin": {"data":"`+encoded+`", "content_type":"application/octet-stream"}}}`))
+	assertNoError(t, err, "Couldn't create document")
+
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Couldn't get document")
+	atts := BodyAttachments(body)
+
+	// Only the large attachment of a compressible type is compressed:
+	meta := atts["big.txt"].(map[string]interface{})
+	assert.Equals(t, meta["encoding"], "gzip")
+	assert.Equals(t, meta["length"], float64(len(text)))
+	assert.True(t, meta["encoded_length"].(float64) < float64(len(text)))
+	data, err := db.GetAttachment(AttachmentKey(meta["digest"].(string)))
+	assertNoError(t, err, "Couldn't get attachment")
+	decoded, err := DecodeAttachmentEncoding(data, "gzip")
+	assertNoError(t, err, "Couldn't decode attachment")
+	assert.Equals(t, string(decoded), text)
+
+	for _, name := range []string{"small.txt", "big.bin"} {
+		meta = atts[name].(map[string]interface{})
+		assert.Equals(t, meta["encoding"], nil)
+		assert.Equals(t, meta["encoded_length"], nil)
+	}
+
+	_, err = db.Put("doc2", unjson(`{"_attachments": {"a": {"data":"aGVsbG8gd29ybGQ=", "encoding":"zip"}}}`))
+	assertHTTPError(t, err, 415)
+}
+
+func TestCompressibleContentTypes(t *testing.T) {
+	for _, contentType := range []string{"text/plain", "text/html; charset=utf-8", "application/json",
+		"Application/JSON", "application/vnd.api+json", "image/svg+xml"} {
+		assert.True(t, isCompressibleContentType(contentType))
+	}
+	for _, contentType := range []string{"", "image/png", "application/octet-stream", "application/zip"} {
+		assert.False(t, isCompressibleContentType(contentType))
+	}
+}
@@ -69,6 +69,18 @@ type CacheOptions struct {
 	CachePendingSeqMaxWait time.Duration // Max wait for pending sequence before skipping
 	CachePendingSeqMaxNum  int           // Max number of pending sequences before skipping
 	CacheSkippedSeqMaxWait time.Duration // Max wait for skipped sequence before abandoning
+	ChannelCacheMinLength  int           // Keep at least this many entries in each channel's cache
+	ChannelCacheMaxLength  int           // Don't keep more than this many entries per channel
+	ChannelCacheAge        time.Duration // Entries past the min length are kept this long
+}
+
+// A snapshot of a changes cache's utilization, from DatabaseContext.ChangeCacheStats.
+type ChangeCacheStats struct {
+	Channels      int `json:"channels"`       // Number of channels cached
+	CachedEntries int `json:"cached_entries"` // Total entries in all channel caches
+	MaxLength     int `json:"max_length"`     // Most entries in any one channel's cache
+	PendingSeqs   int `json:"pending_seqs"`   // Out-of-order sequences waiting for earlier ones
+	SkippedSeqs   int `json:"skipped_seqs"`   // Sequences skipped over that may still arrive
 }
 
 //////// HOUSEKEEPING:
@@ -89,6 +101,9 @@ func (c *changeCache) Init(context *DatabaseContext, lastSequence uint64, onChan
 		CachePendingSeqMaxWait: DefaultCachePendingSeqMaxWait,
 		CachePendingSeqMaxNum:  DefaultCachePendingSeqMaxNum,
 		CacheSkippedSeqMaxWait: DefaultSkippedSeqMaxWait,
+		ChannelCacheMinLength:  DefaultChannelCacheMinLength,
+		ChannelCacheMaxLength:  DefaultChannelCacheMaxLength,
+		ChannelCacheAge:        DefaultChannelCacheAge,
 	}
 
 	if options.CachePendingSeqMaxNum > 0 {
@@ -103,6 +118,18 @@ func (c *changeCache) Init(context *DatabaseContext, lastSequence uint64, onChan
 		c.options.CacheSkippedSeqMaxWait = options.CacheSkippedSeqMaxWait
 	}
 
+	if options.ChannelCacheMinLength > 0 {
+		c.options.ChannelCacheMinLength = options.ChannelCacheMinLength
+	}
+
+	if options.ChannelCacheMaxLength > 0 {
+		c.options.ChannelCacheMaxLength = options.ChannelCacheMaxLength
+	}
+
+	if options.ChannelCacheAge > 0 {
+		c.options.ChannelCacheAge = options.ChannelCacheAge
+	}
+
 	base.LogTo("Cache", "Initializing changes cache with options %+v", c.options)
 
 	heap.Init(&c.pendingLogs)
@@ -140,6 +167,23 @@ func (c *changeCache) ClearLogs() {
 	c.lock.Unlock()
 }
 
+// Forgets all cached changes and restarts from lastSequence, after the bucket's sequence counter
+// has gone backwards.
+func (c *changeCache) resetSequences(lastSequence uint64) {
+	c.lock.Lock()
+	c.initialSequence = lastSequence
+	c.nextSequence = lastSequence + 1
+	c.receivedSeqs = make(map[uint64]struct{})
+	c.channelCaches = make(map[string]*channelCache, 10)
+	c.pendingLogs = nil
+	heap.Init(&c.pendingLogs)
+	c.lock.Unlock()
+
+	c.skippedSeqLock.Lock()
+	c.skippedSeqs = nil
+	c.skippedSeqLock.Unlock()
+}
+
 // If set to false, DocChanged() becomes a no-op.
 func (c *changeCache) EnableChannelLogs(enable bool) {
 	c.lock.Lock()
@@ -269,6 +313,11 @@ func (c *changeCache) waitForSequenceWithMissing(sequence uint64) {
 // The JSON must be the raw document from the bucket, with the metadata and all.
 func (c *changeCache) DocChanged(docID string, docJSON []byte) {
 	entryTime := time.Now()
+	if !strings.HasPrefix(docID, auth.UserKeyPrefix) && !strings.HasPrefix(docID, auth.RoleKeyPrefix) &&
+		!strings.HasPrefix(docID, kUnusedSeqKeyPrefix) {
+		// Queued here, not in the goroutine below, so DocChangedFuncs see the feed's order:
+		c.context.queueDocChanged(docID, docJSON)
+	}
 	// ** This method does not directly access any state of c, so it doesn't lock.
 	go func() {
 		// Is this a user/role doc?
@@ -278,8 +327,13 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte) {
 		} else if strings.HasPrefix(docID, auth.RoleKeyPrefix) {
 			c.processPrincipalDoc(docID, docJSON, false)
 			return
+		} else if strings.HasPrefix(docID, kUnusedSeqKeyPrefix) {
+			c.unusedSequenceMarker(docID)
+			return
 		}
 
+		docID = docIDForKey(docID)
+
 		// First unmarshal the doc (just its metadata, to save time/memory):
 		doc, err := unmarshalDocumentSyncData(docJSON, false)
 		if err != nil || !doc.hasValidSyncData() {
@@ -322,6 +376,7 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte) {
 		if c.onChange != nil && len(changedChannels) > 0 {
 			c.onChange(changedChannels)
 		}
+
 	}()
 }
 
@@ -496,12 +551,36 @@ func (c *changeCache) getChannelCache(channelName string) *channelCache {
 func (c *changeCache) _getChannelCache(channelName string) *channelCache {
 	cache := c.channelCaches[channelName]
 	if cache == nil {
-		cache = newChannelCache(c.context, channelName, c.initialSequence+1)
+		cache = newChannelCacheWithOptions(c.context, channelName, c.initialSequence+1,
+			&ChannelCacheOptions{
+				channelCacheMinLength: c.options.ChannelCacheMinLength,
+				channelCacheMaxLength: c.options.ChannelCacheMaxLength,
+				channelCacheAge:       c.options.ChannelCacheAge,
+			})
 		c.channelCaches[channelName] = cache
 	}
 	return cache
 }
 
+// Returns the current utilization of the cache.
+func (c *changeCache) Stats() ChangeCacheStats {
+	c.lock.RLock()
+	stats := ChangeCacheStats{Channels: len(c.channelCaches), PendingSeqs: len(c.pendingLogs)}
+	for _, cache := range c.channelCaches {
+		length := cache.length()
+		stats.CachedEntries += length
+		if length > stats.MaxLength {
+			stats.MaxLength = length
+		}
+	}
+	c.lock.RUnlock()
+
+	c.skippedSeqLock.RLock()
+	stats.SkippedSeqs = len(c.skippedSeqs)
+	c.skippedSeqLock.RUnlock()
+	return stats
+}
+
 //////// CHANGE ACCESS:
 
 func (c *changeCache) GetChangesInChannel(channelName string, options ChangesOptions) ([]*LogEntry, error) {
@@ -539,6 +618,16 @@ func (c *changeCache) getOldestSkippedSequence() uint64 {
 	}
 }
 
+// Returns the oldest skipped sequence still being waited for, and the number of them.
+func (c *changeCache) skippedSequenceState() (oldest uint64, count int) {
+	c.skippedSeqLock.RLock()
+	defer c.skippedSeqLock.RUnlock()
+	if len(c.skippedSeqs) > 0 {
+		oldest = c.skippedSeqs[0].seq
+	}
+	return oldest, len(c.skippedSeqs)
+}
+
 //////// LOG PRIORITY QUEUE
 
 func (h LogPriorityQueue) Len() int           { return len(h) }
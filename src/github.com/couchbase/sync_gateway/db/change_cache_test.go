@@ -796,3 +796,34 @@ func appendFromFeed(changes *[]*ChangeEntry, feed <-chan (*ChangeEntry), numEntr
 	return nil
 
 }
+
+// Test that the channel cache limits given in CacheOptions are applied, and show up in the stats
+func TestChannelCacheOptions(t *testing.T) {
+	options := shortWaitCache()
+	options.ChannelCacheMinLength = 2
+	options.ChannelCacheMaxLength = 3
+	options.ChannelCacheAge = 100 * time.Millisecond
+	db := setupTestDBWithCacheOptions(t, options)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		WriteDirect(db, []string{"ABC"}, seq)
+	}
+	WriteDirect(db, []string{"NBC"}, 6)
+	db.changeCache.waitForSequence(6)
+
+	// Max length applies as entries are added:
+	abcCache := db.changeCache.getChannelCache("ABC")
+	assert.True(t, verifyCacheSequences(abcCache, []uint64{3, 4, 5}))
+	stats := db.ChangeCacheStats()
+	assert.True(t, stats.Channels >= 2) // ABC, NBC, and maybe "*"
+	assert.Equals(t, stats.MaxLength, 3)
+	assert.True(t, stats.CachedEntries >= 4)
+	assert.Equals(t, stats.PendingSeqs, 0)
+
+	// Once the entries are older than the max age, housekeeping prunes down to the min length:
+	time.Sleep(200 * time.Millisecond)
+	db.changeCache.CleanUp()
+	assert.True(t, verifyCacheSequences(abcCache, []uint64{4, 5}))
+}
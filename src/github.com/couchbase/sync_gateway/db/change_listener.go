@@ -21,6 +21,13 @@ type changeListener struct {
 	keyCounts    map[string]uint64    // Latest count at which each doc key was updated
 	DocChannel   chan walrus.TapEvent // Passthru channel for doc mutations
 	OnDocChanged func(docID string, jsonData []byte)
+
+	// Called when the sync function's doc changes.
+	OnSyncFunctionChanged func(jsonData []byte)
+
+	// Called when a deferred invalidation doc changes; returns the keys of the principal docs
+	// to notify about, as though they'd changed.
+	OnDeferredInvalidation func(key string, jsonData []byte) base.Set
 }
 
 // Starts a changeListener on a given Bucket.
@@ -56,6 +63,18 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool) error
 						listener.OnDocChanged(key, event.Value)
 					}
 					listener.Notify(base.SetOf(key))
+				} else if key == kSyncDataKey {
+					if listener.OnSyncFunctionChanged != nil && event.Opcode == walrus.TapMutation {
+						listener.OnSyncFunctionChanged(event.Value)
+					}
+				} else if strings.HasPrefix(key, auth.DeferredInvalKeyPrefix) {
+					if listener.OnDeferredInvalidation != nil {
+						listener.Notify(listener.OnDeferredInvalidation(key, event.Value))
+					}
+				} else if strings.HasPrefix(key, kUnusedSeqKeyPrefix) {
+					if trackDocs && event.Opcode == walrus.TapMutation && listener.OnDocChanged != nil {
+						listener.OnDocChanged(key, event.Value)
+					}
 				} else if trackDocs && !strings.HasPrefix(key, kSyncKeyPrefix) {
 					if listener.OnDocChanged != nil {
 						listener.OnDocChanged(key, event.Value)
@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
@@ -55,23 +56,30 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 	if !options.IncludeDocs && !includeConflicts {
 		return
 	}
+	revID := entry.Changes[0]["rev"]
+	if !includeConflicts {
+		// Only the body is needed, which may well be in the revision cache:
+		var err error
+		if entry.Doc, err = db.GetRev(entry.ID, revID, false, nil); err != nil {
+			base.Warn("Changes feed: error getting doc %q/%q: %v", entry.ID, revID, err)
+		}
+		return
+	}
+
 	doc, err := db.GetDoc(entry.ID)
 	if err != nil {
 		base.Warn("Changes feed: error getting doc %q: %v", entry.ID, err)
 		return
 	}
 
-	revID := entry.Changes[0]["rev"]
-	if includeConflicts {
-		doc.History.forEachLeaf(func(leaf *RevInfo) {
-			if leaf.ID != revID {
-				entry.Changes = append(entry.Changes, ChangeRev{"rev": leaf.ID})
-				if !leaf.Deleted {
-					entry.Deleted = false
-				}
+	doc.History.forEachLeaf(func(leaf *RevInfo) {
+		if leaf.ID != revID {
+			entry.Changes = append(entry.Changes, ChangeRev{"rev": leaf.ID})
+			if !leaf.Deleted {
+				entry.Deleted = false
 			}
-		})
-	}
+		}
+	})
 	if options.IncludeDocs {
 		var err error
 		entry.Doc, err = db.getRevFromDoc(doc, revID, false)
@@ -122,7 +130,7 @@ func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan
 
 			select {
 			case <-options.Terminator:
-				base.LogTo("Changes+", "Aborting changesFeed")
+				db.LogTo("Changes+", "Aborting changesFeed")
 				return
 			case feed <- &change:
 			}
@@ -155,7 +163,7 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 		to = fmt.Sprintf("  (to %s)", db.user.Name())
 	}
 
-	base.LogTo("Changes", "MultiChangesFeed(%s, %+v) ... %s", chans, options, to)
+	db.LogTo("Changes", "MultiChangesFeed(%s, %+v) ... %s", chans, options, to)
 
 	if (options.Continuous || options.Wait) && options.Terminator == nil {
 		base.Warn("MultiChangesFeed: Terminator missing for Continuous/Wait mode")
@@ -164,7 +172,7 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 	output := make(chan *ChangeEntry, 50)
 	go func() {
 		defer func() {
-			base.LogTo("Changes", "MultiChangesFeed done %s", to)
+			db.LogTo("Changes", "MultiChangesFeed done %s", to)
 			close(output)
 		}()
 
@@ -217,7 +225,7 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 			if changeWaiter != nil {
 				changeWaiter.UpdateChannels(channelsSince)
 			}
-			base.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince, to)
+			db.LogTo("Changes+", "MultiChangesFeed: channels expand to %#v ... %s", channelsSince, to)
 
 			// lowSequence is used to send composite keys to clients, so that they can obtain any currently
 			// skipped sequences in a future iteration or request.
@@ -238,8 +246,14 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 			// with access to both channels would see two versions on the feed.
 			for name, seqAddedAt := range channelsSince {
 				chanOpts := options
-				if seqAddedAt > 1 && options.Since.Before(SequenceID{Seq: seqAddedAt}) && options.Since.TriggeredBy == 0 {
-					// Newly added channel so send all of it to user:
+				if options.Since.TriggeredBy == 0 {
+					if seqAddedAt > 1 && options.Since.Before(SequenceID{Seq: seqAddedAt}) {
+						// Newly added channel so send all of it to user:
+						chanOpts.Since = SequenceID{Seq: 0, TriggeredBy: seqAddedAt}
+					}
+				} else if seqAddedAt > options.Since.TriggeredBy {
+					// Channel was granted after the one whose backfill is in progress, so the user
+					// hasn't seen any of it yet; backfill it from the start too:
 					chanOpts.Since = SequenceID{Seq: 0, TriggeredBy: seqAddedAt}
 				}
 				feed, err := db.changesFeed(name, chanOpts)
@@ -274,9 +288,14 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 				}
 			}
 
-			// If the user object has changed, create a special pseudo-feed for it:
+			// If the user object has changed, or the user has lost access to channels, create a
+			// special pseudo-feed for it. Its "removed" property lists the lost channels:
 			if db.user != nil {
 				userSeq := SequenceID{Seq: db.user.Sequence()}
+				lost, lostSeq := db.user.ChannelsLostSince(options.Since.Seq)
+				if lostSeq > userSeq.Seq {
+					userSeq.Seq = lostSeq
+				}
 				if options.Since.Before(userSeq) {
 					name := db.user.Name()
 					if name == "" {
@@ -285,6 +304,7 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 					entry := ChangeEntry{
 						Seq:     userSeq,
 						ID:      "_user/" + name,
+						Removed: lost,
 						Changes: []ChangeRev{},
 					}
 					userFeed := make(chan *ChangeEntry, 1)
@@ -326,9 +346,10 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 					break // Exit the loop when there are no more entries
 				}
 
-				// Clear the current entries for the sequence just sent:
+				// Clear the current entries for the sequence just sent. (The user pseudo-entry
+				// can share a sequence with the doc that revoked its access; it's sent next.)
 				for i, cur := range current {
-					if cur != nil && cur.Seq == minSeq {
+					if cur != nil && cur.Seq == minSeq && cur.ID == minEntry.ID {
 						current[i] = nil
 						// Also concatenate the matching entries' Removed arrays:
 						if cur != minEntry && cur.Removed != nil {
@@ -357,7 +378,7 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 				minEntry.Seq.LowSeq = lowSequence
 
 				// Send the entry, and repeat the loop:
-				base.LogTo("Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
+				db.LogTo("Changes+", "MultiChangesFeed sending %+v %s", minEntry, to)
 				select {
 				case <-options.Terminator:
 					return
@@ -380,7 +401,7 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 
 			// If nothing found, and in wait mode: wait for the db to change, then run again.
 			// First notify the reader that we're waiting by sending a nil.
-			base.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
+			db.LogTo("Changes+", "MultiChangesFeed waiting... %s", to)
 			output <- nil
 			if !changeWaiter.Wait() {
 				break
@@ -396,11 +417,14 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 			// Before checking again, update the User object in case its channel access has
 			// changed while waiting:
 			if newCount := changeWaiter.CurrentUserCount(); newCount > userChangeCount {
-				base.LogTo("Changes+", "MultiChangesFeed reloading user %q", db.user.Name())
+				db.LogTo("Changes+", "MultiChangesFeed reloading user %q", db.user.Name())
 				userChangeCount = newCount
 				if err := db.ReloadUser(); err != nil {
 					base.Warn("Error reloading user %q: %v", db.user.Name(), err)
 					return
+				} else if db.CredentialsRevoked() {
+					base.LogTo("Changes", "MultiChangesFeed: credentials of user %q were revoked; ending feed", db.user.Name())
+					return
 				}
 			}
 
@@ -449,6 +473,18 @@ func (context *DatabaseContext) WaitForPendingChanges() (err error) {
 	return
 }
 
+// Returns a tag that identifies the state of the changes cache: it changes whenever a new
+// change (or a late-arriving skipped sequence) is processed, so anything derived from the
+// database's documents can only differ between two calls if the tag does.
+func (context *DatabaseContext) ChangesStateTag() string {
+	tag := strconv.FormatUint(context.changeCache.LastSequence(), 10)
+	if oldestSkipped, numSkipped := context.changeCache.skippedSequenceState(); numSkipped > 0 {
+		// The skipped queue only shrinks until the last sequence advances:
+		tag += fmt.Sprintf("::%d::%d", oldestSkipped, numSkipped)
+	}
+	return tag
+}
+
 // Late Sequence Feed
 // Manages the changes feed interaction with a channels cache's set of late-arriving entries
 type lateSequenceFeed struct {
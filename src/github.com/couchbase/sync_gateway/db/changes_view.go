@@ -33,7 +33,8 @@ func (dbc *DatabaseContext) getChangesInChannelFromView(
 	optMap := changesViewOptions(channelName, endSeq, options)
 	base.LogTo("Cache", "  Querying 'channels' view for %q (start=#%d, end=#%d, limit=%d)", channelName, options.Since.SafeSequence()+1, endSeq, options.Limit)
 	vres := channelsViewResult{}
-	err := dbc.Bucket.ViewCustom(DesignDocSyncGateway, ViewChannels, optMap, &vres)
+	err := dbc.viewCustomWithDeadline(DesignDocSyncGateway, ViewChannels, optMap, &vres,
+		dbc.viewQueryDeadline())
 	if err != nil {
 		base.Logf("Error from 'channels' view: %v", err)
 		return nil, err
@@ -47,7 +48,7 @@ func (dbc *DatabaseContext) getChangesInChannelFromView(
 	for _, row := range vres.Rows {
 		entry := &LogEntry{
 			Sequence:     uint64(row.Key[1].(float64)),
-			DocID:        row.ID,
+			DocID:        docIDForKey(row.ID),
 			RevID:        row.Value.Rev,
 			Flags:        row.Value.Flags,
 			TimeReceived: time.Now(),
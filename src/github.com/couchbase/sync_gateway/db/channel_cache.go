@@ -109,6 +109,13 @@ func (c *channelCache) pruneCache() {
 	c.lock.Unlock()
 }
 
+// Returns the number of entries in the cache.
+func (c *channelCache) length() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.logs)
+}
+
 // Returns all of the cached entries for sequences greater than 'since' in the given channel.
 // Entries are returned in increasing-sequence order.
 func (c *channelCache) getCachedChanges(options ChangesOptions) (validFrom uint64, result []*LogEntry) {
@@ -0,0 +1,191 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/couchbaselabs/go-couchbase"
+	"github.com/couchbaselabs/walrus"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Names of the conflict resolution policies that can be given in a database's config.
+const (
+	ConflictsLastWriteWins = "last_write_wins" // The revision that arrived last wins
+	ConflictsLongestBranch = "longest_branch"  // The deepest branch wins (the default winner)
+	ConflictsCustom        = "custom"          // A JS function picks or merges the winner
+)
+
+// Automatically resolves conflicts created when PutExistingRev adds a revision to a branch
+// other than the current one. The losing branches are tombstoned, so clients see a single
+// live revision again.
+type ConflictResolver struct {
+	policy string
+	custom *walrus.JSServer // Only used by the "custom" policy
+}
+
+// Creates a resolver for a policy. The "custom" policy needs fnSource: a JS function that's
+// given an array of the conflicting revision bodies and returns the body to keep. Returning one
+// of them unchanged makes that revision the winner; returning a modified body (or one without a
+// "_rev") stores it as a new revision on top of the winner. Returning null leaves the conflict.
+func NewConflictResolver(policy string, fnSource string) (*ConflictResolver, error) {
+	resolver := &ConflictResolver{policy: policy}
+	switch policy {
+	case ConflictsLastWriteWins, ConflictsLongestBranch:
+	case ConflictsCustom:
+		if fnSource == "" {
+			return nil, fmt.Errorf("Conflict policy %q requires a resolver function", policy)
+		}
+		if _, err := newJsEventTask(fnSource); err != nil {
+			return nil, err
+		}
+		resolver.custom = walrus.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				return newJsEventTask(fnSource)
+			})
+	default:
+		return nil, fmt.Errorf("Unknown conflict resolution policy %q", policy)
+	}
+	return resolver, nil
+}
+
+func (resolver *ConflictResolver) Policy() string {
+	return resolver.policy
+}
+
+// Chooses the winning revision among the conflicting (non-deleted) leaves of a document.
+// If the winner's body should be replaced by a merged one, that's returned as well.
+// An empty winner means the conflict should be left alone.
+func (resolver *ConflictResolver) resolve(db *Database, doc *document, leaves []string, newRevID string) (winner string, merged Body, err error) {
+	switch resolver.policy {
+	case ConflictsLastWriteWins:
+		winner = doc.CurrentRev
+		for _, leaf := range leaves {
+			if leaf == newRevID {
+				winner = newRevID
+			}
+		}
+		return winner, nil, nil
+	case ConflictsLongestBranch:
+		return doc.CurrentRev, nil, nil
+	}
+
+	bodies := make([]Body, 0, len(leaves))
+	for _, leaf := range leaves {
+		body, err := db.getAvailableRev(doc, leaf)
+		if err != nil {
+			return "", nil, err
+		}
+		body["_rev"] = leaf
+		bodies = append(bodies, body)
+	}
+	result, err := resolver.custom.Call(bodies)
+	if err != nil {
+		return "", nil, err
+	}
+	resultBody, ok := result.(map[string]interface{})
+	if !ok {
+		if result != nil {
+			base.Warn("Conflict resolver for %q returned %T, not an object; ignoring", doc.ID, result)
+		}
+		return "", nil, nil
+	}
+
+	merged = Body(resultBody)
+	winner, _ = merged["_rev"].(string)
+	for i, leaf := range leaves {
+		if leaf == winner {
+			if bodiesEqual(merged, bodies[i]) {
+				merged = nil // Winner is kept as-is
+			}
+			return winner, merged, nil
+		}
+	}
+	return doc.CurrentRev, merged, nil
+}
+
+// Compares two revision bodies, ignoring the "_id" property.
+func bodiesEqual(body1, body2 Body) bool {
+	copy1, copy2 := body1.ShallowCopy(), body2.ShallowCopy()
+	delete(copy1, "_id")
+	delete(copy2, "_id")
+	return string(canonicalEncoding(copy1)) == string(canonicalEncoding(copy2))
+}
+
+// Resolves a conflict in a document, if there is one, using the database's ConflictResolver:
+// adds the merged revision (if any) and tombstones every losing leaf revision. These all go into
+// a single update of the document, so a failure can't leave the conflict half-resolved. The
+// update's new revision -- the merged one, or else the first tombstone -- goes through the sync
+// and validation functions as usual; any other tombstones get the channels of the leaves they
+// delete.
+func (db *Database) resolveConflicts(docid string, newRevID string) error {
+	var winner string
+	storedRev, err := db.updateDoc(docid, false, func(doc *document) (Body, error) {
+		// (Be careful: this block can be invoked multiple times if there are races!)
+		var leaves []string
+		doc.History.forEachLeaf(func(leaf *RevInfo) {
+			if !leaf.Deleted {
+				leaves = append(leaves, leaf.ID)
+			}
+		})
+		if len(leaves) < 2 {
+			return nil, couchbase.UpdateCancel
+		}
+		var merged Body
+		var err error
+		winner, merged, err = db.ConflictResolver.resolve(db, doc, leaves, newRevID)
+		if err != nil {
+			return nil, err
+		} else if winner == "" {
+			return nil, couchbase.UpdateCancel
+		}
+
+		var newBody Body
+		if merged != nil {
+			// Add the merged body as a new revision on top of the winner, the way Put would:
+			newBody = merged.ShallowCopy()
+			delete(newBody, "_id")
+			delete(newBody, "_rev")
+			deleted, _ := newBody["_deleted"].(bool)
+			generation := genOfRevID(winner) + 1
+			if err := db.beforeWrite(docid, newBody, true); err != nil {
+				return nil, err
+			} else if err := db.storeAttachments(doc, newBody, generation, winner); err != nil {
+				return nil, err
+			}
+			mergedRev := createRevID(generation, winner, newBody)
+			newBody["_rev"] = mergedRev
+			doc.History.addRevision(RevInfo{ID: mergedRev, Parent: winner, Deleted: deleted})
+		}
+		for _, leaf := range leaves {
+			if leaf == winner {
+				continue
+			}
+			tombstone := Body{"_deleted": true}
+			tombstoneRev := createRevID(genOfRevID(leaf)+1, leaf, tombstone)
+			info := RevInfo{ID: tombstoneRev, Parent: leaf, Deleted: true}
+			if newBody == nil {
+				tombstone["_rev"] = tombstoneRev
+				newBody = tombstone
+			} else {
+				info.Channels = doc.History[leaf].Channels
+			}
+			doc.History.addRevision(info)
+		}
+		return newBody, nil
+	})
+	if err == nil && storedRev != "" {
+		db.LogTo("CRUD", "Resolved conflict in %q with policy %q: %q wins", docid,
+			db.ConflictResolver.Policy(), winner)
+	}
+	return err
+}
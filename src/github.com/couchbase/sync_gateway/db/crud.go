@@ -26,8 +26,11 @@ import (
 
 //////// READING DOCUMENTS:
 
+// Longest key Couchbase Server will store.
+const kMaxKeyLength = 250
+
 func realDocID(docid string) string {
-	if len(docid) > 250 {
+	if len(docid) > kMaxKeyLength {
 		return "" // Invalid doc IDs
 	}
 	if strings.HasPrefix(docid, "_") {
@@ -38,7 +41,7 @@ func realDocID(docid string) string {
 
 // Lowest-level method that reads a document from the bucket.
 func (db *DatabaseContext) GetDoc(docid string) (*document, error) {
-	key := realDocID(docid)
+	key := db.docKey(docid)
 	if key == "" {
 		return nil, base.HTTPErrorf(400, "Invalid doc ID")
 	}
@@ -49,6 +52,30 @@ func (db *DatabaseContext) GetDoc(docid string) (*document, error) {
 		return nil, err
 	} else if !doc.hasValidSyncData() {
 		return nil, base.HTTPErrorf(404, "Not imported")
+	} else if err = db.loadExternalBody(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Like GetDoc, but doesn't decode the document's revision history until doc.loadHistory is called.
+func (db *DatabaseContext) getDocWithoutHistory(docid string) (*document, error) {
+	key := db.docKey(docid)
+	if key == "" {
+		return nil, base.HTTPErrorf(400, "Invalid doc ID")
+	}
+	dbExpvars.Add("document_gets", 1)
+	data, err := db.Bucket.GetRaw(key)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := unmarshalDocumentWithoutHistory(docid, data)
+	if err != nil {
+		return nil, err
+	} else if !doc.hasValidSyncData() {
+		return nil, base.HTTPErrorf(404, "Not imported")
+	} else if err = db.loadExternalBody(doc); err != nil {
+		return nil, err
 	}
 	return doc, nil
 }
@@ -77,6 +104,31 @@ func (db *Database) Get(docid string) (Body, error) {
 	return db.GetRev(docid, "", false, nil)
 }
 
+// Maps each of the given revision IDs to the current leaf revision(s) descended from it, as
+// done by open_revs with latest=true. A revision that isn't in the tree is passed through as-is
+// so that it'll be reported as missing.
+func (db *Database) GetLatestRevIDs(docid string, revids []string) ([]string, error) {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		return nil, err
+	}
+	latest := make([]string, 0, len(revids))
+	seen := map[string]bool{}
+	for _, revid := range revids {
+		leaves := []string{revid}
+		if doc.History.contains(revid) {
+			leaves = doc.History.leavesDescendedFrom(revid)
+		}
+		for _, leaf := range leaves {
+			if !seen[leaf] {
+				seen[leaf] = true
+				latest = append(latest, leaf)
+			}
+		}
+	}
+	return latest, nil
+}
+
 // Returns the body of a revision of a document. Uses the revision cache.
 // revid may be "", meaning the current revision.
 func (db *Database) GetRev(docid, revid string, listRevisions bool, attachmentsSince []string) (Body, error) {
@@ -97,8 +149,9 @@ func (db *Database) GetRev(docid, revid string, listRevisions bool, attachmentsS
 			return nil, err
 		}
 	} else {
-		// No rev ID given, so load doc and get its current revision:
-		if doc, err = db.GetDoc(docid); doc == nil {
+		// No rev ID given, so load doc and get its current revision. The current revision's
+		// body and channels don't need the doc's history, so that's only decoded if needed:
+		if doc, err = db.getDocWithoutHistory(docid); doc == nil {
 			return nil, err
 		}
 		revid = doc.CurrentRev
@@ -108,8 +161,13 @@ func (db *Database) GetRev(docid, revid string, listRevisions bool, attachmentsS
 		if doc.hasFlag(channels.Deleted) {
 			body["_deleted"] = true
 		}
-		revisions = encodeRevisions(doc.History.getHistory(revid))
-		inChannels = doc.History[revid].Channels
+		if listRevisions {
+			if err = doc.loadHistory(); err != nil {
+				return nil, err
+			}
+			revisions = encodeRevisions(doc.History.getHistory(revid))
+		}
+		inChannels = doc.currentChannels()
 	}
 
 	// Authorize the access:
@@ -154,6 +212,8 @@ func (db *Database) GetRev(docid, revid string, listRevisions bool, attachmentsS
 				if doc, err = db.GetDoc(docid); doc == nil {
 					return nil, err
 				}
+			} else if err = doc.loadHistory(); err != nil {
+				return nil, err
 			}
 			ancestor := doc.History.findAncestorFromSet(revid, attachmentsSince)
 			if ancestor != "" {
@@ -223,6 +283,8 @@ func (db *DatabaseContext) getRevision(doc *document, revid string) (Body, error
 			return nil, base.HTTPErrorf(404, "missing")
 		} else if data, err := db.getOldRevisionJSON(doc.ID, revid); data == nil {
 			return nil, err
+		} else if data, err = db.expandBodyDelta(doc, data); err != nil {
+			return nil, err
 		} else if err = json.Unmarshal(data, &body); err != nil {
 			return nil, err
 		}
@@ -241,17 +303,30 @@ func (db *Database) getRevisionJSON(doc *document, revid string) ([]byte, error)
 		return body, nil
 	} else if !doc.History.contains(revid) {
 		return nil, base.HTTPErrorf(404, "missing")
+	} else if doc.hasMovedBody(revid) {
+		return db.getMovedBodyJSON(doc, revid)
+	} else if data, err := db.getOldRevisionJSON(doc.ID, revid); data == nil {
+		return nil, err
 	} else {
-		return db.getOldRevisionJSON(doc.ID, revid)
+		return db.expandBodyDelta(doc, data)
 	}
 }
 
-// Gets the body of a revision's nearest ancestor, as raw JSON (without _id or _rev.)
-// If no ancestor has any JSON, returns nil but no error.
+// Gets the body of a revision's nearest ancestor, as raw JSON (without _id or _rev.) This is
+// the oldDoc passed to the sync and validation functions.
+// If the revision has ancestors but none of their bodies are available any more (as when a
+// replicator pushes a branch whose common ancestor was compacted away) this falls back to the
+// body of the winning other leaf revision. Otherwise oldDoc would be null, which the functions
+// would take to mean a new document, skipping checks like "only the owner can change the owner."
+// If no ancestor or other leaf has any JSON, returns nil but no error.
 func (db *Database) getAncestorJSON(doc *document, revid string) ([]byte, error) {
+	leafRevID := revid
 	for {
 		if revid = doc.History.getParent(revid); revid == "" {
-			return nil, nil
+			if doc.History.getParent(leafRevID) == "" {
+				return nil, nil // A new document (or branch), so there's no old one
+			}
+			return db.getOtherLeafJSON(doc, leafRevID)
 		} else if body, err := db.getRevisionJSON(doc, revid); body != nil {
 			return body, nil
 		} else if !base.IsDocNotFoundError(err) {
@@ -260,6 +335,28 @@ func (db *Database) getAncestorJSON(doc *document, revid string) ([]byte, error)
 	}
 }
 
+// Returns the body of the winning leaf revision other than revid, or nil if there isn't one.
+func (db *Database) getOtherLeafJSON(doc *document, revid string) ([]byte, error) {
+	winner := ""
+	winnerExists := false
+	doc.History.forEachLeaf(func(info *RevInfo) {
+		exists := !info.Deleted
+		if info.ID != revid && (winner == "" || (exists && !winnerExists) ||
+			(exists == winnerExists && compareRevIDs(info.ID, winner) > 0)) {
+			winner = info.ID
+			winnerExists = exists
+		}
+	})
+	if winner == "" {
+		return nil, nil
+	}
+	body, err := db.getRevisionJSON(doc, winner)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	}
+	return body, err
+}
+
 // Returns the body of a revision given a document struct. Checks user access.
 func (db *Database) getRevFromDoc(doc *document, revid string, listRevisions bool) (Body, error) {
 	var body Body
@@ -311,7 +408,9 @@ func (db *Database) getAvailableRev(doc *document, revid string) (Body, error) {
 }
 
 // Moves a revision's ancestor's body out of the document object and into a separate db doc.
+// Where it saves space, the body is stored as a delta against the (new) revision's body.
 func (db *Database) backupAncestorRevs(doc *document, revid string) error {
+	newRevID := revid
 	// Find an ancestor that still has JSON in the document:
 	var json []byte
 	for {
@@ -323,6 +422,14 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 	}
 
 	// Store the JSON as a separate doc in the bucket:
+	if newJSON := doc.getRevisionJSON(newRevID); newJSON != nil {
+		if delta := encodeBodyDelta(json, newJSON, newRevID); delta != nil {
+			// The delta's source has to outlive it, even once it's an old revision itself:
+			if err := db.setDeltaSourceJSON(doc.ID, newRevID, newJSON); err == nil {
+				json = delta
+			}
+		}
+	}
 	if err := db.setOldRevisionJSON(doc.ID, revid, json); err != nil {
 		// This isn't fatal since we haven't lost any information; just warn about it.
 		base.Warn("backupAncestorRevs failed: doc=%q rev=%q err=%v", doc.ID, revid, err)
@@ -335,12 +442,16 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 	} else {
 		doc.History.setRevisionBody(revid, nil)
 	}
-	base.LogTo("CRUD+", "Backed up obsolete rev %q/%q", doc.ID, revid)
+	db.LogTo("CRUD+", "Backed up obsolete rev %q/%q", doc.ID, revid)
 	return nil
 }
 
 //////// UPDATING DOCUMENTS:
 
+// If a revision changes the access of more users/roles than this, their channels aren't
+// invalidated right away, but when each is next loaded. (See auth.DeferChannelInvalidations.)
+var MaxInlineAccessInvalidations = 100
+
 // Initializes the gateway-specific "_sync_" metadata of a new document.
 // Used when importing an existing Couchbase doc that hasn't been seen by the gateway before.
 func (db *Database) initializeSyncData(doc *document) (err error) {
@@ -363,6 +474,9 @@ func (db *Database) Put(docid string, body Body) (string, error) {
 	if generation < 0 {
 		return "", base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
 	}
+	if err := checkBodyIDs(docid, body, ""); err != nil {
+		return "", err
+	}
 	generation++
 	deleted, _ := body["_deleted"].(bool)
 
@@ -384,30 +498,70 @@ func (db *Database) Put(docid string, body Body) (string, error) {
 			return nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
 		}
 
+		// If the doc is being created (or resurrected), let the on_create function fill it in:
+		newBody := body
+		if !deleted && (matchRev == "" || doc.History[matchRev].Deleted) {
+			var err error
+			if newBody, err = db.applyOnCreate(body); err != nil {
+				return nil, err
+			}
+		}
+		if err := db.beforeWrite(docid, newBody, true); err != nil {
+			return nil, err
+		}
+
 		// Process the attachments, replacing bodies with digests. This alters 'body' so it has to
 		// be done before calling createRevID (the ID is based on the digest of the body.)
-		if err := db.storeAttachments(doc, body, generation, matchRev); err != nil {
+		if err := db.storeAttachments(doc, newBody, generation, matchRev); err != nil {
 			return nil, err
 		}
 
 		// Make up a new _rev, and add it to the history:
-		newRev := createRevID(generation, matchRev, body)
-		body["_rev"] = newRev
+		newRev := createRevID(generation, matchRev, newBody)
+		newBody["_rev"] = newRev
 		doc.History.addRevision(RevInfo{ID: newRev, Parent: matchRev, Deleted: deleted})
-		return body, nil
+		return newBody, nil
 	})
 }
 
+// Returns a 400 error if a revision body's "_id" property isn't the ID of the doc it's being
+// saved to, or if revid is given and the "_rev" property isn't equal to it.
+func checkBodyIDs(docid string, body Body, revid string) error {
+	if id, ok := body["_id"].(string); ok && id != docid {
+		return base.HTTPErrorf(http.StatusBadRequest,
+			"Document ID in body (%q) doesn't match the one in the URL (%q)", id, docid)
+	}
+	if revid != "" {
+		if bodyRev, ok := body["_rev"].(string); ok && bodyRev != revid {
+			return base.HTTPErrorf(http.StatusBadRequest,
+				"Revision ID in body (%q) doesn't match its _revisions (%q)", bodyRev, revid)
+		}
+	}
+	return nil
+}
+
 // Adds an existing revision to a document along with its history (list of rev IDs.)
 // This is equivalent to the "new_edits":false mode of CouchDB.
 func (db *Database) PutExistingRev(docid string, body Body, docHistory []string) error {
+	_, err := db.PutExistingRevIfNew(docid, body, docHistory)
+	return err
+}
+
+// Same as PutExistingRev, but also returns false if the revision already existed, in which
+// case nothing was changed.
+// The history only has to overlap the doc's rev tree: it's grafted on at the newest revision
+// they have in common (their common ancestor), and only the revisions after that are added.
+func (db *Database) PutExistingRevIfNew(docid string, body Body, docHistory []string) (added bool, err error) {
 	newRev := docHistory[0]
 	generation, _ := parseRevID(newRev)
 	if generation < 0 {
-		return base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
+	}
+	if err := checkBodyIDs(docid, body, newRev); err != nil {
+		return false, err
 	}
 	deleted, _ := body["_deleted"].(bool)
-	_, err := db.updateDoc(docid, false, func(doc *document) (Body, error) {
+	storedRev, err := db.updateDoc(docid, false, func(doc *document) (Body, error) {
 		// (Be careful: this block can be invoked multiple times if there are races!)
 		// Find the point where this doc's history branches from the current rev:
 		currentRevIndex := len(docHistory)
@@ -420,12 +574,20 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 			}
 		}
 		if currentRevIndex == 0 {
-			base.LogTo("CRUD+", "PutExistingRev(%q): No new revisions to add", docid)
+			db.LogTo("CRUD+", "PutExistingRev(%q): No new revisions to add", docid)
 			return nil, couchbase.UpdateCancel // No new revisions to add
 		}
 
-		// Add all the new-to-me revisions to the rev tree:
+		// Add all the new-to-me revisions to the rev tree. Each has to be exactly one generation
+		// newer than its parent, or the history would graft onto the wrong place in the tree:
 		for i := currentRevIndex - 1; i >= 0; i-- {
+			if parent != "" {
+				gen, _ := parseRevID(docHistory[i])
+				parentGen, _ := parseRevID(parent)
+				if gen != parentGen+1 {
+					return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid revision history")
+				}
+			}
 			doc.History.addRevision(RevInfo{
 				ID:      docHistory[i],
 				Parent:  parent,
@@ -433,6 +595,10 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 			parent = docHistory[i]
 		}
 
+		if err := db.beforeWrite(docid, body, false); err != nil {
+			return nil, err
+		}
+
 		// Process the attachments, replacing bodies with digests.
 		parentRevID := doc.History[newRev].Parent
 		if err := db.storeAttachments(doc, body, generation, parentRevID); err != nil {
@@ -441,16 +607,38 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 		body["_rev"] = newRev
 		return body, nil
 	})
-	return err
+	if err != nil || storedRev == "" {
+		return false, err
+	}
+	if db.ConflictResolver != nil {
+		// The rev is safely stored, so a failure to resolve isn't fatal; it stays a conflict.
+		if resolveErr := db.resolveConflicts(docid, storedRev); resolveErr != nil {
+			base.Warn("PutExistingRev(%q): Couldn't resolve conflict: %v", docid, resolveErr)
+		}
+	}
+	return true, nil
+}
+
+// Returns a 403 error if this Database is the guest user's and GuestReadOnly is set.
+func (db *Database) checkGuestCanWrite() error {
+	if db.GuestReadOnly && db.user != nil && db.user.Name() == "" {
+		return base.HTTPErrorf(http.StatusForbidden, "Guest access is read-only")
+	}
+	return nil
 }
 
 // Common subroutine of Put and PutExistingRev: a shell that loads the document, lets the caller
 // make changes to it in a callback and supply a new body, then saves the body and document.
 func (db *Database) updateDoc(docid string, allowImport bool, callback func(*document) (Body, error)) (string, error) {
-	key := realDocID(docid)
+	key := db.docKey(docid)
 	if key == "" {
 		return "", base.HTTPErrorf(400, "Invalid doc ID")
+	} else if err := db.checkGuestCanWrite(); err != nil {
+		return "", err
+	} else if err := db.beginWrite(); err != nil {
+		return "", err
 	}
+	defer db.endWrite()
 
 	var newRevID, parentRevID string
 	var doc *document
@@ -459,14 +647,21 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	var changedPrincipals, changedRoleUsers []string
 	var docSequence uint64
 	var unusedSequences []uint64
+	var obsoleteBodyKey string
+	var obsoleteMovedKeys []string
+	var rejected bool
+	bodiesStored := map[string]bool{}
 
 	err := db.Bucket.WriteUpdate(key, 0, func(currentValue []byte) (raw []byte, writeOpts walrus.WriteOptions, err error) {
 		// Be careful: this block can be invoked multiple times if there are races!
+		defer func() { rejected = (err != nil) }()
 		if doc, err = unmarshalDocument(docid, currentValue); err != nil {
 			return
 		} else if !allowImport && currentValue != nil && !doc.hasValidSyncData() {
 			err = base.HTTPErrorf(409, "Not imported")
 			return
+		} else if err = db.loadExternalBody(doc); err != nil {
+			return
 		}
 
 		// Invoke the callback to update the document and return a new revision body:
@@ -488,6 +683,11 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 		var branched, inConflict bool
 		doc.CurrentRev, branched, inConflict = doc.History.winningRevision()
 		doc.setFlag(channels.Deleted, doc.History[doc.CurrentRev].Deleted)
+		if !doc.hasFlag(channels.Deleted) {
+			doc.TombstonedAt = 0
+		} else if doc.TombstonedAt == 0 {
+			doc.TombstonedAt = time.Now().Unix() // Starts the tombstone's retention period
+		}
 		doc.setFlag(channels.Conflict, inConflict)
 		doc.setFlag(channels.Branched, branched)
 
@@ -511,11 +711,27 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 				// body to the top level doc.body:
 				doc.body = doc.History.getParsedRevisionBody(doc.CurrentRev)
 				doc.History.setRevisionBody(doc.CurrentRev, nil)
+				if doc.body == nil && doc.hasMovedBody(doc.CurrentRev) {
+					var bodyJSON []byte
+					if bodyJSON, err = db.getMovedBodyJSON(doc, doc.CurrentRev); err != nil {
+						return
+					} else if err = json.Unmarshal(bodyJSON, &doc.body); err != nil {
+						return
+					}
+				}
 			}
 		}
 
-		// Run the sync function, to validate the update and compute its channels/access:
+		// Give the validation function (if any) a chance to reject the update:
 		body["_id"] = doc.ID
+		if err = db.checkImmutableFields(doc, body, prevCurrentRev); err != nil {
+			return
+		}
+		if err = db.validateDoc(doc, body, newRevID); err != nil {
+			return
+		}
+
+		// Run the sync function, to validate the update and compute its channels/access:
 		channels, access, roles, err := db.getChannelsAndAccess(doc, body, newRevID)
 		if err != nil {
 			return
@@ -535,7 +751,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 				// we previously allocated is unusable now. We have to allocate a new sequence
 				// instead, but we add the unused one(s) to the document so when the changeCache
 				// reads the doc it won't freak out over the break in the sequence numbering.
-				base.LogTo("Cache", "updateDoc %q: Unused sequence #%d", docid, docSequence)
+				db.LogTo("Cache", "updateDoc %q: Unused sequence #%d", docid, docSequence)
 				unusedSequences = append(unusedSequences, docSequence)
 			}
 			if docSequence, err = db.sequences.nextSequence(); err != nil {
@@ -556,7 +772,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 				// channels & access, for purposes of updating the doc:
 				var curBody Body
 				if curBody, err = db.getAvailableRev(doc, doc.CurrentRev); curBody != nil {
-					base.LogTo("CRUD+", "updateDoc(%q): Rev %q causes %q to become current again",
+					db.LogTo("CRUD+", "updateDoc(%q): Rev %q causes %q to become current again",
 						docid, newRevID, doc.CurrentRev)
 					channels, access, roles, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
 					if err != nil {
@@ -581,7 +797,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
 				if cbb, ok := db.Bucket.(base.CouchbaseBucket); ok { //Backing store is Couchbase Server
 					if major, _, _, err := cbb.CBSVersion(); err == nil && major >= 3 {
-						base.LogTo("CRUD+", "Optimizing write for Couchbase Server >= 3.0")
+						db.LogTo("CRUD+", "Optimizing write for Couchbase Server >= 3.0")
 					} else {
 						// make sure the write blocks till
 						// the new value is indexable, otherwise when a User/Role updates (using a view) it
@@ -597,34 +813,59 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			}
 
 		} else {
-			base.LogTo("CRUD+", "updateDoc(%q): Rev %q leaves %q still current",
+			db.LogTo("CRUD+", "updateDoc(%q): Rev %q leaves %q still current",
 				docid, newRevID, prevCurrentRev)
 		}
 
 		// Prune old revision history to limit the number of revisions:
 		if pruned := doc.History.pruneRevisions(db.RevsLimit); pruned > 0 {
-			base.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
+			db.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
 		}
+		obsoleteMovedKeys = doc.pruneMovedBodies()
 
 		doc.TimeSaved = time.Now()
+		doc.LastWriter = db.writerInfo()
+
+		// Move a large body out of the document itself:
+		if obsoleteBodyKey, err = db.storeExternalBody(doc, false, bodiesStored); err != nil {
+			return
+		}
 
 		// Return the new raw document value for the bucket to store.
-		raw, err = json.Marshal(doc)
-		base.LogTo("Cache", "SAVING #%d", doc.Sequence) //TEMP?
+		if raw, err = json.Marshal(doc); err == nil && len(raw) > DocSizeWarningThreshold {
+			raw, err = db.shrinkDocValue(doc, raw, bodiesStored)
+			if obsoleteBodyKey == doc.ExternalBody {
+				obsoleteBodyKey = "" // shrinkDocValue moved the body back out
+			}
+		}
+		db.LogTo("Cache", "SAVING #%d", doc.Sequence) //TEMP?
 		return
 	})
 
+	if rejected && docSequence > 0 {
+		// The update was rejected after allocating sequence(s), which no doc will have. (If instead
+		// the bucket write itself failed, e.g. timed out, it may still have happened, so the
+		// sequences can't safely be released.)
+		db.releaseSequences(append(unusedSequences, docSequence))
+	}
+
 	if err == couchbase.UpdateCancel {
 		return "", nil
 	} else if err == couchbase.ErrOverwritten {
 		// ErrOverwritten is ok; if a later revision got persisted, that's fine too
-		base.LogTo("CRUD+", "Note: Rev %q/%q was overwritten in RAM before becoming indexable",
+		db.LogTo("CRUD+", "Note: Rev %q/%q was overwritten in RAM before becoming indexable",
 			docid, newRevID)
 	} else if err != nil {
 		return "", err
 	}
 
 	dbExpvars.Add("revs_added", 1)
+	db.deleteExternalBody(obsoleteBodyKey)
+	for _, key := range obsoleteMovedKeys {
+		if err := db.Bucket.Delete(key); err != nil && !base.IsDocNotFoundError(err) {
+			base.Warn("Couldn't delete moved revision body %q: %v", key, err)
+		}
+	}
 
 	// Store the new revision in the cache
 	history := doc.History.getHistory(newRevID)
@@ -634,19 +875,52 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	revChannels := doc.History[newRevID].Channels
 	db.revisionCache.Put(body, encodeRevisions(history), revChannels)
 
+	if db.WriteLog != nil {
+		entry := WriteLogEntry{
+			DocID:    docid,
+			RevID:    newRevID,
+			Sequence: doc.Sequence,
+			Channels: revChannels,
+			Deleted:  doc.History[newRevID].Deleted,
+			Time:     doc.TimeSaved,
+		}
+		if err := db.WriteLog.Append(entry); err != nil {
+			base.Warn("Couldn't append %q / %q to write log: %v", docid, newRevID, err)
+		}
+	}
+
+	if db.writeHooks != nil {
+		db.writeHooks.AfterWrite(docid, newRevID, body)
+	}
+
 	// Raise event
 	if db.EventMgr.HasHandlerForEvent(DocumentChange) {
 		db.EventMgr.RaiseDocumentChangeEvent(body, revChannels)
 	}
 
 	// Now that the document has successfully been stored, we can make other db changes:
-	base.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
+	db.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
 
 	// Mark affected users/roles as needing to recompute their channel access:
 	if len(changedPrincipals) > 0 {
-		base.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
+		deferred := false
+		if len(changedPrincipals) > MaxInlineAccessInvalidations {
+			// Too many to update now; they'll be updated as they're next loaded:
+			db.LogTo("Access", "Rev %q/%q invalidates channels of %d users/roles; deferring",
+				docid, newRevID, len(changedPrincipals))
+			err := db.Authenticator().DeferChannelInvalidations(changedPrincipals, doc.Sequence)
+			if err != nil {
+				base.Warn("Error deferring channel invalidations for %q: %v", docid, err)
+			} else {
+				deferred = true
+			}
+		} else {
+			db.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
+		}
 		for _, name := range changedPrincipals {
-			db.invalUserOrRoleChannels(name)
+			if !deferred {
+				db.invalUserOrRoleChannels(name, doc.Sequence)
+			}
 			//If this is the current in memory db.user, reload to generate updated channels
 			if db.user != nil && db.user.Name() == name {
 				user, err := db.Authenticator().GetUser(db.user.Name())
@@ -660,7 +934,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	}
 
 	if len(changedRoleUsers) > 0 {
-		base.LogTo("Access", "Rev %q/%q invalidates roles of %s", docid, newRevID, changedRoleUsers)
+		db.LogTo("Access", "Rev %q/%q invalidates roles of %s", docid, newRevID, changedRoleUsers)
 		for _, name := range changedRoleUsers {
 			db.invalUserRoles(name)
 			//If this is the current in memory db.user, reload to generate updated roles
@@ -687,7 +961,7 @@ func (db *Database) Post(body Body) (string, string, error) {
 	// If there's an incoming _id property, use that as the doc ID.
 	docid, idFound := body["_id"].(string)
 	if !idFound {
-		docid = base.CreateUUID()
+		docid = db.GenerateDocID()
 	}
 
 	rev, err := db.Put(docid, body)
@@ -698,6 +972,8 @@ func (db *Database) Post(body Body) (string, string, error) {
 }
 
 // Deletes a document, by adding a new revision whose "_deleted" property is true.
+// The tombstone has no other properties; to record data in it (such as who deleted the doc, or
+// why) Put a body with "_deleted":true instead. Its properties are kept like any other rev's.
 func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 	body := Body{"_deleted": true, "_rev": revid}
 	return db.Put(docid, body)
@@ -708,7 +984,7 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 // Calls the JS sync function to assign the doc to channels, grant users
 // access to channels, and reject invalid documents.
 func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string) (result base.Set, access channels.AccessMap, roles channels.AccessMap, err error) {
-	base.LogTo("CRUD+", "Invoking sync on doc %q rev %s", doc.ID, body["_rev"])
+	db.LogTo("CRUD+", "Invoking sync on doc %q rev %s", doc.ID, body["_rev"])
 
 	// Get the parent revision, to pass to the sync function:
 	var oldJsonBytes []byte
@@ -731,10 +1007,30 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 			err = output.Rejection
 			if err != nil {
 				base.Logf("Sync fn rejected: new=%+v  old=%s --> %s", body, oldJson, err)
+				if httpErr, ok := err.(*base.HTTPError); ok && httpErr.Status == http.StatusUnauthorized {
+					// {unauthorized:...} means the client should log in and try again:
+					err = &base.AuthChallengeError{HTTPError: *httpErr}
+				}
 			} else if !validateAccessMap(access) || !validateRoleAccessMap(roles) {
 				err = base.HTTPErrorf(500, "Error in JS sync function")
 			}
 
+		} else if status, message := base.ErrorAsHTTPStatus(err); status == http.StatusBadRequest {
+			// The function's output was invalid, e.g. an illegal channel name:
+			base.Warn("Sync fn output invalid: %s; doc = %s", message, body)
+			err = base.HTTPErrorf(http.StatusBadRequest, "Invalid sync function output: %s", message)
+		} else if db.SyncFnOnError == SyncFnErrorsAccept {
+			// The function failed, but the policy is to save the doc anyway:
+			base.Warn("Sync fn failed on doc %q (%v); accepting it into channel %q",
+				doc.ID, err, db.SyncFnErrorChannel)
+			dbExpvars.Add("sync_fn_errors_accepted", 1)
+			result = base.Set{}
+			if db.SyncFnErrorChannel != "" {
+				result = base.SetOf(db.SyncFnErrorChannel)
+			}
+			err = nil
+		} else if err == channels.ErrSyncFnTimeout || err == channels.ErrSyncFnInputTooLarge {
+			base.Warn("Sync fn on doc %q: %s", doc.ID, message)
 		} else {
 			base.Warn("Sync fn exception: %+v; doc = %s", err, body)
 			err = base.HTTPErrorf(500, "Exception in JS sync function")
@@ -757,6 +1053,110 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 	return
 }
 
+// Rejects a new revision that changes or removes any of the database's ImmutableFields that
+// the document's current revision (prevRevID, the winner before this update) had. That's used
+// rather than the new revision's parent, so that a conflicting branch off an older revision
+// can't change them; and if the doc is deleted the last live revision before the tombstone is
+// used, so deleting and recreating it can't either. Deletions, and changes made by an admin,
+// are allowed.
+func (db *Database) checkImmutableFields(doc *document, body Body, prevRevID string) error {
+	if len(db.ImmutableFields) == 0 || db.user == nil || body["_deleted"] == true {
+		return nil
+	}
+	var oldJSON []byte
+	for revid := prevRevID; revid != "" && oldJSON == nil; revid = doc.History[revid].Parent {
+		if doc.History[revid] == nil {
+			break // history was pruned
+		} else if doc.History[revid].Deleted {
+			continue
+		}
+		var err error
+		if oldJSON, err = db.getRevisionJSON(doc, revid); err != nil && !base.IsDocNotFoundError(err) {
+			return err
+		}
+	}
+	if oldJSON == nil {
+		return nil
+	}
+	var oldBody Body
+	if err := json.Unmarshal(oldJSON, &oldBody); err != nil {
+		return err
+	}
+	for _, field := range db.ImmutableFields {
+		oldValue, existed := oldBody[field]
+		if !existed {
+			continue
+		}
+		// Compare the JSON encodings, since the new body's numbers may not be float64s:
+		oldValueJSON, _ := json.Marshal(oldValue)
+		newValueJSON, _ := json.Marshal(body[field])
+		if _, exists := body[field]; !exists || string(oldValueJSON) != string(newValueJSON) {
+			return base.HTTPErrorf(http.StatusForbidden, "Field %q can't be changed", field)
+		}
+	}
+	return nil
+}
+
+// Runs the database's validate_doc_update function, if it has one, on a new revision.
+func (db *Database) validateDoc(doc *document, body Body, revID string) error {
+	if db.Validator == nil {
+		return nil
+	}
+	oldJson, err := db.getAncestorJSON(doc, revID)
+	if err != nil {
+		return err
+	}
+	err = db.Validator.Validate(body, string(oldJson), makeUserCtx(db.user))
+	if _, isHTTPErr := err.(*base.HTTPError); isHTTPErr {
+		base.Logf("Validation rejected: new=%+v  old=%s --> %s", body, oldJson, err)
+	} else if err != nil {
+		base.Warn("Validation fn exception: %+v; doc = %s", err, body)
+		err = base.HTTPErrorf(500, "Exception in JS validation function")
+	}
+	return err
+}
+
+// Runs the sync function on a stored revision of a document (the current one if revid is ""),
+// passing its nearest available ancestor as oldDoc, but doesn't save anything. If fnSource is
+// non-empty it's run instead of the database's own sync function. The output's Rejection is
+// set if the function rejected the revision or threw an exception; err is only returned if the
+// revision couldn't be loaded.
+func (db *Database) SyncFnDryRun(docid, revid, fnSource string) (output *channels.ChannelMapperOutput, parentRevID string, err error) {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		return nil, "", err
+	}
+	if revid == "" {
+		revid = doc.CurrentRev
+	}
+	body, err := db.getRevision(doc, revid)
+	if err != nil {
+		return nil, "", err
+	}
+	if doc.History[revid].Deleted {
+		body["_deleted"] = true
+	}
+	oldJSON, err := db.getAncestorJSON(doc, revid)
+	if err != nil {
+		return nil, "", err
+	}
+	parentRevID = doc.History.getParent(revid)
+
+	mapper := db.ChannelMapper
+	if fnSource != "" {
+		mapper = channels.NewLimitedChannelMapper(fnSource, db.SyncFnLimits)
+	} else if mapper == nil {
+		mapper = channels.NewDefaultChannelMapper()
+	}
+	output, err = mapper.MapToChannelsAndAccess(body, string(oldJSON), makeUserCtx(db.user))
+	if err != nil {
+		output = &channels.ChannelMapperOutput{
+			Rejection: base.HTTPErrorf(500, "Exception in JS sync function: %v", err),
+		}
+	}
+	return output, parentRevID, nil
+}
+
 // Creates a userCtx object to be passed to the sync function
 func makeUserCtx(user auth.User) map[string]interface{} {
 	if user == nil {
@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/couchbaselabs/go-couchbase"
@@ -28,13 +29,29 @@ import (
 
 // Basic description of a database. Shared between all Database objects on the same database.
 // This object is thread-safe so it can be shared between HTTP handlers.
+//
+// A DatabaseContext is long-lived: it's created once when the database is opened and holds all
+// the state that outlives a request -- the bucket connection, sequence allocator, change
+// listener, changes & revision caches, JS functions and event manager. The exported
+// configuration fields (ChannelMapper, RevsLimit, WriteLog, etc.) are set up right after
+// NewDatabaseContext returns and must not be changed once the context is in use; everything
+// that does change at runtime is unexported and guarded by its own lock or by the object that
+// owns it.
 type DatabaseContext struct {
 	Name               string                  // Database name
 	Bucket             base.Bucket             // Storage
 	tapListener        changeListener          // Listens on server Tap feed
+	deferredInvals     *auth.InvalidationCache // Principals' deferred channel invalidations
 	sequences          *sequenceAllocator      // Source of new sequence numbers
 	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function
-	StartTime          time.Time               // Timestamp when context was instantiated
+	SyncFnLimits       channels.SyncFnLimits   // Limits on sync fn calls; set before UpdateSyncFun
+	SyncFnOnError      string                  // SyncFnErrorsReject (default) or SyncFnErrorsAccept
+	SyncFnErrorChannel string                  // Channel for docs accepted despite a sync fn error
+	Validator          *channels.DocValidator  // Runs JS 'validate_doc_update' function, if any
+	OnCreate           *OnCreateFunction       // Runs JS 'on_create' function, if any
+	ImportFilter       *ImportFilterFunction   // Chooses which docs to import (nil=all); see NewImportingDatabaseContext
+	startTime          time.Time               // When context was instantiated (or rolled back)
+	lock               sync.RWMutex            // Protects startTime
 	ChangesClientStats Statistics              // Tracks stats of # of changes connections
 	RevsLimit          uint32                  // Max depth a document's revision tree can grow to
 	autoImport         bool                    // Add sync data to new untracked docs?
@@ -43,6 +60,27 @@ type DatabaseContext struct {
 	changeCache        changeCache             //
 	EventMgr           *EventManager           // Manages notification events
 	AllowEmptyPassword bool                    // Allow empty passwords?  Defaults to false
+	GuestReadOnly      bool                    // If true, the guest user can't write documents
+	GenerateDocID      base.UUIDGenerator      // Creates IDs of docs POSTed without an _id
+	WriteLog           *WriteLog               // Optional log of accepted writes
+	ConflictResolver   *ConflictResolver       // Resolves conflicts pushed by replicators, if set
+	TombstoneRetention time.Duration           // How long deleted docs are kept before purging
+	Attachments        AttachmentRestrictions  // Allowed types & number of doc attachments
+	AttachmentStore    AttachmentStore         // Stores attachment data (by default in the bucket)
+	ExternalBodySize   int                     // Bodies bigger than this are stored separately (0=never)
+	DocKeys            DocKeyMapper            // Maps doc IDs to bucket keys (nil = same as ID)
+	ViewQueryTimeout   time.Duration           // Max time a _changes/_all_docs view query can take
+	ImmutableFields    []string                // Top-level doc properties that can't be changed once set
+	TagWrites          bool                    // Record the user & client IP of each write in the doc
+	PlainSequences     bool                    // Send last_seq as a plain sequence, not a SequenceToken
+	SessionOptions     auth.SessionOptions     // How new login sessions expire
+	freeze             writeFreeze             // Set while document writes are refused
+	selfCheck          selfCheckState          // Results of the last RunSelfCheck
+	docChanged         docChangedCallbacks     // Callbacks registered with OnDocChanged
+	indexRebuild       indexRebuildState       // Progress of StartIndexRebuild
+	FetchConcurrency   int                     // Max docs a single request fetches at once
+	statsHistory       statsHistoryState       // Recorder started by StartStatsHistory
+	abandonedViews     int32                   // Timed-out view queries still running (atomic)
 }
 
 const DefaultRevsLimit = 1000
@@ -51,10 +89,18 @@ const DefaultRevsLimit = 1000
 const RevisionCacheCapacity = 5000
 
 // Represents a simulated CouchDB database. A new instance is created for each HTTP request,
-// so this struct does not have to be thread-safe.
+// so this struct does not have to be thread-safe. It's just a lightweight handle that pairs the
+// shared DatabaseContext with the user the request is authenticated as (nil for an admin), which
+// all access checks are made against.
 type Database struct {
 	*DatabaseContext
-	user auth.User
+	user               auth.User
+	clientIP           string     // Address of the client making the request, if known
+	adminRequest       bool       // Set if acting for a request made through the admin API
+	userSessionVersion uint64     // user's SessionVersion when the Database was created
+	credentialsRevoked bool       // Set by ReloadUser if the user's credentials are no longer valid
+	ignorePassword     bool       // If true, password changes don't revoke the user's credentials
+	writeHooks         WriteHooks // Called around each revision saved, if set
 }
 
 // All special/internal documents the gateway creates have this prefix in their keys.
@@ -85,25 +131,43 @@ func ConnectToBucket(spec base.BucketSpec) (bucket base.Bucket, err error) {
 
 // Creates a new DatabaseContext on a bucket. The bucket will be closed when this context closes.
 func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, cacheOptions CacheOptions) (*DatabaseContext, error) {
+	return NewImportingDatabaseContext(dbName, bucket, autoImport, nil, -1, cacheOptions)
+}
+
+// Like NewDatabaseContext, but with an import filter and a number of doc shards (see
+// SetDocShards; -1 uses whatever key scheme is recorded.) They have to be given here rather than
+// set afterwards, since docs start being imported as soon as the context starts listening to the
+// bucket, before this returns.
+func NewImportingDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, importFilter *ImportFilterFunction, docShards int, cacheOptions CacheOptions) (*DatabaseContext, error) {
 	if err := ValidateDatabaseName(dbName); err != nil {
 		return nil, err
 	}
 	context := &DatabaseContext{
-		Name:       dbName,
-		Bucket:     bucket,
-		StartTime:  time.Now(),
-		RevsLimit:  DefaultRevsLimit,
-		autoImport: autoImport,
+		Name:             dbName,
+		Bucket:           bucket,
+		startTime:        time.Now(),
+		RevsLimit:        DefaultRevsLimit,
+		autoImport:       autoImport,
+		ImportFilter:     importFilter,
+		GenerateDocID:    base.CreateUUID,
+		ViewQueryTimeout: DefaultViewQueryTimeout,
+		FetchConcurrency: DefaultFetchConcurrency,
+		SessionOptions:   auth.DefaultSessionOptions,
 	}
+	context.AttachmentStore, _ = NewAttachmentStore("", bucket)
 	context.revisionCache = NewRevisionCache(RevisionCacheCapacity, context.revCacheLoader)
 
 	context.EventMgr = NewEventManager()
 
 	var err error
+	if err = context.SetDocShards(docShards); err != nil {
+		return nil, err
+	}
 	context.sequences, err = newSequenceAllocator(bucket)
 	if err != nil {
 		return nil, err
 	}
+	context.sequences.onRollback = context.sequencesRolledBack
 	lastSeq, err := context.sequences.lastSequence()
 	if err != nil {
 		return nil, err
@@ -112,6 +176,9 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, cach
 		context.tapListener.Notify(changedChannels)
 	}, cacheOptions)
 	context.tapListener.OnDocChanged = context.changeCache.DocChanged
+	context.tapListener.OnSyncFunctionChanged = context.syncFunctionDocChanged
+	context.deferredInvals = auth.NewInvalidationCache(bucket)
+	context.tapListener.OnDeferredInvalidation = context.deferredInvals.Update
 
 	if err = context.tapListener.Start(bucket, true); err != nil {
 		return nil, err
@@ -120,30 +187,85 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, cach
 	return context, nil
 }
 
+// Called when the bucket's sequence counter has gone backwards, i.e. the bucket's been flushed
+// or rolled back (as by a failover to a replica that hadn't received the latest mutations.)
+// Clients' checkpointed sequences may now be higher than any the database will assign for a
+// while, so they'd silently miss changes. Changing the instance_start_time tells replicators to
+// discard their checkpoints and start over; incrementing the epoch tells caching clients to
+// discard their caches.
+func (context *DatabaseContext) sequencesRolledBack(oldSeq, newSeq uint64) {
+	base.Warn("********************************************************************")
+	base.Warn("Database %q: bucket %q appears to have been FLUSHED or ROLLED BACK",
+		context.Name, context.Bucket.GetName())
+	base.Warn("(sequence went from %d back to %d.) Resetting instance_start_time and the",
+		oldSeq, newSeq)
+	base.Warn("changes cache; replicating clients will need to restart from scratch.")
+	base.Warn("********************************************************************")
+	context.lock.Lock()
+	context.startTime = time.Now()
+	context.lock.Unlock()
+	context.changeCache.resetSequences(newSeq)
+	context.incrementEpoch()
+	dbExpvars.Add("sequence_rollbacks", 1)
+}
+
 func (context *DatabaseContext) Close() {
+	context.StopIndexRebuild()
+	context.StopStatsHistory()
 	context.tapListener.Stop()
 	context.changeCache.Stop()
+	context.docChanged.stop()
 	context.Shadower.Stop()
+	if context.WriteLog != nil {
+		context.WriteLog.Close()
+	}
 	context.Bucket.Close()
 	context.Bucket = nil
 }
 
+// Returns the time the context was created, or was reset after the bucket was rolled back.
+// Clients see this as the database's "instance_start_time".
+func (context *DatabaseContext) StartTime() time.Time {
+	context.lock.RLock()
+	defer context.lock.RUnlock()
+	return context.startTime
+}
+
+// Returns the current utilization of the database's changes cache.
+func (context *DatabaseContext) ChangeCacheStats() ChangeCacheStats {
+	return context.changeCache.Stats()
+}
+
 func (context *DatabaseContext) IsClosed() bool {
 	return context.Bucket == nil
 }
 
 func (context *DatabaseContext) Authenticator() *auth.Authenticator {
-	// Authenticators are lightweight & stateless, so it's OK to return a new one every time
-	return auth.NewAuthenticator(context.Bucket, context)
+	// Authenticators are lightweight, so it's OK to return a new one every time; the only state
+	// they share is the context's in-memory cache of deferred invalidations.
+	authr := auth.NewAuthenticator(context.Bucket, context)
+	if context.deferredInvals != nil {
+		authr.UseInvalidationCache(context.deferredInvals)
+	}
+	return authr
+}
+
+// Logs a message about this database, if the key is enabled globally or just for this database.
+func (context *DatabaseContext) LogTo(key string, format string, args ...interface{}) {
+	base.LogToDb(context.Name, key, format, args...)
 }
 
 // Makes a Database object given its name and bucket.
 func GetDatabase(context *DatabaseContext, user auth.User) (*Database, error) {
-	return &Database{context, user}, nil
+	db := &Database{DatabaseContext: context, user: user}
+	if user != nil {
+		db.userSessionVersion = user.SessionVersion()
+	}
+	return db, nil
 }
 
 func CreateDatabase(context *DatabaseContext) (*Database, error) {
-	return &Database{context, nil}, nil
+	return &Database{DatabaseContext: context}, nil
 }
 
 func (db *Database) SameAs(otherdb *Database) bool {
@@ -152,15 +274,36 @@ func (db *Database) SameAs(otherdb *Database) bool {
 }
 
 // Reloads the database's User object, in case its persistent properties have been changed.
+// If the user has since been deleted or disabled, or their password changed, the old User
+// object is kept but CredentialsRevoked will return true.
 func (db *Database) ReloadUser() error {
 	if db.user == nil {
 		return nil
 	}
 	user, err := db.Authenticator().GetUser(db.user.Name())
-	if err == nil {
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Disabled() ||
+		(!db.ignorePassword && user.SessionVersion() != db.userSessionVersion) {
+		db.credentialsRevoked = true
+	}
+	if user != nil {
 		db.user = user
 	}
-	return err
+	return nil
+}
+
+// Tells the Database its user authenticated without their password (or a session created with
+// it), e.g. with an API key, so a password change won't revoke their credentials.
+func (db *Database) IgnorePasswordChanges() {
+	db.ignorePassword = true
+}
+
+// Returns true if ReloadUser found that the credentials the user authenticated with are no
+// longer valid. A long-running request, like a continuous changes feed, should then end.
+func (db *Database) CredentialsRevoked() bool {
+	return db.credentialsRevoked
 }
 
 //////// ALL DOCUMENTS:
@@ -178,6 +321,18 @@ func (db *Database) DocCount() int {
 }
 
 func installViews(bucket base.Bucket) error {
+	// add all design docs from map into bucket
+	for designDocName, designDoc := range syncDesignDocs() {
+		if err := bucket.PutDDoc(designDocName, designDoc); err != nil {
+			base.Warn("Error installing Couchbase design doc: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the design docs the gateway needs in its bucket.
+func syncDesignDocs() map[string]walrus.DesignDoc {
 	// View for finding every Couchbase doc (used when deleting a database)
 	// Key is docid; value is null
 	allbits_map := `function (doc, meta) {
@@ -196,13 +351,17 @@ func installViews(bucket base.Bucket) error {
                      	if (channels[ch] == null)
                      		channelNames.push(ch);
                      }
-                     emit(meta.id, {r:sync.rev, s:sync.sequence, c:channelNames}); }`
+                     %s
+                     emit(docid, {r:sync.rev, s:sync.sequence, c:channelNames}); }`
+	alldocs_map = fmt.Sprintf(alldocs_map, kViewDocIDJS)
 	// View for importing unknown docs
 	// Key is [existing?, docid] where 'existing?' is false for unknown docs
 	import_map := `function (doc, meta) {
                      if(meta.id.substring(0,6) != "_sync:") {
                        var exists = (doc["_sync"] !== undefined);
-                       emit([exists, meta.id], null); } }`
+                       %s
+                       emit([exists, docid], null); } }`
+	import_map = fmt.Sprintf(import_map, kViewDocIDJS)
 	// View for compaction -- finds all revision docs
 	// Key and value are ignored.
 	oldrevs_map := `function (doc, meta) {
@@ -210,6 +369,23 @@ func installViews(bucket base.Bucket) error {
                      if (meta.id.substring(0,10) == "_sync:rev:")
 	                     emit("",null); }`
 
+	// View for enumerating _local docs (for debugging)
+	// Key is docid without the "_local/" prefix; value is revid
+	localdocs_map := `function (doc, meta) {
+                     if (meta.id.substring(0,%d) == %q)
+                       emit(meta.id.substring(%d), doc._rev); }`
+	localdocs_map = fmt.Sprintf(localdocs_map, len(kLocalDocKeyPrefix), kLocalDocKeyPrefix,
+		len(kLocalDocKeyPrefix))
+
+	// View for purging tombstones -- finds all deleted docs
+	// Key is the Unix time the doc was deleted; value is ignored.
+	tombstones_map := `function (doc, meta) {
+                     var sync = doc._sync;
+                     if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+                       return;
+                     if ((sync.flags & 1) && sync.tombstoned_at)
+                       emit(sync.tombstoned_at, null); }`
+
 	// Sessions view - used for session delete
 	// Key is username; value is docid
 	sessions_map := `function (doc, meta) {
@@ -300,23 +476,17 @@ func installViews(bucket base.Bucket) error {
 
 	designDocMap[DesignDocSyncHousekeeping] = walrus.DesignDoc{
 		Views: walrus.ViewMap{
-			ViewAllBits:  walrus.ViewDef{Map: allbits_map},
-			ViewAllDocs:  walrus.ViewDef{Map: alldocs_map, Reduce: "_count"},
-			ViewImport:   walrus.ViewDef{Map: import_map, Reduce: "_count"},
-			ViewOldRevs:  walrus.ViewDef{Map: oldrevs_map, Reduce: "_count"},
-			ViewSessions: walrus.ViewDef{Map: sessions_map},
+			ViewAllBits:    walrus.ViewDef{Map: allbits_map},
+			ViewAllDocs:    walrus.ViewDef{Map: alldocs_map, Reduce: "_count"},
+			ViewImport:     walrus.ViewDef{Map: import_map, Reduce: "_count"},
+			ViewOldRevs:    walrus.ViewDef{Map: oldrevs_map, Reduce: "_count"},
+			ViewSessions:   walrus.ViewDef{Map: sessions_map},
+			ViewLocalDocs:  walrus.ViewDef{Map: localdocs_map},
+			ViewTombstones: walrus.ViewDef{Map: tombstones_map},
 		},
 	}
 
-	// add all design docs from map into bucket
-	for designDocName, designDoc := range designDocMap {
-		if err := bucket.PutDDoc(designDocName, designDoc); err != nil {
-			base.Warn("Error installing Couchbase design doc: %v", err)
-			return err
-		}
-	}
-
-	return nil
+	return designDocMap
 }
 
 type IDAndRev struct {
@@ -357,7 +527,8 @@ func (db *Database) ForEachDocID(callback ForEachDocIDFunc, resultsOpts ForEachD
 		opts["endkey"] = resultsOpts.Endkey
 	}
 
-	err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAllDocs, opts, &vres)
+	err := db.viewCustomWithDeadline(DesignDocSyncHousekeeping, ViewAllDocs, opts, &vres,
+		db.viewQueryDeadline())
 	if err != nil {
 		base.Warn("all_docs got error: %v", err)
 		return err
@@ -456,6 +627,30 @@ func (db *DatabaseContext) DeleteUserSessions(userName string) error {
 	return nil
 }
 
+// Deletes session documents that have expired. (Couchbase Server deletes them by itself, but not
+// every bucket does.)
+func (db *DatabaseContext) DeleteExpiredSessions() (int, error) {
+	opts := Body{"stale": false}
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewSessions, opts)
+	if err != nil {
+		base.Warn("sessions view returned %v", err)
+		return 0, err
+	}
+
+	count := 0
+	authr := db.Authenticator()
+	for _, row := range vres.Rows {
+		docId := row.Value.(string)
+		deleted, err := authr.DeleteSessionIfExpired(strings.TrimPrefix(docId, auth.SessionKeyPrefix))
+		if err != nil {
+			base.Warn("Error deleting %q: %v", docId, err)
+		} else if deleted {
+			count++
+		}
+	}
+	return count, nil
+}
+
 // Deletes old revisions that have been moved to individual docs
 func (db *Database) Compact() (int, error) {
 	opts := Body{"stale": false, "reduce": false}
@@ -479,9 +674,52 @@ func (db *Database) Compact() (int, error) {
 	return count, nil
 }
 
-// Deletes all orphaned CouchDB attachments not used by any revisions.
-func VacuumAttachments(bucket base.Bucket) (int, error) {
-	return 0, base.HTTPErrorf(http.StatusNotImplemented, "Vacuum is temporarily out of order")
+// Purges deleted documents whose tombstones are older than the database's TombstoneRetention.
+// Until then a tombstone (the rev tree and deletion sequence) is kept so that replicators can
+// still learn of the deletion. Does nothing if TombstoneRetention is zero.
+func (db *Database) PurgeTombstones() (int, error) {
+	if db.TombstoneRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-db.TombstoneRetention).Unix()
+	opts := Body{"stale": false, "endkey": cutoff}
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewTombstones, opts)
+	if err != nil {
+		base.Warn("tombstones view returned %v", err)
+		return 0, err
+	}
+
+	base.Logf("Purging up to %d tombstones of %q ...", len(vres.Rows), db.Name)
+	count := 0
+	for _, row := range vres.Rows {
+		// Make sure the doc hasn't been resurrected since the view was indexed, and delete it
+		// only if it isn't resurrected before then either:
+		var doc *document
+		err := db.Bucket.Update(row.ID, 0, func(currentValue []byte) ([]byte, error) {
+			var err error
+			if len(currentValue) == 0 {
+				return nil, couchbase.UpdateCancel
+			} else if doc, err = unmarshalDocument(docIDForKey(row.ID), currentValue); err != nil {
+				return nil, err
+			} else if !doc.hasFlag(channels.Deleted) || doc.TombstonedAt > cutoff {
+				return nil, couchbase.UpdateCancel
+			}
+			base.LogTo("CRUD", "\tPurging tombstone %q", row.ID)
+			return nil, nil // deletes the doc
+		})
+		if err == couchbase.UpdateCancel {
+			continue
+		} else if err != nil {
+			base.Warn("Error purging %q: %v", row.ID, err)
+		} else {
+			db.deleteExternalBody(doc.ExternalBody)
+			for _, revid := range doc.MovedBodies {
+				db.Bucket.Delete(leafRevisionKey(doc.ID, revid))
+			}
+			count++
+		}
+	}
+	return count, nil
 }
 
 //////// SYNC FUNCTION:
@@ -493,55 +731,137 @@ const kSyncDataKey = "_sync:syncdata"
 // If multiple gateway instances try to update the function at the same time (to the same new
 // value) only one of them will get a changed=true result.
 func (context *DatabaseContext) UpdateSyncFun(syncFun string) (changed bool, err error) {
-	if syncFun == "" {
-		context.ChannelMapper = nil
-	} else if context.ChannelMapper != nil {
-		_, err = context.ChannelMapper.SetFunction(syncFun)
-	} else {
-		context.ChannelMapper = channels.NewChannelMapper(syncFun)
-	}
-	if err != nil {
-		base.Warn("Error setting sync function: %s", err)
-		return
-	}
+	return context.UpdateSyncFunBy(syncFun, "")
+}
+
+// Like UpdateSyncFun, but records who or what made the change in the function's history.
+func (context *DatabaseContext) UpdateSyncFunBy(syncFun string, changedBy string) (changed bool, err error) {
+	return context.updateSyncFun(syncFun, changedBy, syncFunSet)
+}
+
+// Sets the sync function from the database's config. Unlike UpdateSyncFunBy, if an admin has
+// rolled the function back (see RollBackSyncFun) since the config set this same function, the
+// rolled-back function is kept; the config only takes over again once its function changes.
+func (context *DatabaseContext) UpdateSyncFunFromConfig(syncFun string) (changed bool, err error) {
+	return context.updateSyncFun(syncFun, "config", syncFunFromConfig)
+}
+
+// Ways the sync function can be set, which affect whether a later config can override it.
+const (
+	syncFunSet = iota
+	syncFunFromConfig
+	syncFunRollBack
+)
 
-	var syncData struct { // format of the sync-fn document
-		Sync string
+func (context *DatabaseContext) updateSyncFun(syncFun string, changedBy string, how int) (changed bool, err error) {
+	if err = context.setSyncFunction(syncFun); err != nil {
+		return
 	}
 
+	effectiveSyncFun := syncFun
 	err = context.Bucket.Update(kSyncDataKey, 0, func(currentValue []byte) ([]byte, error) {
 		// The first time opening a new db, currentValue will be nil. Don't treat this as a change.
+		var syncData syncFunctionData
+		changed = false
+		effectiveSyncFun = syncFun
 		if currentValue != nil {
 			parseErr := json.Unmarshal(currentValue, &syncData)
 			if parseErr != nil || syncData.Sync != syncFun {
 				changed = true
 			}
 		}
-		if changed || currentValue == nil {
-			syncData.Sync = syncFun
-			return json.Marshal(syncData)
-		} else {
+		save := changed || currentValue == nil
+		switch how {
+		case syncFunFromConfig:
+			if syncData.RolledBack && syncData.ConfigSync != nil && *syncData.ConfigSync == syncFun {
+				// An admin rolled back from this config's function; keep their choice:
+				effectiveSyncFun = syncData.Sync
+				changed = false
+				return nil, couchbase.UpdateCancel
+			}
+			if syncData.RolledBack || syncData.ConfigSync == nil || *syncData.ConfigSync != syncFun {
+				syncData.RolledBack = false
+				syncData.ConfigSync = &syncFun
+				save = true
+			}
+		case syncFunRollBack:
+			if !syncData.RolledBack {
+				syncData.RolledBack = true
+				save = true
+			}
+		}
+		if !save {
 			return nil, couchbase.UpdateCancel // value unchanged, no need to save
 		}
+		if changed || currentValue == nil {
+			syncData.addVersion(syncFun, changedBy)
+		}
+		return json.Marshal(syncData)
 	})
 
 	if err == couchbase.UpdateCancel {
 		err = nil
 	}
+	if err == nil && effectiveSyncFun != syncFun {
+		base.Logf("Database %q: keeping the sync function an admin rolled back to, instead of the config's",
+			context.Name)
+		err = context.setSyncFunction(effectiveSyncFun)
+	}
 	return
 }
 
+// Compiles the sync function and makes it current on this node, without saving it.
+func (context *DatabaseContext) setSyncFunction(syncFun string) (err error) {
+	if syncFun == "" {
+		context.ChannelMapper = nil
+	} else if context.ChannelMapper != nil {
+		_, err = context.ChannelMapper.SetFunction(syncFun)
+	} else {
+		context.ChannelMapper = channels.NewLimitedChannelMapper(syncFun, context.SyncFnLimits)
+	}
+	if err != nil {
+		base.Warn("Error setting sync function: %s", err)
+	}
+	return
+}
+
+// Called when the sync-fn doc changes, possibly on another node; makes its function current.
+func (context *DatabaseContext) syncFunctionDocChanged(value []byte) {
+	var syncData syncFunctionData
+	if json.Unmarshal(value, &syncData) == nil {
+		context.setSyncFunction(syncData.Sync)
+	}
+}
+
+// Counts of documents visited by ResyncAllDocs.
+type ResyncStats struct {
+	DocsProcessed int `json:"docs_processed"` // Docs the sync function was run on
+	DocsChanged   int `json:"docs_changed"`   // Docs whose channels or access changed
+	DocsFailed    int `json:"docs_failed"`    // Docs that couldn't be updated
+}
+
 // Re-runs the sync function on every current document in the database (if doCurrentDocs==true)
 // and/or imports docs in the bucket not known to the gateway (if doImportDocs==true).
-// To be used when the JavaScript sync function changes.
+// To be used when the JavaScript sync function changes. Returns the number of docs changed.
 func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool) (int, error) {
+	stats, err := db.updateAllDocChannels(doCurrentDocs, doImportDocs)
+	return stats.DocsChanged, err
+}
+
+// Re-runs the sync function on every current document, like UpdateAllDocChannels, and returns
+// counts of the docs processed, changed and failed.
+func (db *Database) ResyncAllDocs() (ResyncStats, error) {
+	return db.updateAllDocChannels(true, false)
+}
+
+func (db *Database) updateAllDocChannels(doCurrentDocs bool, doImportDocs bool) (stats ResyncStats, err error) {
 	if doCurrentDocs {
 		base.Log("Recomputing document channels...")
 	}
 	if doImportDocs {
 		base.Log("Importing documents...")
 	} else if !doCurrentDocs {
-		return 0, nil // no-op if neither option is set
+		return // no-op if neither option is set
 	}
 	options := Body{"stale": false, "reduce": false}
 	if !doCurrentDocs {
@@ -552,7 +872,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 	}
 	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewImport, options)
 	if err != nil {
-		return 0, err
+		return
 	}
 
 	// We are about to alter documents without updating their sequence numbers, which would
@@ -562,76 +882,22 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 	db.changeCache.ClearLogs()
 
 	base.Logf("Re-running sync function on all %d documents...", len(vres.Rows))
-	changeCount := 0
 	for _, row := range vres.Rows {
 		rowKey := row.Key.([]interface{})
 		docid := rowKey[1].(string)
-		key := realDocID(docid)
-		//base.Log("\tupdating %q", docid)
-		err := db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
-			// Be careful: this block can be invoked multiple times if there are races!
-			if currentValue == nil {
-				return nil, couchbase.UpdateCancel // someone deleted it?!
-			}
-			doc, err := unmarshalDocument(docid, currentValue)
-			if err != nil {
-				return nil, err
-			}
-
-			imported := false
-			if !doc.hasValidSyncData() {
-				// This is a document not known to the sync gateway. Ignore or import it:
-				if !doImportDocs {
-					return nil, couchbase.UpdateCancel
-				}
-				imported = true
-				if err = db.initializeSyncData(doc); err != nil {
-					return nil, err
-				}
-				base.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
-			} else {
-				if !doCurrentDocs {
-					return nil, couchbase.UpdateCancel
-				}
-				base.LogTo("CRUD", "\tRe-syncing document %q", docid)
-			}
-
-			// Run the sync fn over each current/leaf revision, in case there are conflicts:
-			changed := 0
-			doc.History.forEachLeaf(func(rev *RevInfo) {
-				body, _ := db.getRevFromDoc(doc, rev.ID, false)
-				channels, access, roles, err := db.getChannelsAndAccess(doc, body, rev.ID)
-				if err != nil {
-					// Probably the validator rejected the doc
-					base.Warn("Error calling sync() on doc %q: %v", docid, err)
-					access = nil
-					channels = nil
-				}
-				rev.Channels = channels
-
-				if rev.ID == doc.CurrentRev {
-					changed = len(doc.Access.updateAccess(doc, access)) +
-						len(doc.RoleAccess.updateAccess(doc, roles)) +
-						len(doc.updateChannels(channels))
-				}
-			})
-
-			if changed > 0 || imported {
-				base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
-				return json.Marshal(doc)
-			} else {
-				return nil, couchbase.UpdateCancel
-			}
-		})
+		stats.DocsProcessed++
+		err := db.resyncDocument(docid, doCurrentDocs, doImportDocs, false)
 		if err == nil {
-			changeCount++
+			stats.DocsChanged++
 		} else if err != couchbase.UpdateCancel {
 			base.Warn("Error updating doc %q: %v", docid, err)
+			stats.DocsFailed++
 		}
 	}
-	base.Logf("Finished re-running sync function; %d docs changed", changeCount)
+	base.Logf("Finished re-running sync function; %d docs changed, %d failed",
+		stats.DocsChanged, stats.DocsFailed)
 
-	if changeCount > 0 {
+	if stats.DocsChanged > 0 {
 		// Now invalidate channel cache of all users/roles:
 		base.Log("Invalidating channel caches of users/roles...")
 		users, roles, _ := db.AllPrincipalIDs()
@@ -641,8 +907,74 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 		for _, name := range roles {
 			db.invalRoleChannels(name)
 		}
+		db.incrementEpoch()
 	}
-	return changeCount, nil
+	return stats, nil
+}
+
+// Re-runs the sync function on a document, or imports it if it isn't known to the gateway,
+// and saves its updated channels and access grants. Unless force is true the document is only
+// saved if something changed. Returns couchbase.UpdateCancel if it wasn't saved.
+func (db *Database) resyncDocument(docid string, doCurrentDocs, doImportDocs, force bool) error {
+	key := db.docKey(docid)
+	//base.Log("\tupdating %q", docid)
+	return db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		if currentValue == nil {
+			return nil, couchbase.UpdateCancel // someone deleted it?!
+		}
+		doc, err := unmarshalDocument(docid, currentValue)
+		if err != nil {
+			return nil, err
+		} else if err = db.loadExternalBody(doc); err != nil {
+			return nil, err
+		}
+
+		imported := false
+		if !doc.hasValidSyncData() {
+			// This is a document not known to the sync gateway. Ignore or import it:
+			if !doImportDocs || !db.shouldImport(doc) {
+				return nil, couchbase.UpdateCancel
+			}
+			imported = true
+			if err = db.initializeSyncData(doc); err != nil {
+				return nil, err
+			}
+			base.LogTo("CRUD", "\tImporting document %q --> rev %q", docid, doc.CurrentRev)
+		} else {
+			if !doCurrentDocs {
+				return nil, couchbase.UpdateCancel
+			}
+			base.LogTo("CRUD", "\tRe-syncing document %q", docid)
+		}
+
+		// Run the sync fn over each current/leaf revision, in case there are conflicts:
+		changed := 0
+		doc.History.forEachLeaf(func(rev *RevInfo) {
+			body, _ := db.getRevFromDoc(doc, rev.ID, false)
+			channels, access, roles, err := db.getChannelsAndAccess(doc, body, rev.ID)
+			if err != nil {
+				// Probably the validator rejected the doc
+				base.Warn("Error calling sync() on doc %q: %v", docid, err)
+				access = nil
+				channels = nil
+			}
+			rev.Channels = channels
+
+			if rev.ID == doc.CurrentRev {
+				changed = len(doc.Access.updateAccess(doc, access)) +
+					len(doc.RoleAccess.updateAccess(doc, roles)) +
+					len(doc.updateChannels(channels))
+			}
+		})
+
+		if changed > 0 || imported || force {
+			base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
+			return json.Marshal(doc)
+		} else {
+			return nil, couchbase.UpdateCancel
+		}
+	})
 }
 
 func (db *Database) invalUserRoles(username string) {
@@ -666,11 +998,20 @@ func (db *Database) invalRoleChannels(rolename string) {
 	}
 }
 
-func (db *Database) invalUserOrRoleChannels(name string) {
+// Invalidates the channels of a user, or a role if the name has a "role:" prefix, because of
+// the document change with the given sequence.
+func (db *Database) invalUserOrRoleChannels(name string, sequence uint64) {
+	authr := db.Authenticator()
+	var princ auth.Principal
 	if strings.HasPrefix(name, "role:") {
-		db.invalRoleChannels(name[5:])
-	} else {
-		db.invalUserChannels(name)
+		if role, _ := authr.GetRole(name[5:]); role != nil {
+			princ = role
+		}
+	} else if user, _ := authr.GetUser(name); user != nil {
+		princ = user
+	}
+	if princ != nil {
+		authr.InvalidateChannelsAt(princ, sequence)
 	}
 }
 
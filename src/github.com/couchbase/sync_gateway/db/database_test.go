@@ -12,10 +12,13 @@ package db
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/couchbaselabs/go.assert"
+	"github.com/couchbaselabs/walrus"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
@@ -373,6 +376,100 @@ func TestChangesAfterChannelAdded(t *testing.T) {
 		Changes: []ChangeRev{{"rev": revid}}})
 }
 
+// A channel granted while the backfill of an earlier grant is in progress must be backfilled too
+func TestChangesAfterChannelAddedDuringBackfill(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+
+	// Create docs in two channels the user can't see yet (sequences 1 and 2):
+	revid1, _ := db.Put("doc1", Body{"channels": []string{"NBC"}})
+	revid2, _ := db.Put("doc2", Body{"channels": []string{"PBS"}})
+
+	// Grant access to PBS (sequence 3), and read the backfill:
+	userInfo, err := db.GetPrincipal("naomi", true)
+	userInfo.ExplicitChannels = base.SetOf("ABC", "PBS")
+	_, err = db.UpdatePrincipal(*userInfo, true, true)
+	assertNoError(t, err, "UpdatePrincipal failed")
+
+	db.changeCache.waitForSequence(3)
+	db.user, _ = authenticator.GetUser("naomi")
+	changes, err := db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 2}})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.DeepEquals(t, changes[0], &ChangeEntry{
+		Seq:     SequenceID{Seq: 2, TriggeredBy: 3},
+		ID:      "doc2",
+		Changes: []ChangeRev{{"rev": revid2}}})
+
+	// Grant access to NBC (sequence 4), then continue from the middle of the PBS backfill:
+	userInfo, err = db.GetPrincipal("naomi", true)
+	userInfo.ExplicitChannels = base.SetOf("ABC", "PBS", "NBC")
+	_, err = db.UpdatePrincipal(*userInfo, true, true)
+	assertNoError(t, err, "UpdatePrincipal failed")
+
+	db.changeCache.waitForSequence(4)
+	db.user, _ = authenticator.GetUser("naomi")
+	changes, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 2, TriggeredBy: 3}})
+	assertNoError(t, err, "Couldn't GetChanges (2nd)")
+	assert.Equals(t, len(changes), 2)
+	assert.DeepEquals(t, changes[0], &ChangeEntry{
+		Seq:     SequenceID{Seq: 1, TriggeredBy: 4},
+		ID:      "doc1",
+		Changes: []ChangeRev{{"rev": revid1}}})
+	assert.DeepEquals(t, changes[1], &ChangeEntry{
+		Seq:     SequenceID{Seq: 4},
+		ID:      "_user/naomi",
+		Changes: []ChangeRev{}})
+}
+
+// The user pseudo-entry lists the channels the user has lost access to
+func TestChangesAfterChannelRevoked(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){if (doc.grant) access("naomi", doc.grant); channel(doc.channels);}`)
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+
+	// Grant access to PBS (sequence 1), and add a doc to it (sequence 2):
+	grantRev, _ := db.Put("grant", Body{"grant": "PBS", "channels": []string{"ABC"}})
+	db.Put("doc1", Body{"channels": []string{"PBS"}})
+	db.changeCache.waitForSequence(2)
+	db.user, _ = authenticator.GetUser("naomi")
+	assert.True(t, db.user.CanSeeChannel("PBS"))
+
+	// Revoke it (sequence 3):
+	grantRev, err := db.Put("grant", Body{"_rev": grantRev, "channels": []string{"ABC"}})
+	assertNoError(t, err, "Couldn't update grant doc")
+	db.changeCache.waitForSequence(3)
+	db.user, _ = authenticator.GetUser("naomi")
+	assert.False(t, db.user.CanSeeChannel("PBS"))
+
+	changes, err := db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 2}})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.DeepEquals(t, changes[0], &ChangeEntry{
+		Seq:     SequenceID{Seq: 3},
+		ID:      "grant",
+		Changes: []ChangeRev{{"rev": grantRev}}})
+	assert.DeepEquals(t, changes[1], &ChangeEntry{
+		Seq:     SequenceID{Seq: 3},
+		ID:      "_user/naomi",
+		Removed: base.SetOf("PBS"),
+		Changes: []ChangeRev{}})
+
+	// A client that's already seen the revocation isn't told again:
+	changes, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 3}})
+	assertNoError(t, err, "Couldn't GetChanges (2nd)")
+	assert.Equals(t, len(changes), 0)
+}
+
 // Unit test for bug #673
 func TestUpdatePrincipal(t *testing.T) {
 	base.LogKeys["Cache"] = true
@@ -406,6 +503,32 @@ func TestUpdatePrincipal(t *testing.T) {
 	assert.Equals(t, nextSeq, uint64(3))
 }
 
+func TestUpdatePrincipalLongChannelNames(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// A channel name stored before the length limit existed is still accepted:
+	stored := strings.Repeat("s", channels.MaxChannelNameLength+1)
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf(stored))
+	assertNoError(t, authenticator.Save(user), "Couldn't save user")
+	userInfo, err := db.GetPrincipal("naomi", true)
+	assertNoError(t, err, "Couldn't get user")
+	userInfo.ExplicitChannels = base.SetOf(stored, "ABC")
+	_, err = db.UpdatePrincipal(*userInfo, true, true)
+	assertNoError(t, err, "Couldn't update user with a stored long channel")
+	_, err = db.PatchPrincipal("naomi", true, []PrincipalPatchOp{{Op: "add", Path: "/admin_channels", Value: stored}})
+	assertNoError(t, err, "Couldn't re-add a stored long channel")
+
+	// But a new one isn't:
+	tooLong := strings.Repeat("n", channels.MaxChannelNameLength+1)
+	userInfo.ExplicitChannels = base.SetOf(stored, tooLong)
+	_, err = db.UpdatePrincipal(*userInfo, true, true)
+	assertHTTPError(t, err, 400)
+	_, err = db.PatchPrincipal("naomi", true, []PrincipalPatchOp{{Op: "add", Path: "/admin_channels", Value: tooLong}})
+	assertHTTPError(t, err, 400)
+}
+
 func TestConflicts(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -495,6 +618,154 @@ func TestConflicts(t *testing.T) {
 		branched: true})
 }
 
+func TestPutExistingRevOverlappingHistory(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	added, err := db.PutExistingRevIfNew("doc", Body{"n": 2}, []string{"2-b", "1-a"})
+	assertNoError(t, err, "add 2-b")
+	assert.True(t, added)
+
+	// A longer history that overlaps the existing one only grafts the new tail:
+	added, err = db.PutExistingRevIfNew("doc", Body{"n": 4}, []string{"4-d", "3-c", "2-b", "1-a"})
+	assertNoError(t, err, "add 4-d")
+	assert.True(t, added)
+	doc, _ := db.GetDoc("doc")
+	assert.Equals(t, len(doc.History), 4)
+	assert.DeepEquals(t, doc.History.getHistory("4-d"), []string{"4-d", "3-c", "2-b", "1-a"})
+
+	// A truncated history that starts after the root still finds the common ancestor:
+	added, err = db.PutExistingRevIfNew("doc", Body{"n": 5}, []string{"5-e", "4-d", "3-c"})
+	assertNoError(t, err, "add 5-e")
+	assert.True(t, added)
+	doc, _ = db.GetDoc("doc")
+	assert.Equals(t, len(doc.History), 5)
+	assert.Equals(t, doc.History.getParent("5-e"), "4-d")
+
+	// Pushing an existing revision again is a no-op:
+	added, err = db.PutExistingRevIfNew("doc", Body{"n": 4}, []string{"4-d", "3-c", "2-b", "1-a"})
+	assertNoError(t, err, "re-add 4-d")
+	assert.False(t, added)
+
+	// A history whose generations don't line up with the tree is rejected:
+	_, err = db.PutExistingRevIfNew("doc", Body{"n": 9}, []string{"9-x", "4-d"})
+	assertHTTPError(t, err, 400)
+}
+
+func TestConflictResolution(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	liveLeaves := func(docid string) []string {
+		doc, err := db.GetDoc(docid)
+		assertNoError(t, err, "Couldn't get doc")
+		leaves := []string{}
+		doc.History.forEachLeaf(func(leaf *RevInfo) {
+			if !leaf.Deleted {
+				leaves = append(leaves, leaf.ID)
+			}
+		})
+		return leaves
+	}
+	pushConflict := func(docid string) {
+		assertNoError(t, db.PutExistingRev(docid, Body{"n": 1}, []string{"1-a"}), "add 1-a")
+		assertNoError(t, db.PutExistingRev(docid, Body{"n": 2}, []string{"2-b", "1-a"}), "add 2-b")
+		assertNoError(t, db.PutExistingRev(docid, Body{"n": 3}, []string{"2-a", "1-a"}), "add 2-a")
+	}
+
+	var err error
+	db.ConflictResolver, err = NewConflictResolver(ConflictsLongestBranch, "")
+	assertNoError(t, err, "Couldn't create resolver")
+	pushConflict("longest")
+	assert.DeepEquals(t, liveLeaves("longest"), []string{"2-b"})
+
+	db.ConflictResolver, err = NewConflictResolver(ConflictsLastWriteWins, "")
+	assertNoError(t, err, "Couldn't create resolver")
+	pushConflict("lww")
+	assert.DeepEquals(t, liveLeaves("lww"), []string{"2-a"})
+	gotBody, _ := db.Get("lww")
+	assert.Equals(t, gotBody["_rev"], "2-a")
+
+	// Custom resolver that merges the conflicting revisions into a new one:
+	db.ConflictResolver, err = NewConflictResolver(ConflictsCustom, `function(revs) {
+		var total = 0;
+		for (var i = 0; i < revs.length; i++)
+			total += revs[i].n;
+		return {n: total};
+	}`)
+	assertNoError(t, err, "Couldn't create resolver")
+	pushConflict("custom")
+	leaves := liveLeaves("custom")
+	assert.Equals(t, len(leaves), 1)
+	doc, _ := db.GetDoc("custom")
+	assert.Equals(t, doc.History.getParent(leaves[0]), "2-b")
+	gotBody, _ = db.Get("custom")
+	assert.Equals(t, gotBody["n"], int64(5))
+
+	// If the merged revision is rejected, none of the resolution happens:
+	mapper := db.ChannelMapper
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		if (doc.n == 5) throw({forbidden: "no merging"});
+	}`)
+	pushConflict("rejected")
+	assert.Equals(t, len(liveLeaves("rejected")), 2)
+	doc, _ = db.GetDoc("rejected")
+	assert.Equals(t, len(doc.History), 3)
+	db.ChannelMapper = mapper
+
+	// Custom resolver that returns null leaves the conflict in place:
+	db.ConflictResolver, err = NewConflictResolver(ConflictsCustom, `function(revs) {return null;}`)
+	assertNoError(t, err, "Couldn't create resolver")
+	pushConflict("unresolved")
+	assert.Equals(t, len(liveLeaves("unresolved")), 2)
+
+	_, err = NewConflictResolver("coin_toss", "")
+	assert.True(t, err != nil)
+	_, err = NewConflictResolver(ConflictsCustom, "")
+	assert.True(t, err != nil)
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create doc1")
+	_, err = db.Put("doc2", Body{"n": 2})
+	assertNoError(t, err, "Couldn't create doc2")
+	_, err = db.DeleteDoc("doc1", rev1)
+	assertNoError(t, err, "Couldn't delete doc1")
+
+	// The tombstone records when the doc was deleted:
+	doc, _ := db.GetDoc("doc1")
+	assert.True(t, doc.TombstonedAt > 0)
+	doc, _ = db.GetDoc("doc2")
+	assert.Equals(t, doc.TombstonedAt, int64(0))
+
+	// With no retention period, tombstones are kept forever:
+	count, err := db.PurgeTombstones()
+	assertNoError(t, err, "PurgeTombstones failed")
+	assert.Equals(t, count, 0)
+
+	// A tombstone within the retention period is kept:
+	db.TombstoneRetention = time.Hour
+	count, err = db.PurgeTombstones()
+	assertNoError(t, err, "PurgeTombstones failed")
+	assert.Equals(t, count, 0)
+
+	// Backdate the tombstone so it's past the retention period:
+	doc, _ = db.GetDoc("doc1")
+	doc.TombstonedAt -= 2 * 3600
+	assertNoError(t, db.Bucket.Set("doc1", 0, doc), "Couldn't backdate doc1")
+	count, err = db.PurgeTombstones()
+	assertNoError(t, err, "PurgeTombstones failed")
+	assert.Equals(t, count, 1)
+	doc, err = db.GetDoc("doc1")
+	assert.True(t, doc == nil)
+	_, err = db.Get("doc2")
+	assertNoError(t, err, "doc2 should not have been purged")
+}
+
 func TestSyncFnOnPush(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -531,6 +802,176 @@ func TestSyncFnOnPush(t *testing.T) {
 	assert.DeepEquals(t, doc.History["4-four"].Channels, base.SetOf("clibup"))
 }
 
+func TestValidateDocUpdate(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	var err error
+	db.Validator, err = channels.NewDocValidator(`function(newDoc, oldDoc) {
+		if (!newDoc._deleted && typeof newDoc.count != "number")
+			throw({forbidden: "count must be a number"});
+		if (oldDoc && newDoc.count < oldDoc.count)
+			throw({forbidden: "count can't decrease"});
+	}`)
+	assertNoError(t, err, "Couldn't create validator")
+
+	_, err = db.Put("doc1", Body{"count": "one"})
+	assertHTTPError(t, err, 403)
+	rev1id, err := db.Put("doc1", Body{"count": 1})
+	assertNoError(t, err, "Couldn't create document")
+
+	_, err = db.Put("doc1", Body{"_rev": rev1id, "count": 0})
+	assertHTTPError(t, err, 403)
+	err = db.PutExistingRev("doc1", Body{"_rev": "2-abc", "count": 0}, []string{"2-abc", rev1id})
+	assertHTTPError(t, err, 403)
+	_, _, err = db.Post(Body{"count": "two"})
+	assertHTTPError(t, err, 403)
+
+	_, err = db.Put("doc1", Body{"_rev": rev1id, "count": 2})
+	assertNoError(t, err, "Valid update was rejected")
+}
+
+func TestSyncFnOldDoc(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc, oldDoc) {
+		if (oldDoc && doc.owner != oldDoc.owner)
+			throw({forbidden: "can't change owner"});
+	}`)
+
+	rev1id, err := db.Put("doc1", Body{"owner": "alice"})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("doc1", Body{"_rev": rev1id, "owner": "mallory"})
+	assertHTTPError(t, err, 403)
+
+	// A pushed branch whose ancestors' bodies aren't available still gets an oldDoc:
+	err = db.PutExistingRev("doc1", Body{"_rev": "3-c", "owner": "mallory"}, []string{"3-c", "2-b", "1-a"})
+	assertHTTPError(t, err, 403)
+	err = db.PutExistingRev("doc1", Body{"_rev": "3-c", "owner": "alice"}, []string{"3-c", "2-b", "1-a"})
+	assertNoError(t, err, "Valid branch was rejected")
+
+	// But a new document doesn't:
+	err = db.PutExistingRev("doc2", Body{"_rev": "2-b", "owner": "bob"}, []string{"2-b", "1-a"})
+	assertNoError(t, err, "New doc was rejected")
+}
+
+func TestOnCreate(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	var err error
+	db.OnCreate, err = NewOnCreateFunction(`function(doc, userCtx) {
+		doc.owner = userCtx ? userCtx.name : "admin";
+		if (doc.count === undefined)
+			doc.count = 0;
+		doc._id = "ignored";
+	}`)
+	assertNoError(t, err, "Couldn't create on_create function")
+	db.Validator, err = channels.NewDocValidator(`function(newDoc, oldDoc) {
+		if (typeof newDoc.count != "number")
+			throw({forbidden: "count must be a number"});
+	}`)
+	assertNoError(t, err, "Couldn't create validator")
+
+	// Defaults are filled in before validation, but special properties can't be changed:
+	rev1id, err := db.Put("doc1", Body{"title": "hi"})
+	assertNoError(t, err, "Couldn't create document")
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Couldn't get document")
+	assert.Equals(t, body["owner"], "admin")
+	assert.Equals(t, body["count"], float64(0))
+	assert.Equals(t, body["title"], "hi")
+	assert.Equals(t, body["_id"], "doc1")
+
+	docid, _, err := db.Post(Body{"count": 5})
+	assertNoError(t, err, "Couldn't post document")
+	body, err = db.Get(docid)
+	assertNoError(t, err, "Couldn't get document")
+	assert.Equals(t, body["count"], float64(5))
+	assert.Equals(t, body["owner"], "admin")
+
+	// Updates aren't transformed:
+	_, err = db.Put("doc1", Body{"_rev": rev1id, "count": 1})
+	assertNoError(t, err, "Couldn't update document")
+	body, err = db.Get("doc1")
+	assertNoError(t, err, "Couldn't get document")
+	assert.Equals(t, body["owner"], nil)
+
+	_, err = NewOnCreateFunction(`function(doc) {`)
+	assert.True(t, err != nil)
+}
+
+func TestSelfCheck(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	report := db.RunSelfCheck()
+	assert.True(t, report.OK)
+	assert.Equals(t, db.LastSelfCheck(), report)
+
+	// Break a design doc and a metadata doc:
+	designDoc := syncDesignDocs()[DesignDocSyncHousekeeping]
+	delete(designDoc.Views, ViewAllDocs)
+	assertNoError(t, db.Bucket.PutDDoc(DesignDocSyncHousekeeping, designDoc), "PutDDoc failed")
+	assertNoError(t, db.Bucket.SetRaw(kDocShardsKey, 0, []byte("{garbage")), "SetRaw failed")
+
+	report = db.RunSelfCheck()
+	assert.False(t, report.OK)
+	failed := map[string]string{}
+	for _, check := range report.Checks {
+		if !check.OK {
+			failed[check.Name] = check.Detail
+		}
+	}
+	assert.Equals(t, len(failed), 2)
+	assert.Equals(t, failed["design_doc:"+DesignDocSyncHousekeeping], `view "all_docs" is missing`)
+	assert.True(t, strings.HasPrefix(failed["metadata:"+kDocShardsKey], "Invalid JSON"))
+}
+
+func TestViewQueryDeadline(t *testing.T) {
+	bucket := base.NewChaosBucket(testBucket(), 1)
+	context, err := NewDatabaseContext("db", bucket, false, CacheOptions{})
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+
+	_, err = db.Put("doc1", Body{"key": "value"})
+	assertNoError(t, err, "Couldn't create document")
+	var vres walrus.ViewResult
+	assertNoError(t, db.viewCustomWithDeadline(DesignDocSyncHousekeeping, ViewAllDocs,
+		Body{"stale": false}, &vres, db.viewQueryDeadline()), "Query failed")
+	assert.Equals(t, len(vres.Rows), 1)
+
+	// Make view queries slower than the timeout:
+	db.ViewQueryTimeout = 50 * time.Millisecond
+	bucket.AddRule(base.ChaosRule{Ops: []string{"ViewCustom"}, Rate: 1.0, Latency: 500 * time.Millisecond})
+	vres = walrus.ViewResult{}
+	err = db.viewCustomWithDeadline(DesignDocSyncHousekeeping, ViewAllDocs,
+		Body{"stale": false}, &vres, db.viewQueryDeadline())
+	assertHTTPError(t, err, 503)
+	assert.Equals(t, len(vres.Rows), 0)
+	assert.Equals(t, atomic.LoadInt32(&db.abandonedViews), int32(1))
+
+	// Once too many abandoned queries are still running, queries fail without being made:
+	defer func(max int32) { MaxAbandonedViewQueries = max }(MaxAbandonedViewQueries)
+	MaxAbandonedViewQueries = 1
+	start := time.Now()
+	err = db.viewCustomWithDeadline(DesignDocSyncHousekeeping, ViewAllDocs,
+		Body{"stale": false}, &vres, db.viewQueryDeadline())
+	assertHTTPError(t, err, 503)
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	// ...until they finish:
+	time.Sleep(600 * time.Millisecond)
+	assert.Equals(t, atomic.LoadInt32(&db.abandonedViews), int32(0))
+
+	// A zero timeout means no deadline:
+	db.ViewQueryTimeout = 0
+	assert.True(t, db.viewQueryDeadline().IsZero())
+}
+
 func TestInvalidChannel(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -539,7 +980,40 @@ func TestInvalidChannel(t *testing.T) {
 
 	body := Body{"channels": []string{"bad name"}}
 	_, err := db.Put("doc", body)
+	assertHTTPError(t, err, 400)
+	assert.True(t, strings.Contains(err.Error(), `Illegal channel name "bad name"`))
+}
+
+func TestSyncFnErrorPolicy(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){
+		if (doc.crash) throw("oops");
+		channel(doc.channel);}`)
+
+	// By default a failing sync function fails the write:
+	_, err := db.Put("doc1", Body{"crash": true, "channel": "foo"})
 	assertHTTPError(t, err, 500)
+
+	assert.True(t, db.SetSyncFnErrorPolicy("ignore", "") != nil)
+	assert.True(t, db.SetSyncFnErrorPolicy(SyncFnErrorsAccept, "bad name") != nil)
+
+	// The "accept" policy saves the doc, in the error channel only:
+	assertNoError(t, db.SetSyncFnErrorPolicy(SyncFnErrorsAccept, "errors"), "SetSyncFnErrorPolicy")
+	_, err = db.Put("doc1", Body{"crash": true, "channel": "foo"})
+	assertNoError(t, err, "Put failed")
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc failed")
+	_, inErrors := doc.Channels["errors"]
+	assert.True(t, inErrors)
+	_, inFoo := doc.Channels["foo"]
+	assert.False(t, inFoo)
+
+	// ...but rejections are still honored:
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){throw({forbidden: "nope"});}`)
+	_, err = db.Put("doc2", Body{})
+	assertHTTPError(t, err, 403)
 }
 
 func TestAccessFunctionValidation(t *testing.T) {
@@ -612,6 +1086,56 @@ func TestAccessFunction(t *testing.T) {
 	assert.DeepEquals(t, user.InheritedChannels(), expected)
 }
 
+// A doc that grants access to lots of users shouldn't rewrite their docs.
+func TestDeferredAccessInvalidation(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	defer func(saved int) { MaxInlineAccessInvalidations = saved }(MaxInlineAccessInvalidations)
+	MaxInlineAccessInvalidations = 2
+
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){access(doc.users, doc.userChannels);}`)
+	authenticator := db.Authenticator()
+	names := []string{"u0", "u1", "u2", "u3", "role:r"}
+	for _, name := range names[:4] {
+		user, _ := authenticator.NewUser(name, "letmein", nil)
+		assertNoError(t, authenticator.Save(user), "Save")
+		_, err := authenticator.GetUser(name) // computes its channels
+		assertNoError(t, err, "GetUser")
+	}
+	role, _ := authenticator.NewRole("r", nil)
+	assertNoError(t, authenticator.Save(role), "Save")
+	_, err := authenticator.GetRole("r")
+	assertNoError(t, err, "GetRole")
+
+	_, err = db.Put("event", Body{"users": names, "userChannels": []string{"party"}})
+	assertNoError(t, err, "Put")
+
+	// The user docs haven't been touched:
+	raw, err := db.Bucket.GetRaw(auth.UserKeyPrefix + "u0")
+	assertNoError(t, err, "GetRaw")
+	user, err := authenticator.UnmarshalUser(raw, "u0", 0)
+	assertNoError(t, err, "UnmarshalUser")
+	assert.True(t, user.Channels() != nil)
+	assert.False(t, user.Channels().Contains("party"))
+
+	// But loading them picks up the new grant:
+	for _, name := range names[:4] {
+		user, err := authenticator.GetUser(name)
+		assertNoError(t, err, "GetUser")
+		assert.True(t, user.Channels().Contains("party"))
+	}
+	role, err = authenticator.GetRole("r")
+	assertNoError(t, err, "GetRole")
+	assert.True(t, role.Channels().Contains("party"))
+
+	// A small grant is still applied immediately:
+	_, err = db.Put("small", Body{"users": []string{"u0"}, "userChannels": []string{"small"}})
+	assertNoError(t, err, "Put")
+	raw, _ = db.Bucket.GetRaw(auth.UserKeyPrefix + "u0")
+	user, _ = authenticator.UnmarshalUser(raw, "u0", 0)
+	assert.True(t, user.Channels() == nil)
+}
+
 func TestDocIDs(t *testing.T) {
 	assert.Equals(t, realDocID(""), "")
 	assert.Equals(t, realDocID("_"), "")
@@ -660,6 +1184,39 @@ func TestImport(t *testing.T) {
 	assertNoError(t, err, "can't get doc")
 }
 
+func TestImportFilter(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	var err error
+	db.ImportFilter, err = NewImportFilterFunction(`function(doc) {return doc.type == "mobile";}`)
+	assertNoError(t, err, "NewImportFilterFunction")
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {channel(doc.type);}`)
+
+	// Add docs to the underlying bucket, as another application would:
+	db.Bucket.Add("mobile1", 0, Body{"type": "mobile"})
+	db.Bucket.Add("mobile2", 0, Body{"type": "mobile"})
+	db.Bucket.Add("server1", 0, Body{"type": "server"})
+
+	count, err := db.UpdateAllDocChannels(false, true)
+	assertNoError(t, err, "UpdateAllDocChannels")
+	assert.Equals(t, count, 2)
+
+	// The accepted docs were run through the sync function and given sequences:
+	doc, err := db.GetDoc("mobile1")
+	assertNoError(t, err, "can't get doc")
+	assert.True(t, doc.Sequence > 0)
+	_, inMobile := doc.Channels["mobile"]
+	assert.True(t, inMobile)
+
+	// The other one is still unknown to the gateway:
+	_, err = db.GetDoc("server1")
+	assertHTTPError(t, err, 404)
+
+	_, err = NewImportFilterFunction(`function(doc) {`)
+	assert.True(t, err != nil)
+}
+
 func TestPostWithExistingId(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -742,6 +1299,47 @@ func TestPostWithUserSpecialProperty(t *testing.T) {
 
 }
 
+// Writes docs through a bucket that injects CAS conflicts and failures, and checks that every
+// successful write still shows up exactly once in the changes feed.
+func TestUpdateDocWithInjectedFaults(t *testing.T) {
+	chaosBucket := base.NewChaosBucket(testBucket(), 42)
+	context, err := NewDatabaseContext("db", chaosBucket, false, CacheOptions{})
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+
+	chaosBucket.AddRule(base.ChaosRule{Ops: []string{"WriteUpdate"}, KeyPrefix: "chaos", Rate: 0.5, CASConflict: true})
+	chaosBucket.AddRule(base.ChaosRule{Ops: []string{"WriteUpdate"}, KeyPrefix: "chaos", Rate: 0.2, Err: base.ErrChaosInjected})
+
+	var lastSeq uint64
+	saved := base.Set{}
+	for i := 0; i < 20; i++ {
+		docid := fmt.Sprintf("chaos%d", i)
+		if _, err := db.Put(docid, Body{"n": i}); err == nil {
+			saved[docid] = struct{}{}
+			doc, _ := db.GetDoc(docid)
+			lastSeq = doc.Sequence
+		} else {
+			assert.Equals(t, err, base.ErrChaosInjected)
+		}
+	}
+	chaosBucket.ClearRules()
+	assert.True(t, len(saved) > 0)
+
+	db.changeCache.waitForSequence(lastSeq)
+	changes, err := db.GetChanges(base.SetOf("*"), ChangesOptions{})
+	assertNoError(t, err, "Couldn't GetChanges")
+	seen := base.Set{}
+	for _, change := range changes {
+		if saved.Contains(change.ID) {
+			assert.False(t, seen.Contains(change.ID))
+			seen[change.ID] = struct{}{}
+		}
+	}
+	assert.DeepEquals(t, seen, saved)
+}
+
 //////// BENCHMARKS
 
 func BenchmarkDatabase(b *testing.B) {
@@ -759,3 +1357,338 @@ func BenchmarkDatabase(b *testing.B) {
 		db.Close()
 	}
 }
+
+// Updates a doc that grants a channel to numUsers users, each of whom has computed channels.
+func benchmarkAccessGrantFanOut(b *testing.B, numUsers int, deferred bool) {
+	base.SetLogLevel(2) // disables logging
+	defer func(saved int) { MaxInlineAccessInvalidations = saved }(MaxInlineAccessInvalidations)
+	if deferred {
+		MaxInlineAccessInvalidations = 0
+	} else {
+		MaxInlineAccessInvalidations = numUsers
+	}
+
+	bucket, _ := ConnectToBucket(base.BucketSpec{
+		Server:     kTestURL,
+		BucketName: fmt.Sprintf("fanout-%d-%v-%d", numUsers, deferred, b.N)})
+	context, _ := NewDatabaseContext("db", bucket, false, CacheOptions{})
+	defer context.Close()
+	db, _ := CreateDatabase(context)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){access(doc.users, doc.channel);}`)
+	authenticator := db.Authenticator()
+	users := make([]string, numUsers)
+	for i := range users {
+		users[i] = fmt.Sprintf("user%d", i)
+		user, _ := authenticator.NewUser(users[i], "letmein", nil)
+		authenticator.Save(user)
+		authenticator.GetUser(users[i])
+	}
+
+	b.ResetTimer()
+	revid := ""
+	for i := 0; i < b.N; i++ {
+		body := Body{"users": users, "channel": fmt.Sprintf("event%d", i)}
+		if revid != "" {
+			body["_rev"] = revid
+		}
+		var err error
+		if revid, err = db.Put("event", body); err != nil {
+			b.Fatalf("Put failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkAccessGrantFanOut1000Inline(b *testing.B) {
+	benchmarkAccessGrantFanOut(b, 1000, false)
+}
+
+func BenchmarkAccessGrantFanOut1000Deferred(b *testing.B) {
+	benchmarkAccessGrantFanOut(b, 1000, true)
+}
+
+func BenchmarkAccessGrantFanOut10000Deferred(b *testing.B) {
+	benchmarkAccessGrantFanOut(b, 10000, true)
+}
+
+// Returns a linear revision history of n revisions, newest first, as PutExistingRev takes it.
+func makeLongRevHistory(n int) []string {
+	history := make([]string, n)
+	for i := range history {
+		gen := n - i
+		history[i] = fmt.Sprintf("%d-%032x", gen, gen*7919)
+	}
+	return history
+}
+
+func BenchmarkGetDocWith10kRevs(b *testing.B) {
+	base.SetLogLevel(2) // disables logging
+	bucket, _ := ConnectToBucket(base.BucketSpec{
+		Server:     kTestURL,
+		BucketName: fmt.Sprintf("longhistory-%d", b.N)})
+	context, _ := NewDatabaseContext("db", bucket, false, CacheOptions{})
+	defer context.Close()
+	context.RevsLimit = 20000
+	db, _ := CreateDatabase(context)
+	if err := db.PutExistingRev("doc", Body{"n": 1}, makeLongRevHistory(10000)); err != nil {
+		b.Fatalf("PutExistingRev failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get("doc"); err != nil {
+			b.Fatalf("Get failed: %v", err)
+		}
+	}
+}
+
+func TestGetDocWithLongHistory(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	defer func(saved bool) { CompactRevTrees = saved }(CompactRevTrees)
+	CompactRevTrees = true
+
+	history := makeLongRevHistory(CompactRevTreeMinSize + 50)
+	body := Body{"channels": []string{"ABC"}}
+	assertNoError(t, db.PutExistingRev("doc", body, history), "PutExistingRev failed")
+	raw, err := db.Bucket.GetRaw(db.docKey("doc"))
+	assertNoError(t, err, "GetRaw failed")
+	assert.True(t, strings.Contains(string(raw), `"encoding":2`))
+
+	// Getting the current revision doesn't need the history, unless it's asked for:
+	authenticator := db.Authenticator()
+	db.user, _ = authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	gotBody, err := db.Get("doc")
+	assertNoError(t, err, "Get failed")
+	assert.Equals(t, gotBody["_rev"], history[0])
+	assert.Equals(t, gotBody["_revisions"], nil)
+
+	gotBody, err = db.GetRev("doc", "", true, nil)
+	assertNoError(t, err, "GetRev failed")
+	revisions := gotBody["_revisions"].(Body)
+	assert.Equals(t, revisions["start"], len(history))
+	assert.Equals(t, len(revisions["ids"].([]string)), len(history))
+
+	doc, err := db.GetDoc("doc")
+	assertNoError(t, err, "GetDoc failed")
+	assert.Equals(t, len(doc.History), len(history))
+	assert.Equals(t, doc.History.getParent(history[0]), history[1])
+
+	// Users without access to the doc's channel still can't read it:
+	db.user, _ = authenticator.NewUser("hiro", "letmein", channels.SetOf("PBS"))
+	_, err = db.Get("doc")
+	assertHTTPError(t, err, 403)
+}
+
+func TestSequenceRollback(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create doc")
+	startTime := db.StartTime()
+
+	// Simulate a bucket flush by deleting the sequence counter:
+	assertNoError(t, db.Bucket.Delete("_sync:seq"), "Couldn't delete counter")
+	lastSeq, err := db.LastSequence()
+	assertNoError(t, err, "LastSequence failed")
+	assert.Equals(t, lastSeq, uint64(0))
+
+	// The rollback handler runs asynchronously:
+	for i := 0; i < 100 && db.StartTime() == startTime; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, db.StartTime().After(startTime))
+	assert.Equals(t, db.changeCache.nextSequence, uint64(1))
+
+	// New revisions get sequences from the restarted counter:
+	_, err = db.Put("doc2", Body{"n": 2})
+	assertNoError(t, err, "Couldn't create doc")
+	doc, err := db.GetDoc("doc2")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, doc.Sequence, uint64(1))
+}
+
+func TestOnDocChanged(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// The callbacks are called one at a time, on a goroutine of their own:
+	changes := make(chan DocChange, 10)
+	bodyChanges := make(chan DocChange, 10)
+	remove := db.OnDocChanged(func(change DocChange) { changes <- change }, false)
+	db.OnDocChanged(func(change DocChange) { bodyChanges <- change }, true)
+	nextChange := func(ch chan DocChange) DocChange {
+		select {
+		case change := <-ch:
+			return change
+		case <-time.After(5 * time.Second):
+			t.Fatalf("DocChangedFunc wasn't called")
+			return DocChange{}
+		}
+	}
+
+	rev1id, err := db.Put("doc1", Body{"channels": []string{"a"}, "n": 1})
+	assertNoError(t, err, "Couldn't create document")
+	change := nextChange(changes)
+	assert.Equals(t, change.DocID, "doc1")
+	assert.Equals(t, change.RevID, rev1id)
+	assert.DeepEquals(t, change.Channels, base.SetOf("a"))
+	assert.True(t, change.Sequence > 0)
+	assert.True(t, change.Current)
+	assert.True(t, change.Body == nil)
+	bodyChange1 := nextChange(bodyChanges)
+	assert.Equals(t, bodyChange1.Body["_id"], "doc1")
+	assert.Equals(t, bodyChange1.Body["n"], float64(1))
+
+	// A conflicting revision that doesn't win:
+	err = db.PutExistingRev("doc1", Body{"n": 3}, []string{"3-b", "2-b", rev1id})
+	assertNoError(t, err, "Couldn't add revision")
+	assert.True(t, nextChange(changes).Current)
+	err = db.PutExistingRev("doc1", Body{"n": 2}, []string{"2-a", rev1id})
+	assertNoError(t, err, "Couldn't add conflicting revision")
+	change = nextChange(changes)
+	assert.Equals(t, change.RevID, "2-a")
+	assert.False(t, change.Current)
+	nextChange(bodyChanges)
+	assert.Equals(t, nextChange(bodyChanges).Body["n"], float64(2))
+
+	remove()
+	_, err = db.DeleteDoc("doc1", "3-b")
+	assertNoError(t, err, "Couldn't delete document")
+	bodyChange := nextChange(bodyChanges)
+	assert.True(t, bodyChange.Deleted)
+	assert.Equals(t, bodyChange.Body["_deleted"], true)
+	assert.True(t, bodyChange.Sequence > bodyChange1.Sequence)
+	select {
+	case <-changes:
+		t.Errorf("Removed DocChangedFunc was called")
+	default:
+	}
+}
+
+func TestOnDocChangedIsSerial(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Callbacks never overlap, and see each document's revisions in order:
+	const numRevs = 20
+	var running int32
+	lastSeqs := map[string]uint64{}
+	done := make(chan bool, 1)
+	count := 0
+	db.OnDocChanged(func(change DocChange) {
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Errorf("DocChangedFuncs called concurrently")
+		}
+		time.Sleep(time.Millisecond)
+		if change.Sequence <= lastSeqs[change.DocID] {
+			t.Errorf("Got #%d of %q after #%d", change.Sequence, change.DocID, lastSeqs[change.DocID])
+		}
+		lastSeqs[change.DocID] = change.Sequence
+		atomic.AddInt32(&running, -1)
+		if count++; count == 2*numRevs {
+			done <- true
+		}
+	}, false)
+
+	revs := map[string]string{}
+	for i := 0; i < numRevs; i++ {
+		for _, docID := range []string{"doc1", "doc2"} {
+			body := Body{"n": i}
+			if revs[docID] != "" {
+				body["_rev"] = revs[docID]
+			}
+			revID, err := db.Put(docID, body)
+			assertNoError(t, err, "Couldn't save document")
+			revs[docID] = revID
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Only got %d of %d changes", count, 2*numRevs)
+	}
+}
+
+func TestChangesFeedEndsWhenCredentialsRevoked(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+	userDB, _ := GetDatabase(db.DatabaseContext, user)
+
+	// Changing the user's channels doesn't revoke their credentials:
+	userInfo, err := db.GetPrincipal("naomi", true)
+	assert.True(t, userInfo != nil)
+	userInfo.ExplicitChannels = base.SetOf("ABC", "PBS")
+	_, err = db.UpdatePrincipal(*userInfo, true, true)
+	assertNoError(t, err, "UpdatePrincipal failed")
+	assertNoError(t, userDB.ReloadUser(), "ReloadUser failed")
+	assert.False(t, userDB.CredentialsRevoked())
+
+	// Start a continuous feed and wait for it to catch up:
+	options := ChangesOptions{Wait: true, Continuous: true, Terminator: make(chan bool)}
+	defer close(options.Terminator)
+	feed, err := userDB.MultiChangesFeed(base.SetOf("*"), options)
+	assertNoError(t, err, "MultiChangesFeed failed")
+	for entry := range feed {
+		if entry == nil {
+			break
+		}
+	}
+
+	// Repeating the same password doesn't revoke anything, nor does changing it for a user who
+	// didn't log in with it:
+	password := "letmein"
+	userInfo.Password = &password
+	_, err = db.UpdatePrincipal(*userInfo, true, true)
+	assertNoError(t, err, "UpdatePrincipal failed")
+	assertNoError(t, userDB.ReloadUser(), "ReloadUser failed")
+	assert.False(t, userDB.CredentialsRevoked())
+	keyUserDB, _ := GetDatabase(db.DatabaseContext, user)
+	keyUserDB.IgnorePasswordChanges()
+
+	// Changing the password ends the feed:
+	password = "123456"
+	_, err = db.UpdatePrincipal(*userInfo, true, true)
+	assertNoError(t, err, "UpdatePrincipal failed")
+	timeout := time.After(5 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-feed:
+		case <-timeout:
+			t.Fatalf("Changes feed didn't end after the password changed")
+		}
+	}
+	assert.True(t, userDB.CredentialsRevoked())
+	assertNoError(t, keyUserDB.ReloadUser(), "ReloadUser failed")
+	assert.False(t, keyUserDB.CredentialsRevoked())
+}
+
+// A sequence allocated for an update that then fails is released, so the change cache doesn't
+// wait for it.
+func TestReleaseUnusedSequence(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Make the first update fail after its sequence is allocated:
+	maxSize, warningSize := MaxDocValueSize, DocSizeWarningThreshold
+	MaxDocValueSize, DocSizeWarningThreshold = 20, 10
+	_, err := db.Put("doc1", Body{"n": 1})
+	MaxDocValueSize, DocSizeWarningThreshold = maxSize, warningSize
+	assertHTTPError(t, err, 413)
+	_, err = db.Bucket.GetRaw(kUnusedSeqKeyPrefix + "1")
+	assertNoError(t, err, "Sequence wasn't released")
+
+	_, err = db.Put("doc2", Body{"n": 2})
+	assertNoError(t, err, "Couldn't create doc")
+	db.changeCache.waitForSequence(2)
+	changes, err := db.GetChanges(base.SetOf("*"), ChangesOptions{})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc2")
+}
@@ -0,0 +1,54 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// When several gateway nodes open a new database at the same time, each of them can find that
+// the database's metadata (its identity and document key scheme) doesn't exist yet. If each then
+// wrote its own, they'd end up using different metadata. Instead each node tries to Add the doc,
+// which only one can do; the first one wins, and every node -- winner included -- then reads
+// back what was stored and checks it against its own configuration.
+
+// How many times to try creating a metadata doc that keeps disappearing.
+const kMaxMetadataCreateAttempts = 5
+
+// Creates a metadata doc with the given value, unless it already exists. Returns the doc's
+// stored value, which is either the given value or the one another node created first.
+func (context *DatabaseContext) createMetadataDoc(key string, value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < kMaxMetadataCreateAttempts; attempt++ {
+		added, err := context.Bucket.AddRaw(key, 0, data)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := context.Bucket.GetRaw(key)
+		if base.IsDocNotFoundError(err) {
+			continue // Deleted since it was added; try again
+		} else if err != nil {
+			return nil, err
+		}
+		if added {
+			base.LogTo("CRUD", "Database %q: created %s", context.Name, key)
+		} else {
+			base.LogTo("CRUD", "Database %q: %s was created by another node", context.Name, key)
+		}
+		return stored, nil
+	}
+	return nil, fmt.Errorf("Database %q: couldn't create %s", context.Name, key)
+}
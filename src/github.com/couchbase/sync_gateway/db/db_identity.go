@@ -0,0 +1,96 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Key of the bucket doc that records the database's identity.
+const kDbInfoKey = "_sync:dbinfo"
+
+// Identifies a database's contents, so clients that cache them can tell when to discard the
+// cache. The UUID is created along with the bucket's contents, so it changes if the bucket is
+// flushed or replaced. The Epoch increases whenever existing data may have changed without
+// new sequences being assigned: after a resync changes any docs, or when the sequence counter
+// rolls back, and it carries on across a flush, so it never goes backwards. Unlike
+// instance_start_time, neither changes when the gateway restarts.
+type DatabaseIdentity struct {
+	UUID  string `json:"uuid"`
+	Epoch uint64 `json:"epoch"`
+}
+
+// Returns the database's identity. It's created when the database is opened (see
+// InitIdentity), so this doesn't write to the bucket.
+func (context *DatabaseContext) Identity() (DatabaseIdentity, error) {
+	var ident DatabaseIdentity
+	err := context.Bucket.Get(kDbInfoKey, &ident)
+	if base.IsDocNotFoundError(err) || (err == nil && ident.UUID == "") {
+		err = base.HTTPErrorf(http.StatusInternalServerError, "Database %q has no identity", context.Name)
+	}
+	return ident, err
+}
+
+// Creates the database's identity if the bucket doesn't have one yet; called when the database
+// is opened. The epoch is raised to at least minEpoch, so that it can carry on from where it was
+// before the bucket was flushed, rather than going back to 0.
+func (context *DatabaseContext) InitIdentity(minEpoch uint64) (DatabaseIdentity, error) {
+	return context.updateIdentity(func(ident *DatabaseIdentity) bool {
+		if ident.Epoch >= minEpoch {
+			return false
+		}
+		ident.Epoch = minEpoch
+		return true
+	})
+}
+
+// Increments the database's epoch.
+func (context *DatabaseContext) incrementEpoch() {
+	ident, err := context.updateIdentity(func(ident *DatabaseIdentity) bool {
+		ident.Epoch++
+		return true
+	})
+	if err != nil {
+		base.Warn("Database %q: couldn't increment epoch: %v", context.Name, err)
+	} else {
+		base.Logf("Database %q: epoch is now %d", context.Name, ident.Epoch)
+	}
+}
+
+// Updates the identity doc, creating it (with a new UUID) if necessary. The update function
+// returns false if it didn't change anything.
+func (context *DatabaseContext) updateIdentity(update func(*DatabaseIdentity) bool) (DatabaseIdentity, error) {
+	var ident DatabaseIdentity
+	err := context.Bucket.Update(kDbInfoKey, 0, func(currentValue []byte) ([]byte, error) {
+		ident = DatabaseIdentity{}
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &ident); err != nil {
+				base.Warn("Database %q: invalid %s doc; replacing it", context.Name, kDbInfoKey)
+				ident = DatabaseIdentity{}
+			}
+		}
+		changed := update(&ident)
+		if ident.UUID == "" {
+			ident.UUID = base.CreateUUID()
+		} else if !changed {
+			return nil, couchbase.UpdateCancel // Someone else created it first
+		}
+		return json.Marshal(ident)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return ident, err
+}
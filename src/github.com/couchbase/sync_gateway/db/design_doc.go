@@ -24,6 +24,8 @@ const (
 	ViewImport                = "import"
 	ViewOldRevs               = "old_revs"
 	ViewSessions              = "sessions"
+	ViewLocalDocs             = "local_docs"
+	ViewTombstones            = "tombstones"
 )
 
 func isInternalDDoc(ddocName string) bool {
@@ -66,6 +68,8 @@ func (db *Database) PutDesignDoc(ddocName string, ddoc DesignDoc) (err error) {
 	                    delete doc.sync;
 	                    meta.rev = sync.rev;
 	                    meta.channels = channels;
+	                    ` + kViewDocIDJS + `
+	                    meta.id = docid;
 
 	                    var _emit = emit;
 	                    (function(){
@@ -134,7 +138,7 @@ func filterViewResult(input walrus.ViewResult, user auth.User) (result walrus.Vi
 			result.Rows = append(result.Rows, &walrus.ViewRow{
 				Key:   row.Key,
 				Value: value[1],
-				ID:    row.ID,
+				ID:    docIDForKey(row.ID),
 				Doc:   row.Doc,
 			})
 		}
@@ -0,0 +1,20 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+/*
+Package db is Sync Gateway's storage and data model layer: documents and their revision trees,
+attachments, sequences, the changes feed and its caches, and the sync function's channel and
+access bookkeeping, all stored in a Couchbase (or Walrus) bucket.
+
+It has no HTTP dependencies, so it can be used programmatically. Open a bucket with
+ConnectToBucket, wrap it in a long-lived DatabaseContext with NewDatabaseContext, then call
+CreateDatabase (or GetDatabase, to act as a specific user) to get a lightweight Database to make
+calls on. Errors that should map to an HTTP status are returned as *base.HTTPError.
+*/
+package db
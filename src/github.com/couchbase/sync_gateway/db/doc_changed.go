@@ -0,0 +1,191 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sync"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A program that embeds the gateway can register Go callbacks to be told about every revision
+// committed to a database, for indexing, notifications or auditing, without having to follow
+// the _changes feed. (Unlike event handlers, these don't need any configuration.) They're driven
+// by the change listener's feed, so they also hear about revisions saved by other gateway nodes,
+// imported from the bucket, or rewritten by a resync.
+
+// Describes a revision that's been committed, for a DocChangedFunc.
+type DocChange struct {
+	DocID    string   // Document ID
+	RevID    string   // ID of the new revision
+	Sequence uint64   // Sequence the revision was assigned
+	Channels base.Set // Channels the revision is in
+	Deleted  bool     // True if the revision is a deletion
+	Current  bool     // False if the revision isn't the doc's current one (it's a conflict)
+	Body     Body     // The revision's body, if asked for; must not be modified
+}
+
+// A callback registered with DatabaseContext.OnDocChanged.
+type DocChangedFunc func(change DocChange)
+
+type docChangedCallback struct {
+	fn          DocChangedFunc
+	includeBody bool
+}
+
+type docChangedCallbacks struct {
+	lock      sync.RWMutex
+	callbacks map[int]docChangedCallback
+	nextID    int
+	queue     chan docChangedEvent // Feeds the goroutine that calls the callbacks
+	done      chan struct{}        // Closed when the database is closed
+}
+
+// A document that arrived on the change listener's feed, waiting to be passed to callbacks.
+type docChangedEvent struct {
+	key     string
+	docJSON []byte
+}
+
+// Registers a callback to be called after each revision is saved. It's called when the revision
+// arrives on the change listener's feed. All callbacks are called on a single goroutine, one
+// revision at a time and in the order the feed delivers them: a document's revisions arrive in
+// order, but revisions of different documents may not be in sequence order, and a callback may
+// run before the revision shows up in the _changes feed. A slow callback holds up the feed, so
+// it should hand off any slow work. Like the feed, it may skip intermediate revisions of a
+// document that changes rapidly. If includeBody is true, the DocChange will include the
+// revision's body. Returns a function that unregisters the callback.
+func (context *DatabaseContext) OnDocChanged(fn DocChangedFunc, includeBody bool) (remove func()) {
+	c := &context.docChanged
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.callbacks == nil {
+		c.callbacks = map[int]docChangedCallback{}
+	}
+	id := c.nextID
+	c.nextID++
+	c.callbacks[id] = docChangedCallback{fn, includeBody}
+	if c.queue == nil {
+		c.queue = make(chan docChangedEvent, 100)
+		if c.done == nil {
+			c.done = make(chan struct{})
+		}
+		go context.runDocChangedCallbacks(c.queue, c.done)
+	}
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.callbacks, id)
+	}
+}
+
+// Queues a document that arrived on the change listener's feed, if any DocChangedFuncs are
+// registered. Blocks if the callbacks are falling behind.
+func (context *DatabaseContext) queueDocChanged(key string, docJSON []byte) {
+	c := &context.docChanged
+	c.lock.RLock()
+	registered := len(c.callbacks) > 0
+	queue, done := c.queue, c.done
+	c.lock.RUnlock()
+	if !registered {
+		return
+	}
+	select {
+	case queue <- docChangedEvent{key, docJSON}:
+	case <-done:
+	}
+}
+
+// Stops calling DocChangedFuncs, when the database is closed.
+func (c *docChangedCallbacks) stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
+
+// Runs on its own goroutine, calling the DocChangedFuncs for each queued document in turn.
+func (context *DatabaseContext) runDocChangedCallbacks(queue chan docChangedEvent, done chan struct{}) {
+	for {
+		select {
+		case event := <-queue:
+			context.notifyDocChanged(event.key, event.docJSON)
+		case <-done:
+			return
+		}
+	}
+}
+
+// Calls the registered DocChangedFuncs, if any, for a document that arrived on the change
+// listener's feed.
+func (context *DatabaseContext) notifyDocChanged(key string, docJSON []byte) {
+	c := &context.docChanged
+	c.lock.RLock()
+	if len(c.callbacks) == 0 {
+		c.lock.RUnlock()
+		return
+	}
+	// Copy the callbacks so they're called without the lock held, and can unregister themselves:
+	callbacks := make([]docChangedCallback, 0, len(c.callbacks))
+	for _, callback := range c.callbacks {
+		callbacks = append(callbacks, callback)
+	}
+	c.lock.RUnlock()
+
+	docID := docIDForKey(key)
+	doc, err := unmarshalDocument(docID, docJSON)
+	if err != nil || !doc.hasValidSyncData() {
+		base.Warn("notifyDocChanged: Error unmarshaling doc %q: %v", docID, err)
+		return
+	} else if doc.Sequence <= context.changeCache.initialSequence {
+		return // An old value from before the database was opened, like the change cache ignores
+	}
+	revID := doc.newestRevID()
+	revInfo := doc.History[revID]
+	if revInfo == nil {
+		return
+	}
+	change := DocChange{
+		DocID:    docID,
+		RevID:    revID,
+		Sequence: doc.Sequence,
+		Channels: revInfo.Channels,
+		Deleted:  revInfo.Deleted,
+		Current:  revID == doc.CurrentRev,
+	}
+	var body Body
+	for _, callback := range callbacks {
+		if callback.includeBody {
+			if err = context.loadExternalBody(doc); err == nil {
+				body, err = context.getRevision(doc, revID)
+			}
+			if err != nil {
+				base.Warn("notifyDocChanged: Couldn't get body of %q / %q: %v", docID, revID, err)
+			} else if change.Deleted {
+				body["_deleted"] = true
+			}
+			break
+		}
+	}
+
+	for _, callback := range callbacks {
+		change.Body = nil
+		if callback.includeBody {
+			change.Body = body
+		}
+		callback.fn(change)
+	}
+}
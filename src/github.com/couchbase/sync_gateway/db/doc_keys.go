@@ -0,0 +1,146 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// By default a document is stored in the bucket under its own ID. A very large database can
+// instead shard its documents' keys across a number of hash prefixes: a doc is stored under
+// "_shardXX:<docid>", where XX is the hex shard number derived from the ID. (Doc IDs can't
+// begin with "_", so such keys can't collide with unsharded ones, and a key can be mapped back
+// to its doc ID without knowing the scheme.) The scheme is recorded in the bucket when the
+// database is created and can't be changed afterwards, since existing docs would be lost.
+// Note that documents written directly to the bucket by other apps are imported under their
+// keys as-is, so a sharded database's docs should only be written through the gateway.
+
+// Maps document IDs to the keys they're stored under in the bucket.
+type DocKeyMapper interface {
+	DocKey(docid string) string
+}
+
+// Prefix of sharded document keys.
+const kShardKeyPrefix = "_shard"
+
+// Length of the prefix of a sharded key, e.g. "_shard0f:".
+const kShardKeyPrefixLength = len(kShardKeyPrefix) + 3
+
+// Max number of shards; the shard number has to fit in two hex digits.
+const MaxDocShards = 256
+
+// Key of the bucket doc that records a database's key scheme.
+const kDocShardsKey = "_sync:shards"
+
+// A DocKeyMapper that distributes keys across NumShards hash prefixes.
+type hashShardMapper struct {
+	NumShards uint32
+}
+
+func (m hashShardMapper) DocKey(docid string) string {
+	shard := crc32.ChecksumIEEE([]byte(docid)) % m.NumShards
+	return fmt.Sprintf("%s%02x:%s", kShardKeyPrefix, shard, docid)
+}
+
+// Returns a DocKeyMapper that shards keys across numShards prefixes.
+func NewHashShardMapper(numShards int) DocKeyMapper {
+	return hashShardMapper{NumShards: uint32(numShards)}
+}
+
+// Returns the bucket key of a document, or "" if the doc ID is invalid. (With sharded keys, the
+// shard prefix takes up part of the key length limit, so the longest IDs are invalid.)
+func (context *DatabaseContext) docKey(docid string) string {
+	if realDocID(docid) == "" {
+		return ""
+	} else if context.DocKeys == nil {
+		return docid
+	} else if len(docid) > kMaxKeyLength-kShardKeyPrefixLength {
+		return ""
+	}
+	return context.DocKeys.DocKey(docid)
+}
+
+// Returns the doc ID stored under a bucket key (under any key scheme.)
+func docIDForKey(key string) string {
+	if len(key) > kShardKeyPrefixLength && strings.HasPrefix(key, kShardKeyPrefix) &&
+		key[kShardKeyPrefixLength-1] == ':' {
+		return key[kShardKeyPrefixLength:]
+	}
+	return key
+}
+
+// JavaScript statement for view map functions, that sets 'docid' to the ID of the doc.
+var kViewDocIDJS = fmt.Sprintf(`var docid = meta.id;
+                     if (docid.substring(0,%d) == %q && docid.charAt(%d) == ":")
+                       docid = docid.substring(%d);`,
+	len(kShardKeyPrefix), kShardKeyPrefix, kShardKeyPrefixLength-1, kShardKeyPrefixLength)
+
+// The contents of the kDocShardsKey doc.
+type docShardsInfo struct {
+	NumShards int `json:"num_shards"`
+}
+
+// Sets the number of shards for the database's document keys (0 for no sharding), which must
+// match what's recorded in the bucket. NewImportingDatabaseContext calls this before the context
+// starts reading docs, so they're all read under the right scheme. If nothing is recorded yet, numShards is recorded --
+// unless it's nonzero and the database already has docs, since they'd become unreachable.
+// If numShards is -1 the recorded scheme is used, whatever it is; if none is recorded, unsharded
+// keys are recorded, since another node may be about to record a different scheme and the
+// nodes have to agree on one before either writes any docs.
+func (context *DatabaseContext) SetDocShards(numShards int) error {
+	if numShards > MaxDocShards {
+		return base.HTTPErrorf(http.StatusBadRequest, "Too many doc shards (max is %d)", MaxDocShards)
+	}
+	value, err := context.Bucket.GetRaw(kDocShardsKey)
+	if base.IsDocNotFoundError(err) {
+		proposed := docShardsInfo{}
+		if numShards > 0 {
+			if context.hasDocuments() {
+				return base.HTTPErrorf(http.StatusConflict,
+					"Can't shard the keys of database %q, which already has documents", context.Name)
+			}
+			proposed.NumShards = numShards
+		}
+		value, err = context.createMetadataDoc(kDocShardsKey, proposed)
+	}
+	if err != nil {
+		return err
+	}
+	var stored docShardsInfo
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return err
+	}
+
+	if numShards >= 0 && stored.NumShards != numShards {
+		return base.HTTPErrorf(http.StatusConflict,
+			"Database %q has %d doc shards; its key scheme can't be changed to %d shards",
+			context.Name, stored.NumShards, numShards)
+	}
+	if stored.NumShards > 0 {
+		base.Logf("Database %q: document keys are sharded %d ways", context.Name, stored.NumShards)
+		context.DocKeys = NewHashShardMapper(stored.NumShards)
+	} else {
+		context.DocKeys = nil
+	}
+	return nil
+}
+
+// Returns true if the database contains any documents.
+func (context *DatabaseContext) hasDocuments() bool {
+	opts := Body{"stale": false, "reduce": false, "limit": 1}
+	vres, err := context.Bucket.View(DesignDocSyncHousekeeping, ViewAllDocs, opts)
+	return err != nil || len(vres.Rows) > 0 // assume the worst if the view fails
+}
@@ -0,0 +1,162 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+func TestDocKeyMapping(t *testing.T) {
+	mapper := NewHashShardMapper(16)
+	key := mapper.DocKey("doc1")
+	assert.True(t, strings.HasPrefix(key, "_shard"))
+	assert.True(t, strings.HasSuffix(key, ":doc1"))
+	assert.Equals(t, len(key), len("_shard00:doc1"))
+	assert.Equals(t, mapper.DocKey("doc1"), key)
+	assert.Equals(t, docIDForKey(key), "doc1")
+	assert.Equals(t, docIDForKey("_shard0f:a:b"), "a:b")
+
+	// Unsharded keys map to themselves:
+	for _, key := range []string{"doc1", "shard00:x", "_sharded", "_sync:seq"} {
+		assert.Equals(t, docIDForKey(key), key)
+	}
+}
+
+func setupShardedTestDB(t *testing.T, numShards int) *Database {
+	context, err := NewImportingDatabaseContext("db", testBucket(), false, nil, numShards, CacheOptions{})
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	return db
+}
+
+func TestShardedDatabase(t *testing.T) {
+	db := setupShardedTestDB(t, 4)
+	defer tearDownTestDB(t, db)
+
+	revid, err := db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create doc")
+	key := db.docKey("doc1")
+	assert.True(t, key != "doc1")
+	_, err = db.Bucket.GetRaw(key)
+	assertNoError(t, err, "Doc isn't stored under its sharded key")
+	_, err = db.Bucket.GetRaw("doc1")
+	assert.True(t, err != nil)
+
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, body["_rev"], revid)
+
+	db.changeCache.waitForSequence(1)
+	changes, err := db.GetChanges(base.SetOf("*"), ChangesOptions{})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc1")
+
+	var ids []string
+	err = db.ForEachDocID(func(doc IDAndRev, channels []string) bool {
+		ids = append(ids, doc.DocID)
+		return true
+	}, ForEachDocIDOptions{})
+	assertNoError(t, err, "ForEachDocID failed")
+	assert.DeepEquals(t, ids, []string{"doc1"})
+
+	// The key scheme is recorded, and can't be changed:
+	assertHTTPError(t, db.SetDocShards(8), 409)
+	assertHTTPError(t, db.SetDocShards(0), 409)
+	assertNoError(t, db.SetDocShards(-1), "SetDocShards(-1) failed")
+	assert.Equals(t, db.docKey("doc1"), key)
+
+	// The shard prefix counts against the key length limit:
+	longID := strings.Repeat("x", kMaxKeyLength-kShardKeyPrefixLength)
+	_, err = db.Put(longID, Body{"n": 1})
+	assertNoError(t, err, "Couldn't create doc with longest ID")
+	assert.Equals(t, len(db.docKey(longID)), kMaxKeyLength)
+	_, err = db.Put(longID+"x", Body{"n": 1})
+	assertHTTPError(t, err, 400)
+}
+
+func TestUnspecifiedDocShardsAreRecorded(t *testing.T) {
+	db := setupTestDB(t) // opened with no doc shards specified
+	defer tearDownTestDB(t, db)
+	assert.Equals(t, db.docKey("doc1"), "doc1")
+	var stored docShardsInfo
+	assertNoError(t, db.Bucket.Get(kDocShardsKey, &stored), "Key scheme wasn't recorded")
+	assert.Equals(t, stored.NumShards, 0)
+
+	// So another node can't choose a different scheme:
+	assertHTTPError(t, db.SetDocShards(4), 409)
+	assert.Equals(t, db.docKey("doc1"), "doc1")
+}
+
+func TestCantShardExistingDatabase(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	_, err := db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create doc")
+	// As if the database predated recording key schemes:
+	assertNoError(t, db.Bucket.Delete(kDocShardsKey), "Couldn't delete key scheme")
+	assertHTTPError(t, db.SetDocShards(4), 409)
+	assertNoError(t, db.SetDocShards(0), "SetDocShards(0) failed")
+	assert.Equals(t, db.docKey("doc1"), "doc1")
+}
+
+func TestConcurrentDatabaseCreation(t *testing.T) {
+	bucket := testBucket()
+	defer bucket.Close()
+
+	// Several nodes open the new database at once, configured with different key schemes (or
+	// none, which means whatever's recorded):
+	schemes := []int{0, 4, 16, -1}
+	const numNodes = 12
+	nodes := make([]*DatabaseContext, numNodes)
+	errs := make([]error, numNodes)
+	idents := make([]DatabaseIdentity, numNodes)
+	var wg sync.WaitGroup
+	for i := range nodes {
+		nodes[i] = &DatabaseContext{Name: "db", Bucket: bucket}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if errs[i] = nodes[i].SetDocShards(schemes[i%len(schemes)]); errs[i] == nil {
+				idents[i], errs[i] = nodes[i].InitIdentity(0)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Exactly one scheme won, and the nodes that opened the database all agree on it:
+	var stored docShardsInfo
+	assertNoError(t, bucket.Get(kDocShardsKey, &stored), "Key scheme wasn't recorded")
+	ident, err := (&DatabaseContext{Name: "db", Bucket: bucket}).Identity()
+	assertNoError(t, err, "Identity failed")
+	opened := 0
+	for i, node := range nodes {
+		if scheme := schemes[i%len(schemes)]; scheme < 0 || scheme == stored.NumShards {
+			assertNoError(t, errs[i], "Node with the winning key scheme failed")
+			assert.Equals(t, idents[i], ident)
+			if stored.NumShards == 0 {
+				assert.True(t, node.DocKeys == nil)
+			} else {
+				assert.Equals(t, node.DocKeys, NewHashShardMapper(stored.NumShards))
+			}
+			opened++
+		} else {
+			assertHTTPError(t, errs[i], 409)
+		}
+	}
+	assert.Equals(t, opened, numNodes/len(schemes)*2)
+}
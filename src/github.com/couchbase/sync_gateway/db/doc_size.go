@@ -0,0 +1,136 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A document is stored as a single bucket value, holding the current body plus the sync metadata:
+// the revision tree (with the bodies of any conflicting revisions), channels and access. If that
+// grows past Couchbase's value size limit the write fails, with an error that doesn't say why.
+// So when a document's value gets close to the limit, a warning is logged and the document is
+// shrunk by moving bodies into auxiliary docs: first those of the non-current revisions, then
+// the current body (as an external body.) Only if it's still too big is the write rejected.
+// The bodies of conflicting leaf revisions are still live, so unlike obsolete revisions they go
+// into docs (see leafRevisionKey) that don't expire and aren't deleted by compaction; the doc's
+// MovedBodies lists them. Each is deleted once its revision stops being a conflicting leaf.
+
+// Largest value Couchbase Server will store.
+var MaxDocValueSize = 20 * 1024 * 1024
+
+// Size of a document value at which it's shrunk, and a warning logged.
+var DocSizeWarningThreshold = MaxDocValueSize / 10 * 8
+
+// Called when a document's JSON (raw) is over DocSizeWarningThreshold. Moves revision bodies out
+// of the document until it's under the threshold, and returns its new JSON. Returns a 413 error
+// if it's still over MaxDocValueSize. This runs inside the document's CAS update, since the
+// bodies have to be stored before the doc that refers to them; the keys already stored by an
+// earlier attempt of the same update are kept in stored, so a retry doesn't write them again.
+func (db *Database) shrinkDocValue(doc *document, raw []byte, stored map[string]bool) ([]byte, error) {
+	base.Warn("Doc %q is %d bytes, close to the %d-byte limit; moving revision bodies out of it",
+		doc.ID, len(raw), MaxDocValueSize)
+	dbExpvars.Add("large_docs", 1)
+
+	var err error
+	for revid, info := range doc.History {
+		if len(info.Body) == 0 || revid == doc.CurrentRev {
+			continue
+		}
+		if !doc.History.isLeaf(revid) {
+			// An obsolete revision; back it up as usual:
+			if err = db.setOldRevisionJSON(doc.ID, revid, info.Body); err != nil {
+				return nil, err
+			}
+		} else {
+			if key := leafRevisionKey(doc.ID, revid); !stored[key] {
+				if err = db.Bucket.SetRaw(key, 0, info.Body); err != nil {
+					return nil, err
+				}
+				stored[key] = true
+			}
+			doc.MovedBodies = append(doc.MovedBodies, revid)
+		}
+		db.LogTo("CRUD+", "Moved %d-byte body of %q / %q out of the doc", len(info.Body), doc.ID, revid)
+		info.Body = nil
+	}
+	if raw, err = json.Marshal(doc); err != nil || len(raw) <= DocSizeWarningThreshold {
+		return raw, err
+	}
+
+	if doc.ExternalBody == "" {
+		if _, err = db.storeExternalBody(doc, true, stored); err != nil {
+			return nil, err
+		}
+		if raw, err = json.Marshal(doc); err != nil || len(raw) <= DocSizeWarningThreshold {
+			return raw, err
+		}
+	}
+
+	if len(raw) > MaxDocValueSize {
+		dbExpvars.Add("docs_too_large", 1)
+		base.Warn("Doc %q is too large to save: its metadata alone is %d bytes", doc.ID, len(raw))
+		return nil, base.HTTPErrorf(http.StatusRequestEntityTooLarge,
+			"Document is too large: its metadata is %d bytes; the limit is %d", len(raw), MaxDocValueSize)
+	}
+	return raw, nil
+}
+
+// Key of the doc holding the body of a conflicting leaf revision moved out by shrinkDocValue.
+// Its prefix differs from oldRevisionKey's, so compaction leaves it alone.
+func leafRevisionKey(docid string, revid string) string {
+	return fmt.Sprintf("_sync:leafrev:%s:%d:%s", docid, len(revid), revid)
+}
+
+// Returns true if the body of a revision has been moved to its leafRevisionKey.
+func (doc *document) hasMovedBody(revid string) bool {
+	for _, moved := range doc.MovedBodies {
+		if moved == revid {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the body of a revision that shrinkDocValue moved out of the document.
+func (db *Database) getMovedBodyJSON(doc *document, revid string) ([]byte, error) {
+	data, err := db.Bucket.GetRaw(leafRevisionKey(doc.ID, revid))
+	if base.IsDocNotFoundError(err) {
+		base.Warn("Moved body of %q / %q is missing", doc.ID, revid)
+		err = base.HTTPErrorf(404, "missing")
+	}
+	return data, err
+}
+
+// Removes revisions from doc.MovedBodies that are no longer conflicting leaves (because they've
+// been pruned, have gained a child, or have become current) and returns the keys of their
+// moved bodies, which should be deleted once the document has been saved.
+func (doc *document) pruneMovedBodies() (obsoleteKeys []string) {
+	if len(doc.MovedBodies) == 0 {
+		return nil
+	}
+	remaining := make([]string, 0, len(doc.MovedBodies))
+	for _, revid := range doc.MovedBodies {
+		if revid != doc.CurrentRev && doc.History.isLeaf(revid) {
+			remaining = append(remaining, revid)
+		} else {
+			obsoleteKeys = append(obsoleteKeys, leafRevisionKey(doc.ID, revid))
+		}
+	}
+	if len(remaining) == 0 {
+		remaining = nil
+	}
+	doc.MovedBodies = remaining
+	return obsoleteKeys
+}
@@ -0,0 +1,70 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestShrinkLargeDoc(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	defer func(max, warning int) {
+		MaxDocValueSize, DocSizeWarningThreshold = max, warning
+	}(MaxDocValueSize, DocSizeWarningThreshold)
+	MaxDocValueSize, DocSizeWarningThreshold = 3000, 1500
+
+	rev1id, err := db.Put("doc", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create doc")
+	paddingA, paddingB := strings.Repeat("a", 900), strings.Repeat("b", 900)
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 2, "padding": paddingA}, []string{"2-a", rev1id}), "PutExistingRev failed")
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 3, "padding": paddingB}, []string{"2-b", rev1id}), "PutExistingRev failed")
+
+	// The conflicting revision's body was moved out of the doc, but can still be read:
+	raw, err := db.Bucket.GetRaw("doc")
+	assertNoError(t, err, "Couldn't get raw doc")
+	assert.True(t, len(raw) <= DocSizeWarningThreshold)
+	assert.False(t, strings.Contains(string(raw), paddingA))
+	assert.True(t, strings.Contains(string(raw), paddingB))
+	body, err := db.GetRev("doc", "2-a", false, nil)
+	assertNoError(t, err, "Couldn't get conflicting rev")
+	assert.Equals(t, body["padding"], paddingA)
+
+	// Compaction doesn't delete it, since it's still a leaf:
+	_, err = db.Compact()
+	assertNoError(t, err, "Compact failed")
+	body, err = db.GetRev("doc", "2-a", false, nil)
+	assertNoError(t, err, "Couldn't get conflicting rev after compaction")
+	assert.Equals(t, body["padding"], paddingA)
+
+	// A current body that's too big by itself is stored externally:
+	paddingC := strings.Repeat("c", 1600)
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 4, "padding": paddingC}, []string{"3-c", "2-b", rev1id}), "PutExistingRev failed")
+	doc, err := db.GetDoc("doc")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, doc.ExternalBody, externalBodyKey("doc", "3-c"))
+	body, err = db.Get("doc")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, body["padding"], paddingC)
+
+	// Once the conflict is resolved, the moved body is deleted:
+	assertNoError(t, db.PutExistingRev("doc", Body{"_deleted": true}, []string{"3-a", "2-a", rev1id}), "PutExistingRev failed")
+	_, err = db.Bucket.GetRaw(leafRevisionKey("doc", "2-a"))
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// If the metadata alone is too big, the write fails clearly:
+	MaxDocValueSize, DocSizeWarningThreshold = 20, 10
+	_, err = db.Put("doc2", Body{"n": 1})
+	assertHTTPError(t, err, 413)
+}
@@ -31,6 +31,10 @@ type syncData struct {
 	Channels        channels.ChannelMap `json:"channels,omitempty"`
 	Access          UserAccessMap       `json:"access,omitempty"`
 	RoleAccess      UserAccessMap       `json:"role_access,omitempty"`
+	TombstonedAt    int64               `json:"tombstoned_at,omitempty"` // Unix time the doc was deleted
+	ExternalBody    string              `json:"external_body,omitempty"` // Key of separately-stored body
+	MovedBodies     []string            `json:"moved_bodies,omitempty"`  // Leaf revs whose bodies are in leafRevisionKey docs
+	LastWriter      *WriterInfo         `json:"last_writer,omitempty"`   // Who made the last change, if TagWrites
 
 	// Fields used by bucket-shadowing:
 	UpstreamCAS *uint64 `json:"upstream_cas,omitempty"` // CAS value of remote doc
@@ -48,8 +52,9 @@ type syncData struct {
 // "_sync" property.
 type document struct {
 	syncData
-	body Body
-	ID   string `json:"-"`
+	body       Body
+	ID         string `json:"-"`
+	rawHistory []byte // Undecoded History, if unmarshaled by unmarshalDocumentWithoutHistory
 }
 
 // Returns a new empty document.
@@ -72,6 +77,61 @@ func unmarshalDocument(docid string, data []byte) (*document, error) {
 	return doc, nil
 }
 
+// Unmarshals a document, except for its revision history, which for a document with many
+// revisions is most of the work; it's decoded by loadHistory only if it's needed.
+func unmarshalDocumentWithoutHistory(docid string, data []byte) (*document, error) {
+	var root struct {
+		SyncData *struct {
+			syncData
+			History json.RawMessage `json:"history"` // hides syncData.History
+		} `json:"_sync"`
+	}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	doc := &document{ID: docid}
+	if root.SyncData != nil {
+		doc.syncData = root.SyncData.syncData
+		doc.rawHistory = root.SyncData.History
+		if doc.Deleted_OLD {
+			doc.Deleted_OLD = false
+			doc.Flags |= channels.Deleted // Backward compatibility with old Deleted property
+		}
+	}
+	if err := json.Unmarshal(data, &doc.body); err != nil {
+		return nil, err
+	}
+	delete(doc.body, "_sync")
+	return doc, nil
+}
+
+// Decodes the revision history of a document read by unmarshalDocumentWithoutHistory.
+func (doc *document) loadHistory() error {
+	if doc.History != nil {
+		return nil
+	}
+	doc.History = make(RevTree)
+	if len(doc.rawHistory) > 0 {
+		if err := json.Unmarshal(doc.rawHistory, &doc.History); err != nil {
+			return err
+		}
+		doc.rawHistory = nil
+	}
+	return nil
+}
+
+// The channels the current revision is in. Unlike the current revision's History entry, this
+// is available without decoding the history.
+func (doc *document) currentChannels() base.Set {
+	names := make([]string, 0, len(doc.Channels))
+	for channel, removal := range doc.Channels {
+		if removal == nil {
+			names = append(names, channel)
+		}
+	}
+	return base.SetFromArray(names)
+}
+
 // Unmarshals just a document's sync metadata from JSON data.
 // (This is somewhat faster, if all you need is the sync data without the doc body.)
 func unmarshalDocumentSyncData(data []byte, needHistory bool) (*syncData, error) {
@@ -252,8 +312,8 @@ func (doc *document) UnmarshalJSON(data []byte) error {
 
 func (doc *document) MarshalJSON() ([]byte, error) {
 	body := doc.body
-	if body == nil {
-		body = Body{}
+	if body == nil || doc.ExternalBody != "" {
+		body = Body{} // An external body is stored separately (see storeExternalBody)
 	}
 	body["_sync"] = &doc.syncData
 	data, err := json.Marshal(body)
@@ -0,0 +1,99 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// If a database's ExternalBodySize is nonzero, the body of a document's current revision is
+// stored in a separate bucket doc when its JSON is larger than that, and the document itself
+// holds only the sync metadata plus the key of the body doc ("external_body".) That way
+// metadata-only updates (new conflicting revs, access changes, resyncs...) don't have to
+// rewrite a huge value, and the body gets the whole of Couchbase's value size limit.
+// Note that Couchbase views only see the metadata of such a document, not its body.
+
+// Key of the doc that stores the external body of revision revid of a document.
+func externalBodyKey(docid string, revid string) string {
+	return fmt.Sprintf("_sync:body:%s:%d:%s", docid, len(revid), revid)
+}
+
+// Loads a document's external body, if it has one, into doc.body.
+func (db *DatabaseContext) loadExternalBody(doc *document) error {
+	if doc.ExternalBody == "" {
+		return nil
+	}
+	data, err := db.Bucket.GetRaw(doc.ExternalBody)
+	if err != nil {
+		base.Warn("Couldn't load external body %q of doc %q: %v", doc.ExternalBody, doc.ID, err)
+		return err
+	}
+	var body Body
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+	doc.body = body
+	return nil
+}
+
+// Called just before a document is saved, inside its CAS update. If the current revision's body
+// is over the size threshold (or force is true) stores it in its own doc and marks the document
+// as referring to that. The body has to be stored before the document that refers to it, or a
+// failed write (or a reader in between) would find the document pointing at a missing key; since
+// the key is unique to the revision, storing it early never clobbers a body that's in use. (If
+// the update then fails, the body doc is left unreferenced; it isn't deleted, since the same
+// revision may have been saved concurrently by another writer.) Keys already stored by an earlier
+// attempt of the same update are kept in stored, so a retry doesn't write them again. Returns the
+// key of the doc's previous external body if that's no longer needed; the caller should delete it
+// after the document's been saved.
+func (db *DatabaseContext) storeExternalBody(doc *document, force bool, stored map[string]bool) (obsoleteKey string, err error) {
+	oldKey := doc.ExternalBody
+	newKey := ""
+	if (db.ExternalBodySize > 0 || force) && len(doc.body) > 0 {
+		key := externalBodyKey(doc.ID, doc.CurrentRev)
+		if key == oldKey {
+			return "", nil // Already stored; don't rewrite it
+		}
+		bodyJSON, err := json.Marshal(doc.body)
+		if err != nil {
+			return "", err
+		}
+		if force || len(bodyJSON) > db.ExternalBodySize {
+			if !stored[key] {
+				db.LogTo("CRUD+", "Storing %d-byte body of %q / %q externally",
+					len(bodyJSON), doc.ID, doc.CurrentRev)
+				if err := db.Bucket.SetRaw(key, 0, bodyJSON); err != nil {
+					base.Warn("Couldn't store external body %q of doc %q: %v", key, doc.ID, err)
+					return "", err
+				}
+				stored[key] = true
+			}
+			newKey = key
+		}
+	}
+	doc.ExternalBody = newKey
+	if oldKey != newKey {
+		obsoleteKey = oldKey
+	}
+	return obsoleteKey, nil
+}
+
+// Deletes an external body doc that's no longer referenced.
+func (db *DatabaseContext) deleteExternalBody(key string) {
+	if key == "" {
+		return
+	}
+	if err := db.Bucket.Delete(key); err != nil && !base.IsDocNotFoundError(err) {
+		base.Warn("Couldn't delete obsolete external body %q: %v", key, err)
+	}
+}
@@ -0,0 +1,57 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestExternalBody(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ExternalBodySize = 100
+
+	padding := strings.Repeat("x", 200)
+	rev1id, err := db.Put("doc1", Body{"n": 1, "padding": padding})
+	assertNoError(t, err, "Couldn't create doc")
+
+	// The doc itself contains only the metadata:
+	raw, err := db.Bucket.GetRaw("doc1")
+	assertNoError(t, err, "Couldn't get raw doc")
+	assert.False(t, strings.Contains(string(raw), padding))
+	bodyKey := externalBodyKey("doc1", rev1id)
+	assert.True(t, strings.Contains(string(raw), bodyKey))
+	_, err = db.Bucket.GetRaw(bodyKey)
+	assertNoError(t, err, "External body wasn't stored")
+
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, body["padding"], padding)
+
+	// A small revision goes back into the doc, and the external body is deleted:
+	rev2id, err := db.Put("doc1", Body{"_rev": rev1id, "n": 2})
+	assertNoError(t, err, "Couldn't update doc")
+	raw, err = db.Bucket.GetRaw("doc1")
+	assertNoError(t, err, "Couldn't get raw doc")
+	assert.False(t, strings.Contains(string(raw), "external_body"))
+	_, err = db.Bucket.GetRaw(bodyKey)
+	assert.True(t, err != nil)
+
+	// Growing it again moves the new body out again:
+	_, err = db.Put("doc1", Body{"_rev": rev2id, "n": 3, "padding": padding})
+	assertNoError(t, err, "Couldn't update doc")
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, doc.body["n"], float64(3))
+	assert.Equals(t, doc.ExternalBody, externalBodyKey("doc1", doc.CurrentRev))
+}
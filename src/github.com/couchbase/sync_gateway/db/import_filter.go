@@ -0,0 +1,78 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/couchbaselabs/walrus"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Wraps an import filter so that any truthy result counts as true.
+const importFilterWrapper = `
+	function(doc) {
+		var fn = %s;
+		return fn(doc) ? true : false;
+	}`
+
+// A thread-safe wrapper around a JS import filter, which decides which documents written to
+// the bucket by other applications (e.g. with a Couchbase SDK, so without any sync metadata)
+// get imported into the gateway. It's called as fn(doc) and returns true to import the doc;
+// an imported doc then gets a revision ID and a sequence, is run through the sync function and
+// shows up in changes feeds like any other. Docs the filter turns down are left untouched, and
+// stay invisible to the gateway.
+type ImportFilterFunction struct {
+	*walrus.JSServer
+}
+
+// Compiles an import filter. Returns an error if the source isn't a valid JS function.
+func NewImportFilterFunction(fnSource string) (*ImportFilterFunction, error) {
+	wrappedSource := fmt.Sprintf(importFilterWrapper, fnSource)
+	if _, err := newJsEventTask(wrappedSource); err != nil {
+		return nil, err
+	}
+	return &ImportFilterFunction{
+		JSServer: walrus.NewJSServer(wrappedSource, kTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				return newJsEventTask(fnSource)
+			}),
+	}, nil
+}
+
+// Runs the filter on a document body. An exception in the filter counts as false.
+func (fn *ImportFilterFunction) accepts(docid string, body Body) bool {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return false
+	}
+	result, err := fn.Call(walrus.JSONString(bodyJSON))
+	if err != nil {
+		base.Warn("import_filter fn exception: %+v; doc = %q", err, docid)
+		return false
+	}
+	accepted, _ := result.(bool)
+	return accepted
+}
+
+// Returns true if a document without sync metadata should be imported, i.e. if there's no
+// import filter or the filter accepts it.
+func (context *DatabaseContext) shouldImport(doc *document) bool {
+	if context.ImportFilter == nil {
+		return true
+	} else if context.ImportFilter.accepts(doc.ID, doc.body) {
+		return true
+	}
+	base.LogTo("CRUD+", "Import filter skipped doc %q", doc.ID)
+	dbExpvars.Add("import_filter_skipped", 1)
+	return false
+}
@@ -0,0 +1,227 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Rebuilding the channel indexes is the recovery path for when they're suspected to be corrupt,
+// e.g. after a bad migration. It discards everything derived from documents' channel and access
+// assignments and recomputes it from the documents themselves:
+// 1. The gateway's design docs are deleted and reinstalled, so the server reindexes their views.
+// 2. The sync function is re-run on every document, and each one is rewritten with its
+//    recomputed channels and access grants (even if they appear not to have changed.)
+// 3. Every user's and role's channels and roles are invalidated, to be recomputed on next use.
+// 4. The channel cache is cleared, and the database's epoch is incremented.
+// It runs in the background; its progress can be polled with IndexRebuildStatus. While it runs,
+// changes feeds fall back to querying the views, so they'll be slower and may be incomplete.
+// Document writes must be frozen (see FreezeWrites) for the whole rebuild: the channel cache is
+// off meanwhile, so writes made during it would never reach the changes feeds. The rebuild
+// fails if writes are unfrozen before it finishes.
+
+// States of an index rebuild.
+const (
+	IndexRebuildIdle      = "idle"      // Never run since the gateway started
+	IndexRebuildRunning   = "running"   // In progress
+	IndexRebuildCompleted = "completed" // Finished successfully
+	IndexRebuildStopped   = "stopped"   // Stopped by StopIndexRebuild before finishing
+	IndexRebuildFailed    = "failed"    // Stopped by an error
+)
+
+// Progress of the current or most recent index rebuild.
+type IndexRebuildStatus struct {
+	State            string     `json:"state"`
+	Step             string     `json:"step,omitempty"` // What it's doing, while running
+	DocsTotal        int        `json:"docs_total"`
+	DocsProcessed    int        `json:"docs_processed"`
+	DocErrors        int        `json:"doc_errors"`
+	MaxDocsPerSecond int        `json:"max_docs_per_second"` // 0 means unthrottled
+	StartedAt        *time.Time `json:"started_at,omitempty"`
+	FinishedAt       *time.Time `json:"finished_at,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+type indexRebuildState struct {
+	lock   sync.Mutex
+	status IndexRebuildStatus
+	stop   chan struct{}
+}
+
+// Starts rebuilding the database's channel indexes in the background. maxDocsPerSecond limits
+// how fast documents are rewritten, to spare the bucket; 0 means no limit. Fails with a 409
+// status if a rebuild is already running, or a 503 status if writes aren't frozen.
+func (context *DatabaseContext) StartIndexRebuild(maxDocsPerSecond int) error {
+	state := &context.indexRebuild
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.status.State == IndexRebuildRunning {
+		return base.HTTPErrorf(http.StatusConflict, "Index rebuild is already running")
+	}
+	if err := context.RequireWritesFrozen("an index rebuild"); err != nil {
+		return err
+	}
+	if maxDocsPerSecond < 0 {
+		maxDocsPerSecond = 0
+	}
+	now := time.Now()
+	state.status = IndexRebuildStatus{
+		State:            IndexRebuildRunning,
+		MaxDocsPerSecond: maxDocsPerSecond,
+		StartedAt:        &now,
+	}
+	state.stop = make(chan struct{})
+	base.Logf("Database %q: starting index rebuild", context.Name)
+	go context.rebuildIndexes(maxDocsPerSecond, state.stop)
+	return nil
+}
+
+// Asks a running index rebuild to stop. Returns false if none is running.
+func (context *DatabaseContext) StopIndexRebuild() bool {
+	state := &context.indexRebuild
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.status.State != IndexRebuildRunning || state.stop == nil {
+		return false
+	}
+	close(state.stop)
+	state.stop = nil
+	return true
+}
+
+// Returns the progress of the current or most recent index rebuild.
+func (context *DatabaseContext) IndexRebuildStatus() IndexRebuildStatus {
+	state := &context.indexRebuild
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.status.State == "" {
+		return IndexRebuildStatus{State: IndexRebuildIdle}
+	}
+	return state.status
+}
+
+func (context *DatabaseContext) updateIndexRebuild(fn func(status *IndexRebuildStatus)) {
+	state := &context.indexRebuild
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	fn(&state.status)
+}
+
+func (context *DatabaseContext) rebuildIndexes(maxDocsPerSecond int, stop <-chan struct{}) {
+	db := &Database{DatabaseContext: context}
+	err := db.doRebuildIndexes(maxDocsPerSecond, stop)
+
+	context.updateIndexRebuild(func(status *IndexRebuildStatus) {
+		now := time.Now()
+		status.FinishedAt = &now
+		status.Step = ""
+		if err == errIndexRebuildStopped {
+			status.State = IndexRebuildStopped
+		} else if err != nil {
+			status.State = IndexRebuildFailed
+			status.Error = err.Error()
+		} else {
+			status.State = IndexRebuildCompleted
+		}
+		base.Logf("Database %q: index rebuild %s: %d of %d docs processed, %d errors",
+			context.Name, status.State, status.DocsProcessed, status.DocsTotal, status.DocErrors)
+	})
+}
+
+var errIndexRebuildStopped = errors.New("index rebuild stopped")
+var errIndexRebuildUnfrozen = errors.New("writes were unfrozen during the index rebuild")
+
+func (db *Database) doRebuildIndexes(maxDocsPerSecond int, stop <-chan struct{}) error {
+	setStep := func(step string) {
+		db.updateIndexRebuild(func(status *IndexRebuildStatus) { status.Step = step })
+	}
+
+	setStep("reinstalling views")
+	for designDocName := range syncDesignDocs() {
+		if err := db.Bucket.DeleteDDoc(designDocName); err != nil {
+			base.Warn("Index rebuild: couldn't delete design doc %q: %v", designDocName, err)
+		}
+	}
+	if err := installViews(db.Bucket); err != nil {
+		return err
+	}
+
+	setStep("indexing documents")
+	options := Body{"stale": false, "reduce": false, "startkey": []interface{}{true}}
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewImport, options)
+	if err != nil {
+		return err
+	}
+	db.updateIndexRebuild(func(status *IndexRebuildStatus) { status.DocsTotal = len(vres.Rows) })
+
+	// Documents are about to be rewritten without new sequence numbers, which would confuse
+	// the changeCache, so turn it off until done (as UpdateAllDocChannels does):
+	db.changeCache.EnableChannelLogs(false)
+	defer db.changeCache.EnableChannelLogs(true)
+	db.changeCache.ClearLogs()
+
+	setStep("recomputing document channels")
+	var interval time.Duration
+	if maxDocsPerSecond > 0 {
+		interval = time.Second / time.Duration(maxDocsPerSecond)
+	}
+	for _, row := range vres.Rows {
+		rowStart := time.Now()
+		select {
+		case <-stop:
+			return errIndexRebuildStopped
+		default:
+		}
+		if frozen, _ := db.WritesFrozen(); !frozen {
+			return errIndexRebuildUnfrozen
+		}
+		docid := row.Key.([]interface{})[1].(string)
+		err := db.resyncDocument(docid, true, false, true)
+		failed := err != nil && err != couchbase.UpdateCancel
+		if failed {
+			base.Warn("Index rebuild: error updating doc %q: %v", docid, err)
+		}
+		db.updateIndexRebuild(func(status *IndexRebuildStatus) {
+			status.DocsProcessed++
+			if failed {
+				status.DocErrors++
+			}
+		})
+		if wait := interval - time.Since(rowStart); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return errIndexRebuildStopped
+			}
+		}
+	}
+
+	setStep("invalidating users and roles")
+	users, roles, err := db.AllPrincipalIDs()
+	if err != nil {
+		return err
+	}
+	for _, name := range users {
+		db.invalUserRoles(name)
+		db.invalUserChannels(name)
+	}
+	for _, name := range roles {
+		db.invalRoleChannels(name)
+	}
+	db.incrementEpoch()
+	return nil
+}
@@ -0,0 +1,99 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbaselabs/walrus"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Wraps an on_create function. It can modify the doc it's given or return a new one. It only
+// sees the doc's regular properties; the special ones (_id, _attachments...) are left alone.
+const onCreateWrapper = `
+	function(doc, userCtx) {
+		var fn = %s;
+		var result = fn(doc, userCtx);
+		return (result === undefined) ? doc : result;
+	}`
+
+// A thread-safe wrapper around a JS on_create function, which fills in default properties,
+// such as timestamps or the creator's name, of documents created by PUT or POST before they're
+// validated and saved. It's called as fn(doc, userCtx); userCtx is null for admin requests.
+// It isn't called on revisions pushed by replicators, which have to be stored as-is.
+type OnCreateFunction struct {
+	*walrus.JSServer
+}
+
+// Compiles an on_create function. Returns an error if the source isn't a valid JS function.
+func NewOnCreateFunction(fnSource string) (*OnCreateFunction, error) {
+	wrappedSource := fmt.Sprintf(onCreateWrapper, fnSource)
+	if _, err := newJsEventTask(wrappedSource); err != nil {
+		return nil, err
+	}
+	return &OnCreateFunction{
+		JSServer: walrus.NewJSServer(wrappedSource, kTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				return newJsEventTask(fnSource)
+			}),
+	}, nil
+}
+
+// Runs the function on the body of a new document, returning the transformed body.
+func (fn *OnCreateFunction) transform(body Body, userCtx map[string]interface{}) (Body, error) {
+	bodyJSON, err := json.Marshal(userProperties(body))
+	if err != nil {
+		return nil, err
+	}
+	result, err := fn.Call(walrus.JSONString(bodyJSON), userCtx)
+	if err != nil {
+		base.Warn("on_create fn exception: %+v; doc = %s", err, bodyJSON)
+		return nil, base.HTTPErrorf(http.StatusInternalServerError, "Exception in JS on_create function")
+	}
+	resultBody, ok := result.(map[string]interface{})
+	if !ok {
+		base.Warn("on_create fn returned %T, not an object; doc = %s", result, bodyJSON)
+		return nil, base.HTTPErrorf(http.StatusInternalServerError, "JS on_create function didn't return an object")
+	}
+	newBody := userProperties(resultBody)
+	for key, value := range body {
+		if isSpecialProperty(key) {
+			newBody[key] = value
+		}
+	}
+	return newBody, nil
+}
+
+func isSpecialProperty(key string) bool {
+	return key != "" && key[0] == '_'
+}
+
+// Returns a copy of a body without any of its special ("_"-prefixed) properties.
+func userProperties(body Body) Body {
+	props := Body{}
+	for key, value := range body {
+		if !isSpecialProperty(key) {
+			props[key] = value
+		}
+	}
+	return props
+}
+
+// Applies the database's on_create function, if any, to the body of a document being created.
+func (db *Database) applyOnCreate(body Body) (Body, error) {
+	if db.OnCreate == nil {
+		return body, nil
+	}
+	return db.OnCreate.transform(body, makeUserCtx(db.user))
+}
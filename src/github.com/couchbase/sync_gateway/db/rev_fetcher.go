@@ -0,0 +1,58 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+// Default value of DatabaseContext.FetchConcurrency.
+const DefaultFetchConcurrency = 8
+
+// A revision to be fetched by ForEachRev, and the result of fetching it.
+type RevFetch struct {
+	DocID            string
+	RevID            string   // May be "", meaning the current revision
+	AttachmentsSince []string // As in GetRev
+	Body             Body     // The revision's body, once fetched
+	Err              error    // The error fetching it; if set beforehand, the fetch is skipped
+}
+
+// Fetches a list of revisions, as GetRev would, and calls the callback with each one in order.
+// A request for hundreds of docs would otherwise read them one at a time, or if parallelized
+// naively, hog the bucket's connections; instead at most FetchConcurrency fetches are running
+// (or waiting for the callback) at once. Revisions are read through the revision cache.
+func (db *Database) ForEachRev(fetches []RevFetch, listRevisions bool, callback func(*RevFetch)) {
+	concurrency := db.FetchConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	done := make([]chan struct{}, len(fetches))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	go func() {
+		for i := range fetches {
+			slots <- struct{}{} // Blocks while 'concurrency' fetches are outstanding
+			go func(fetch *RevFetch, done chan struct{}) {
+				if fetch.Err == nil {
+					fetch.Body, fetch.Err = db.GetRev(fetch.DocID, fetch.RevID, listRevisions,
+						fetch.AttachmentsSince)
+				}
+				close(done)
+			}(&fetches[i], done[i])
+		}
+	}()
+
+	for i := range fetches {
+		<-done[i]
+		callback(&fetches[i])
+		fetches[i].Body = nil // Let the body be GC'd; the caller is done with it
+		<-slots
+	}
+}
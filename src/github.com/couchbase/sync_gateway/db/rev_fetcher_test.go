@@ -0,0 +1,47 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestForEachRev(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.FetchConcurrency = 3
+
+	const numDocs = 20
+	revids := make([]string, numDocs)
+	for i := 0; i < numDocs; i++ {
+		var err error
+		revids[i], err = db.Put(fmt.Sprintf("doc%d", i), Body{"n": i})
+		assertNoError(t, err, "Couldn't create doc")
+	}
+
+	// Ask for every doc, plus one that's missing and one that's already failed:
+	fetches := make([]RevFetch, 0, numDocs+2)
+	for i := 0; i < numDocs; i++ {
+		fetches = append(fetches, RevFetch{DocID: fmt.Sprintf("doc%d", i), RevID: revids[i]})
+	}
+	fetches = append(fetches, RevFetch{DocID: "nosuchdoc"})
+	fetches = append(fetches, RevFetch{DocID: "doc0", Err: base.HTTPErrorf(400, "bad")})
+
+	n := 0
+	db.ForEachRev(fetches, true, func(fetch *RevFetch) {
+		if n < numDocs {
+			assertNoError(t, fetch.Err, "Fetch failed")
+			assert.Equals(t, fetch.Body["_id"], fmt.Sprintf("doc%d", n))
+			assert.True(t, fetch.Body["_revisions"] != nil)
+		} else if n == numDocs {
+			assertHTTPError(t, fetch.Err, 404)
+		} else {
+			assertHTTPError(t, fetch.Err, 400)
+			assert.True(t, fetch.Body == nil)
+		}
+		n++
+	})
+	assert.Equals(t, n, numDocs+2)
+}
@@ -57,23 +57,26 @@ func (body Body) ImmutableAttachmentsCopy() Body {
 func (db *DatabaseContext) getOldRevisionJSON(docid string, revid string) ([]byte, error) {
 	data, err := db.Bucket.GetRaw(oldRevisionKey(docid, revid))
 	if base.IsDocNotFoundError(err) {
-		base.LogTo("CRUD+", "No old revision %q / %q", docid, revid)
+		db.LogTo("CRUD+", "No old revision %q / %q", docid, revid)
 		err = base.HTTPErrorf(404, "missing")
 	}
 	if data != nil {
-		base.LogTo("CRUD+", "Got old revision %q / %q --> %d bytes", docid, revid, len(data))
+		db.LogTo("CRUD+", "Got old revision %q / %q --> %d bytes", docid, revid, len(data))
 	}
 	return data, err
 }
 
 func (db *Database) setOldRevisionJSON(docid string, revid string, body []byte) error {
-	base.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(body))
+	db.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(body))
 
 	// Set old revisions to expire after 5 minutes.  Future enhancement to make this a config
 	// setting might be appropriate.
-	return db.Bucket.SetRaw(oldRevisionKey(docid, revid), 300, body)
+	return db.Bucket.SetRaw(oldRevisionKey(docid, revid), kOldRevisionExpiry, body)
 }
 
+// How long old revision bodies are kept (seconds.)
+const kOldRevisionExpiry = 300
+
 //////// UTILITY FUNCTIONS:
 
 func oldRevisionKey(docid string, revid string) string {
@@ -0,0 +1,122 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// An old revision body stored as the differences from a newer revision (its "source"), instead
+// of as a full copy. Only top-level properties are compared: Set holds the old values of the
+// properties that differ, and Unset lists the properties the old revision didn't have.
+// (Marshaling puts "_deltaSrc" first, which is how isBodyDelta recognizes one; a real body
+// can't have that property since user-defined properties can't start with "_".)
+type bodyDelta struct {
+	Source string                     `json:"_deltaSrc"`
+	Set    map[string]json.RawMessage `json:"set,omitempty"`
+	Unset  []string                   `json:"unset,omitempty"`
+}
+
+var kBodyDeltaPrefix = []byte(`{"_deltaSrc":`)
+
+func isBodyDelta(data []byte) bool {
+	return bytes.HasPrefix(data, kBodyDeltaPrefix)
+}
+
+// Encodes oldJSON as a delta against sourceJSON, the body of revision sourceRevID. Returns
+// nil if that's not possible or wouldn't be any smaller than oldJSON itself.
+func encodeBodyDelta(oldJSON, sourceJSON []byte, sourceRevID string) []byte {
+	var oldProps, sourceProps map[string]json.RawMessage
+	if json.Unmarshal(oldJSON, &oldProps) != nil || json.Unmarshal(sourceJSON, &sourceProps) != nil {
+		return nil
+	} else if oldProps == nil || sourceProps == nil {
+		return nil
+	}
+	delta := bodyDelta{Source: sourceRevID, Set: map[string]json.RawMessage{}}
+	for key, value := range oldProps {
+		if sourceValue, found := sourceProps[key]; !found || !bytes.Equal(value, sourceValue) {
+			delta.Set[key] = value
+		}
+	}
+	for key := range sourceProps {
+		if _, found := oldProps[key]; !found {
+			delta.Unset = append(delta.Unset, key)
+		}
+	}
+	deltaJSON, err := json.Marshal(delta)
+	if err != nil || len(deltaJSON) >= len(oldJSON) {
+		return nil
+	}
+	return deltaJSON
+}
+
+// Reconstructs an old revision body from a delta and the body of its source revision.
+func applyBodyDelta(deltaJSON, sourceJSON []byte) ([]byte, error) {
+	var delta bodyDelta
+	if err := json.Unmarshal(deltaJSON, &delta); err != nil {
+		return nil, err
+	}
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(sourceJSON, &props); err != nil {
+		return nil, err
+	} else if props == nil {
+		props = map[string]json.RawMessage{}
+	}
+	for _, key := range delta.Unset {
+		delete(props, key)
+	}
+	for key, value := range delta.Set {
+		props[key] = value
+	}
+	return json.Marshal(props)
+}
+
+// Key of the doc holding the full body of a revision that an old revision was delta-encoded
+// against. It's not an oldRevisionKey, so compaction doesn't delete it, and it's kept as long as
+// the old revisions delta-encoded against it.
+func deltaSourceKey(docid string, revid string) string {
+	return fmt.Sprintf("_sync:deltasrc:%s:%d:%s", docid, len(revid), revid)
+}
+
+// Stores the full body of a revision that an old revision is being delta-encoded against.
+func (db *Database) setDeltaSourceJSON(docid string, revid string, body []byte) error {
+	return db.Bucket.SetRaw(deltaSourceKey(docid, revid), kOldRevisionExpiry, body)
+}
+
+// If data is a delta-encoded old revision body, reconstructs the full body from the delta's
+// source revision (which may itself have to be reconstructed); otherwise returns data as-is.
+func (db *DatabaseContext) expandBodyDelta(doc *document, data []byte) ([]byte, error) {
+	if !isBodyDelta(data) {
+		return data, nil
+	}
+	var delta bodyDelta
+	if err := json.Unmarshal(data, &delta); err != nil {
+		return nil, err
+	}
+	sourceJSON := doc.getRevisionJSON(delta.Source)
+	if sourceJSON == nil {
+		sourceJSON, _ = db.Bucket.GetRaw(deltaSourceKey(doc.ID, delta.Source))
+	}
+	if sourceJSON == nil {
+		// Deltas stored before the source was saved separately:
+		var err error
+		if sourceJSON, err = db.getOldRevisionJSON(doc.ID, delta.Source); err != nil {
+			base.Warn("Can't reconstruct old revision of %q: missing source rev %q", doc.ID, delta.Source)
+			return nil, err
+		} else if sourceJSON, err = db.expandBodyDelta(doc, sourceJSON); err != nil {
+			return nil, err
+		}
+	}
+	return applyBodyDelta(data, sourceJSON)
+}
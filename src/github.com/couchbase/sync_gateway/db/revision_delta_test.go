@@ -0,0 +1,71 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestBodyDeltaRoundTrip(t *testing.T) {
+	padding := strings.Repeat("x", 100)
+	oldJSON := []byte(`{"a":1,"b":{"c":[1,2]},"gone":true,"padding":"` + padding + `"}`)
+	newJSON := []byte(`{"a":2,"b":{"c":[1,2]},"added":"yes","padding":"` + padding + `"}`)
+
+	delta := encodeBodyDelta(oldJSON, newJSON, "2-abc")
+	assert.True(t, delta != nil)
+	assert.True(t, isBodyDelta(delta))
+	assert.True(t, len(delta) < len(oldJSON))
+
+	rebuilt, err := applyBodyDelta(delta, newJSON)
+	assertNoError(t, err, "applyBodyDelta failed")
+	assert.DeepEquals(t, unjson(string(rebuilt)), unjson(string(oldJSON)))
+
+	// No delta if it wouldn't save space:
+	assert.True(t, encodeBodyDelta([]byte(`{"a":1}`), []byte(`{"b":2}`), "2-abc") == nil)
+	assert.False(t, isBodyDelta(oldJSON))
+}
+
+func TestOldRevisionStoredAsDelta(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	padding := strings.Repeat("x", 200)
+	rev1id, err := db.Put("doc1", Body{"n": 1, "padding": padding})
+	assertNoError(t, err, "Couldn't create doc")
+	rev2id, err := db.Put("doc1", Body{"_rev": rev1id, "n": 2, "padding": padding})
+	assertNoError(t, err, "Couldn't update doc")
+	_, err = db.Put("doc1", Body{"_rev": rev2id, "n": 3, "padding": padding})
+	assertNoError(t, err, "Couldn't update doc")
+
+	raw, err := db.Bucket.GetRaw(oldRevisionKey("doc1", rev1id))
+	assertNoError(t, err, "Old revision wasn't stored")
+	assert.True(t, isBodyDelta(raw))
+
+	// Both old revisions can be reconstructed, including rev 1 whose delta source (rev 2)
+	// is itself stored as a delta:
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "Couldn't get doc")
+	body, err := db.getRevision(doc, rev1id)
+	assertNoError(t, err, "Couldn't get rev 1")
+	assert.Equals(t, body["n"], int64(1))
+	assert.Equals(t, body["padding"], padding)
+	body, err = db.getRevision(doc, rev2id)
+	assertNoError(t, err, "Couldn't get rev 2")
+	assert.Equals(t, body["n"], int64(2))
+
+	// Rev 1 doesn't depend on rev 2's old-revision doc, which compaction may delete:
+	assert.Equals(t, db.Bucket.Delete(oldRevisionKey("doc1", rev2id)), nil)
+	body, err = db.getRevision(doc, rev1id)
+	assertNoError(t, err, "Couldn't get rev 1 without rev 2's old-revision doc")
+	assert.Equals(t, body["n"], int64(1))
+}
@@ -34,16 +34,28 @@ type RevTree map[string]*RevInfo
 // The form in which a RevTree is stored in JSON. For space-efficiency it's stored as an array of
 // rev IDs, with a parallel array of parent indexes. Ordering in the arrays doesn't matter.
 // So the parent of Revs[i] is Revs[Parents[i]] (unless Parents[i] == -1, which denotes a root.)
+// Large trees use a more compact encoding instead, with the extra fields below; see
+// revtree_compact.go.
 type revTreeList struct {
 	Revs     []string   `json:"revs"`              // The revision IDs
 	Parents  []int      `json:"parents"`           // Index of parent of each revision (-1 if root)
 	Deleted  []int      `json:"deleted,omitempty"` // Indexes of revisions that are deletions
 	Bodies   []string   `json:"bodies,omitempty"`  // JSON of each revision
 	Channels []base.Set `json:"channels"`
+
+	Encoding      int                 `json:"encoding,omitempty"`       // kCompactRevTreeEncoding, or 0
+	BranchParents [][2]int            `json:"branch_parents,omitempty"` // [index, parent index] pairs
+	BodyMap       map[string]string   `json:"body_map,omitempty"`       // Index -> JSON of revision
+	ChannelMap    map[string]base.Set `json:"channel_map,omitempty"`    // Index -> channels of revision
 }
 
 func (tree RevTree) MarshalJSON() ([]byte, error) {
 	n := len(tree)
+	if CompactRevTrees && n >= CompactRevTreeMinSize {
+		if data, err := tree.marshalCompact(); data != nil || err != nil {
+			return data, err
+		}
+	}
 	rep := revTreeList{
 		Revs:     make([]string, n),
 		Parents:  make([]int, n),
@@ -83,6 +95,8 @@ func (tree RevTree) UnmarshalJSON(inputjson []byte) (err error) {
 	err = json.Unmarshal(inputjson, &rep)
 	if err != nil {
 		return
+	} else if rep.Encoding != 0 {
+		return tree.unmarshalCompact(&rep)
 	}
 
 	for i, revid := range rep.Revs {
@@ -217,6 +231,23 @@ func (tree RevTree) findAncestorFromSet(revid string, ancestors []string) string
 	return ""
 }
 
+// Returns the leaf revisions descended from revid (including revid itself, if it's a leaf.)
+func (tree RevTree) leavesDescendedFrom(revid string) []string {
+	leaves := []string{}
+	tree.forEachLeaf(func(leaf *RevInfo) {
+		for ancestor := leaf.ID; ancestor != ""; ancestor = tree[ancestor].Parent {
+			if ancestor == revid {
+				leaves = append(leaves, leaf.ID)
+				break
+			}
+			if tree[ancestor] == nil {
+				break // history was pruned
+			}
+		}
+	})
+	return leaves
+}
+
 // Records a revision in a RevTree.
 func (tree RevTree) addRevision(info RevInfo) {
 	revid := info.ID
@@ -0,0 +1,185 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A document edited thousands of times has a revision tree that dwarfs its body. The original
+// encoding spends a parent index, an empty body and a null channel list on every revision, and
+// repeats each generation number. The compact encoding instead sorts the revisions by generation,
+// so that in a linear history each one's parent is the one before it:
+//   - "revs" lists the rev IDs in that order. A rev whose generation is one more than the
+//     previous entry's is written as just its digest.
+//   - "branch_parents" lists [index, parent index] only for revisions whose parent isn't the
+//     previous entry (parent index -1 for a root.) The first entry is a root by default.
+//   - "deleted" is as before; "body_map" and "channel_map" map the index (as a string) to the
+//     body or channels of only those revisions that have them.
+// Older versions of the gateway can't read it (they'd crash on the missing "parents" array), so
+// it's only written if CompactRevTrees is enabled, which must wait until every gateway using the
+// bucket understands it. Even then it's only used for trees with at least CompactRevTreeMinSize
+// revisions, and only if every rev ID has the usual "gen-digest" form. It's always readable.
+
+// Value of the "encoding" property of a compactly-encoded RevTree.
+const kCompactRevTreeEncoding = 2
+
+// If true, revision trees at least CompactRevTreeMinSize large are stored in the compact
+// encoding. Set from the server config's CompactRevTrees.
+var CompactRevTrees = false
+
+// Revision trees at least this large are stored in the compact encoding, if it's enabled.
+var CompactRevTreeMinSize = 100
+
+// Returns the tree in the compact encoding, or nil if it has a rev ID the encoding can't handle.
+func (tree RevTree) marshalCompact() ([]byte, error) {
+	n := len(tree)
+	revs := make(revsByGeneration, 0, n)
+	for revid, _ := range tree {
+		gen, digest := splitRevID(revid)
+		if gen == 0 {
+			return nil, nil
+		}
+		revs = append(revs, sortableRev{revid, gen, digest})
+	}
+	sort.Sort(revs)
+
+	revIndexes := make(map[string]int, n)
+	for i, rev := range revs {
+		revIndexes[rev.id] = i
+	}
+
+	rep := revTreeList{Encoding: kCompactRevTreeEncoding, Revs: make([]string, n)}
+	for i, rev := range revs {
+		info := tree[rev.id]
+		rep.Revs[i] = rev.id
+		if i > 0 && rev.gen == revs[i-1].gen+1 && !strings.Contains(rev.digest, "-") {
+			rep.Revs[i] = rev.digest
+		}
+
+		parentIndex, found := revIndexes[info.Parent]
+		if !found {
+			parentIndex = -1 // root, or parent is missing
+		}
+		if parentIndex != i-1 {
+			rep.BranchParents = append(rep.BranchParents, [2]int{i, parentIndex})
+		}
+		if info.Deleted {
+			rep.Deleted = append(rep.Deleted, i)
+		}
+		if len(info.Body) > 0 {
+			if rep.BodyMap == nil {
+				rep.BodyMap = map[string]string{}
+			}
+			rep.BodyMap[strconv.Itoa(i)] = string(info.Body)
+		}
+		if info.Channels != nil {
+			if rep.ChannelMap == nil {
+				rep.ChannelMap = map[string]base.Set{}
+			}
+			rep.ChannelMap[strconv.Itoa(i)] = info.Channels
+		}
+	}
+	return json.Marshal(rep)
+}
+
+func (tree RevTree) unmarshalCompact(rep *revTreeList) error {
+	if rep.Encoding != kCompactRevTreeEncoding {
+		return fmt.Errorf("Unknown revision tree encoding %d", rep.Encoding)
+	}
+	n := len(rep.Revs)
+	revids := make([]string, n)
+	prevGen := 0
+	for i, rev := range rep.Revs {
+		if i == 0 || strings.Contains(rev, "-") {
+			revids[i] = rev
+			prevGen, _ = splitRevID(rev)
+		} else {
+			prevGen++
+			revids[i] = strconv.Itoa(prevGen) + "-" + rev
+		}
+	}
+
+	infos := make([]RevInfo, n) // allocate all the RevInfos at once
+	for i, revid := range revids {
+		infos[i].ID = revid
+		if i > 0 {
+			infos[i].Parent = revids[i-1]
+		}
+		tree[revid] = &infos[i]
+	}
+	for _, pair := range rep.BranchParents {
+		i, parentIndex := pair[0], pair[1]
+		if i < 0 || i >= n || parentIndex >= n {
+			return fmt.Errorf("Invalid revision tree: bad parent index %v", pair)
+		}
+		infos[i].Parent = ""
+		if parentIndex >= 0 {
+			infos[i].Parent = revids[parentIndex]
+		}
+	}
+	for _, i := range rep.Deleted {
+		if i < 0 || i >= n {
+			return fmt.Errorf("Invalid revision tree: bad deleted index %d", i)
+		}
+		infos[i].Deleted = true
+	}
+	for key, body := range rep.BodyMap {
+		if i, err := strconv.Atoi(key); err != nil || i < 0 || i >= n {
+			return fmt.Errorf("Invalid revision tree: bad body index %q", key)
+		} else if len(body) > 0 {
+			infos[i].Body = []byte(body)
+		}
+	}
+	for key, channels := range rep.ChannelMap {
+		if i, err := strconv.Atoi(key); err != nil || i < 0 || i >= n {
+			return fmt.Errorf("Invalid revision tree: bad channels index %q", key)
+		} else {
+			infos[i].Channels = channels
+		}
+	}
+	return nil
+}
+
+// Like parseRevID, but much faster, since it's called for every revision in a tree.
+// Returns a generation of 0 if the revid isn't in "gen-digest" form.
+func splitRevID(revid string) (int, string) {
+	if dash := strings.Index(revid, "-"); dash > 0 {
+		if gen, err := strconv.Atoi(revid[0:dash]); err == nil && gen > 0 &&
+			strconv.Itoa(gen) == revid[0:dash] {
+			return gen, revid[dash+1:]
+		}
+	}
+	return 0, revid
+}
+
+type sortableRev struct {
+	id     string
+	gen    int
+	digest string
+}
+
+// Sorts revisions by generation, then by rev ID.
+type revsByGeneration []sortableRev
+
+func (revs revsByGeneration) Len() int      { return len(revs) }
+func (revs revsByGeneration) Swap(i, j int) { revs[i], revs[j] = revs[j], revs[i] }
+func (revs revsByGeneration) Less(i, j int) bool {
+	if revs[i].gen != revs[j].gen {
+		return revs[i].gen < revs[j].gen
+	}
+	return revs[i].id < revs[j].id
+}
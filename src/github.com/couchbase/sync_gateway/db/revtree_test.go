@@ -12,6 +12,7 @@ package db
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"runtime"
 	"sort"
 	"strings"
@@ -116,6 +117,14 @@ func TestRevTreeIsLeaf(t *testing.T) {
 	assertFalse(t, branchymap.isLeaf(""), "isLeaf failed on ''")
 }
 
+func TestRevTreeLeavesDescendedFrom(t *testing.T) {
+	leaves := branchymap.leavesDescendedFrom("1-one")
+	sort.Strings(leaves)
+	assert.DeepEquals(t, leaves, []string{"3-drei", "3-three"})
+	assert.DeepEquals(t, branchymap.leavesDescendedFrom("3-drei"), []string{"3-drei"})
+	assert.DeepEquals(t, branchymap.leavesDescendedFrom("bogus"), []string{})
+}
+
 func TestRevTreeWinningRev(t *testing.T) {
 	tempmap := branchymap.copy()
 	winner, branched, conflict := tempmap.winningRevision()
@@ -173,6 +182,74 @@ func TestPruneRevisions(t *testing.T) {
 	assert.Equals(t, tempmap["6-six"].Parent, "5-five")
 }
 
+// Returns a linear RevTree of n revisions, the last of which is a deletion in channel "ABC".
+func makeLongRevTree(n int) RevTree {
+	tree := make(RevTree, n)
+	parent := ""
+	for gen := 1; gen <= n; gen++ {
+		revid := fmt.Sprintf("%d-%032x", gen, gen*7919)
+		tree[revid] = &RevInfo{ID: revid, Parent: parent}
+		parent = revid
+	}
+	tree[parent].Deleted = true
+	tree[parent].Channels = base.SetOf("ABC")
+	return tree
+}
+
+func TestRevTreeCompactEncoding(t *testing.T) {
+	defer func(saved int) { CompactRevTreeMinSize = saved }(CompactRevTreeMinSize)
+	defer func(saved bool) { CompactRevTrees = saved }(CompactRevTrees)
+	CompactRevTrees = true
+	CompactRevTreeMinSize = 0
+
+	pruned := branchymap.copy()
+	pruned["4-vier"] = &RevInfo{ID: "4-vier", Parent: "3-drei", Deleted: true}
+	pruned.pruneRevisions(2)
+
+	for _, tree := range []RevTree{testmap, branchymap, pruned, makeLongRevTree(500)} {
+		bytes, err := json.Marshal(tree)
+		assertNoError(t, err, "Couldn't write RevTree to JSON")
+		assert.True(t, strings.Contains(string(bytes), `"encoding":2`))
+		gotmap := RevTree{}
+		assertNoError(t, json.Unmarshal(bytes, &gotmap), "Couldn't parse compact RevTree")
+		assert.DeepEquals(t, gotmap, tree)
+	}
+	bytes, _ := json.Marshal(branchymap)
+	assert.Equals(t, string(bytes),
+		`{"revs":["1-one","two","drei","3-three"],"parents":null,"channels":null,`+
+			`"encoding":2,"branch_parents":[[3,1]]}`)
+
+	// Rev IDs the compact encoding can't represent fall back to the original encoding:
+	odd := RevTree{"1-one": {ID: "1-one"}, "bogus": {ID: "bogus", Parent: "1-one"}}
+	bytes, _ = json.Marshal(odd)
+	assert.False(t, strings.Contains(string(bytes), `"encoding"`))
+
+	// Small trees use the original encoding unless configured otherwise:
+	CompactRevTreeMinSize = 100
+	bytes, _ = json.Marshal(branchymap)
+	assert.False(t, strings.Contains(string(bytes), `"encoding"`))
+
+	// The compact encoding of a long history is much smaller:
+	long := makeLongRevTree(10000)
+	original, _ := json.Marshal(long)
+	CompactRevTreeMinSize = 0
+	compact, _ := json.Marshal(long)
+	t.Logf("10k-rev tree: original encoding %d bytes, compact %d bytes", len(original), len(compact))
+	assert.True(t, len(compact) < len(original)*3/4)
+
+	// Nothing is written in the compact encoding unless it's enabled, but it's still readable:
+	CompactRevTrees = false
+	bytes, _ = json.Marshal(long)
+	assert.False(t, strings.Contains(string(bytes), `"encoding"`))
+	gotmap := RevTree{}
+	assertNoError(t, json.Unmarshal(compact, &gotmap), "Couldn't parse compact RevTree")
+	assert.DeepEquals(t, gotmap, long)
+
+	assert.True(t, json.Unmarshal([]byte(`{"revs":["1-a"],"encoding":3}`), &RevTree{}) != nil)
+	assert.True(t, json.Unmarshal([]byte(`{"revs":["1-a"],"encoding":2,"branch_parents":[[5,0]]}`),
+		&RevTree{}) != nil)
+}
+
 func TestParseRevisions(t *testing.T) {
 	type testCase struct {
 		json string
@@ -203,6 +280,50 @@ func TestParseRevisions(t *testing.T) {
 	}
 }
 
+//////// BENCHMARKS:
+
+func benchmarkRevTreeUnmarshal(b *testing.B, compact bool) {
+	defer func(saved int) { CompactRevTreeMinSize = saved }(CompactRevTreeMinSize)
+	defer func(saved bool) { CompactRevTrees = saved }(CompactRevTrees)
+	CompactRevTrees = true
+	if compact {
+		CompactRevTreeMinSize = 0
+	} else {
+		CompactRevTreeMinSize = math.MaxInt32
+	}
+	bytes, _ := json.Marshal(makeLongRevTree(10000))
+	b.SetBytes(int64(len(bytes)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := RevTree{}
+		if err := json.Unmarshal(bytes, &tree); err != nil {
+			b.Fatalf("Unmarshal failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkRevTreeUnmarshal10kOriginal(b *testing.B) {
+	benchmarkRevTreeUnmarshal(b, false)
+}
+
+func BenchmarkRevTreeUnmarshal10kCompact(b *testing.B) {
+	benchmarkRevTreeUnmarshal(b, true)
+}
+
+func BenchmarkRevTreeMarshal10kCompact(b *testing.B) {
+	defer func(saved int) { CompactRevTreeMinSize = saved }(CompactRevTreeMinSize)
+	defer func(saved bool) { CompactRevTrees = saved }(CompactRevTrees)
+	CompactRevTrees = true
+	CompactRevTreeMinSize = 0
+	tree := makeLongRevTree(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(tree); err != nil {
+			b.Fatalf("Marshal failed: %v", err)
+		}
+	}
+}
+
 //////// HELPERS:
 
 func assertFailed(t *testing.T, message string) {
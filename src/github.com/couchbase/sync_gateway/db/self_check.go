@@ -0,0 +1,143 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/walrus"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// When a database is loaded, its bucket is checked for the design docs and metadata the gateway
+// depends on, so that problems (like a design doc edited by hand, or a corrupted metadata doc)
+// show up in the log and in GET /db/_status right away instead of as a failed query later.
+
+// The result of one consistency check.
+type SelfCheckResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// The results of a database's consistency checks.
+type SelfCheckReport struct {
+	OK        bool              `json:"ok"`
+	CheckedAt time.Time         `json:"checked_at"`
+	Checks    []SelfCheckResult `json:"checks"`
+}
+
+type selfCheckState struct {
+	lock   sync.Mutex
+	report *SelfCheckReport
+}
+
+// Bucket metadata docs that have to contain valid JSON if they exist.
+var kMetadataDocKeys = []string{kSyncDataKey, kDocShardsKey, kAttachmentGCKey, kDbInfoKey}
+
+// Checks the bucket's design docs and metadata, logs any problems found, and returns a report.
+// The report is also kept for LastSelfCheck.
+func (context *DatabaseContext) RunSelfCheck() *SelfCheckReport {
+	report := &SelfCheckReport{OK: true, CheckedAt: time.Now()}
+	addResult := func(name string, err error) {
+		result := SelfCheckResult{Name: name, OK: (err == nil)}
+		if err != nil {
+			result.Detail = err.Error()
+			report.OK = false
+			base.Warn("Database %q: self-check %q FAILED: %v", context.Name, name, err)
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	designDocs := syncDesignDocs()
+	names := make([]string, 0, len(designDocs))
+	for name := range designDocs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addResult("design_doc:"+name, context.checkDesignDoc(name, designDocs[name]))
+	}
+	addResult("sequence", context.checkSequenceDoc())
+	for _, key := range kMetadataDocKeys {
+		addResult("metadata:"+key, context.checkMetadataDoc(key))
+	}
+
+	context.selfCheck.lock.Lock()
+	context.selfCheck.report = report
+	context.selfCheck.lock.Unlock()
+	return report
+}
+
+// Returns the report of the most recent self-check, running one if necessary.
+func (context *DatabaseContext) LastSelfCheck() *SelfCheckReport {
+	context.selfCheck.lock.Lock()
+	report := context.selfCheck.report
+	context.selfCheck.lock.Unlock()
+	if report == nil {
+		report = context.RunSelfCheck()
+	}
+	return report
+}
+
+// Verifies that a design doc exists and that its views have the expected definitions.
+func (context *DatabaseContext) checkDesignDoc(name string, expected walrus.DesignDoc) error {
+	var actual walrus.DesignDoc
+	if err := context.Bucket.GetDDoc(name, &actual); err != nil {
+		return fmt.Errorf("Can't read design doc: %v", err)
+	}
+	var problems []string
+	for viewName, view := range expected.Views {
+		if actualView, found := actual.Views[viewName]; !found {
+			problems = append(problems, fmt.Sprintf("view %q is missing", viewName))
+		} else if actualView.Map != view.Map || actualView.Reduce != view.Reduce {
+			problems = append(problems, fmt.Sprintf("view %q has the wrong definition", viewName))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Verifies that the sequence counter exists and is a number.
+func (context *DatabaseContext) checkSequenceDoc() error {
+	data, err := context.Bucket.GetRaw(kSequenceKey)
+	if err != nil {
+		return fmt.Errorf("Can't read sequence counter: %v", err)
+	}
+	if _, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return fmt.Errorf("Sequence counter isn't a number: %q", data)
+	}
+	return nil
+}
+
+// Verifies that a metadata doc, if it exists, contains valid JSON.
+func (context *DatabaseContext) checkMetadataDoc(key string) error {
+	data, err := context.Bucket.GetRaw(key)
+	if base.IsDocNotFoundError(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Can't read: %v", err)
+	}
+	var value map[string]interface{}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("Invalid JSON: %v", err)
+	}
+	return nil
+}
@@ -16,22 +16,39 @@ import (
 )
 
 type sequenceAllocator struct {
-	bucket base.Bucket // Bucket whose counter to use
-	mutex  sync.Mutex  // Makes this object thread-safe
-	last   uint64      // Last sequence # assigned
-	max    uint64      // Max sequence # reserved
+	bucket     base.Bucket                 // Bucket whose counter to use
+	mutex      sync.Mutex                  // Makes this object thread-safe
+	last       uint64                      // Last sequence # assigned
+	max        uint64                      // Max sequence # reserved
+	onRollback func(oldSeq, newSeq uint64) // Called (asynchronously) if the counter goes backwards
 }
 
+// Key of the bucket's sequence counter.
+const kSequenceKey = "_sync:seq"
+
 func newSequenceAllocator(bucket base.Bucket) (*sequenceAllocator, error) {
 	s := &sequenceAllocator{bucket: bucket}
 	return s, s.reserveSequences(0) // just reads latest sequence from bucket
 }
 
 func (s *sequenceAllocator) lastSequence() (uint64, error) {
+	s.mutex.Lock()
+	prevMax := s.max
+	s.mutex.Unlock()
+
 	dbExpvars.Add("sequence_gets", 1)
-	last, err := s.bucket.Incr("_sync:seq", 0, 0, 0)
+	last, err := s.bucket.Incr(kSequenceKey, 0, 0, 0)
 	if err != nil {
 		base.Warn("Error from Incr in lastSequence(): %v", err)
+	} else if last < prevMax {
+		// The counter is lower than a value we'd already reserved before reading it:
+		s.mutex.Lock()
+		if s.max == prevMax {
+			s.last = last // Discard the remaining reserved sequences; they're from the old timeline
+			s.max = last
+			s.rolledBack(prevMax, last)
+		}
+		s.mutex.Unlock()
 	}
 	return last, err
 }
@@ -54,11 +71,14 @@ func (s *sequenceAllocator) _reserveSequences(numToReserve uint64) error {
 		//OPT: Could remember multiple discontiguous ranges of free sequences
 	}
 	dbExpvars.Add("sequence_reserves", 1)
-	max, err := s.bucket.Incr("_sync:seq", numToReserve, numToReserve, 0)
+	max, err := s.bucket.Incr(kSequenceKey, numToReserve, numToReserve, 0)
 	if err != nil {
 		base.Warn("Error from Incr in _reserveSequences(%d): %v", numToReserve, err)
 		return err
 	}
+	if max < s.max+numToReserve {
+		s.rolledBack(s.max, max-numToReserve)
+	}
 	s.max = max
 	s.last = max - numToReserve
 	return nil
@@ -69,3 +89,13 @@ func (s *sequenceAllocator) reserveSequences(numToReserve uint64) error {
 	defer s.mutex.Unlock()
 	return s._reserveSequences(numToReserve)
 }
+
+// The bucket's sequence counter has gone backwards, which happens if the bucket is flushed or
+// rolled back. Sequences may now be reused, so this has to be reported to the database.
+func (s *sequenceAllocator) rolledBack(oldSeq, newSeq uint64) {
+	base.Warn("Sequence counter of bucket %q went backwards, from %d to %d!",
+		s.bucket.GetName(), oldSeq, newSeq)
+	if s.onRollback != nil {
+		go s.onRollback(oldSeq, newSeq)
+	}
+}
@@ -44,7 +44,13 @@ func (s SequenceID) String() string {
 	}
 }
 
-func ParseSequenceID(str string) (s SequenceID, err error) {
+// Parses a sequence as given by a client, which may be a versioned SequenceToken.
+func ParseSequenceID(str string) (SequenceID, error) {
+	token, err := ParseSequenceToken(str)
+	return token.Seq, err
+}
+
+func parseUnversionedSequenceID(str string) (s SequenceID, err error) {
 	if str == "" {
 		return SequenceID{}, nil
 	}
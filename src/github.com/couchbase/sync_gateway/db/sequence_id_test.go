@@ -85,3 +85,36 @@ func TestCompareSequenceIDs(t *testing.T) {
 		}
 	}
 }
+
+func TestSequenceToken(t *testing.T) {
+	token := NewSequenceToken(SequenceID{LowSeq: 12, TriggeredBy: 5678, Seq: 1234})
+	assert.Equals(t, token.String(), "v1.12:5678:1234")
+	asJson, err := json.Marshal(token)
+	assertNoError(t, err, "Marshal failed")
+	assert.Equals(t, string(asJson), `"v1.12:5678:1234"`)
+
+	var token2 SequenceToken
+	assertNoError(t, json.Unmarshal(asJson, &token2), "Unmarshal failed")
+	assert.Equals(t, token2, token)
+
+	// Unversioned sequences, e.g. stored in old checkpoints, are version 1:
+	for _, old := range []string{`1234`, `"1234"`, `"5678:1234"`} {
+		var oldToken SequenceToken
+		assertNoError(t, json.Unmarshal([]byte(old), &oldToken), "Unmarshal failed")
+		assert.Equals(t, oldToken.Version, 1)
+	}
+	seq, err := ParseSequenceID("v1.5678:1234")
+	assertNoError(t, err, "ParseSequenceID failed")
+	assert.Equals(t, seq, SequenceID{TriggeredBy: 5678, Seq: 1234})
+	seq, err = ParseSequenceID("1234")
+	assertNoError(t, err, "ParseSequenceID failed")
+	assert.Equals(t, seq, SequenceID{Seq: 1234})
+
+	// Versions from the future, and garbage, are rejected:
+	for _, bad := range []string{"v2.1234", "v1", "vx.1234"} {
+		_, err = ParseSequenceToken(bad)
+		assertHTTPError(t, err, 400)
+	}
+	_, err = ParseSequenceToken("v1.x")
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Clients store the last_seq of a _changes response, typically in a replication checkpoint, and
+// pass it back later as 'since'. To keep those stored sequences interpretable if the sequence
+// format changes (e.g. to a vector clock once gateways are clustered), last_seq is a versioned
+// token, "v1.<sequence>". A sequence without a version prefix predates tokens, and is treated as
+// version 1. Gateways that predate tokens reject them, so while any of those share the bucket,
+// the database's "sequence_tokens" config property should be false, which makes last_seq a plain
+// sequence again. Clients should treat sequences and tokens as opaque.
+
+// Version of the current sequence format.
+const SequenceTokenVersion = 1
+
+const kSequenceTokenPrefix = "v"
+
+// A versioned sequence, as given to clients to store.
+type SequenceToken struct {
+	Version int        // Format version of the sequence
+	Seq     SequenceID // The sequence itself (for version 1)
+}
+
+// Returns a token in the current format for a sequence.
+func NewSequenceToken(seq SequenceID) SequenceToken {
+	return SequenceToken{Version: SequenceTokenVersion, Seq: seq}
+}
+
+func (t SequenceToken) String() string {
+	return kSequenceTokenPrefix + strconv.Itoa(t.Version) + "." + t.Seq.String()
+}
+
+// Parses a sequence token, or an unversioned sequence (which is treated as version 1.)
+func ParseSequenceToken(str string) (t SequenceToken, err error) {
+	t.Version = 1
+	if strings.HasPrefix(str, kSequenceTokenPrefix) {
+		dot := strings.Index(str, ".")
+		if dot < 0 {
+			return t, base.HTTPErrorf(400, "Invalid sequence")
+		}
+		if t.Version, err = strconv.Atoi(str[len(kSequenceTokenPrefix):dot]); err != nil {
+			return t, base.HTTPErrorf(400, "Invalid sequence")
+		} else if t.Version != SequenceTokenVersion {
+			return t, base.HTTPErrorf(400, "Unsupported sequence version %d", t.Version)
+		}
+		str = str[dot+1:]
+	}
+	t.Seq, err = parseUnversionedSequenceID(str)
+	return t, err
+}
+
+func (t SequenceToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *SequenceToken) UnmarshalJSON(data []byte) error {
+	var seq SequenceID
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		token, err := ParseSequenceToken(str)
+		*t = token
+		return err
+	} else if err := seq.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*t = SequenceToken{Version: 1, Seq: seq}
+	return nil
+}
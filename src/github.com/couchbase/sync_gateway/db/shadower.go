@@ -151,6 +151,9 @@ func (s *Shadower) PushRevision(doc *document) {
 		err = s.bucket.Delete(doc.ID)
 	} else {
 		base.LogTo("Shadow", "Pushing %q, rev %q", doc.ID, doc.CurrentRev)
+		if err = s.context.loadExternalBody(doc); err != nil {
+			return
+		}
 		body := doc.getRevision(doc.CurrentRev)
 		if body == nil {
 			base.Warn("Can't get rev %q.%q to push to external bucket", doc.ID, doc.CurrentRev)
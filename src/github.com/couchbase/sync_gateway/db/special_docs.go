@@ -36,6 +36,8 @@ func (db *Database) putSpecial(doctype string, docid string, matchRev string, bo
 	key := db.realSpecialDocID(doctype, docid)
 	if key == "" {
 		return "", base.HTTPErrorf(400, "Invalid doc ID")
+	} else if err := db.checkGuestCanWrite(); err != nil {
+		return "", err
 	}
 	var revid string
 	err := db.Bucket.Update(key, 0, func(value []byte) ([]byte, error) {
@@ -86,6 +88,26 @@ func (db *Database) realSpecialDocID(doctype string, docid string) string {
 	return "_sync:" + doctype + ":" + docid
 }
 
+// Key prefix of _local docs. Being under "_sync:" keeps them out of _all_docs and _changes.
+const kLocalDocKeyPrefix = "_sync:local:"
+
+// Returns the IDs (without the "_local/" prefix) and revisions of all _local docs, in ID order.
+// This is for debugging; replicators only ever access local docs by ID.
+func (db *Database) AllLocalDocIDs() ([]IDAndRev, error) {
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewLocalDocs, Body{"stale": false})
+	if err != nil {
+		base.Warn("local_docs got error: %v", err)
+		return nil, err
+	}
+	docs := make([]IDAndRev, 0, len(vres.Rows))
+	for _, row := range vres.Rows {
+		docid, _ := row.Key.(string)
+		revid, _ := row.Value.(string)
+		docs = append(docs, IDAndRev{DocID: docid, RevID: revid})
+	}
+	return docs, nil
+}
+
 func stripSpecialSpecialProperties(body Body) Body {
 	stripped := Body{}
 	for key, value := range body {
@@ -0,0 +1,197 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A database can keep a history of its key stats, so that trends (write volume, number of
+// clients, cache usage) can be seen without standing up an external metrics system. A snapshot
+// is taken periodically and stored in the bucket; each UTC day's snapshots are kept together in
+// one document, "_sync:stats:YYYY-MM-DD", and days older than the retention period are deleted.
+// Every gateway node serving the database adds its own snapshots, tagged with its node ID, so the
+// interval has a lower limit to keep a day's document from growing too large.
+
+const kStatsHistoryKeyPrefix = kSyncKeyPrefix + "stats:"
+
+const kStatsHistoryDayFormat = "2006-01-02"
+
+// Longest time range GetStatsHistory will look through.
+const kMaxStatsHistoryRange = 366 * 24 * time.Hour
+
+// Default values for StartStatsHistory.
+const (
+	DefaultStatsHistoryInterval      = 5 * time.Minute
+	DefaultStatsHistoryRetentionDays = 30
+)
+
+// Shortest interval StartStatsHistory will record snapshots at.
+const MinStatsHistoryInterval = time.Minute
+
+// Identifies this gateway node in the stats history. Defaults to the host name.
+var StatsNodeID = defaultStatsNodeID()
+
+func defaultStatsNodeID() string {
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "unknown"
+}
+
+// Stats of a database at a moment in time.
+type StatsSnapshot struct {
+	Time         time.Time        `json:"time"`
+	Node         string           `json:"node"`          // StatsNodeID of the node that took it
+	LastSequence uint64           `json:"last_sequence"` // Last sequence allocated; its rise is the write volume
+	ChangesFeeds uint32           `json:"changes_feeds"` // Number of _changes feeds open
+	Cache        ChangeCacheStats `json:"cache"`         // Utilization of the changes cache
+}
+
+// The contents of one day's stats history document.
+type statsHistoryDay struct {
+	Snapshots []StatsSnapshot `json:"snapshots"`
+}
+
+type statsHistoryState struct {
+	lock          sync.Mutex
+	retentionDays int
+	lastPurgedDay string
+	stop          chan struct{}
+}
+
+// Starts recording a stats snapshot at every interval (at least MinStatsHistoryInterval),
+// keeping them for retentionDays days.
+func (context *DatabaseContext) StartStatsHistory(interval time.Duration, retentionDays int) {
+	if interval < MinStatsHistoryInterval {
+		interval = MinStatsHistoryInterval
+	}
+	context.StopStatsHistory()
+	state := &context.statsHistory
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.retentionDays = retentionDays
+	stop := make(chan struct{})
+	state.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := context.RecordStatsSnapshot(); err != nil {
+					base.Warn("Couldn't record stats of db %q: %v", context.Name, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops recording stats snapshots, if StartStatsHistory was called.
+func (context *DatabaseContext) StopStatsHistory() {
+	state := &context.statsHistory
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.stop != nil {
+		close(state.stop)
+		state.stop = nil
+	}
+}
+
+// Returns the database's current stats.
+func (context *DatabaseContext) StatsSnapshot() StatsSnapshot {
+	lastSeq, _ := context.LastSequence()
+	return StatsSnapshot{
+		Time:         time.Now().UTC(),
+		Node:         StatsNodeID,
+		LastSequence: lastSeq,
+		ChangesFeeds: context.ChangesClientStats.CurrentCount(),
+		Cache:        context.ChangeCacheStats(),
+	}
+}
+
+// Takes a snapshot of the database's stats and adds it to the stored history. Also deletes the
+// history from before the retention period, the first time it's called each day.
+func (context *DatabaseContext) RecordStatsSnapshot() (*StatsSnapshot, error) {
+	snapshot := context.StatsSnapshot()
+	day := snapshot.Time.Format(kStatsHistoryDayFormat)
+	err := context.Bucket.Update(kStatsHistoryKeyPrefix+day, 0, func(currentValue []byte) ([]byte, error) {
+		var history statsHistoryDay
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &history); err != nil {
+				base.Warn("Replacing unreadable stats history %q: %v", day, err)
+			}
+		}
+		history.Snapshots = append(history.Snapshots, snapshot)
+		return json.Marshal(history)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	state := &context.statsHistory
+	state.lock.Lock()
+	retentionDays := state.retentionDays
+	purge := retentionDays > 0 && state.lastPurgedDay != day
+	state.lastPurgedDay = day
+	state.lock.Unlock()
+	if purge {
+		context.purgeStatsHistory(snapshot.Time, retentionDays)
+	}
+	return &snapshot, nil
+}
+
+// Deletes the stats history of the days before the retention period. Since the gateway may not
+// have been running every day, it looks back a while further, too.
+func (context *DatabaseContext) purgeStatsHistory(now time.Time, retentionDays int) {
+	for i := retentionDays + 1; i <= 2*retentionDays+7; i++ {
+		day := now.AddDate(0, 0, -i).Format(kStatsHistoryDayFormat)
+		if err := context.Bucket.Delete(kStatsHistoryKeyPrefix + day); err != nil && !base.IsDocNotFoundError(err) {
+			base.Warn("Couldn't delete stats history %q of db %q: %v", day, context.Name, err)
+		}
+	}
+}
+
+// Returns the recorded stats snapshots taken between start and end (inclusive), oldest first.
+func (context *DatabaseContext) GetStatsHistory(start, end time.Time) ([]StatsSnapshot, error) {
+	if end.Before(start) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "History range ends before it starts")
+	} else if end.Sub(start) > kMaxStatsHistoryRange {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "History range is too long")
+	}
+	snapshots := []StatsSnapshot{}
+	lastDay := end.UTC().Format(kStatsHistoryDayFormat)
+	for t := start.UTC(); ; t = t.AddDate(0, 0, 1) {
+		day := t.Format(kStatsHistoryDayFormat)
+		var history statsHistoryDay
+		if err := context.Bucket.Get(kStatsHistoryKeyPrefix+day, &history); err != nil {
+			if !base.IsDocNotFoundError(err) {
+				return nil, err
+			}
+		}
+		for _, snapshot := range history.Snapshots {
+			if !snapshot.Time.Before(start) && !snapshot.Time.After(end) {
+				snapshots = append(snapshots, snapshot)
+			}
+		}
+		if day >= lastDay {
+			break
+		}
+	}
+	return snapshots, nil
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestStatsHistory(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.statsHistory.retentionDays = 30
+
+	// An old day's history that's past the retention period:
+	old := statsHistoryDay{Snapshots: []StatsSnapshot{{Time: time.Now().UTC().AddDate(0, 0, -40)}}}
+	oldKey := kStatsHistoryKeyPrefix + old.Snapshots[0].Time.Format(kStatsHistoryDayFormat)
+	assertNoError(t, db.Bucket.Set(oldKey, 0, old), "Set failed")
+
+	start := time.Now().UTC()
+	first, err := db.RecordStatsSnapshot()
+	assertNoError(t, err, "RecordStatsSnapshot failed")
+	_, err = db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Put failed")
+	second, err := db.RecordStatsSnapshot()
+	assertNoError(t, err, "RecordStatsSnapshot failed")
+	assert.True(t, second.LastSequence > first.LastSequence)
+
+	snapshots, err := db.GetStatsHistory(start, time.Now())
+	assertNoError(t, err, "GetStatsHistory failed")
+	assert.Equals(t, len(snapshots), 2)
+	assert.Equals(t, snapshots[0].LastSequence, first.LastSequence)
+	assert.Equals(t, snapshots[1].LastSequence, second.LastSequence)
+	assert.Equals(t, snapshots[0].Node, StatsNodeID)
+
+	// The old history was purged:
+	var raw interface{}
+	assert.True(t, db.Bucket.Get(oldKey, &raw) != nil)
+	snapshots, err = db.GetStatsHistory(start.AddDate(0, 0, -41), start.AddDate(0, 0, -39))
+	assertNoError(t, err, "GetStatsHistory failed")
+	assert.Equals(t, len(snapshots), 0)
+
+	_, err = db.GetStatsHistory(start, start.Add(-time.Hour))
+	assertHTTPError(t, err, 400)
+	_, err = db.GetStatsHistory(start.AddDate(-2, 0, 0), start)
+	assertHTTPError(t, err, 400)
+}
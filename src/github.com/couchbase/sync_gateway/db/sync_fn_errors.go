@@ -0,0 +1,43 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Policies for a document whose sync function call fails: by throwing an exception, timing out,
+// or being given too large a document. (Rejections by the function itself always fail the write.)
+const (
+	SyncFnErrorsReject = "reject" // The write fails (the default)
+	SyncFnErrorsAccept = "accept" // The doc is saved, assigned only to SyncFnErrorChannel if any
+)
+
+// Sets the policy for sync function errors, and the channel that docs accepted by the "accept"
+// policy are assigned to ("" for none, i.e. only admins can see them.)
+func (context *DatabaseContext) SetSyncFnErrorPolicy(policy string, errorChannel string) error {
+	switch policy {
+	case "", SyncFnErrorsReject:
+		policy = SyncFnErrorsReject
+	case SyncFnErrorsAccept:
+	default:
+		return fmt.Errorf("Unknown sync function error policy %q", policy)
+	}
+	if errorChannel != "" {
+		if err := channels.ValidateChannelName(errorChannel); err != nil {
+			return err
+		}
+	}
+	context.SyncFnOnError = policy
+	context.SyncFnErrorChannel = errorChannel
+	return nil
+}
@@ -0,0 +1,100 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Changing the sync function is risky, so the bucket's sync-fn document keeps a history of the
+// recent versions, with when and by whom each was set, and a previous one can be restored.
+// A restored version stays current, on every node, until the config's function changes: it's
+// not replaced by the (unchanged) config's function when a gateway restarts.
+
+// Max number of versions of the sync function kept in its history.
+var MaxSyncFunctionHistory = 20
+
+// One version of a database's sync function.
+type SyncFunctionVersion struct {
+	Version   int        `json:"version"`              // Starts at 1 and increases with each change
+	Sync      string     `json:"sync"`                 // The function's source code
+	ChangedAt *time.Time `json:"changed_at,omitempty"` // Missing if set before history was kept
+	ChangedBy string     `json:"changed_by,omitempty"` // Who or what set it, e.g. "config"
+}
+
+// Format of the sync-fn document. (Sync is the current function, stored under its original
+// key so older gateways can still read it.)
+type syncFunctionData struct {
+	Sync       string
+	History    []SyncFunctionVersion `json:"history,omitempty"`     // Oldest first; last is current
+	ConfigSync *string               `json:"config_sync,omitempty"` // Function last set by the config
+	RolledBack bool                  `json:"rolled_back,omitempty"` // Rolled back since ConfigSync was set?
+}
+
+// Appends a new current version to the history, dropping the oldest ones if it's too long.
+func (data *syncFunctionData) addVersion(syncFun string, changedBy string) {
+	if len(data.History) == 0 && data.Sync != "" {
+		// Function was saved before history was kept; record it as the first version:
+		data.History = []SyncFunctionVersion{{Version: 1, Sync: data.Sync}}
+	}
+	version := 1
+	if n := len(data.History); n > 0 {
+		version = data.History[n-1].Version + 1
+	}
+	now := time.Now()
+	data.History = append(data.History, SyncFunctionVersion{
+		Version:   version,
+		Sync:      syncFun,
+		ChangedAt: &now,
+		ChangedBy: changedBy,
+	})
+	if extra := len(data.History) - MaxSyncFunctionHistory; extra > 0 {
+		data.History = data.History[extra:]
+	}
+	data.Sync = syncFun
+}
+
+// Returns the saved versions of the sync function, oldest first; the last is the current one.
+func (context *DatabaseContext) SyncFunctionHistory() ([]SyncFunctionVersion, error) {
+	var data syncFunctionData
+	raw, err := context.Bucket.GetRaw(kSyncDataKey)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return []SyncFunctionVersion{}, nil
+		}
+		return nil, err
+	} else if err = json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	if len(data.History) == 0 && data.Sync != "" {
+		return []SyncFunctionVersion{{Version: 1, Sync: data.Sync}}, nil
+	}
+	return data.History, nil
+}
+
+// Makes a previous version of the sync function current again, as a new version. Returns 404
+// if that version isn't in the history. The caller will probably want to resync afterwards.
+func (context *DatabaseContext) RollBackSyncFun(version int, changedBy string) (changed bool, err error) {
+	history, err := context.SyncFunctionHistory()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range history {
+		if v.Version == version {
+			base.Logf("Database %q: rolling sync function back to version %d", context.Name, version)
+			return context.updateSyncFun(v.Sync, changedBy, syncFunRollBack)
+		}
+	}
+	return false, base.HTTPErrorf(http.StatusNotFound, "No version %d of the sync function", version)
+}
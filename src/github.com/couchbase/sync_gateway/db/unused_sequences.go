@@ -0,0 +1,53 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// If a document update fails after a sequence has been allocated for it -- most often because the
+// sync function rejected it on a retry -- no document will ever carry that sequence. Every
+// gateway node's change cache would then wait for it until it gave up on it as skipped, holding
+// back later changes meanwhile. So the sequence is released, by writing a short-lived marker doc
+// whose arrival on the feed tells each change cache the sequence is unused.
+
+const kUnusedSeqKeyPrefix = kSyncKeyPrefix + "unusedSeq:"
+
+// How long unused-sequence markers stay in the bucket (seconds.)
+const kUnusedSeqExpiry = 60
+
+// Marks sequences as unused, so change caches don't wait for them.
+func (context *DatabaseContext) releaseSequences(sequences []uint64) {
+	for _, seq := range sequences {
+		context.LogTo("Cache", "Releasing unused sequence #%d", seq)
+		key := kUnusedSeqKeyPrefix + strconv.FormatUint(seq, 10)
+		if err := context.Bucket.SetRaw(key, kUnusedSeqExpiry, []byte("{}")); err != nil {
+			base.Warn("Couldn't release unused sequence #%d: %v", seq, err)
+		}
+	}
+	dbExpvars.Add("sequences_released", int64(len(sequences)))
+}
+
+// Called by the change cache when an unused-sequence marker arrives.
+func (c *changeCache) unusedSequenceMarker(key string) {
+	seq, err := strconv.ParseUint(key[len(kUnusedSeqKeyPrefix):], 10, 64)
+	if err != nil {
+		base.Warn("changeCache: Invalid unused sequence marker %q", key)
+		return
+	} else if seq <= c.initialSequence {
+		return
+	}
+	base.LogTo("Cache", "Received unused #%d", seq)
+	c.processEntry(&LogEntry{Sequence: seq, TimeReceived: time.Now()})
+}
@@ -115,6 +115,14 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		updatedChannels = ch.TimedSet{}
 	}
 	if !updatedChannels.Equals(newInfo.ExplicitChannels) {
+		// Only channels that are being added have to obey the length limit:
+		for channel := range newInfo.ExplicitChannels {
+			if _, found := updatedChannels[channel]; !found {
+				if err = ch.ValidateNewChannelName(channel); err != nil {
+					return
+				}
+			}
+		}
 		changed = true
 	}
 
@@ -168,3 +176,126 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 	}
 	return
 }
+
+// One operation of a principal patch (see PatchPrincipal.) It's modeled on JSON Patch, but
+// operates on sets: "add" or "remove" a channel or role name (or an array of them) from the
+// "/admin_channels" or "/admin_roles" property.
+type PrincipalPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// Checks that a patch op is valid, returning the names it adds or removes.
+func (op PrincipalPatchOp) names(isUser bool) ([]string, error) {
+	if op.Op != "add" && op.Op != "remove" {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid patch op %q", op.Op)
+	}
+	if op.Path != "/admin_channels" && !(isUser && op.Path == "/admin_roles") {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid patch path %q", op.Path)
+	}
+	var names []string
+	switch value := op.Value.(type) {
+	case string:
+		names = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			name, ok := item.(string)
+			if !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Patch values must be strings")
+			}
+			names = append(names, name)
+		}
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Patch value must be a string or array")
+	}
+	return names, nil
+}
+
+// Applies a list of add/remove operations to a user's or role's explicit channels (and a user's
+// explicit roles.) All the operations are applied in a single atomic update of the principal, so
+// either they all take effect or none do. Returns false if the principal already matched.
+func (dbc *DatabaseContext) PatchPrincipal(name string, isUser bool, ops []PrincipalPatchOp) (changed bool, err error) {
+	opNames := make([][]string, len(ops))
+	for i, op := range ops {
+		if opNames[i], err = op.names(isUser); err != nil {
+			return false, err
+		}
+	}
+
+	var nextSeq uint64
+	err = dbc.Authenticator().ModifyPrincipal(name, isUser, func(princ auth.Principal) (bool, error) {
+		changed = false
+		explicitChannels := princ.ExplicitChannels()
+		if explicitChannels == nil {
+			explicitChannels = ch.TimedSet{}
+		}
+		var user auth.User
+		explicitRoles := ch.TimedSet{}
+		if isUser {
+			user = princ.(auth.User)
+			if user.ExplicitRoles() != nil {
+				explicitRoles = user.ExplicitRoles()
+			}
+		}
+
+		channels := map[string]bool{}
+		for _, channel := range explicitChannels.AllChannels() {
+			channels[channel] = true
+		}
+		roles := map[string]bool{}
+		for _, role := range explicitRoles.AllChannels() {
+			roles[role] = true
+		}
+		for i, op := range ops {
+			target := channels
+			if op.Path == "/admin_roles" {
+				target = roles
+			}
+			for _, item := range opNames[i] {
+				if op.Op == "add" {
+					if op.Path == "/admin_channels" && !target[item] {
+						if err := ch.ValidateNewChannelName(item); err != nil {
+							return false, err
+						}
+					}
+					target[item] = true
+				} else {
+					delete(target, item)
+				}
+			}
+		}
+
+		newChannels := base.SetFromArray(setKeys(channels))
+		newRoles := base.SetFromArray(setKeys(roles))
+		if explicitChannels.Equals(newChannels) && explicitRoles.Equals(newRoles) {
+			return false, nil
+		}
+
+		// Allocate a sequence only once, even if the update has to be retried:
+		if nextSeq == 0 {
+			var err error
+			if nextSeq, err = dbc.sequences.nextSequence(); err != nil {
+				return false, err
+			}
+		}
+		princ.SetSequence(nextSeq)
+		if explicitChannels.UpdateAtSequence(newChannels, nextSeq) {
+			princ.SetExplicitChannels(explicitChannels)
+		}
+		if isUser && explicitRoles.UpdateAtSequence(newRoles, nextSeq) {
+			user.SetExplicitRoles(explicitRoles)
+		}
+		changed = true
+		return true, nil
+	})
+	return changed, err
+}
+
+func setKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys
+}
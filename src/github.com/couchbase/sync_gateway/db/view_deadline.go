@@ -0,0 +1,101 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Default value of DatabaseContext.ViewQueryTimeout.
+const DefaultViewQueryTimeout = 75 * time.Second
+
+// Max number of timed-out view queries per database that may still be running in the background.
+// Past that, queries fail right away instead of piling more load onto the slow index.
+var MaxAbandonedViewQueries int32 = 10
+
+// Returns the deadline for a view query starting now, i.e. the database's ViewQueryTimeout from
+// now. (It doesn't depend on the client's own timeout, such as a longpoll's, which can be much
+// longer or zero.) A zero time means there's no deadline.
+func (context *DatabaseContext) viewQueryDeadline() time.Time {
+	if context.ViewQueryTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(context.ViewQueryTimeout)
+}
+
+// Queries a view like Bucket.ViewCustom, but gives up and returns a 503 error if the query
+// hasn't finished by the deadline (if it's nonzero), so a slow index can't tie up the handler
+// indefinitely. The bucket API can't cancel a query, so an abandoned one keeps running in the
+// background until it finishes, and its result is discarded; but at most MaxAbandonedViewQueries
+// can be running at once, after which queries fail immediately until some of those finish.
+func (context *DatabaseContext) viewCustomWithDeadline(ddoc, name string, params Body, result interface{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		return context.Bucket.ViewCustom(ddoc, name, params, result)
+	}
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return viewTimeoutError(ddoc, name)
+	} else if atomic.LoadInt32(&context.abandonedViews) >= MaxAbandonedViewQueries {
+		dbExpvars.Add("view_query_timeouts", 1)
+		return viewTimeoutError(ddoc, name)
+	}
+
+	// Query into a separate result, so an abandoned query can't write into the caller's:
+	resultValue := reflect.New(reflect.TypeOf(result).Elem())
+	done := make(chan error, 1)
+	var state int32 // viewQueryRunning, viewQueryFinished or viewQueryAbandoned
+	go func() {
+		err := context.Bucket.ViewCustom(ddoc, name, params, resultValue.Interface())
+		if !atomic.CompareAndSwapInt32(&state, viewQueryRunning, viewQueryFinished) {
+			atomic.AddInt32(&context.abandonedViews, -1) // the caller gave up on it
+		}
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err == nil {
+			reflect.ValueOf(result).Elem().Set(resultValue.Elem())
+		}
+		return err
+	case <-timer.C:
+		if atomic.CompareAndSwapInt32(&state, viewQueryRunning, viewQueryAbandoned) {
+			atomic.AddInt32(&context.abandonedViews, 1)
+		} else if err := <-done; err == nil {
+			// It finished just as the timer fired:
+			reflect.ValueOf(result).Elem().Set(resultValue.Elem())
+			return nil
+		} else {
+			return err
+		}
+		dbExpvars.Add("view_query_timeouts", 1)
+		base.Warn("Database %q: query of view %s/%s timed out after %v", context.Name, ddoc, name,
+			timeout)
+		return viewTimeoutError(ddoc, name)
+	}
+}
+
+// States of a query made by viewCustomWithDeadline.
+const (
+	viewQueryRunning = int32(iota)
+	viewQueryFinished
+	viewQueryAbandoned
+)
+
+func viewTimeoutError(ddoc, name string) error {
+	return base.HTTPErrorf(http.StatusServiceUnavailable, "Timed out querying view %s/%s", ddoc, name)
+}
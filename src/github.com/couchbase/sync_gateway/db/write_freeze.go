@@ -0,0 +1,103 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// While a database's writes are frozen, document updates fail with a 503 status, but reads and
+// changes feeds keep working. This is for temporarily shedding load, e.g. during a rebalance of
+// the backing bucket. (_local docs, such as replication checkpoints, can still be saved.)
+// Once a database has been deleted, document updates fail with a 410 status instead; and since
+// handlers may still hold the DatabaseContext, MarkDeleted waits for updates already in progress
+// to finish, so that the context can then be closed safely.
+type writeFreeze struct {
+	lock     sync.RWMutex
+	frozen   bool
+	reason   string
+	deleted  bool
+	inFlight sync.WaitGroup // Document updates in progress
+}
+
+// Starts refusing document writes. The reason is returned to clients in the error message.
+func (context *DatabaseContext) FreezeWrites(reason string) {
+	context.freeze.lock.Lock()
+	defer context.freeze.lock.Unlock()
+	context.freeze.frozen = true
+	context.freeze.reason = reason
+	base.Logf("Database %q: writes FROZEN (%s)", context.Name, reason)
+}
+
+// Resumes accepting document writes.
+func (context *DatabaseContext) UnfreezeWrites() {
+	context.freeze.lock.Lock()
+	defer context.freeze.lock.Unlock()
+	if context.freeze.frozen {
+		base.Logf("Database %q: writes unfrozen", context.Name)
+	}
+	context.freeze.frozen = false
+	context.freeze.reason = ""
+}
+
+// Returns true, and the reason given, if document writes are currently refused.
+func (context *DatabaseContext) WritesFrozen() (frozen bool, reason string) {
+	context.freeze.lock.RLock()
+	defer context.freeze.lock.RUnlock()
+	return context.freeze.frozen, context.freeze.reason
+}
+
+// Checks that document writes are frozen before a maintenance operation (such as a resync or
+// index rebuild) that rewrites documents without giving them new sequences, which would lose
+// concurrent writes from the changes feeds. Returns a 503 error if they aren't; otherwise waits
+// for any writes that began before the freeze to finish.
+func (context *DatabaseContext) RequireWritesFrozen(operation string) error {
+	if frozen, _ := context.WritesFrozen(); !frozen {
+		return base.HTTPErrorf(http.StatusServiceUnavailable,
+			"Database must be offline (writes frozen via POST /db/_freeze) to run %s", operation)
+	}
+	context.freeze.inFlight.Wait()
+	return nil
+}
+
+// Permanently refuses document writes, because the database is being deleted, and waits for any
+// writes in progress to finish.
+func (context *DatabaseContext) MarkDeleted() {
+	context.freeze.lock.Lock()
+	context.freeze.deleted = true
+	context.freeze.lock.Unlock()
+	context.freeze.inFlight.Wait()
+}
+
+// Call before a document write; if it returns nil, call endWrite when done. Returns a 503 error
+// if writes are frozen, or a 410 error if the database has been deleted.
+func (context *DatabaseContext) beginWrite() error {
+	context.freeze.lock.RLock()
+	defer context.freeze.lock.RUnlock()
+	if context.freeze.deleted {
+		return base.HTTPErrorf(http.StatusGone, "Database %q has been deleted", context.Name)
+	} else if context.freeze.frozen {
+		reason := context.freeze.reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		return base.HTTPErrorf(http.StatusServiceUnavailable,
+			"Database is temporarily not accepting writes: %s", reason)
+	}
+	context.freeze.inFlight.Add(1)
+	return nil
+}
+
+func (context *DatabaseContext) endWrite() {
+	context.freeze.inFlight.Done()
+}
@@ -0,0 +1,53 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+)
+
+// Callbacks a Database makes around each document revision it saves, so that the code using it
+// (e.g. the REST API's middleware) can inspect, alter or veto writes made on its behalf.
+type WriteHooks interface {
+	// Called before a revision is saved, before the validation and sync functions run. It may
+	// return an error to reject the write. A new revision (made by Put) hasn't been given its
+	// ID yet, so the hook may modify its body. But an existing revision being pushed by a
+	// replicator (PutExistingRev) already has its ID, which its body has to match; so the hook
+	// gets a copy of it and any changes it makes are ignored. It's called again if the write has
+	// to be retried due to a conflicting update of the document.
+	BeforeWrite(docid string, body Body) error
+
+	// Called after a revision has been saved.
+	AfterWrite(docid string, revid string, body Body)
+}
+
+// Sets the hooks to call when this Database saves a revision; nil for none.
+func (db *Database) SetWriteHooks(hooks WriteHooks) {
+	db.writeHooks = hooks
+}
+
+// Calls the BeforeWrite hook, if any. If canModify is false the hook gets a copy of the body.
+func (db *Database) beforeWrite(docid string, body Body, canModify bool) error {
+	if db.writeHooks == nil {
+		return nil
+	}
+	if !canModify {
+		var bodyCopy Body
+		bodyJSON, err := json.Marshal(body)
+		if err == nil {
+			err = json.Unmarshal(bodyJSON, &bodyCopy)
+		}
+		if err != nil {
+			return err
+		}
+		body = bodyCopy
+	}
+	return db.writeHooks.BeforeWrite(docid, body)
+}
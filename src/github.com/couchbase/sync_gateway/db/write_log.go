@@ -0,0 +1,155 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Default maximum size of a write log file before it's rotated.
+const DefaultWriteLogMaxSize = 100 * 1024 * 1024
+
+var errWriteLogClosed = errors.New("write log is closed")
+
+// One accepted write, as recorded in a WriteLog.
+type WriteLogEntry struct {
+	DocID    string    `json:"id"`
+	RevID    string    `json:"rev"`
+	Sequence uint64    `json:"seq"`
+	Channels base.Set  `json:"channels,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// An append-only log of the revisions accepted by a database, one JSON object per line.
+// It's meant for forensic replay and for rebuilding caches/indexes after a restart.
+// Retention is bounded: when the file reaches maxSize it's renamed with a ".1" suffix
+// (replacing any older one) and a new file is started, so at most ~2*maxSize is kept.
+type WriteLog struct {
+	path    string
+	maxSize int64
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+}
+
+// Opens (or creates) a write log at the given path, appending to any existing entries.
+func OpenWriteLog(path string, maxSize int64) (*WriteLog, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultWriteLogMaxSize
+	}
+	wlog := &WriteLog{path: path, maxSize: maxSize}
+	if err := wlog.open(); err != nil {
+		return nil, err
+	}
+	return wlog, nil
+}
+
+func (wlog *WriteLog) open() error {
+	file, err := os.OpenFile(wlog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	wlog.file = file
+	wlog.size = info.Size()
+	return nil
+}
+
+// Appends an entry to the log, rotating the file first if it's full.
+func (wlog *WriteLog) Append(entry WriteLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	wlog.lock.Lock()
+	defer wlog.lock.Unlock()
+	if wlog.file == nil {
+		return errWriteLogClosed
+	}
+	if wlog.size > 0 && wlog.size+int64(len(line)) > wlog.maxSize {
+		if err := wlog.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := wlog.file.Write(line)
+	wlog.size += int64(n)
+	return err
+}
+
+// Renames the full file with a ".1" suffix and starts a new one. If the file can't be renamed,
+// the log carries on appending to it (and tries again at the next Append.)
+func (wlog *WriteLog) rotate() error {
+	wlog.file.Close()
+	wlog.file = nil
+	if err := os.Rename(wlog.path, wlog.path+".1"); err != nil {
+		base.Warn("WriteLog: Couldn't rotate %s: %v", wlog.path, err)
+	}
+	return wlog.open()
+}
+
+func (wlog *WriteLog) Close() error {
+	wlog.lock.Lock()
+	defer wlog.lock.Unlock()
+	if wlog.file == nil {
+		return nil
+	}
+	err := wlog.file.Close()
+	wlog.file = nil
+	return err
+}
+
+// Reads the entries of the write log at the given path, oldest first (including the rotated
+// ".1" file if present), passing each to the callback. Stops if the callback returns an error.
+func ReplayWriteLog(path string, callback func(WriteLogEntry) error) error {
+	for _, filePath := range []string{path + ".1", path} {
+		file, err := os.Open(filePath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = replayWriteLogFile(file, callback)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replayWriteLogFile(file *os.File, callback func(WriteLogEntry) error) error {
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry WriteLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A crash can leave a truncated last line; skip it rather than failing the replay.
+			base.Warn("WriteLog: skipping unreadable entry in %s: %v", file.Name(), err)
+			continue
+		}
+		if err := callback(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,101 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func replayAll(t *testing.T, path string) (entries []WriteLogEntry) {
+	err := ReplayWriteLog(path, func(entry WriteLogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	assertNoError(t, err, "ReplayWriteLog failed")
+	return
+}
+
+func TestWriteLogRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writelog")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "writes.log")
+
+	wlog, err := OpenWriteLog(path, 500)
+	assertNoError(t, err, "OpenWriteLog failed")
+	for i := 1; i <= 20; i++ {
+		assertNoError(t, wlog.Append(WriteLogEntry{DocID: fmt.Sprintf("doc%d", i), RevID: "1-a", Sequence: uint64(i)}),
+			"Append failed")
+	}
+	wlog.Close()
+
+	// Older entries were dropped, but the remaining ones are in order and end with the newest:
+	entries := replayAll(t, path)
+	assert.True(t, len(entries) > 0 && len(entries) < 20)
+	for i, entry := range entries {
+		assert.Equals(t, entry.Sequence, uint64(20-len(entries)+i+1))
+	}
+	info, _ := os.Stat(path)
+	assert.True(t, info.Size() <= 500)
+}
+
+func TestWriteLogRotationFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writelog")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "writes.log")
+
+	// A non-empty directory in the way of the rotated file makes the rename fail:
+	os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700)
+
+	wlog, err := OpenWriteLog(path, 500)
+	assertNoError(t, err, "OpenWriteLog failed")
+	for i := 1; i <= 20; i++ {
+		assertNoError(t, wlog.Append(WriteLogEntry{DocID: fmt.Sprintf("doc%d", i), RevID: "1-a", Sequence: uint64(i)}),
+			"Append failed")
+	}
+	wlog.Close()
+
+	// Nothing was lost; the entries are all still in the current file:
+	data, err := ioutil.ReadFile(path)
+	assertNoError(t, err, "Couldn't read write log")
+	assert.Equals(t, strings.Count(string(data), "\n"), 20)
+}
+
+func TestWriteLogRecordsWrites(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writelog")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "writes.log")
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	var err error
+	db.WriteLog, err = OpenWriteLog(path, 0)
+	assertNoError(t, err, "OpenWriteLog failed")
+
+	rev1id, err := db.Put("wlog1", Body{"n": 1})
+	assertNoError(t, err, "Put failed")
+	rev2id, err := db.DeleteDoc("wlog1", rev1id)
+	assertNoError(t, err, "DeleteDoc failed")
+
+	entries := replayAll(t, path)
+	assert.Equals(t, len(entries), 2)
+	assert.Equals(t, entries[0].DocID, "wlog1")
+	assert.Equals(t, entries[0].RevID, rev1id)
+	assert.False(t, entries[0].Deleted)
+	assert.Equals(t, entries[1].RevID, rev2id)
+	assert.True(t, entries[1].Deleted)
+	assert.True(t, entries[1].Sequence > entries[0].Sequence)
+}
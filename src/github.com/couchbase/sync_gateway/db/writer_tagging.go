@@ -0,0 +1,51 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+// Couchbase Server's audit log only knows that the gateway's bucket credentials made a change,
+// not which gateway user or client was behind it. The memcached protocol has no way to attach
+// metadata to an operation, so when DatabaseContext.TagWrites is set the gateway records it in
+// the document itself instead: each write stores the user and client IP in the doc's _sync
+// metadata, where it can be correlated with server-side audit records of the same key and CAS.
+
+// Identifies who made a document change.
+type WriterInfo struct {
+	User     string `json:"user,omitempty"`      // Name of the authenticated user; "" for the guest
+	Admin    bool   `json:"admin,omitempty"`     // True if made through the admin API
+	Internal bool   `json:"internal,omitempty"`  // True if made by the gateway itself, e.g. import or resync
+	ClientIP string `json:"client_ip,omitempty"` // Address of the client, if known
+}
+
+// Sets the address of the client on whose behalf this Database is acting.
+func (db *Database) SetClientIP(ip string) {
+	db.clientIP = ip
+}
+
+// Marks this Database as acting for a request made through the admin API. A Database without a
+// user that isn't marked is the gateway's own, and its writes are tagged as Internal.
+func (db *Database) SetAdminRequest() {
+	db.adminRequest = true
+}
+
+// Returns the WriterInfo to record in docs this Database writes, or nil if TagWrites is off.
+func (db *Database) writerInfo() *WriterInfo {
+	if !db.TagWrites {
+		return nil
+	}
+	info := &WriterInfo{ClientIP: db.clientIP}
+	if db.user != nil {
+		info.User = db.user.Name()
+	} else if db.adminRequest {
+		info.Admin = true
+	} else {
+		info.Internal = true
+	}
+	return info
+}
@@ -0,0 +1,50 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/couchbase/sync_gateway/client"
+)
+
+// Runs the "doctor" command, which smoke-tests a running gateway and prints a pass/fail report,
+// e.g. "sync_gateway doctor -user=NAME -password=PASSWORD http://host:4984/db/".
+// Returns the process exit status: 0 if every check passed, 1 if any failed, 2 for bad usage.
+func doctorMain(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	username := flags.String("user", "", "Name of a user that can read and write the test channel")
+	password := flags.String("password", "", "Password of the user")
+	channel := flags.String("channel", client.DefaultDoctorChannel, "Channel to write the test document to")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s doctor [options] DATABASE_URL\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	} else if flags.NArg() != 1 || *username == "" {
+		flags.Usage()
+		return 2
+	}
+
+	report := client.RunDoctor(client.DoctorOptions{
+		DBURL:    flags.Arg(0),
+		Username: *username,
+		Password: *password,
+		Channel:  *channel,
+	})
+	report.Write(os.Stdout)
+	if !report.Passed() {
+		return 1
+	}
+	return 0
+}
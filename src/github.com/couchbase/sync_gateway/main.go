@@ -19,6 +19,9 @@ import (
 
 // Simple Sync Gateway launcher tool.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(doctorMain(os.Args[2:]))
+	}
 
 	signalchannel := make(chan os.Signal, 1)
 	signal.Notify(signalchannel, syscall.SIGHUP)
@@ -12,11 +12,14 @@ package rest
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 )
 
@@ -41,7 +44,43 @@ func (h *handler) handleCreateDB() error {
 
 // Get admin database info
 func (h *handler) handleGetDbConfig() error {
-	h.writeJSON(h.server.GetDatabaseConfig(h.db.Name))
+	config, err := redactedConfig(h.server.GetDatabaseConfig(h.db.Name))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(config)
+	return nil
+}
+
+// Handles GET /db/_status: the results of the database's consistency self-check, and the
+// utilization of its changes cache. The check is run when the database is loaded;
+// ?refresh=true runs it again.
+func (h *handler) handleGetDbStatus() error {
+	var status struct {
+		*db.SelfCheckReport
+		ChangeCache db.ChangeCacheStats `json:"change_cache"`
+	}
+	if h.getBoolQuery("refresh") {
+		status.SelfCheckReport = h.db.RunSelfCheck()
+	} else {
+		status.SelfCheckReport = h.db.LastSelfCheck()
+	}
+	status.ChangeCache = h.db.ChangeCacheStats()
+	h.writeJSON(status)
+	return nil
+}
+
+// Handles GET /_config: the effective server configuration, with passwords redacted, and where
+// each property's value came from.
+func (h *handler) handleGetServerConfig() error {
+	h.assertAdminOnly()
+	h.server.lock.RLock()
+	properties, sources, err := h.server.config.introspect()
+	h.server.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"config": properties, "sources": sources})
 	return nil
 }
 
@@ -55,6 +94,25 @@ func (h *handler) handleDeleteDB() error {
 	return nil
 }
 
+// Handles POST /db/_rename: renames the database to the "new_name" given in the body. Requests
+// to the old name fail with a 410 status for a while afterwards, saying what the new name is.
+func (h *handler) handleRenameDB() error {
+	h.assertAdminOnly()
+	var params struct {
+		NewName string `json:"new_name"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	} else if params.NewName == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing new_name")
+	}
+	if err := h.server.RenameDatabase(h.db.Name, params.NewName); err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"ok": true, "db_name": params.NewName})
+	return nil
+}
+
 // raw document access for admin api
 
 func (h *handler) handleGetRawDoc() error {
@@ -91,6 +149,219 @@ func (h *handler) handleSetLogging() error {
 	return nil
 }
 
+// Per-database log keys; these enable logging for this database only, on top of /_logging.
+func (h *handler) handleGetDbLogging() error {
+	h.writeJSON(base.GetDbLogKeys(h.db.Name))
+	return nil
+}
+
+func (h *handler) handleSetDbLogging() error {
+	var keys map[string]bool
+	if err := h.readJSONInto(&keys); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON or non-boolean values")
+	}
+	base.UpdateDbLogKeys(h.db.Name, keys, h.rq.Method == "PUT")
+	return nil
+}
+
+// Handles GET /db/_freeze: reports whether document writes are currently refused.
+func (h *handler) handleGetWriteFreeze() error {
+	frozen, reason := h.db.WritesFrozen()
+	response := db.Body{"frozen": frozen}
+	if frozen {
+		response["reason"] = reason
+	}
+	h.writeJSON(response)
+	return nil
+}
+
+// Handles PUT or POST /db/_freeze: refuses document writes (with a 503 status) until unfrozen,
+// while still serving reads and changes. The optional JSON body's "reason" is reported to
+// clients whose writes are refused.
+func (h *handler) handleFreezeWrites() error {
+	var options struct {
+		Reason string `json:"reason"`
+	}
+	body, err := h.readBody()
+	if err != nil {
+		return err
+	} else if len(body) > 0 {
+		if err := json.Unmarshal(body, &options); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON")
+		}
+	}
+	h.db.FreezeWrites(options.Reason)
+	return nil
+}
+
+// Handles DELETE /db/_freeze: resumes accepting document writes.
+func (h *handler) handleUnfreezeWrites() error {
+	h.db.UnfreezeWrites()
+	return nil
+}
+
+// Handles POST /db/_rebuild_indexes: starts rebuilding the database's channel and access
+// indexes from its documents, in the background. The optional "max_docs_per_second" query
+// parameter throttles it. Document writes must be frozen (see /db/_freeze) until it finishes.
+// Responds with the task's initial status.
+func (h *handler) handleStartIndexRebuild() error {
+	maxDocsPerSecond := h.getIntQuery("max_docs_per_second", 0)
+	if err := h.db.StartIndexRebuild(int(maxDocsPerSecond)); err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, h.db.IndexRebuildStatus())
+	return nil
+}
+
+// Handles GET /db/_rebuild_indexes: reports the progress of the current or last index rebuild.
+func (h *handler) handleGetIndexRebuild() error {
+	h.writeJSON(h.db.IndexRebuildStatus())
+	return nil
+}
+
+// Handles GET /db/_stats_history: the database's current stats, and the snapshots of them
+// recorded between the "start" and "end" query parameters (RFC 3339 times; by default the range
+// is the last day.) Snapshots are only recorded if the database config has "stats_history".
+func (h *handler) handleGetStatsHistory() error {
+	end := time.Now().UTC()
+	start := end.Add(-24 * time.Hour)
+	var err error
+	if str := h.getQuery("end"); str != "" {
+		if end, err = time.Parse(time.RFC3339, str); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid end time")
+		}
+		start = end.Add(-24 * time.Hour)
+	}
+	if str := h.getQuery("start"); str != "" {
+		if start, err = time.Parse(time.RFC3339, str); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid start time")
+		}
+	}
+	snapshots, err := h.db.GetStatsHistory(start, end)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{
+		"current":   h.db.StatsSnapshot(),
+		"start":     start,
+		"end":       end,
+		"snapshots": snapshots,
+	})
+	return nil
+}
+
+// Handles DELETE /db/_rebuild_indexes: stops a running index rebuild.
+func (h *handler) handleStopIndexRebuild() error {
+	if !h.db.StopIndexRebuild() {
+		return base.HTTPErrorf(http.StatusNotFound, "No index rebuild is running")
+	}
+	return nil
+}
+
+// Handles GET /db/_sync_function/history: lists the saved versions of the sync function, with
+// when and by whom each was set. The last one is the current function.
+func (h *handler) handleGetSyncFunHistory() error {
+	history, err := h.db.SyncFunctionHistory()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"versions": history})
+	return nil
+}
+
+// Handles POST /db/_sync_function/rollback: makes a previous version of the sync function
+// current again. Unless "resync" is false, every doc is then re-run through it, as by _resync;
+// so, like _resync, that requires the database to be offline.
+func (h *handler) handleRollBackSyncFun() error {
+	var options struct {
+		Version   int    `json:"version"`
+		Resync    *bool  `json:"resync"`
+		ChangedBy string `json:"changed_by"`
+	}
+	if err := h.readJSONInto(&options); err != nil {
+		return err
+	} else if options.Version <= 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing or invalid version")
+	}
+	if options.ChangedBy == "" {
+		options.ChangedBy = "admin API"
+	}
+	resync := options.Resync == nil || *options.Resync
+	if resync {
+		// Check before changing anything, so a refused rollback doesn't leave docs unsynced:
+		if err := h.db.RequireWritesFrozen("a resync"); err != nil {
+			return err
+		}
+	}
+	changed, err := h.db.RollBackSyncFun(options.Version, options.ChangedBy)
+	if err != nil {
+		return err
+	}
+	response := db.Body{"version": options.Version, "changed": changed}
+	if changed && resync {
+		docsChanged, err := h.db.UpdateAllDocChannels(true, false)
+		if err != nil {
+			return err
+		}
+		response["changes"] = docsChanged
+	}
+	h.writeJSON(response)
+	return nil
+}
+
+// Handles GET or POST /db/_sync_debug/{docid}: runs the sync function on a stored revision of
+// the doc (?rev=, default current) and reports the channels, access and rejection it produces,
+// without saving anything. A POST body can supply a different "sync" function to try out, and
+// "user" (or ?user=) makes it run as that user instead of as an admin.
+func (h *handler) handleSyncFnDryRun() error {
+	h.assertAdminOnly()
+	docid := h.PathVar("docid")
+	var options struct {
+		Sync string `json:"sync"`
+		User string `json:"user"`
+	}
+	if h.rq.Method == "POST" {
+		if err := h.readJSONInto(&options); err != nil {
+			return err
+		}
+	}
+	if options.User == "" {
+		options.User = h.getQuery("user")
+	}
+
+	database := h.db
+	if options.User != "" {
+		user, err := h.db.Authenticator().GetUser(internalUserName(options.User))
+		if user == nil {
+			if err == nil {
+				err = base.HTTPErrorf(http.StatusNotFound, "No such user")
+			}
+			return err
+		}
+		database, _ = db.GetDatabase(h.db.DatabaseContext, user)
+	}
+
+	output, parentRevID, err := database.SyncFnDryRun(docid, h.getQuery("rev"), options.Sync)
+	if err != nil {
+		return err
+	}
+	result := db.Body{
+		"id":       docid,
+		"channels": output.Channels,
+		"access":   output.Access,
+		"roles":    output.Roles,
+	}
+	if parentRevID != "" {
+		result["parent_rev"] = parentRevID
+	}
+	if output.Rejection != nil {
+		status, reason := base.ErrorAsHTTPStatus(output.Rejection)
+		result["rejection"] = db.Body{"status": status, "reason": reason}
+	}
+	h.writeJSON(result)
+	return nil
+}
+
 //////// USERS & ROLES:
 
 func internalUserName(name string) string {
@@ -107,24 +378,6 @@ func externalUserName(name string) string {
 	return name
 }
 
-func marshalPrincipal(princ auth.Principal) ([]byte, error) {
-	name := externalUserName(princ.Name())
-	info := db.PrincipalConfig{
-		Name:             &name,
-		ExplicitChannels: princ.ExplicitChannels().AsSet(),
-	}
-	if user, ok := princ.(auth.User); ok {
-		info.Channels = user.InheritedChannels().AsSet()
-		info.Email = user.Email()
-		info.Disabled = user.Disabled()
-		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
-		info.RoleNames = user.RoleNames().AllChannels()
-	} else {
-		info.Channels = princ.Channels().AsSet()
-	}
-	return json.Marshal(info)
-}
-
 // Handles PUT and POST for a user or a role.
 func (h *handler) updatePrincipal(name string, isUser bool) error {
 	h.assertAdminOnly()
@@ -156,8 +409,8 @@ func (h *handler) updatePrincipal(name string, isUser bool) error {
 	if err != nil {
 		return err
 	} else if replaced {
-		// on update with a new password, remove previous user sessions
-		if newInfo.Password != nil {
+		// on update with a new password, or disabling the account, remove previous user sessions
+		if isUser && (newInfo.Password != nil || newInfo.Disabled) {
 			err = h.db.DeleteUserSessions(*newInfo.Name)
 			if err != nil {
 				return err
@@ -182,6 +435,48 @@ func (h *handler) putRole() error {
 	return h.updatePrincipal(rolename, false)
 }
 
+// Handles POST /_user/_bulk_patch or /_role/_bulk_patch: applies the same list of add/remove
+// operations on admin_channels (or admin_roles) to every named principal. Each principal is
+// updated atomically; the response reports the outcome for each one, in order.
+func (h *handler) bulkPatchPrincipals(isUser bool) error {
+	h.assertAdminOnly()
+	var input struct {
+		Names []string              `json:"names"`
+		Ops   []db.PrincipalPatchOp `json:"ops"`
+	}
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	} else if input.Names == nil || len(input.Ops) == 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Request needs 'names' and 'ops' arrays")
+	}
+
+	results := make([]db.Body, 0, len(input.Names))
+	for _, name := range input.Names {
+		result := db.Body{"name": name}
+		changed, err := h.db.PatchPrincipal(internalUserName(name), isUser, input.Ops)
+		if err != nil {
+			status, reason := base.ErrorAsHTTPStatus(err)
+			result["error"] = base.CouchHTTPErrorName(status)
+			result["reason"] = reason
+			result["status"] = status
+		} else {
+			result["ok"] = true
+			result["changed"] = changed
+		}
+		results = append(results, result)
+	}
+	h.writeJSON(results)
+	return nil
+}
+
+func (h *handler) bulkPatchUsers() error {
+	return h.bulkPatchPrincipals(true)
+}
+
+func (h *handler) bulkPatchRoles() error {
+	return h.bulkPatchPrincipals(false)
+}
+
 func (h *handler) deleteUser() error {
 	h.assertAdminOnly()
 	user, err := h.db.Authenticator().GetUser(mux.Vars(h.rq)["name"])
@@ -191,7 +486,14 @@ func (h *handler) deleteUser() error {
 		}
 		return err
 	}
-	return h.db.Authenticator().Delete(user)
+	if err = h.db.Authenticator().Delete(user); err != nil {
+		return err
+	}
+	// The user's sessions and API keys would be useless now, so don't leave them around:
+	if err = h.db.Authenticator().RevokeAllAPIKeys(user.Name()); err != nil {
+		return err
+	}
+	return h.db.DeleteUserSessions(user.Name())
 }
 
 func (h *handler) deleteRole() error {
@@ -216,9 +518,122 @@ func (h *handler) getUserInfo() error {
 		return err
 	}
 
-	bytes, err := marshalPrincipal(user)
-	h.response.Write(bytes)
-	return err
+	h.writeJSON(principalResponse(user))
+	return nil
+}
+
+// Handles GET /db/_user/{name}/_channel_history: the user's current channels, and the recent
+// changes to them with the sequences at which channels were granted and revoked.
+func (h *handler) getUserChannelHistory() error {
+	h.assertAdminOnly()
+	user, err := h.db.Authenticator().GetUser(internalUserName(h.PathVar("name")))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	h.writeChannelHistory(user)
+	return nil
+}
+
+// Handles GET /db/_role/{name}/_channel_history, like getUserChannelHistory.
+func (h *handler) getRoleChannelHistory() error {
+	h.assertAdminOnly()
+	role, err := h.db.Authenticator().GetRole(h.PathVar("name"))
+	if role == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	h.writeChannelHistory(role)
+	return nil
+}
+
+func (h *handler) writeChannelHistory(princ auth.Principal) {
+	history := princ.ChannelHistory()
+	if history == nil {
+		history = []auth.ChannelChange{}
+	}
+	h.writeJSON(db.Body{
+		"name":         princ.Name(),
+		"all_channels": princ.Channels(),
+		"history":      history,
+	})
+}
+
+// Handles GET /db/_user/{name}/_access/{docid}: reports whether the user can read the current
+// revision of the document, and through which of its channels and roles.
+func (h *handler) getUserDocAccess() error {
+	h.assertAdminOnly()
+	user, err := h.db.Authenticator().GetUser(internalUserName(h.PathVar("name")))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	docid := h.PathVar("docid")
+	doc, err := h.db.GetDoc(docid)
+	if doc == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+
+	docChannels := doc.History[doc.CurrentRev].Channels
+	if docChannels == nil {
+		docChannels = base.Set{}
+	}
+	// A doc in no channels is visible only to users with access to all channels ("*"),
+	// so check "*" itself in that case.
+	checkChannels := docChannels
+	if len(checkChannels) == 0 {
+		checkChannels = base.SetOf(channels.UserStarChannel)
+	}
+
+	viaChannels := []string{}
+	for channel := range checkChannels {
+		if principalHasChannel(user, channel) {
+			viaChannels = append(viaChannels, channel)
+		}
+	}
+	viaRoles := map[string][]string{}
+	for roleName := range user.RoleNames() {
+		role, err := h.db.Authenticator().GetRole(roleName)
+		if err != nil {
+			return err
+		} else if role == nil {
+			continue
+		}
+		for channel := range checkChannels {
+			if principalHasChannel(role, channel) {
+				viaRoles[roleName] = append(viaRoles[roleName], channel)
+			}
+		}
+	}
+	sort.Strings(viaChannels)
+	for _, roleChannels := range viaRoles {
+		sort.Strings(roleChannels)
+	}
+
+	h.writeJSON(db.Body{
+		"name":         externalUserName(user.Name()),
+		"id":           docid,
+		"rev":          doc.CurrentRev,
+		"channels":     docChannels,
+		"can_read":     len(viaChannels) > 0 || len(viaRoles) > 0,
+		"via_channels": viaChannels,
+		"via_roles":    viaRoles,
+	})
+	return nil
+}
+
+// True if the principal's own channels include the given channel, either directly or via "*".
+func principalHasChannel(princ auth.Principal, channel string) bool {
+	return princ.Channels().Contains(channel) || princ.Channels().Contains(channels.UserStarChannel)
 }
 
 func (h *handler) getRoleInfo() error {
@@ -230,9 +645,8 @@ func (h *handler) getRoleInfo() error {
 		}
 		return err
 	}
-	bytes, err := marshalPrincipal(role)
-	h.response.Write(bytes)
-	return err
+	h.writeJSON(principalResponse(role))
+	return nil
 }
 
 func (h *handler) getUsers() error {
@@ -69,6 +69,24 @@ func (h *handler) handleRoot() error {
 	return nil
 }
 
+// Maximum number of UUIDs that can be requested from /_uuids at once
+const kMaxUUIDCount = 1000
+
+// HTTP handler for /_uuids
+func (h *handler) handleUUIDs() error {
+	count := h.getIntQuery("count", 1)
+	if count > kMaxUUIDCount {
+		return base.HTTPErrorf(http.StatusBadRequest, "count parameter too large")
+	}
+	uuids := make([]string, count)
+	for i := range uuids {
+		uuids[i] = h.server.uuidGenerator()
+	}
+	h.setHeader("Cache-Control", "must-revalidate, no-cache")
+	h.writeJSON(db.Body{"uuids": uuids})
+	return nil
+}
+
 func (h *handler) handleAllDbs() error {
 	h.writeJSON(h.server.AllDatabaseNames())
 	return nil
@@ -79,16 +97,25 @@ func (h *handler) handleCompact() error {
 	if err != nil {
 		return err
 	}
-	h.writeJSON(db.Body{"revs": revsDeleted})
+	tombstonesPurged, err := h.db.PurgeTombstones()
+	if err != nil {
+		return err
+	}
+	// Expired sessions can't be used anyway, so failing to clean them up isn't fatal:
+	sessionsDeleted, err := h.db.DeleteExpiredSessions()
+	if err != nil {
+		base.Warn("Compact: Couldn't delete expired sessions of db %q: %v", h.db.Name, err)
+	}
+	h.writeJSON(db.Body{"revs": revsDeleted, "tombstones": tombstonesPurged, "sessions": sessionsDeleted})
 	return nil
 }
 
 func (h *handler) handleVacuum() error {
-	attsDeleted, err := db.VacuumAttachments(h.db.Bucket)
+	attsDeleted, bytesReclaimed, err := h.db.VacuumAttachments()
 	if err != nil {
 		return err
 	}
-	h.writeJSON(db.Body{"atts": attsDeleted})
+	h.writeJSON(db.Body{"atts": attsDeleted, "bytes": bytesReclaimed})
 	return nil
 }
 
@@ -96,8 +123,14 @@ func (h *handler) handleFlush() error {
 	if bucket, ok := h.db.Bucket.(walrus.DeleteableBucket); ok {
 		name := h.db.Name
 		config := h.server.GetDatabaseConfig(name)
-		h.server.RemoveDatabase(name)
-		err := bucket.CloseAndDelete()
+		ident, err := h.db.Identity()
+		if err != nil {
+			return err
+		}
+		h.server.removeDatabase(name, false) // it's coming right back, so no tombstone
+		// The flush changes the data without new sequences, so the epoch has to go up, not back to 0:
+		h.server.setFlushedEpoch(name, ident.Epoch+1)
+		err = bucket.CloseAndDelete()
 		_, err2 := h.server.AddDatabaseFromConfig(config)
 		if err == nil {
 			err = err2
@@ -108,17 +141,27 @@ func (h *handler) handleFlush() error {
 	}
 }
 
+// Handles POST /db/_resync: re-runs the sync function on every document. Document writes must
+// be frozen (see /db/_freeze) first, so that clients can't update docs while they're processed.
 func (h *handler) handleResync() error {
-	docsChanged, err := h.db.UpdateAllDocChannels(true, false)
+	if err := h.db.RequireWritesFrozen("_resync"); err != nil {
+		return err
+	}
+	stats, err := h.db.ResyncAllDocs()
 	if err != nil {
 		return err
 	}
-	h.writeJSON(db.Body{"changes": docsChanged})
+	h.writeJSON(db.Body{
+		"changes":        stats.DocsChanged,
+		"docs_processed": stats.DocsProcessed,
+		"docs_changed":   stats.DocsChanged,
+		"docs_failed":    stats.DocsFailed,
+	})
 	return nil
 }
 
 func (h *handler) instanceStartTime() json.Number {
-	return json.Number(strconv.FormatInt(h.db.StartTime.UnixNano()/1000, 10))
+	return json.Number(strconv.FormatInt(h.db.StartTime().UnixNano()/1000, 10))
 }
 
 func (h *handler) handleGetDB() error {
@@ -129,15 +172,21 @@ func (h *handler) handleGetDB() error {
 	if err != nil {
 		return err
 	}
-	response := db.Body{
-		"db_name":              h.db.Name,
-		"update_seq":           lastSeq,
-		"committed_update_seq": lastSeq,
-		"instance_start_time":  h.instanceStartTime(),
-		"compact_running":      false, // TODO: Implement this
-		"purge_seq":            0,     // TODO: Should track this value
-		"disk_format_version":  0,     // Probably meaningless, but add for compatibility
-		//"doc_count":          h.db.DocCount(), // Removed: too expensive to compute (#278)
+	ident, err := h.db.Identity()
+	if err != nil {
+		return err
+	}
+	response := databaseInfo{
+		DBName:             h.db.Name,
+		DBUUID:             ident.UUID,
+		Epoch:              ident.Epoch,
+		UpdateSeq:          lastSeq,
+		CommittedUpdateSeq: lastSeq,
+		InstanceStartTime:  h.instanceStartTime(),
+		CompactRunning:     false, // TODO: Implement this
+		PurgeSeq:           0,     // TODO: Should track this value
+		DiskFormatVersion:  0,     // Probably meaningless, but add for compatibility
+		//DocCount:         h.db.DocCount(), // Removed: too expensive to compute (#278)
 	}
 	h.writeJSON(response)
 	return nil
@@ -155,6 +204,11 @@ func (h *handler) handleCreateTarget() error {
 	}
 }
 
+// Databases can only be deleted through the admin API.
+func (h *handler) handleDeleteTarget() error {
+	return base.HTTPErrorf(http.StatusForbidden, "Deleting a DB over the public API is unsupported")
+}
+
 func (h *handler) handleEFC() error { // Handles _ensure_full_commit.
 	// no-op. CouchDB's replicator sends this, so don't barf. Status must be 201.
 	h.writeJSONStatus(http.StatusCreated, db.Body{
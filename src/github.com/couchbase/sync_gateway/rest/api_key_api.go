@@ -0,0 +1,87 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Returns the user named in the URL path, or a 404 error.
+func (h *handler) pathUser() (auth.User, error) {
+	user, err := h.db.Authenticator().GetUser(internalUserName(h.PathVar("name")))
+	if user == nil && err == nil {
+		err = kNotFoundError
+	}
+	return user, err
+}
+
+// ADMIN API: Handles GET /db/_user/{name}/_api_key: lists the user's API keys (not the keys
+// themselves, which are only returned when created.)
+func (h *handler) getUserAPIKeys() error {
+	h.assertAdminOnly()
+	user, err := h.pathUser()
+	if err != nil {
+		return err
+	}
+	keys, err := h.db.Authenticator().GetAPIKeys(user.Name())
+	if err != nil {
+		return err
+	}
+	h.writeJSON(keys)
+	return nil
+}
+
+// ADMIN API: Handles POST /db/_user/{name}/_api_key: creates an API key for the user, with an
+// optional "label" saying what it's for. The response's "key" property is the only copy of it.
+func (h *handler) createUserAPIKey() error {
+	h.assertAdminOnly()
+	user, err := h.pathUser()
+	if err != nil {
+		return err
+	} else if user.Name() == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "The guest user can't have API keys")
+	}
+	var params struct {
+		Label string `json:"label"`
+	}
+	if h.rq.ContentLength != 0 {
+		if err := h.readJSONInto(&params); err != nil {
+			return err
+		}
+	}
+	apiKey, key, err := h.db.Authenticator().CreateAPIKey(user.Name(), params.Label)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		ID      string    `json:"id"`
+		Key     string    `json:"key"`
+		Label   string    `json:"label,omitempty"`
+		Scheme  string    `json:"auth_scheme"`
+		Created time.Time `json:"created"`
+	}
+	response.ID = apiKey.ID
+	response.Key = key
+	response.Label = apiKey.Label
+	response.Scheme = auth.APIKeyAuthScheme
+	response.Created = apiKey.Created
+	h.writeJSONStatus(http.StatusCreated, response)
+	return nil
+}
+
+// ADMIN API: Handles DELETE /db/_user/{name}/_api_key/{id}: revokes one of the user's API keys.
+func (h *handler) revokeUserAPIKey() error {
+	h.assertAdminOnly()
+	return h.db.Authenticator().RevokeAPIKey(internalUserName(h.PathVar("name")), h.PathVar("id"))
+}
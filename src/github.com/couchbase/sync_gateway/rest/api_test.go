@@ -12,13 +12,19 @@ package rest
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -217,6 +223,71 @@ func TestRoot(t *testing.T) {
 	assert.Equals(t, response.Header().Get("Allow"), "GET, HEAD")
 }
 
+func TestUUIDs(t *testing.T) {
+	var rt restTester
+	response := rt.sendRequest("GET", "/_uuids", "")
+	assertStatus(t, response, 200)
+	var body struct {
+		UUIDs []string `json:"uuids"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, len(body.UUIDs), 1)
+
+	response = rt.sendRequest("GET", "/_uuids?count=5", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, len(body.UUIDs), 5)
+
+	response = rt.sendRequest("GET", "/_uuids?count=100000", "")
+	assertStatus(t, response, 400)
+}
+
+func TestDatabaseIdentity(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel(doc.channel)}`}
+	getIdentity := func() (uuid string, epoch float64) {
+		response := rt.sendRequest("GET", "/db/", "")
+		assertStatus(t, response, 200)
+		var body db.Body
+		json.Unmarshal(response.Body.Bytes(), &body)
+		uuid, _ = body["db_uuid"].(string)
+		epoch, _ = body["epoch"].(float64)
+		return
+	}
+	uuid, epoch := getIdentity()
+	assert.True(t, uuid != "")
+	assert.Equals(t, epoch, 0.0)
+
+	// Writing docs doesn't change the identity:
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"channel":"a"}`), 201)
+	uuid2, epoch2 := getIdentity()
+	assert.Equals(t, uuid2, uuid)
+	assert.Equals(t, epoch2, 0.0)
+
+	// A resync that changes nothing doesn't either:
+	database, _ := db.GetDatabase(rt.ServerContext().Database("db"), nil)
+	changeCount, err := database.UpdateAllDocChannels(true, false)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, changeCount, 0)
+	_, epoch2 = getIdentity()
+	assert.Equals(t, epoch2, 0.0)
+
+	// But one that changes docs increments the epoch:
+	_, err = database.UpdateSyncFun(`function(doc) {channel("b")}`)
+	assert.Equals(t, err, nil)
+	changeCount, err = database.UpdateAllDocChannels(true, false)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, changeCount, 1)
+	uuid2, epoch2 = getIdentity()
+	assert.Equals(t, uuid2, uuid)
+	assert.Equals(t, epoch2, 1.0)
+
+	// A flush creates a new UUID, and the epoch keeps going up rather than starting over:
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_flush", ""), 200)
+	uuid2, epoch2 = getIdentity()
+	assert.True(t, uuid2 != uuid)
+	assert.Equals(t, epoch2, 2.0)
+}
+
 func (rt *restTester) createDoc(t *testing.T, docid string) string {
 	response := rt.sendRequest("PUT", "/db/"+docid, `{"prop":true}`)
 	assertStatus(t, response, 201)
@@ -521,6 +592,221 @@ func TestManualAttachmentNewDoc(t *testing.T) {
 	assert.True(t, len(body) == 3)
 }
 
+func TestInlineAttachments(t *testing.T) {
+	var rt restTester
+	response := rt.sendRequest("PUT", "/db/doc1",
+		`{"_attachments": {"hello.txt": {"content_type": "text/plain", "data": "aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, 201)
+
+	// Without ?attachments=true, GET returns a stub:
+	var body db.Body
+	response = rt.sendRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	att := body["_attachments"].(map[string]interface{})["hello.txt"].(map[string]interface{})
+	assert.Equals(t, att["stub"], true)
+	assert.Equals(t, att["length"], float64(11))
+	assert.Equals(t, att["revpos"], float64(1))
+	assert.Equals(t, att["content_type"], "text/plain")
+	assert.True(t, att["digest"] != nil)
+	assert.Equals(t, att["data"], nil)
+
+	// With it, the data is inlined as base64:
+	body = db.Body{}
+	response = rt.sendRequestWithHeaders("GET", "/db/doc1?attachments=true", "",
+		map[string]string{"Accept": "application/json"})
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	att = body["_attachments"].(map[string]interface{})["hello.txt"].(map[string]interface{})
+	assert.Equals(t, att["data"], "aGVsbG8gd29ybGQ=")
+	assert.Equals(t, att["stub"], nil)
+
+	response = rt.sendRequest("GET", "/db/doc1/hello.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), "hello world")
+
+	// Invalid base64 is a bad request:
+	response = rt.sendRequest("PUT", "/db/doc2",
+		`{"_attachments": {"bad.txt": {"content_type": "text/plain", "data": "not base64!"}}}`)
+	assertStatus(t, response, 400)
+}
+
+func TestGetCompressedAttachment(t *testing.T) {
+	var rt restTester
+	dbc, _ := rt.ServerContext().GetDatabase("db")
+	dbc.Attachments.Compress = true
+	text := strings.Repeat("hello world ", 100)
+	response := rt.sendRequest("PUT", "/db/doc1", `{"_attachments": {"big.txt": {"content_type": "text/plain", "data": "`+
+		base64.StdEncoding.EncodeToString([]byte(text))+`"}}}`)
+	assertStatus(t, response, 201)
+
+	// A client that doesn't accept gzip gets the decoded data:
+	response = rt.sendRequest("GET", "/db/doc1/big.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Content-Encoding"), "")
+	assert.Equals(t, string(response.Body.Bytes()), text)
+
+	// One that does gets the stored data as-is:
+	response = rt.sendRequestWithHeaders("GET", "/db/doc1/big.txt", "",
+		map[string]string{"Accept-Encoding": "gzip"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Content-Encoding"), "gzip")
+	unzip, err := gzip.NewReader(response.Body)
+	assert.Equals(t, err, nil)
+	unzipped, err := ioutil.ReadAll(unzip)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, string(unzipped), text)
+
+	// One that refuses gzip gets the decoded data:
+	response = rt.sendRequestWithHeaders("GET", "/db/doc1/big.txt", "",
+		map[string]string{"Accept-Encoding": "gzip;q=0, *"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Content-Encoding"), "")
+	assert.Equals(t, string(response.Body.Bytes()), text)
+
+	// Inline attachment data is decoded too, and can be pushed back as-is:
+	response = rt.sendRequest("GET", "/db/doc1?attachments=true", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	meta := db.BodyAttachments(body)["big.txt"].(map[string]interface{})
+	assert.Equals(t, meta["encoding"], nil)
+	data, _ := base64.StdEncoding.DecodeString(meta["data"].(string))
+	assert.Equals(t, string(data), text)
+	body["n"] = 2
+	bodyJSON, _ := json.Marshal(body)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", string(bodyJSON)), 201)
+}
+
+func TestAttachmentETag(t *testing.T) {
+	var rt restTester
+	response := rt.sendRequest("PUT", "/db/doc1", `{"_attachments": {"a.txt": {"data": "aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, 201)
+
+	response = rt.sendRequest("GET", "/db/doc1/a.txt", "")
+	assertStatus(t, response, 200)
+	etag := response.HeaderMap.Get("Etag")
+	assert.Equals(t, etag, `"sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0="`)
+
+	// A client that already has the data doesn't get it again:
+	response = rt.sendRequestWithHeaders("GET", "/db/doc1/a.txt", "",
+		map[string]string{"If-None-Match": etag})
+	assertStatus(t, response, 304)
+	assert.Equals(t, response.Body.Len(), 0)
+	response = rt.sendRequestWithHeaders("GET", "/db/doc1/a.txt", "",
+		map[string]string{"If-None-Match": `"sha1-other", W/` + etag})
+	assertStatus(t, response, 304)
+
+	// But it does if the attachment's changed:
+	response = rt.sendRequest("GET", "/db/doc1", "")
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	response = rt.sendRequest("PUT", "/db/doc1/a.txt?rev="+body["_rev"].(string), "bye")
+	assertStatus(t, response, 201)
+	response = rt.sendRequestWithHeaders("GET", "/db/doc1/a.txt", "",
+		map[string]string{"If-None-Match": etag})
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), "bye")
+	assert.True(t, response.HeaderMap.Get("Etag") != etag)
+}
+
+func TestGetMultipartAttsSince(t *testing.T) {
+	var rt restTester
+	data := func(c string) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(c, 500)))
+	}
+	response := rt.sendRequest("PUT", "/db/doc1",
+		`{"_attachments": {"a.txt": {"data": "`+data("a")+`"}}}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev1 := body["rev"].(string)
+	response = rt.sendRequest("PUT", "/db/doc1", `{"_rev": "`+rev1+`", "_attachments": {
+		"a.txt": {"stub": true, "revpos": 1},
+		"c.txt": {"data": "`+data("c")+`"},
+		"b.txt": {"data": "`+data("b")+`"}}}`)
+	assertStatus(t, response, 201)
+
+	response = rt.sendRequestWithHeaders("GET", `/db/doc1?attachments=true&atts_since=["`+rev1+`"]`, "",
+		map[string]string{"Accept": "multipart/related"})
+	assertStatus(t, response, 200)
+	mediaType, params, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	assert.Equals(t, mediaType, "multipart/related")
+	reader := multipart.NewReader(response.Body, params["boundary"])
+
+	// The JSON part has a stub for the attachment the client already has:
+	part, err := reader.NextPart()
+	assert.Equals(t, err, nil)
+	body = db.Body{}
+	assert.Equals(t, json.NewDecoder(part).Decode(&body), nil)
+	atts := body["_attachments"].(map[string]interface{})
+	assert.Equals(t, atts["a.txt"].(map[string]interface{})["stub"], true)
+	assert.Equals(t, atts["b.txt"].(map[string]interface{})["follows"], true)
+	assert.Equals(t, atts["c.txt"].(map[string]interface{})["follows"], true)
+
+	// ...followed by the new attachments, in the same order as in the JSON:
+	for _, name := range []string{"b.txt", "c.txt"} {
+		part, err = reader.NextPart()
+		assert.Equals(t, err, nil)
+		assert.Equals(t, part.FileName(), name)
+		content, _ := ioutil.ReadAll(part)
+		assert.Equals(t, string(content), strings.Repeat(name[:1], 500))
+	}
+	_, err = reader.NextPart()
+	assert.Equals(t, err, io.EOF)
+}
+
+func TestDeleteAttachment(t *testing.T) {
+	var rt restTester
+	reqHeaders := map[string]string{"Content-Type": "text/plain"}
+	response := rt.sendRequestWithHeaders("PUT", "/db/doc1/attach1", "attachment one", reqHeaders)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revid := body["rev"].(string)
+	response = rt.sendRequestWithHeaders("PUT", "/db/doc1/attach2?rev="+revid, "attachment two", reqHeaders)
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revid = body["rev"].(string)
+
+	// Delete with a missing or obsolete rev, or of a nonexistent attachment, fails:
+	assertStatus(t, rt.sendRequest("DELETE", "/db/doc1/attach1?rev=1-abc", ""), 404)
+	assertStatus(t, rt.sendRequest("DELETE", "/db/doc1/nosuch?rev="+revid, ""), 404)
+
+	response = rt.sendRequest("DELETE", "/db/doc1/attach1?rev="+revid, "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["ok"], true)
+	newRevid := body["rev"].(string)
+	assert.True(t, newRevid != revid)
+
+	assertStatus(t, rt.sendRequest("GET", "/db/doc1/attach1", ""), 404)
+	response = rt.sendRequest("GET", "/db/doc1/attach2", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), "attachment two")
+
+	// The previous revision still has the attachment:
+	response = rt.sendRequest("GET", "/db/doc1/attach1?rev="+revid, "")
+	assertStatus(t, response, 200)
+
+	// Deleting the last attachment removes _attachments:
+	response = rt.sendRequestWithHeaders("DELETE", "/db/doc1/attach2", "", map[string]string{"If-Match": newRevid})
+	assertStatus(t, response, 200)
+	body = db.Body{}
+	json.Unmarshal(rt.sendRequest("GET", "/db/doc1", "").Body.Bytes(), &body)
+	assert.Equals(t, body["_attachments"], nil)
+}
+
+func TestDeeplyNestedJSON(t *testing.T) {
+	var rt restTester
+	nested := func(depth int) string {
+		return `{"a":` + strings.Repeat("[", depth) + strings.Repeat("]", depth) + `}`
+	}
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", nested(base.DefaultMaxJSONDepth-1)), 201)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc2", nested(base.DefaultMaxJSONDepth)), 400)
+	assertStatus(t, rt.sendRequest("POST", "/db/_bulk_docs", `{"docs": [`+nested(5000)+`]}`), 400)
+}
+
 func TestBulkDocs(t *testing.T) {
 	var rt restTester
 	input := `{"docs": [{"_id": "bulk1", "n": 1}, {"_id": "bulk2", "n": 2}]}`
@@ -650,6 +936,238 @@ func TestOpenRevs(t *testing.T) {
 ]`)
 }
 
+func TestPutExistingRevTwice(t *testing.T) {
+	var rt restTester
+	input := `{"_rev": "2-b", "n": 2, "_revisions": {"start": 2, "ids": ["b", "a"]}}`
+	response := rt.sendRequest("PUT", "/db/doc?new_edits=false", input)
+	assertStatus(t, response, 201)
+	response = rt.sendRequest("PUT", "/db/doc?new_edits=false", input)
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["rev"], "2-b")
+}
+
+func TestDeletedDocWithBody(t *testing.T) {
+	var rt restTester
+	revid := rt.createDoc(t, "doc")
+
+	// Delete the doc by PUTting a tombstone with properties:
+	response := rt.sendRequest("PUT", "/db/doc?rev="+revid, `{"_deleted":true, "reason":"spam"}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	tombstoneRev := body["rev"].(string)
+
+	response = rt.sendRequest("GET", "/db/doc", "")
+	assertStatus(t, response, 404)
+
+	// The tombstone's properties are returned when it's requested by revision:
+	checkTombstone := func() {
+		response = rt.sendRequest("GET", "/db/doc?rev="+tombstoneRev, "")
+		assertStatus(t, response, 200)
+		body = nil
+		json.Unmarshal(response.Body.Bytes(), &body)
+		assert.DeepEquals(t, body, db.Body{"_id": "doc", "_rev": tombstoneRev, "_deleted": true,
+			"reason": "spam"})
+	}
+	checkTombstone()
+
+	// ...and in the changes feed:
+	response = rt.sendAdminRequest("GET", "/db/_changes?include_docs=true", "")
+	assertStatus(t, response, 200)
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.True(t, changes.Results[0].Deleted)
+	assert.Equals(t, changes.Results[0].Doc["reason"], "spam")
+
+	// ...even after the doc is resurrected:
+	response = rt.sendRequest("PUT", "/db/doc?rev="+tombstoneRev, `{"alive":true}`)
+	assertStatus(t, response, 201)
+	checkTombstone()
+}
+
+func TestChangesFormats(t *testing.T) {
+	var rt restTester
+	rt.createDoc(t, "doc1")
+	rt.createDoc(t, "doc2")
+
+	response := rt.sendAdminRequest("GET", "/db/_changes?format=ndjson", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Content-Type"), "application/x-ndjson")
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	assert.Equals(t, len(lines), 3)
+	var entry db.ChangeEntry
+	assert.Equals(t, json.Unmarshal([]byte(lines[0]), &entry), nil)
+	assert.Equals(t, entry.ID, "doc1")
+	var last struct {
+		LastSeq string `json:"last_seq"`
+	}
+	assert.Equals(t, json.Unmarshal([]byte(lines[2]), &last), nil)
+	assert.Equals(t, last.LastSeq, "v1.2")
+
+	response = rt.sendAdminRequest("GET", "/db/_changes?format=seqs", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equals(t, response.Body.String(), "v1.1\nv1.2\nlast_seq v1.2\n")
+
+	// The last line is there even if there are no changes:
+	response = rt.sendAdminRequest("GET", "/db/_changes?format=seqs&since=v1.2", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "last_seq v1.2\n")
+
+	// With sequence tokens turned off (for older gateways sharing the bucket) they're plain:
+	rt.ServerContext().Database("db").PlainSequences = true
+	response = rt.sendAdminRequest("GET", "/db/_changes?format=seqs", "")
+	assert.Equals(t, response.Body.String(), "1\n2\nlast_seq 2\n")
+	response = rt.sendAdminRequest("GET", "/db/_changes?format=seqs&since=v1.2", "")
+	assert.Equals(t, response.Body.String(), "last_seq 2\n")
+	rt.ServerContext().Database("db").PlainSequences = false
+
+	response = rt.sendAdminRequest("GET", "/db/_changes?format=json", "")
+	assertStatus(t, response, 200)
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &changes), nil)
+	assert.Equals(t, len(changes.Results), 2)
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_changes?format=xml", ""), 400)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_changes?feed=continuous&format=seqs", ""), 400)
+}
+
+func TestPendingChanges(t *testing.T) {
+	var pending pendingChanges
+	pending.add(&db.ChangeEntry{ID: "a", Seq: db.SequenceID{Seq: 1}})
+	pending.add(&db.ChangeEntry{ID: "b", Seq: db.SequenceID{Seq: 2}})
+	pending.add(&db.ChangeEntry{ID: "a", Seq: db.SequenceID{Seq: 3}})
+	assert.Equals(t, pending.count(), 2)
+	entries := pending.take()
+	assert.Equals(t, len(entries), 2)
+	assert.Equals(t, entries[0].ID, "b")
+	assert.Equals(t, entries[1].Seq.Seq, uint64(3))
+	assert.Equals(t, pending.count(), 0)
+}
+
+// Sets up a handler for testing generateContinuousChanges directly.
+func (rt *restTester) continuousChangesHandler() *handler {
+	database, _ := db.CreateDatabase(rt.ServerContext().Database("db"))
+	rq, _ := http.NewRequest("GET", "/db/_changes?feed=continuous", nil)
+	h := newHandler(rt.ServerContext(), adminPrivs, httptest.NewRecorder(), rq)
+	h.db = database
+	return h
+}
+
+func TestContinuousChangesSlowClient(t *testing.T) {
+	defer func(maxPending int, slowTimeout time.Duration) {
+		MaxPendingContinuousChanges = maxPending
+		SlowClientTimeout = slowTimeout
+	}(MaxPendingContinuousChanges, SlowClientTimeout)
+	MaxPendingContinuousChanges = 2
+
+	var rt restTester
+	for i := 1; i <= 3; i++ {
+		rt.createDoc(t, fmt.Sprintf("doc%d", i))
+	}
+
+	// A client that doesn't read anything for a while:
+	h := rt.continuousChangesHandler()
+	gate := make(chan struct{})
+	var received []string
+	send := func(changes []*db.ChangeEntry) error {
+		<-gate
+		for _, change := range changes {
+			received = append(received, change.ID)
+		}
+		return nil
+	}
+	done := make(chan error)
+	go func() {
+		done <- h.generateContinuousChanges(channels.SetOf("*"), db.ChangesOptions{Limit: 8}, send, nil)
+	}()
+
+	// Changes made meanwhile overflow the pending buffer, but the feed resumes once the client
+	// reads again, so none are lost:
+	time.Sleep(50 * time.Millisecond)
+	for i := 4; i <= 8; i++ {
+		rt.createDoc(t, fmt.Sprintf("doc%d", i))
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	assert.Equals(t, <-done, nil)
+	assert.DeepEquals(t, received, []string{"doc1", "doc2", "doc3", "doc4", "doc5", "doc6", "doc7", "doc8"})
+
+	// A client that doesn't read at all is given up on:
+	SlowClientTimeout = 50 * time.Millisecond
+	h = rt.continuousChangesHandler()
+	gate = make(chan struct{})
+	go func() {
+		done <- h.generateContinuousChanges(channels.SetOf("*"), db.ChangesOptions{}, send,
+			func() { close(gate) })
+	}()
+	select {
+	case err := <-done:
+		assert.Equals(t, err, errSlowClient)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Feed to slow client wasn't closed")
+	}
+}
+
+func TestRevAndIDMismatch(t *testing.T) {
+	var rt restTester
+	revid := rt.createDoc(t, "doc")
+
+	// Revision IDs given in more than one place have to agree:
+	response := rt.sendRequest("PUT", "/db/doc?rev="+revid, `{"_rev":"1-wrong", "n":2}`)
+	assertStatus(t, response, 400)
+	response = rt.sendRequestWithHeaders("PUT", "/db/doc?rev="+revid, `{"n":2}`,
+		map[string]string{"If-Match": "1-wrong"})
+	assertStatus(t, response, 400)
+	response = rt.sendRequestWithHeaders("DELETE", "/db/doc?rev="+revid, "",
+		map[string]string{"If-Match": "1-wrong"})
+	assertStatus(t, response, 400)
+	response = rt.sendRequest("PUT", "/db/doc?new_edits=false",
+		`{"_rev": "2-b", "_revisions": {"start": 2, "ids": ["c", "a"]}}`)
+	assertStatus(t, response, 400)
+
+	// So does the document ID:
+	response = rt.sendRequest("PUT", "/db/doc?rev="+revid, `{"_id":"other", "n":2}`)
+	assertStatus(t, response, 400)
+
+	// Agreeing ones are fine:
+	response = rt.sendRequestWithHeaders("PUT", "/db/doc?rev="+revid, `{"_id":"doc", "_rev":"`+revid+`"}`,
+		map[string]string{"If-Match": revid})
+	assertStatus(t, response, 201)
+}
+
+func TestOpenRevsLatest(t *testing.T) {
+	var rt restTester
+
+	input := `{"new_edits":false, "docs": [
+                    {"_id": "or1", "_rev": "12-abc", "n": 1,
+                     "_revisions": {"start": 12, "ids": ["abc", "eleven", "ten", "nine"]}}
+              ]}`
+	response := rt.sendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+
+	reqHeaders := map[string]string{
+		"Accept": "application/json",
+	}
+	// An ancestor revision resolves to the current leaf descended from it; duplicates are merged:
+	response = rt.sendRequestWithHeaders("GET", `/db/or1?open_revs=["10-ten","12-abc","5-bogus"]&latest=true`, "", reqHeaders)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), `[
+{"ok":{"_id":"or1","_rev":"12-abc","_revisions":{"ids":["abc","eleven","ten","nine"],"start":12},"n":1}}
+,{"missing":"5-bogus"}
+]`)
+
+	response = rt.sendRequestWithHeaders("GET", `/db/nosuchdoc?open_revs=["1-abc"]&latest=true`, "", reqHeaders)
+	assertStatus(t, response, 404)
+}
+
 func TestLocalDocs(t *testing.T) {
 	var rt restTester
 	response := rt.sendRequest("GET", "/db/_local/loc1", "")
@@ -694,6 +1212,35 @@ func TestLocalDocs(t *testing.T) {
 	assertStatus(t, response, 404)
 }
 
+func TestLocalDocsNotInAllDocs(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendRequest("PUT", "/db/_local/loc1", `{"hi": "there"}`), 201)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"hi": "there"}`), 201)
+
+	response := rt.sendRequest("GET", "/db/_all_docs", "")
+	assertStatus(t, response, 200)
+	var allDocs struct {
+		TotalRows int `json:"total_rows"`
+		Rows      []struct {
+			ID string `json:"id"`
+		} `json:"rows"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &allDocs)
+	assert.Equals(t, len(allDocs.Rows), 1)
+	assert.Equals(t, allDocs.Rows[0].ID, "doc1")
+
+	// Local docs have their own listing, on the admin port:
+	response = rt.sendRequest("GET", "/db/_local_docs", "")
+	assertStatus(t, response, 404)
+	response = rt.sendAdminRequest("GET", "/db/_local_docs", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body, db.Body{"total_rows": float64(1), "rows": []interface{}{
+		map[string]interface{}{"id": "_local/loc1", "key": "_local/loc1",
+			"value": map[string]interface{}{"rev": "0-1"}}}})
+}
+
 func TestResponseEncoding(t *testing.T) {
 	// Make a doc longer than 1k so the HTTP response will be compressed:
 	str := "DORKY "
@@ -744,6 +1291,147 @@ func TestLogin(t *testing.T) {
 	assert.True(t, response.Header().Get("Set-Cookie") != "")
 }
 
+func TestSessionGETUserCtx(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	a := rt.ServerContext().Database("db").Authenticator()
+	role, err := a.NewRole("hipster", channels.SetOf("fedoras"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, a.Save(role), nil)
+	user, err := a.NewUser("bernard", "letmein", channels.SetOf("bikes"))
+	assert.Equals(t, err, nil)
+	user.SetExplicitRoles(channels.TimedSet{"hipster": 1})
+	assert.Equals(t, a.Save(user), nil)
+
+	response := rt.send(requestByUser("GET", "/db/_session", "", "bernard"))
+	assertStatus(t, response, 200)
+	var body struct {
+		UserCtx struct {
+			Name     string
+			Channels map[string]interface{}
+			Roles    []string
+		}
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body.UserCtx.Name, "bernard")
+	assert.DeepEquals(t, body.UserCtx.Roles, []string{"hipster"})
+	assert.True(t, body.UserCtx.Channels["bikes"] != nil)
+	assert.True(t, body.UserCtx.Channels["fedoras"] != nil)
+}
+
+func TestBasicAuth(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	a := rt.ServerContext().Database("db").Authenticator()
+	user, err := a.NewUser("pupshaw", "letmein", channels.SetOf("*"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, a.Save(user), nil)
+
+	// No credentials (and the guest account is disabled):
+	response := rt.sendRequest("GET", "/db/", "")
+	assertStatus(t, response, 401)
+	assert.Equals(t, response.HeaderMap.Get("WWW-Authenticate"), kBasicAuthChallenge)
+
+	// Wrong password, or unknown user:
+	response = rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "pupshaw", "wrong")
+	assertStatus(t, response, 401)
+	assert.Equals(t, response.HeaderMap.Get("WWW-Authenticate"), kBasicAuthChallenge)
+	response = rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "nobody", "letmein")
+	assertStatus(t, response, 401)
+
+	response = rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "pupshaw", "letmein")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("WWW-Authenticate"), "")
+}
+
+func TestSessionHeaderAuth(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	a := rt.ServerContext().Database("db").Authenticator()
+	user, err := a.NewUser("pupshaw", "letmein", channels.SetOf("*"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, a.Save(user), nil)
+
+	response := rt.sendRequest("POST", "/db/_session", `{"name":"pupshaw", "password":"letmein"}`)
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	sessionID, _ := body["session_id"].(string)
+	assert.True(t, sessionID != "")
+
+	reqHeaders := map[string]string{"Authorization": "SyncGatewaySession " + sessionID}
+	response = rt.sendRequestWithHeaders("PUT", "/db/doc1", `{"hi": "there"}`, reqHeaders)
+	assertStatus(t, response, 201)
+	response = rt.sendRequestWithHeaders("GET", "/db/_session", "", reqHeaders)
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["userCtx"].(map[string]interface{})["name"], "pupshaw")
+
+	badHeaders := map[string]string{"Authorization": "SyncGatewaySession bogus"}
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/doc1", "", badHeaders), 401)
+
+	// Logging out with the header deletes the session:
+	assertStatus(t, rt.sendRequestWithHeaders("DELETE", "/db/_session", "", reqHeaders), 200)
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/doc1", "", reqHeaders), 401)
+}
+
+func TestSequenceETags(t *testing.T) {
+	var rt restTester
+	dbc := rt.ServerContext().Database("db")
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"n": 1}`), 201)
+	dbc.WaitForPendingChanges()
+
+	for _, path := range []string{"/db/_changes", "/db/_all_docs"} {
+		response := rt.sendRequest("GET", path, "")
+		assertStatus(t, response, 200)
+		etag := response.HeaderMap.Get("Etag")
+		assert.True(t, etag != "")
+
+		// Unchanged results aren't sent again:
+		response = rt.sendRequestWithHeaders("GET", path, "", map[string]string{"If-None-Match": etag})
+		assertStatus(t, response, 304)
+		assert.Equals(t, response.Body.Len(), 0)
+		response = rt.sendRequestWithHeaders("GET", path, "",
+			map[string]string{"If-None-Match": `"bogus", ` + etag})
+		assertStatus(t, response, 304)
+
+		// Any change to the database changes the ETag:
+		assertStatus(t, rt.sendRequest("PUT", "/db/doc"+path[5:], `{"n": 2}`), 201)
+		dbc.WaitForPendingChanges()
+		response = rt.sendRequestWithHeaders("GET", path, "", map[string]string{"If-None-Match": etag})
+		assertStatus(t, response, 200)
+		assert.True(t, response.HeaderMap.Get("Etag") != etag)
+	}
+
+	// Longpoll feeds and POSTs don't get ETags:
+	response := rt.sendRequest("GET", "/db/_changes?feed=longpoll&since=0", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Etag"), "")
+	response = rt.sendRequest("POST", "/db/_all_docs", `{"keys": ["doc1"]}`)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Etag"), "")
+}
+
+func TestMaxLongpollAge(t *testing.T) {
+	var rt restTester
+	maxLongpollMs := uint64(50)
+	rt.ServerContext().config.MaxLongpollMs = &maxLongpollMs
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"n": 1}`), 201)
+	dbc, _ := rt.ServerContext().GetDatabase("db")
+	dbc.WaitForPendingChanges()
+
+	// The feed gives up waiting long before the heartbeat would be sent:
+	start := time.Now()
+	response := rt.sendRequest("GET", "/db/_changes?feed=longpoll&since=1&heartbeat=30000", "")
+	assertStatus(t, response, 200)
+	assert.True(t, time.Since(start) < 10*time.Second)
+	var changes struct {
+		Results []db.ChangeEntry
+		LastSeq string `json:"last_seq"`
+	}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &changes), nil)
+	assert.Equals(t, len(changes.Results), 0)
+	assert.Equals(t, changes.LastSeq, "v1.1")
+}
+
 func TestReadChangesOptionsFromJSON(t *testing.T) {
 	optStr := `{"feed":"longpoll", "since": "123456:78", "limit":123, "style": "all_docs",
 				"include_docs": true, "filter": "Melitta", "channels": "ABC,BBC"}`
@@ -812,6 +1500,18 @@ func TestAccessControl(t *testing.T) {
 	response = rt.send(request)
 	assertStatus(t, response, 403)
 
+	// ...or its attachment, even by revision:
+	var attBody db.Body
+	json.Unmarshal(rt.sendAdminRequest("GET", "/db/doc2", "").Body.Bytes(), &attBody)
+	response = rt.sendAdminRequest("PUT", "/db/doc2/att?rev="+attBody["_rev"].(string), "data")
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &attBody)
+	for _, path := range []string{"/db/doc2/att", "/db/doc2/att?rev=" + attBody["rev"].(string)} {
+		request, _ = http.NewRequest("GET", path, nil)
+		request.SetBasicAuth("alice", "letmein")
+		assertStatus(t, rt.send(request), 403)
+	}
+
 	// Check that _all_docs only returns the docs the user has access to:
 	request, _ = http.NewRequest("GET", "/db/_all_docs?channels=true", nil)
 	request.SetBasicAuth("alice", "letmein")
@@ -1217,6 +1917,11 @@ func TestRoleAssignmentBeforeUserExists(t *testing.T) {
 	assert.DeepEquals(t, body["roles"], []interface{}{"role1"})
 	assert.DeepEquals(t, body["all_channels"], []interface{}{"!", "chan1"})
 
+	// A role name without the "role:" prefix is rejected, saying why:
+	response = rt.send(request("PUT", "/db/doc2", `{"user":"user1", "role":"role1", "channel":"chan1"}`))
+	assertStatus(t, response, 400)
+	assert.True(t, strings.Contains(string(response.Body.Bytes()), `does not begin with \"role:\"`))
+
 	//assert.DeepEquals(t, body["admin_roles"], []interface{}{"hipster"})
 	//assert.DeepEquals(t, body["all_channels"], []interface{}{"bar", "fedoras", "fixies", "foo"})
 }
@@ -1275,14 +1980,14 @@ func TestRoleAccessChanges(t *testing.T) {
 	json.Unmarshal(response.Body.Bytes(), &changes)
 	assert.Equals(t, len(changes.Results), 2)
 	since := changes.Last_Seq
-	assert.Equals(t, since, "3")
+	assert.Equals(t, since, "v1.3")
 
 	response = rt.send(requestByUser("GET", "/db/_changes", "", "zegpold"))
 	log.Printf("2nd _changes looks like: %s", response.Body.Bytes())
 	json.Unmarshal(response.Body.Bytes(), &changes)
 	assert.Equals(t, len(changes.Results), 1)
 	since = changes.Last_Seq
-	assert.Equals(t, since, "4")
+	assert.Equals(t, since, "v1.4")
 
 	// Update "fashion" doc to grant zegpold the role "hipster" and take it away from alice:
 	str := fmt.Sprintf(`{"user":"zegpold", "role":"role:hipster", "_rev":%q}`, fashionRevID)
@@ -1300,7 +2005,7 @@ func TestRoleAccessChanges(t *testing.T) {
 	log.Printf("3rd _changes looks like: %s", response.Body.Bytes())
 	json.Unmarshal(response.Body.Bytes(), &changes)
 	assert.Equals(t, len(changes.Results), 2)
-	assert.Equals(t, changes.Last_Seq, "6:2")
+	assert.Equals(t, changes.Last_Seq, "v1.6:2")
 	assert.Equals(t, changes.Results[0].ID, "b1")
 	assert.Equals(t, changes.Results[1].ID, "g1")
 
@@ -1525,6 +2230,42 @@ func TestAttachmentsNoCrossTalk(t *testing.T) {
 
 }
 
+func TestOpenRevsAttsSince(t *testing.T) {
+	var rt restTester
+
+	doc1revId := rt.createDoc(t, "doc1")
+	response := rt.sendRequestWithHeaders("PUT", "/db/doc1/attach1?rev="+doc1revId, "attachment body",
+		map[string]string{"Content-Type": "text/plain"})
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revid := body["rev"].(string)
+
+	reqHeaders := map[string]string{
+		"Accept": "application/json",
+	}
+
+	// Without atts_since, open_revs includes the attachment data:
+	var results []db.Body
+	response = rt.sendRequestWithHeaders("GET", fmt.Sprintf(`/db/doc1?open_revs=["%s"]`, revid), "", reqHeaders)
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &results), nil)
+	attach1 := results[0]["ok"].(map[string]interface{})["_attachments"].(map[string]interface{})["attach1"].(map[string]interface{})
+	assert.True(t, attach1["data"] != nil)
+
+	// With atts_since naming a revision that already had the attachment, it's sent as a stub:
+	results = nil
+	response = rt.sendRequestWithHeaders("GET", fmt.Sprintf(`/db/doc1?open_revs=["%s"]&atts_since=["%s"]`, revid, revid), "", reqHeaders)
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &results), nil)
+	attach1 = results[0]["ok"].(map[string]interface{})["_attachments"].(map[string]interface{})["attach1"].(map[string]interface{})
+	assert.True(t, attach1["data"] == nil)
+	assert.Equals(t, attach1["stub"], true)
+
+	response = rt.sendRequestWithHeaders("GET", fmt.Sprintf(`/db/doc1?open_revs=["%s"]&atts_since=bogus`, revid), "", reqHeaders)
+	assertStatus(t, response, 400)
+}
+
 func TestOldDocHandling(t *testing.T) {
 
 	rt := restTester{syncFn: `
@@ -1782,6 +2523,16 @@ func TestCreateTarget(t *testing.T) {
 	assertStatus(t, response, 403)
 }
 
+func TestDeleteDBOnlyOnAdminAPI(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendRequest("DELETE", "/db/", ""), 403)
+	assertStatus(t, rt.sendRequest("DELETE", "/foo/", ""), 403)
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 200)
+
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/", ""), 200)
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 410)
+}
+
 // Test for issue 758 - basic auth with stale session cookie
 func TestBasicAuthWithSessionCookie(t *testing.T) {
 
@@ -1824,3 +2575,134 @@ func TestBasicAuthWithSessionCookie(t *testing.T) {
 	assertStatus(t, response, 200)
 
 }
+
+// A Middleware that refuses requests without a quota header, rejects docs containing an "ssn"
+// property, and counts writes.
+type testMiddleware struct {
+	BaseMiddleware
+	users  []string
+	writes []string
+}
+
+func (m *testMiddleware) PreAuth(rc *RequestContext) error {
+	if !rc.Admin && rc.Request.Header.Get("X-Quota-Key") == "" {
+		return base.HTTPErrorf(kStatusTooManyRequests, "No quota")
+	}
+	rc.Values["key"] = rc.Request.Header.Get("X-Quota-Key")
+	return nil
+}
+
+func (m *testMiddleware) PostAuth(rc *RequestContext) error {
+	if rc.User != nil {
+		m.users = append(m.users, rc.User.Name())
+	}
+	return nil
+}
+
+func (m *testMiddleware) PreWrite(rc *RequestContext, docid string, body db.Body) error {
+	if body["ssn"] != nil {
+		return base.HTTPErrorf(http.StatusForbidden, "Sensitive data")
+	}
+	body["scanned"] = true
+	return nil
+}
+
+func (m *testMiddleware) PostWrite(rc *RequestContext, docid, revid string, body db.Body) {
+	m.writes = append(m.writes, fmt.Sprintf("%v:%s", rc.Values["key"], docid))
+	rc.ResponseHeader.Set("X-Writes", fmt.Sprintf("%d", len(m.writes)))
+}
+
+func TestMiddleware(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	m := &testMiddleware{}
+	rt.ServerContext().AddMiddleware(m)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), 429)
+	quota := map[string]string{"X-Quota-Key": "k1"}
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/", "", quota, "alice", "letmein"), 200)
+	assert.DeepEquals(t, m.users, []string{"alice"})
+
+	response := rt.sendUserRequestWithHeaders("PUT", "/db/doc", `{"ssn":"123-45-6789"}`, quota, "alice", "letmein")
+	assertStatus(t, response, 403)
+	response = rt.sendUserRequestWithHeaders("PUT", "/db/doc", `{"name":"alice"}`, quota, "alice", "letmein")
+	assertStatus(t, response, 201)
+	assert.Equals(t, response.Header().Get("X-Writes"), "1")
+	assert.DeepEquals(t, m.writes, []string{"k1:doc"})
+
+	// The PreWrite hook's change to the body was saved:
+	response = rt.sendAdminRequest("GET", "/db/doc", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["scanned"], true)
+
+	// A pushed revision can be rejected, but not changed, since its ID is already fixed:
+	response = rt.sendUserRequestWithHeaders("POST", "/db/_bulk_docs",
+		`{"new_edits":false, "docs":[{"_id":"doc2", "_rev":"1-abc", "ssn":"123-45-6789"},
+		                             {"_id":"doc3", "_rev":"1-abc", "name":"bob"}]}`, quota, "alice", "letmein")
+	assertStatus(t, response, 201)
+	var results []bulkDocsResult
+	json.Unmarshal(response.Body.Bytes(), &results)
+	assert.Equals(t, results[0].Status, 403)
+	assert.Equals(t, results[1].Error, "")
+	body = nil
+	json.Unmarshal(rt.sendAdminRequest("GET", "/db/doc3", "").Body.Bytes(), &body)
+	assert.Equals(t, body["name"], "bob")
+	assert.Equals(t, body["scanned"], nil)
+}
+
+func TestAcceptHeaderAndPretty(t *testing.T) {
+	var rt restTester
+	revid := rt.createDoc(t, "doc1")
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1/att.txt?rev="+revid, "hello"), 201)
+	get := func(path, accept string) *testResponse {
+		return rt.sendRequestWithHeaders("GET", path, "", map[string]string{"Accept": accept})
+	}
+
+	assertStatus(t, get("/db/doc1", "application/json"), 200)
+	assertStatus(t, get("/db/doc1", "text/html, application/*;q=0.5"), 200)
+	assertStatus(t, get("/db/doc1", "text/html;level=1, */*;q=0.1"), 200)
+	response := get("/db/doc1", "text/html")
+	assertStatus(t, response, 406)
+	assert.True(t, strings.Contains(string(response.Body.Bytes()), "text/html"))
+	assertStatus(t, get("/db/doc1", "text/html, application/json;q=0"), 406)
+	// A more specific range takes precedence over a wildcard, whichever comes first:
+	assertStatus(t, get("/db/doc1", "*/*, application/json;q=0"), 406)
+	assertStatus(t, get("/db/doc1", "application/*;q=0, */*"), 406)
+	assertStatus(t, get("/db/doc1", "application/json, */*;q=0"), 200)
+
+	// Attachments aren't JSON:
+	response = get("/db/doc1/att.txt", "text/plain")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), "hello")
+
+	response = rt.sendRequest("GET", "/db/doc1", "")
+	assert.False(t, strings.Contains(string(response.Body.Bytes()), "\n"))
+	response = rt.sendRequest("GET", "/db/doc1?pretty=true", "")
+	assertStatus(t, response, 200)
+	assert.True(t, strings.Contains(string(response.Body.Bytes()), "\n  \"_id\": \"doc1\""))
+}
+
+func TestSyncFnRejectionStatus(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {
+		if (doc.kind == "secret") throw({unauthorized: "log in first"});
+		if (doc.kind == "private") throw({forbidden: "not yours"});
+		if (doc.kind == "buggy") throw("oops");
+		channel("public");
+	}`}
+	response := rt.sendRequest("PUT", "/db/doc1", `{"kind": "secret"}`)
+	assertStatus(t, response, 401)
+	assert.Equals(t, response.Header().Get("WWW-Authenticate"), kBasicAuthChallenge)
+	response = rt.sendRequest("PUT", "/db/doc1", `{"kind": "private"}`)
+	assertStatus(t, response, 403)
+	assert.Equals(t, response.Header().Get("WWW-Authenticate"), "")
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"kind": "buggy"}`), 500)
+
+	// Nothing was saved, and no sequences were used up:
+	assertStatus(t, rt.sendRequest("GET", "/db/doc1", ""), 404)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"kind": "ok"}`), 201)
+	dbc, _ := rt.ServerContext().GetDatabase("db")
+	lastSeq, _ := dbc.LastSequence()
+	assert.Equals(t, lastSeq, uint64(1))
+}
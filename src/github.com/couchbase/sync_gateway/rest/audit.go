@@ -0,0 +1,69 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Returns an audit event describing the handler's request, with the given type.
+func (h *handler) auditEvent(event string) base.AuditEvent {
+	e := base.AuditEvent{
+		Event:    event,
+		DB:       h.PathVar("db"),
+		Admin:    h.privs == adminPrivs,
+		ClientIP: h.server.clientIP(h.rq),
+		Method:   h.rq.Method,
+		Path:     h.rq.URL.Path,
+		DocID:    h.PathVar("docid"),
+		Status:   h.status,
+		Message:  h.authMethod,
+	}
+	if h.user != nil {
+		e.User = h.user.Name()
+	} else {
+		e.User = h.authName
+	}
+	return e
+}
+
+// Called after a request has been handled, to record any audit events it caused.
+func (h *handler) auditRequest() {
+	if !base.AuditEnabled() {
+		return
+	}
+	if h.status == http.StatusUnauthorized || (h.status == kStatusTooManyRequests && h.authMethod != "") {
+		base.Audit(h.auditEvent(base.AuditLoginFailure))
+	} else if h.authMethod != "" && h.user != nil {
+		base.Audit(h.auditEvent(base.AuditLoginSuccess))
+	}
+	if h.status == http.StatusForbidden {
+		base.Audit(h.auditEvent(base.AuditAccessDenied))
+	}
+	if h.privs == adminPrivs && h.rq.Method != "GET" && h.rq.Method != "HEAD" {
+		base.Audit(h.auditEvent(base.AuditAdminOperation))
+	}
+}
+
+// Records the creation of a login session.
+func (h *handler) auditSession(session *auth.LoginSession) {
+	if !base.AuditEnabled() {
+		return
+	}
+	e := h.auditEvent(base.AuditSessionCreated)
+	e.User = session.Username
+	e.Status = 0
+	e.Message = "expires " + session.Expiration.Format(time.RFC3339)
+	base.Audit(e)
+}
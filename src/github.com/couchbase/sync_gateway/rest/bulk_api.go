@@ -61,6 +61,10 @@ func (h *handler) handleAllDocs() error {
 		}
 	}
 
+	if h.checkSequenceETag() {
+		return nil
+	}
+
 	// Get the set of channels the user has access to; nil if user is admin or has access to user "*"
 	var availableChannels channels.TimedSet
 	if h.user != nil {
@@ -230,7 +234,7 @@ func (h *handler) handleDump() error {
 	viewName := h.PathVar("view")
 	base.LogTo("HTTP", "Dump view %q", viewName)
 	opts := db.Body{"stale": false, "reduce": false}
-	result, err := h.db.Bucket.View(db.DesignDocSyncGateway, viewName, opts)
+	result, err := h.db.QueryDesignDoc(db.DesignDocSyncGateway, viewName, opts)
 	if err != nil {
 		return err
 	}
@@ -303,59 +307,54 @@ func (h *handler) handleBulkGet() error {
 		return err
 	}
 
-	err = h.writeMultipart("mixed", func(writer *multipart.Writer) error {
-		for _, item := range body["docs"].([]interface{}) {
-			var body db.Body
-			var attsSince []string
-			var err error
-
-			doc := item.(map[string]interface{})
-			docid, _ := doc["id"].(string)
-			revid := ""
-			revok := true
-			if doc["rev"] != nil {
-				revid, revok = doc["rev"].(string)
-			}
-			if docid == "" || !revok {
-				err = base.HTTPErrorf(http.StatusBadRequest, "Invalid doc/rev ID in _bulk_get")
-			} else {
-				if includeAttachments {
-					if doc["atts_since"] != nil {
-						raw, ok := doc["atts_since"].([]interface{})
-						if ok {
-							attsSince = make([]string, len(raw))
-							for i := 0; i < len(raw); i++ {
-								attsSince[i], ok = raw[i].(string)
-								if !ok {
-									break
-								}
-							}
-						}
+	// Parse the requested docs/revs first, so they can be fetched in parallel:
+	items, _ := body["docs"].([]interface{})
+	fetches := make([]db.RevFetch, len(items))
+	for i, item := range items {
+		fetch := &fetches[i]
+		doc, _ := item.(map[string]interface{})
+		fetch.DocID, _ = doc["id"].(string)
+		revok := true
+		if doc["rev"] != nil {
+			fetch.RevID, revok = doc["rev"].(string)
+		}
+		if fetch.DocID == "" || !revok {
+			fetch.Err = base.HTTPErrorf(http.StatusBadRequest, "Invalid doc/rev ID in _bulk_get")
+		} else if includeAttachments {
+			if doc["atts_since"] != nil {
+				raw, ok := doc["atts_since"].([]interface{})
+				if ok {
+					fetch.AttachmentsSince = make([]string, len(raw))
+					for i := 0; i < len(raw); i++ {
+						fetch.AttachmentsSince[i], ok = raw[i].(string)
 						if !ok {
-							err = base.HTTPErrorf(http.StatusBadRequest, "Invalid atts_since")
+							break
 						}
-					} else {
-						attsSince = []string{}
 					}
 				}
+				if !ok {
+					fetch.Err = base.HTTPErrorf(http.StatusBadRequest, "Invalid atts_since")
+				}
+			} else {
+				fetch.AttachmentsSince = []string{}
 			}
+		}
+	}
 
-			if err == nil {
-				body, err = h.db.GetRev(docid, revid, includeRevs, attsSince)
-			}
-
-			if err != nil {
+	err = h.writeMultipart("mixed", func(writer *multipart.Writer) error {
+		h.db.ForEachRev(fetches, includeRevs, func(fetch *db.RevFetch) {
+			body := fetch.Body
+			if fetch.Err != nil {
 				// Report error in the response for this doc:
-				status, reason := base.ErrorAsHTTPStatus(err)
+				status, reason := base.ErrorAsHTTPStatus(fetch.Err)
 				errStr := base.CouchHTTPErrorName(status)
-				body = db.Body{"id": docid, "error": errStr, "reason": reason, "status": status}
-				if revid != "" {
-					body["rev"] = revid
+				body = db.Body{"id": fetch.DocID, "error": errStr, "reason": reason, "status": status}
+				if fetch.RevID != "" {
+					body["rev"] = fetch.RevID
 				}
 			}
-
-			h.db.WriteRevisionAsPart(body, err != nil, canCompress, writer)
-		}
+			h.db.WriteRevisionAsPart(body, fetch.Err != nil, canCompress, writer)
+		})
 		return nil
 	})
 
@@ -376,7 +375,7 @@ func (h *handler) handleBulkDocs() error {
 	docs := body["docs"].([]interface{})
 	h.db.ReserveSequences(uint64(len(docs)))
 
-	result := make([]db.Body, 0, len(docs))
+	result := make([]bulkDocsResult, 0, len(docs))
 	for _, item := range docs {
 		doc := item.(map[string]interface{})
 		docid, _ := doc["_id"].(string)
@@ -398,19 +397,16 @@ func (h *handler) handleBulkDocs() error {
 			}
 		}
 
-		status := db.Body{}
-		if docid != "" {
-			status["id"] = docid
-		}
+		status := bulkDocsResult{ID: docid}
 		if err != nil {
 			code, msg := base.ErrorAsHTTPStatus(err)
-			status["status"] = code
-			status["error"] = base.CouchHTTPErrorName(code)
-			status["reason"] = msg
+			status.Status = code
+			status.Error = base.CouchHTTPErrorName(code)
+			status.Reason = msg
 			base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
 			err = nil // wrote it to output already; not going to return it
 		} else {
-			status["rev"] = revid
+			status.Rev = revid
 		}
 		result = append(result, status)
 	}
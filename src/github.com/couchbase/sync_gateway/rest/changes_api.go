@@ -11,6 +11,7 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -33,6 +34,19 @@ const kDefaultTimeoutMS = 5 * 60 * 1000
 // Maximum value of _changes?timeout property
 const kMaxTimeoutMS = 15 * 60 * 1000
 
+// Default for ServerConfig.MaxLongpollMs. A longpoll request with a heartbeat has no timeout, so
+// without a limit an idle one would hold its connection open indefinitely.
+const kDefaultMaxLongpollMS = kMaxTimeoutMS
+
+// Values of the _changes?format property, which selects how a normal or longpoll feed is sent.
+// In the line-based formats a longpoll feed's heartbeats are blank lines, which clients should
+// skip; the last line is always the last_seq to resume from.
+const (
+	changesFormatJSON   = "json"   // The standard {"results":[...], "last_seq":...} object
+	changesFormatNDJSON = "ndjson" // One entry per line, then a line with {"last_seq":...}
+	changesFormatSeqs   = "seqs"   // Plain text: each entry's sequence token, then "last_seq <token>"
+)
+
 func (h *handler) handleRevsDiff() error {
 	var input map[string][]string
 	err := h.readJSONInto(&input)
@@ -127,15 +141,30 @@ func (h *handler) handleChanges() error {
 	h.db.ChangesClientStats.Increment()
 	defer h.db.ChangesClientStats.Decrement()
 
+	format := h.getQuery("format")
+	switch format {
+	case "":
+		format = changesFormatJSON
+	case changesFormatJSON, changesFormatNDJSON, changesFormatSeqs:
+		if feed != "normal" && feed != "" && feed != "longpoll" {
+			return base.HTTPErrorf(http.StatusBadRequest, "format is only supported by normal and longpoll feeds")
+		}
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown changes format")
+	}
+
 	options.Terminator = make(chan bool)
 	defer close(options.Terminator)
 
 	switch feed {
 	case "normal", "":
-		return h.sendSimpleChanges(userChannels, options)
+		if h.checkSequenceETag() {
+			return nil
+		}
+		return h.sendSimpleChanges(userChannels, options, format)
 	case "longpoll":
 		options.Wait = true
-		return h.sendSimpleChanges(userChannels, options)
+		return h.sendSimpleChanges(userChannels, options, format)
 	case "continuous":
 		return h.sendContinuousChangesByHTTP(userChannels, options)
 	case "websocket":
@@ -145,7 +174,16 @@ func (h *handler) handleChanges() error {
 	}
 }
 
-func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions) error {
+// Returns a sequence in the form clients should store and send back as 'since': a versioned
+// SequenceToken, unless the database is configured to send plain sequences.
+func (h *handler) clientSequence(seq db.SequenceID) string {
+	if h.db.PlainSequences {
+		return seq.String()
+	}
+	return db.NewSequenceToken(seq).String()
+}
+
+func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions, format string) error {
 	lastSeq := options.Since
 	var first bool = true
 	feed, err := h.db.MultiChangesFeed(channels, options)
@@ -153,15 +191,25 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 		return err
 	}
 
-	h.setHeader("Content-Type", "application/json")
-	h.response.Write([]byte("{\"results\":[\r\n"))
+	switch format {
+	case changesFormatNDJSON:
+		h.setHeader("Content-Type", "application/x-ndjson")
+	case changesFormatSeqs:
+		h.setHeader("Content-Type", "text/plain; charset=utf-8")
+	default:
+		h.setHeader("Content-Type", "application/json")
+		h.response.Write([]byte("{\"results\":[\r\n"))
+	}
 	if options.Wait {
 		h.flush()
 	}
 	message := "OK"
 	if feed != nil {
-		var heartbeat, timeout <-chan time.Time
+		var heartbeat, timeout, maxAge <-chan time.Time
 		if options.Wait {
+			restExpvars.Add("longpolls_active", 1)
+			defer restExpvars.Add("longpolls_active", -1)
+
 			// Set up heartbeat/timeout
 			if options.HeartbeatMs > 0 {
 				ticker := time.NewTicker(time.Duration(options.HeartbeatMs) * time.Millisecond)
@@ -172,6 +220,17 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 				defer timer.Stop()
 				timeout = timer.C
 			}
+
+			// The server's limit applies regardless of what the client asked for:
+			maxLongpollMs := uint64(kDefaultMaxLongpollMS)
+			if h.server.config.MaxLongpollMs != nil {
+				maxLongpollMs = *h.server.config.MaxLongpollMs
+			}
+			if maxLongpollMs > 0 {
+				timer := time.NewTimer(time.Duration(maxLongpollMs) * time.Millisecond)
+				defer timer.Stop()
+				maxAge = timer.C
+			}
 		}
 
 		encoder := json.NewEncoder(h.response)
@@ -183,12 +242,19 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 					break loop // end of feed
 				}
 				if nil != entry {
-					if first {
-						first = false
-					} else {
-						h.response.Write([]byte(","))
+					switch format {
+					case changesFormatNDJSON:
+						err = encoder.Encode(entry)
+					case changesFormatSeqs:
+						_, err = h.response.Write([]byte(h.clientSequence(entry.Seq) + "\n"))
+					default:
+						if first {
+							first = false
+						} else {
+							h.response.Write([]byte(","))
+						}
+						encoder.Encode(entry)
 					}
-					encoder.Encode(entry)
 					lastSeq = entry.Seq
 				}
 
@@ -198,6 +264,10 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 			case <-timeout:
 				message = "OK (timeout)"
 				break loop
+			case <-maxAge:
+				restExpvars.Add("longpolls_expired", 1)
+				message = "OK (max longpoll age)"
+				break loop
 			}
 			if err != nil {
 				h.logStatus(599, fmt.Sprintf("Write error: %v", err))
@@ -205,17 +275,79 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 			}
 		}
 	}
-	s := fmt.Sprintf("],\n\"last_seq\":%q}\n", lastSeq.String())
-	h.response.Write([]byte(s))
+	switch format {
+	case changesFormatNDJSON:
+		h.response.Write([]byte(fmt.Sprintf("{\"last_seq\":%q}\n", h.clientSequence(lastSeq))))
+	case changesFormatSeqs:
+		h.response.Write([]byte(fmt.Sprintf("last_seq %s\n", h.clientSequence(lastSeq))))
+	default:
+		s := fmt.Sprintf("],\n\"last_seq\":%q}\n", h.clientSequence(lastSeq))
+		h.response.Write([]byte(s))
+	}
 	h.logStatus(http.StatusOK, message)
 	return nil
 }
 
+// Max number of changes held in memory for a continuous feed whose client isn't reading them as
+// fast as they arrive. Past that, the held changes are dropped and the feed resumes from the last
+// sequence actually sent, once the client catches up.
+var MaxPendingContinuousChanges = 1000
+
+// How long a write to a continuous feed's client can be blocked before the feed gives up on it.
+var SlowClientTimeout = 2 * time.Minute
+
+// How long an HTTP continuous feed that's timed out waits for its last write to finish, before
+// the connection is dropped.
+var SlowClientGracePeriod = 5 * time.Second
+
+// Returned by generateContinuousChanges when it gives up on a client that's not reading.
+var errSlowClient = errors.New("client isn't reading the changes feed")
+
+// Changes waiting to be sent to a continuous feed client. A change to a doc that's already
+// pending replaces the earlier one, since the client only needs to hear about the latest.
+type pendingChanges struct {
+	entries []*db.ChangeEntry
+	docs    map[string]int // index in entries of each doc's change
+}
+
+func (p *pendingChanges) add(entry *db.ChangeEntry) {
+	if p.docs == nil {
+		p.docs = map[string]int{}
+	}
+	if i, found := p.docs[entry.ID]; found {
+		p.entries[i] = nil
+	}
+	p.docs[entry.ID] = len(p.entries)
+	p.entries = append(p.entries, entry)
+}
+
+func (p *pendingChanges) count() int {
+	return len(p.docs)
+}
+
+// Removes and returns all the pending changes, in sequence order.
+func (p *pendingChanges) take() []*db.ChangeEntry {
+	entries := make([]*db.ChangeEntry, 0, len(p.docs))
+	for _, entry := range p.entries {
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	p.entries = nil
+	p.docs = nil
+	return entries
+}
+
 // This is the core functionality of both the HTTP and WebSocket-based continuous change feed.
 // It defers to a callback function 'send()' to actually send the changes to the client.
 // It will call send(nil) to notify that it's caught up and waiting for new changes, or as
 // a periodic heartbeat while waiting.
-func (h *handler) generateContinuousChanges(inChannels base.Set, options db.ChangesOptions, send func([]*db.ChangeEntry) error) error {
+//
+// send() is called on a separate goroutine, so that a client that's slow to read can't make
+// changes pile up without bound: see MaxPendingContinuousChanges and SlowClientTimeout. If the
+// client is given up on, abort() (if non-nil) is called to unblock the write in progress, and
+// errSlowClient is returned once it's finished.
+func (h *handler) generateContinuousChanges(inChannels base.Set, options db.ChangesOptions, send func([]*db.ChangeEntry) error, abort func()) error {
 	// Set up heartbeat/timeout
 	var timeoutInterval time.Duration
 	var timer *time.Timer
@@ -233,27 +365,64 @@ func (h *handler) generateContinuousChanges(inChannels base.Set, options db.Chan
 		}()
 	}
 
+	// Start the goroutine that writes to the client:
+	writes := make(chan []*db.ChangeEntry)
+	writeResults := make(chan error, 1)
+	go func() {
+		for changes := range writes {
+			writeResults <- send(changes)
+		}
+	}()
+	writing := false // true while a write is in progress
+	defer func() {
+		if writing {
+			<-writeResults // the handler can't return while the response is being written
+		}
+		close(writes)
+	}()
+
 	options.Wait = true       // we want the feed channel to wait for changes
 	options.Continuous = true // and to keep sending changes indefinitely
-	var lastSeq db.SequenceID
+	startSeq := options.Since
+	var receivedSeq, sentSeq db.SequenceID
 	var feed <-chan *db.ChangeEntry
-	var timeout <-chan time.Time
+	var feedTerminator chan bool
+	stopFeed := func() {
+		if feedTerminator != nil {
+			close(feedTerminator)
+			feedTerminator = nil
+		}
+		feed = nil
+	}
+	defer stopFeed()
+
+	var pending pendingChanges
+	caughtUp := false   // need to tell the client it's caught up
+	overflowed := false // dropped pending changes; resume from sentSeq once the client catches up
+	done := false       // reached the limit; finish writing and stop
+	var slowTimer *time.Timer
+	var slow, timeout <-chan time.Time
 	var err error
 
 loop:
 	for {
-		if feed == nil {
+		if feed == nil && !done && !(overflowed && writing) {
 			// Refresh the feed of all current changes:
-			if lastSeq.Seq > 0 { // start after end of last feed
-				options.Since = lastSeq
+			if receivedSeq.Seq > 0 { // start after end of last feed
+				options.Since = receivedSeq
+			} else {
+				options.Since = startSeq
 			}
 			if h.db.IsClosed() {
 				break loop
 			}
+			feedTerminator = make(chan bool)
+			options.Terminator = feedTerminator
 			feed, err = h.db.MultiChangesFeed(inChannels, options)
 			if err != nil || feed == nil {
 				return err
 			}
+			overflowed = false
 		}
 
 		if timeoutInterval > 0 && timer == nil {
@@ -262,63 +431,89 @@ loop:
 			timeout = timer.C
 		}
 
-		// Wait for either a new change, a heartbeat, or a timeout:
+		// Send pending changes, or the caught-up notification, if the writer's idle:
+		var writeTo chan<- []*db.ChangeEntry
+		var batch []*db.ChangeEntry
+		if !writing && (pending.count() > 0 || caughtUp) {
+			writeTo = writes
+			if pending.count() > 0 {
+				batch = pending.take()
+				if options.Limit > 0 && len(batch) >= options.Limit {
+					batch = batch[0:options.Limit]
+				}
+			}
+		}
+
+		// Wait for either a new change, a finished write, a heartbeat, or a timeout:
 		select {
 		case entry, ok := <-feed:
 			if !ok {
 				feed = nil
+				if h.db.CredentialsRevoked() {
+					break loop // the user's password changed, or they were disabled or deleted
+				}
 			} else if entry == nil {
-				err = send(nil)
+				caughtUp = true
 			} else {
-				entries := []*db.ChangeEntry{entry}
-				waiting := false
-				// Batch up as many entries as we can without waiting:
-			collect:
-				for len(entries) < 20 {
-					select {
-					case entry, ok = <-feed:
-						if !ok {
-							feed = nil
-							break collect
-						} else if entry == nil {
-							waiting = true
-							break collect
-						}
-						entries = append(entries, entry)
-					default:
-						break collect
-					}
-				}
-				base.LogTo("Changes", "sending %d change(s)", len(entries))
-				err = send(entries)
-
-				if err == nil && waiting {
-					err = send(nil)
+				pending.add(entry)
+				receivedSeq = entry.Seq
+				if pending.count() > MaxPendingContinuousChanges {
+					base.LogTo("Changes", "Client is reading slowly; dropping %d pending changes, will resume from %s",
+						pending.count(), sentSeq)
+					pending.take()
+					stopFeed()
+					receivedSeq = sentSeq
+					overflowed = true
 				}
-
-				lastSeq = entries[len(entries)-1].Seq
+			}
+		case writeTo <- batch:
+			writing = true
+			slowTimer = time.NewTimer(SlowClientTimeout)
+			slow = slowTimer.C
+			if batch == nil {
+				caughtUp = false
+			} else {
+				base.LogTo("Changes", "sending %d change(s)", len(batch))
+				sentSeq = batch[len(batch)-1].Seq
 				if options.Limit > 0 {
-					if len(entries) >= options.Limit {
-						break loop
+					options.Limit -= len(batch)
+					if options.Limit == 0 {
+						done = true
+						stopFeed()
 					}
-					options.Limit -= len(entries)
+				}
+				// Reset the timeout after sending an entry:
+				if timer != nil {
+					timer.Stop()
+					timer = nil
 				}
 			}
-			// Reset the timeout after sending an entry:
-			if timer != nil {
-				timer.Stop()
-				timer = nil
-			}
+		case err = <-writeResults:
+			writing = false
+			slowTimer.Stop()
+			slow = nil
 		case <-heartbeat:
-			err = send(nil)
+			if !writing {
+				caughtUp = true
+			}
 		case <-timeout:
 			break loop
+		case <-slow:
+			h.logStatus(http.StatusOK, fmt.Sprintf("Client hasn't read changes for %v; closing feed", SlowClientTimeout))
+			stopFeed()
+			if abort != nil {
+				abort()
+			}
+			return errSlowClient
 		}
 
 		if err != nil {
 			h.logStatus(http.StatusOK, fmt.Sprintf("Write error: %v", err))
 			return nil // error is probably because the client closed the connection
 		}
+		if done && !writing {
+			break loop
+		}
 	}
 	h.logStatus(http.StatusOK, "OK (continuous feed closed)")
 	return nil
@@ -330,7 +525,7 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 	// receiving the response.
 	h.setHeader("Content-Type", "application/octet-stream")
 	h.logStatus(http.StatusOK, "sending continuous feed")
-	return h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
+	err := h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
 		var err error
 		if changes != nil {
 			for _, change := range changes {
@@ -347,7 +542,19 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 		}
 		h.flush()
 		return err
+	}, func() {
+		// Make the stuck write fail, unless the client starts reading again very soon:
+		base.SetHTTPWriteDeadline(h.rq.RemoteAddr, time.Now().Add(SlowClientGracePeriod))
 	})
+	if err == errSlowClient {
+		// Tell the client why the feed ended, if it can still hear it, and drop the connection:
+		data, _ := json.Marshal(db.Body{"error": "timeout", "reason": err.Error()})
+		h.response.Write(append(data, '\n'))
+		h.flush()
+		base.SetHTTPWriteDeadline(h.rq.RemoteAddr, time.Now())
+		return nil
+	}
+	return err
 }
 
 func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options db.ChangesOptions) error {
@@ -388,6 +595,8 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 			}
 			_, err := conn.Write(data)
 			return err
+		}, func() {
+			conn.Close() // unblocks the write to the slow client
 		})
 	}
 	server := websocket.Server{
@@ -0,0 +1,93 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Services replicating with each other can authenticate with TLS client certificates (mutual
+// TLS) instead of passwords. The public listener asks for a certificate signed by a configured
+// CA, and a request on a connection that presented one is authenticated as the user named by
+// the certificate's subject common name, or one of its subject alternative names.
+
+// Configuration of client certificate authentication; see ServerConfig.ClientCert.
+type ClientCertConfig struct {
+	CAFile       string  // PEM file of the CA certificate(s) client certificates must be signed by
+	Required     bool    // If true, connections without a valid client certificate are refused
+	UsernameFrom *string // Certificate field naming the user: "cn" (default), "email" or "dns"
+}
+
+func (config *ClientCertConfig) usernameField() string {
+	if config.UsernameFrom != nil && *config.UsernameFrom != "" {
+		return *config.UsernameFrom
+	}
+	return "cn"
+}
+
+func (config *ClientCertConfig) validate() error {
+	switch config.usernameField() {
+	case "cn", "email", "dns":
+	default:
+		return fmt.Errorf("Invalid UsernameFrom %q; must be \"cn\", \"email\" or \"dns\"", config.usernameField())
+	}
+	if config.CAFile == "" {
+		return fmt.Errorf("Missing CAFile")
+	}
+	return nil
+}
+
+// Returns the username a certificate identifies, or "" if it doesn't have the configured field.
+// For a subject alternative name the first one of that type is used.
+func (config *ClientCertConfig) username(cert *x509.Certificate) string {
+	switch config.usernameField() {
+	case "cn":
+		return cert.Subject.CommonName
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	}
+	return ""
+}
+
+// If the request's connection presented a verified client certificate, returns the user it
+// identifies (or a 401 error if there's no such user, or it's disabled.) Otherwise returns nil.
+func (h *handler) clientCertUser(context *db.DatabaseContext) (auth.User, error) {
+	config := h.server.config.ClientCert
+	if config == nil || h.rq.TLS == nil || len(h.rq.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cert := h.rq.TLS.VerifiedChains[0][0]
+	userName := config.username(cert)
+	h.authMethod, h.authName = "client_cert", userName
+	if userName == "" {
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Client certificate has no %s",
+			config.usernameField())
+	}
+	user, err := context.Authenticator().GetUser(userName)
+	if err != nil {
+		return nil, err
+	} else if user == nil || user.Disabled() {
+		base.Logf("HTTP auth failed for client certificate of %q", userName)
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Client certificate's user is unknown or disabled")
+	}
+	return user, nil
+}
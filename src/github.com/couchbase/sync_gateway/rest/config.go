@@ -34,6 +34,11 @@ var DefaultPool = "default"
 
 var config *ServerConfig
 
+// Paths of the config files given on the command line, and the server started from them; used by
+// ReloadConf to pick up changes to the files.
+var configFilePaths []string
+var runningServerContext *ServerContext
+
 const DefaultMaxCouchbaseConnections = 16
 const DefaultMaxCouchbaseOverflowConnections = 0
 
@@ -45,30 +50,47 @@ const DefaultMaxFileDescriptors uint64 = 5000
 
 // JSON object that defines the server configuration.
 type ServerConfig struct {
-	Interface                      *string         // Interface to bind REST API to, default ":4984"
-	SSLCert                        *string         // Path to SSL cert file, or nil
-	SSLKey                         *string         // Path to SSL private key file, or nil
-	ServerReadTimeout              *int            // maximum duration.Second before timing out read of the HTTP(S) request
-	ServerWriteTimeout             *int            // maximum duration.Second before timing out write of the HTTP(S) response
-	AdminInterface                 *string         // Interface to bind admin API to, default ":4985"
-	AdminUI                        *string         // Path to Admin HTML page, if omitted uses bundled HTML
-	ProfileInterface               *string         // Interface to bind Go profile API to (no default)
-	ConfigServer                   *string         // URL of config server (for dynamic db discovery)
-	Persona                        *PersonaConfig  // Configuration for Mozilla Persona validation
-	Facebook                       *FacebookConfig // Configuration for Facebook validation
-	CORS                           *CORSConfig     // Configuration for allowing CORS
-	Log                            []string        // Log keywords to enable
-	LogFilePath                    *string         // Path to log file, if missing write to stderr
-	Pretty                         bool            // Pretty-print JSON responses?
-	DeploymentID                   *string         // Optional customer/deployment ID for stats reporting
-	StatsReportInterval            *float64        // Optional stats report interval (0 to disable)
-	MaxCouchbaseConnections        *int            // Max # of sockets to open to a Couchbase Server node
-	MaxCouchbaseOverflow           *int            // Max # of overflow sockets to open
-	SlowServerCallWarningThreshold *int            // Log warnings if database calls take this many ms
-	MaxIncomingConnections         *int            // Max # of incoming HTTP connections to accept
-	MaxFileDescriptors             *uint64         // Max # of open file descriptors (RLIMIT_NOFILE)
-	CompressResponses              *bool           // If false, disables compression of HTTP responses
-	Databases                      DbConfigMap     // Pre-configured databases, mapped by name
+	Interface                      *string              // Interface to bind REST API to, default ":4984"
+	SSLCert                        *string              // Path to SSL cert file, or nil
+	SSLKey                         *string              // Path to SSL private key file, or nil
+	ClientCert                     *ClientCertConfig    // Authenticates public API clients by TLS certificate
+	ServerReadTimeout              *int                 // maximum duration.Second before timing out read of the HTTP(S) request
+	ServerWriteTimeout             *int                 // maximum duration.Second before timing out write of the HTTP(S) response
+	MaxLongpollMs                  *uint64              // Longest a longpoll _changes request waits, despite heartbeats (default 15 min)
+	AdminInterface                 *string              // Interface to bind admin API to, default ":4985"
+	IPFilter                       *IPFilterConfig      // Client addresses allowed to use the public API
+	AdminIPFilter                  *IPFilterConfig      // Client addresses allowed to use the admin API
+	AdminUI                        *string              // Path to Admin HTML page, if omitted uses bundled HTML
+	ProfileInterface               *string              // Interface to bind Go profile API to (no default)
+	ConfigServer                   *string              // URL of config server (for dynamic db discovery)
+	Persona                        *PersonaConfig       // Configuration for Mozilla Persona validation
+	Facebook                       *FacebookConfig      // Configuration for Facebook validation
+	OAuth2                         OAuth2ConfigMap      // OAuth2 providers whose access tokens can log in
+	OIDC                           OIDCConfigMap        // OpenID Connect providers whose JWTs are accepted as bearer tokens
+	LoginThrottle                  *LoginThrottleConfig // Locks out users & clients after repeated failed logins
+	RateLimit                      *RateLimitConfig     // Limits the public API request rate of each user & client
+	TrustedProxy                   *TrustedProxyConfig  // Reverse proxies trusted to say who the user is
+	CORS                           *CORSConfig          // Configuration for allowing CORS
+	Log                            []string             // Log keywords to enable
+	LogFilePath                    *string              // Path to log file, if missing write to stderr
+	AuditLogFilePath               *string              // Path to security audit log; if missing there's no audit log
+	Pretty                         bool                 // Pretty-print JSON responses?
+	DeploymentID                   *string              // Optional customer/deployment ID for stats reporting
+	StatsReportInterval            *float64             // Optional stats report interval (0 to disable)
+	MaxCouchbaseConnections        *int                 // Max # of sockets to open to a Couchbase Server node
+	MaxCouchbaseOverflow           *int                 // Max # of overflow sockets to open
+	SlowServerCallWarningThreshold *int                 // Log warnings if database calls take this many ms
+	MaxIncomingConnections         *int                 // Max # of incoming HTTP connections to accept
+	MaxFileDescriptors             *uint64              // Max # of open file descriptors (RLIMIT_NOFILE)
+	CompressResponses              *bool                // If false, disables compression of HTTP responses
+	UUIDAlgorithm                  *string              // Algorithm used by /_uuids: "random", "sequential" or "utc_random"
+	Hardened                       *bool                // Disable admin UI, profiling & debug APIs; admin API on localhost only
+	MaxJSONDepth                   *int                 // Max nesting of arrays/objects in JSON requests (default 100, 0=unlimited)
+	MaxJSONElements                *int                 // Max items in any one JSON array/object in a request (default unlimited)
+	CompactRevTrees                *bool                // Store long revision histories compactly; older gateways can't read them
+	Databases                      DbConfigMap          // Pre-configured databases, mapped by name
+
+	sources map[string]string // Where property values came from, if not a config file
 }
 
 // JSON object that defines a database configuration within the ServerConfig.
@@ -80,15 +102,35 @@ type DbConfig struct {
 	Bucket             *string                        `json:"bucket"`                         // Bucket name on server; defaults to same as 'name'
 	Pool               *string                        `json:"pool"`                           // Couchbase pool name, default "default"
 	Sync               *string                        `json:"sync"`                           // Sync function defines which users can see which data
+	ValidateDocUpdate  *string                        `json:"validate_doc_update,omitempty"`  // Optional JS function that can reject document writes
+	OnCreate           *string                        `json:"on_create,omitempty"`            // Optional JS function that fills in new documents
 	Users              map[string]*db.PrincipalConfig `json:"users,omitempty"`                // Initial user accounts
 	Roles              map[string]*db.PrincipalConfig `json:"roles,omitempty"`                // Initial roles
+	ChannelGrants      map[string][]string            `json:"channel_grants,omitempty"`       // Channels granted to "user" or "role:name"; reapplied on reload
 	RevsLimit          *uint32                        `json:"revs_limit,omitempty"`           // Max depth a document's revision tree can grow to
 	ImportDocs         interface{}                    `json:"import_docs,omitempty"`          // false, true, or "continuous"
+	ImportFilter       *string                        `json:"import_filter,omitempty"`        // Optional JS function choosing which docs to import
 	Shadow             *ShadowConfig                  `json:"shadow,omitempty"`               // External bucket to shadow
 	EventHandlers      *EventHandlerConfig            `json:"event_handlers,omitempty"`       // Event handlers (webhook)
 	FeedType           string                         `json:"feed_type,omitempty"`            // Feed type - "DCP" or "TAP"; defaults based on Couchbase server version
 	AllowEmptyPassword bool                           `json:"allow_empty_password,omitempty"` // Allow empty passwords?  Defaults to false
+	GuestReadOnly      bool                           `json:"guest_read_only,omitempty"`      // Guest user (if enabled) can't write documents
 	CacheConfig        *CacheConfig                   `json:"cache,omitempty"`                // Cache settings
+	DocIDAlgorithm     string                         `json:"docid_algorithm,omitempty"`      // IDs for POSTed docs: "random", "sequential" or "utc_random"
+	WriteLog           *WriteLogConfig                `json:"write_log,omitempty"`            // Local log of accepted writes, for replay
+	ConflictResolution *ConflictResolutionConfig      `json:"conflict_resolution,omitempty"`  // Automatic resolution of replicated conflicts
+	Attachments        *AttachmentConfig              `json:"attachments,omitempty"`          // Restrictions on document attachments
+	TombstoneRetention *uint32                        `json:"tombstone_retention,omitempty"`  // Days to keep deleted docs before _compact purges them
+	ExternalBodySize   int                            `json:"external_body_size,omitempty"`   // Store doc bodies larger than this (bytes) separately
+	DocShards          *int                           `json:"doc_shards,omitempty"`           // Shard doc keys across this many prefixes (set at creation)
+	ViewQueryTimeout   *uint32                        `json:"view_query_timeout,omitempty"`   // Max secs a _changes/_all_docs view query can take (0=none)
+	ImmutableFields    []string                       `json:"immutable_fields,omitempty"`     // Doc properties that can't be changed once set, e.g. "owner"
+	TagWrites          bool                           `json:"tag_writes,omitempty"`           // Record the user & client IP of each write in the doc's metadata
+	Session            *SessionConfig                 `json:"session,omitempty"`              // Lifetime of login sessions
+	FetchConcurrency   *int                           `json:"fetch_concurrency,omitempty"`    // Max docs one _bulk_get fetches at once
+	StatsHistory       *StatsHistoryConfig            `json:"stats_history,omitempty"`        // Periodically record stats in the bucket
+	SyncOptions        *SyncFnConfig                  `json:"sync_options,omitempty"`         // Limits & error policy of the sync function
+	SequenceTokens     *bool                          `json:"sequence_tokens,omitempty"`      // Send last_seq as a versioned token (default true)
 }
 
 type DbConfigMap map[string]*DbConfig
@@ -102,6 +144,32 @@ type FacebookConfig struct {
 	Register bool // If true, server will register new user accounts
 }
 
+// An OAuth2 provider (like Google) whose access tokens can be exchanged for a session by
+// POST /db/_oauth2/{provider}. Users are named "{provider}_{id}".
+type OAuth2Config struct {
+	UserInfoURL string // Provider URL that returns the token owner's profile as JSON
+	ClientID    string // The profile's "aud" or "azp" must match this
+	IDField     string // Profile property holding the user's unique ID; default "sub"
+	EmailField  string // Profile property holding the user's email; default "email"
+	Register    bool   // If true, server will register new user accounts
+}
+
+type OAuth2ConfigMap map[string]*OAuth2Config
+
+// An OpenID Connect provider whose ID tokens (JWTs) are accepted in an "Authorization: Bearer"
+// header. Users are named "{UsernamePrefix}{claim}".
+type OIDCConfig struct {
+	Issuer         string  // Issuer URL; a token's "iss" claim must match it exactly
+	ClientID       string  // A token's "aud" claim must include this
+	JWKSURL        string  // URL of the provider's signing keys; default is from Issuer's discovery doc
+	UsernameClaim  string  // Claim holding the username; default "sub"
+	UsernamePrefix *string // Prepended to the username; default is the provider name plus "_"
+	ClockSkew      *int    // Seconds of leeway in checking expiration times; default 60
+	Register       bool    // If true, server will register new user accounts
+}
+
+type OIDCConfigMap map[string]*OIDCConfig
+
 type CORSConfig struct {
 	Origin      []string // List of allowed origins, use ["*"] to allow access from everywhere
 	LoginOrigin []string // List of allowed login origins
@@ -132,11 +200,50 @@ type EventConfig struct {
 	Timeout     uint64 `json:"timeout,omitempty"` // Timeout (webhook)
 }
 
+type WriteLogConfig struct {
+	Path    string `json:"path"`               // File to append to; rotated to path+".1" when full
+	MaxSize int64  `json:"max_size,omitempty"` // Max bytes per file (default 100MB)
+}
+
+type ConflictResolutionConfig struct {
+	Policy   string `json:"policy"`             // "last_write_wins", "longest_branch" or "custom"
+	Function string `json:"function,omitempty"` // JS resolver function, for the "custom" policy
+}
+
+type AttachmentConfig struct {
+	AllowedTypes []string `json:"allowed_types,omitempty"` // Allowed MIME types, e.g. "image/*"; default is any
+	MaxCount     int      `json:"max_count,omitempty"`     // Max attachments per document; default unlimited
+	Compress     bool     `json:"compress,omitempty"`      // GZip-encode text, JSON, XML attachments
+	Store        string   `json:"store,omitempty"`         // Where to store data: "bucket" (default) or "file:<dir>" (dir must be shared by all nodes)
+}
+
+type SessionConfig struct {
+	TTL         *uint32 `json:"ttl,omitempty"`          // Secs a session lasts (since last use, if sliding); default (or if 0) 86400
+	IdleTimeout *uint32 `json:"idle_timeout,omitempty"` // Secs of disuse after which a session expires; default none
+	Sliding     *bool   `json:"sliding,omitempty"`      // Does using a session extend its TTL? Default true
+}
+
+type StatsHistoryConfig struct {
+	Interval      *uint32 `json:"interval,omitempty"`       // Secs between stats snapshots; default 300, min 60
+	RetentionDays *uint32 `json:"retention_days,omitempty"` // Days to keep snapshots; default 30
+}
+
+type SyncFnConfig struct {
+	TimeoutMs    *uint32 `json:"timeout_ms,omitempty"`     // Max msecs one call can run (0=none, the default)
+	MaxInputSize *int    `json:"max_input_size,omitempty"` // Max bytes of doc JSON one call is given (0=none)
+	OnError      string  `json:"on_error,omitempty"`       // If the fn fails: "reject" the write (default) or "accept" it
+	ErrorChannel string  `json:"error_channel,omitempty"`  // Channel for docs accepted by the "accept" policy
+	Runtimes     *int    `json:"runtimes,omitempty"`       // JS runtimes kept for concurrent calls; default 4
+}
+
 type CacheConfig struct {
-	CachePendingSeqMaxWait *uint32 `json:"max_wait_pending,omitempty"` // Max wait for pending sequence before skipping
-	CachePendingSeqMaxNum  *int    `json:"max_num_pending,omitempty"`  // Max number of pending sequences before skipping
-	CacheSkippedSeqMaxWait *uint32 `json:"max_wait_skipped,omitempty"` // Max wait for skipped sequence before abandoning
-	EnableStarChannel      *bool   `json:"enable_star_channel"`        // Enable star channel
+	CachePendingSeqMaxWait *uint32 `json:"max_wait_pending,omitempty"`         // Max wait for pending sequence before skipping
+	CachePendingSeqMaxNum  *int    `json:"max_num_pending,omitempty"`          // Max number of pending sequences before skipping
+	CacheSkippedSeqMaxWait *uint32 `json:"max_wait_skipped,omitempty"`         // Max wait for skipped sequence before abandoning
+	EnableStarChannel      *bool   `json:"enable_star_channel"`                // Enable star channel
+	ChannelCacheMinLength  *int    `json:"channel_cache_min_length,omitempty"` // Min entries kept per channel
+	ChannelCacheMaxLength  *int    `json:"channel_cache_max_length,omitempty"` // Max entries kept per channel
+	ChannelCacheAge        *int    `json:"channel_cache_expiry,omitempty"`     // Secs to keep entries past the min
 }
 
 func (dbConfig *DbConfig) setup(name string) error {
@@ -287,12 +394,45 @@ func (self *ServerConfig) MergeWith(other *ServerConfig) error {
 	if self.Facebook == nil {
 		self.Facebook = other.Facebook
 	}
+	if self.OAuth2 == nil {
+		self.OAuth2 = other.OAuth2
+	}
+	if self.OIDC == nil {
+		self.OIDC = other.OIDC
+	}
+	if self.LoginThrottle == nil {
+		self.LoginThrottle = other.LoginThrottle
+	}
+	if self.RateLimit == nil {
+		self.RateLimit = other.RateLimit
+	}
+	if self.MaxLongpollMs == nil {
+		self.MaxLongpollMs = other.MaxLongpollMs
+	}
+	if self.TrustedProxy == nil {
+		self.TrustedProxy = other.TrustedProxy
+	}
+	if self.ClientCert == nil {
+		self.ClientCert = other.ClientCert
+	}
+	if self.IPFilter == nil {
+		self.IPFilter = other.IPFilter
+	}
+	if self.AdminIPFilter == nil {
+		self.AdminIPFilter = other.AdminIPFilter
+	}
 	if self.CORS == nil {
 		self.CORS = other.CORS
 	}
 	for _, flag := range other.Log {
 		self.Log = append(self.Log, flag)
 	}
+	if self.Hardened == nil {
+		self.Hardened = other.Hardened
+	}
+	if self.AuditLogFilePath == nil {
+		self.AuditLogFilePath = other.AuditLogFilePath
+	}
 	if other.Pretty {
 		self.Pretty = true
 	}
@@ -305,37 +445,69 @@ func (self *ServerConfig) MergeWith(other *ServerConfig) error {
 	return nil
 }
 
-// Reads the command line flags and the optional config file.
+// Reads the command line flags and the optional config file, setting the config used by
+// ServerMain and ReloadConf.
 func ParseCommandLine() {
-	siteURL := flag.String("personaOrigin", "", "Base URL that clients use to connect to the server")
-	addr := flag.String("interface", DefaultInterface, "Address to bind to")
-	authAddr := flag.String("adminInterface", DefaultAdminInterface, "Address to bind admin interface to")
-	profAddr := flag.String("profileInterface", "", "Address to bind profile interface to")
-	configServer := flag.String("configServer", "", "URL of server that can return database configs")
-	deploymentID := flag.String("deploymentID", "", "Customer/project identifier for stats reporting")
-	couchbaseURL := flag.String("url", DefaultServer, "Address of Couchbase server")
-	poolName := flag.String("pool", DefaultPool, "Name of pool")
-	bucketName := flag.String("bucket", "sync_gateway", "Name of bucket")
-	dbName := flag.String("dbname", "", "Name of Couchbase Server database (defaults to name of bucket)")
-	pretty := flag.Bool("pretty", false, "Pretty-print JSON responses")
-	verbose := flag.Bool("verbose", false, "Log more info about requests")
-	logKeys := flag.String("log", "", "Log keywords, comma separated")
-	logFilePath := flag.String("logFilePath", "", "Path to log file")
-	flag.Parse()
-
-	if flag.NArg() > 0 {
+	var err error
+	config, configFilePaths, err = ParseCommandLineArgs(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		base.LogFatal("%v", err)
+	}
+}
+
+// Parses command-line arguments (without the program name) and reads the config files they name,
+// returning the resulting server config and the paths of the files. Unlike ParseCommandLine it
+// doesn't use the global flag set or config, so it can be called more than once. It doesn't
+// change the log settings either: the log keys given by flags are added to the config's Log,
+// which the caller should pass to base.ParseLogFlags.
+func ParseCommandLineArgs(args []string) (config *ServerConfig, configFilePaths []string, err error) {
+	flags := flag.NewFlagSet("sync_gateway", flag.ContinueOnError)
+	siteURL := flags.String("personaOrigin", "", "Base URL that clients use to connect to the server")
+	addr := flags.String("interface", DefaultInterface, "Address to bind to")
+	authAddr := flags.String("adminInterface", DefaultAdminInterface, "Address to bind admin interface to")
+	profAddr := flags.String("profileInterface", "", "Address to bind profile interface to")
+	configServer := flags.String("configServer", "", "URL of server that can return database configs")
+	deploymentID := flags.String("deploymentID", "", "Customer/project identifier for stats reporting")
+	couchbaseURL := flags.String("url", DefaultServer, "Address of Couchbase server")
+	poolName := flags.String("pool", DefaultPool, "Name of pool")
+	bucketName := flags.String("bucket", "sync_gateway", "Name of bucket")
+	dbName := flags.String("dbname", "", "Name of Couchbase Server database (defaults to name of bucket)")
+	pretty := flags.Bool("pretty", false, "Pretty-print JSON responses")
+	verbose := flags.Bool("verbose", false, "Log more info about requests")
+	logKeys := flags.String("log", "", "Log keywords, comma separated")
+	logFilePath := flags.String("logFilePath", "", "Path to log file")
+	hardened := flags.Bool("hardened", false, "Disable admin UI, profiling & debug APIs; admin API on localhost only")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	setFlags := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	flagSource := func(names ...string) string {
+		for _, name := range names {
+			if setFlags[name] {
+				return kConfigSourceFlag
+			}
+		}
+		return kConfigSourceDefault
+	}
+
+	if flags.NArg() > 0 {
 		// Read the configuration file(s), if any:
-		for i := 0; i < flag.NArg(); i++ {
-			filename := flag.Arg(i)
+		for i := 0; i < flags.NArg(); i++ {
+			filename := flags.Arg(i)
 			c, err := ReadServerConfig(filename)
 			if err != nil {
-				base.LogFatal("Error reading config file %s: %v", filename, err)
+				return nil, nil, fmt.Errorf("Error reading config file %s: %v", filename, err)
 			}
+			configFilePaths = append(configFilePaths, filename)
 			if config == nil {
 				config = c
 			} else {
 				if err := config.MergeWith(c); err != nil {
-					base.LogFatal("Error reading config file %s: %v", filename, err)
+					return nil, nil, fmt.Errorf("Error reading config file %s: %v", filename, err)
 				}
 			}
 		}
@@ -343,33 +515,43 @@ func ParseCommandLine() {
 		// Override the config file with global settings from command line flags:
 		if *addr != DefaultInterface {
 			config.Interface = addr
+			config.setSource("Interface", kConfigSourceFlag)
 		}
 		if *authAddr != DefaultAdminInterface {
 			config.AdminInterface = authAddr
+			config.setSource("AdminInterface", kConfigSourceFlag)
 		}
 		if *profAddr != "" {
 			config.ProfileInterface = profAddr
+			config.setSource("ProfileInterface", kConfigSourceFlag)
 		}
 		if *configServer != "" {
 			config.ConfigServer = configServer
+			config.setSource("ConfigServer", kConfigSourceFlag)
 		}
 		if *deploymentID != "" {
 			config.DeploymentID = deploymentID
+			config.setSource("DeploymentID", kConfigSourceFlag)
 		}
 		if *pretty {
 			config.Pretty = *pretty
-		}
-		if config.Log != nil {
-			base.ParseLogFlags(config.Log)
+			config.setSource("Pretty", kConfigSourceFlag)
 		}
 		if config.Interface == nil {
 			config.Interface = &DefaultInterface
+			config.setSource("Interface", kConfigSourceDefault)
 		}
 		if config.AdminInterface == nil {
 			config.AdminInterface = &DefaultAdminInterface
+			config.setSource("AdminInterface", kConfigSourceDefault)
 		}
 		if *logFilePath != "" {
 			config.LogFilePath = logFilePath
+			config.setSource("LogFilePath", kConfigSourceFlag)
+		}
+		if *hardened {
+			config.Hardened = hardened
+			config.setSource("Hardened", kConfigSourceFlag)
 		}
 
 	} else {
@@ -382,6 +564,7 @@ func ParseCommandLine() {
 			AdminInterface:   authAddr,
 			ProfileInterface: profAddr,
 			Pretty:           *pretty,
+			Hardened:         hardened,
 			Databases: map[string]*DbConfig{
 				*dbName: {
 					Name:   *dbName,
@@ -391,6 +574,12 @@ func ParseCommandLine() {
 				},
 			},
 		}
+		config.setSource("Interface", flagSource("interface"))
+		config.setSource("AdminInterface", flagSource("adminInterface"))
+		config.setSource("ProfileInterface", flagSource("profileInterface"))
+		config.setSource("Pretty", flagSource("pretty"))
+		config.setSource("Hardened", flagSource("hardened"))
+		config.setSource("Databases", flagSource("url", "pool", "bucket", "dbname"))
 	}
 
 	if *siteURL != "" {
@@ -398,15 +587,17 @@ func ParseCommandLine() {
 			config.Persona = new(PersonaConfig)
 		}
 		config.Persona.Origin = *siteURL
+		config.setSource("Persona", kConfigSourceFlag)
 	}
 
-	base.LogKeys["HTTP"] = true
+	config.Log = append(config.Log, "HTTP")
 	if *verbose {
-		base.LogKeys["HTTP+"] = true
+		config.Log = append(config.Log, "HTTP+")
 	}
-	base.ParseLogFlag(*logKeys)
-
-	//return config
+	if *logKeys != "" {
+		config.Log = append(config.Log, strings.Split(*logKeys, ",")...)
+	}
+	return config, configFilePaths, nil
 }
 
 func setMaxFileDescriptors(maxP *uint64) {
@@ -422,22 +613,8 @@ func setMaxFileDescriptors(maxP *uint64) {
 	}
 }
 
-func (config *ServerConfig) serve(addr string, handler http.Handler) {
-	maxConns := DefaultMaxIncomingConnections
-	if config.MaxIncomingConnections != nil {
-		maxConns = *config.MaxIncomingConnections
-	}
-
-	err := base.ListenAndServeHTTP(addr, maxConns, config.SSLCert, config.SSLKey, handler, config.ServerReadTimeout, config.ServerWriteTimeout)
-	if err != nil {
-		base.LogFatal("Failed to start HTTP server on %s: %v", addr, err)
-	}
-}
-
 // Starts and runs the server given its configuration. (This function never returns.)
 func RunServer(config *ServerConfig) {
-	PrettyPrint = config.Pretty
-
 	base.Logf("==== %s ====", LongVersionString)
 
 	if os.Getenv("GOMAXPROCS") == "" && runtime.GOMAXPROCS(0) == 1 {
@@ -450,25 +627,17 @@ func RunServer(config *ServerConfig) {
 
 	setMaxFileDescriptors(config.MaxFileDescriptors)
 
-	sc := NewServerContext(config)
-	for _, dbConfig := range config.Databases {
-		if _, err := sc.AddDatabaseFromConfig(dbConfig); err != nil {
-			base.LogFatal("Error opening database: %v", err)
-		}
+	server, err := NewServer(config)
+	if err != nil {
+		base.LogFatal("%v", err)
 	}
+	runningServerContext = server.ServerContext()
+	runningServerContext.logAttackSurface()
 
-	if config.ProfileInterface != nil {
-		//runtime.MemProfileRate = 10 * 1024
-		base.Logf("Starting profile server on %s", *config.ProfileInterface)
-		go func() {
-			http.ListenAndServe(*config.ProfileInterface, nil)
-		}()
+	if err := server.Start(); err != nil {
+		base.LogFatal("%v", err)
 	}
-
-	base.Logf("Starting admin server on %s", *config.AdminInterface)
-	go config.serve(*config.AdminInterface, CreateAdminHandler(sc))
-	base.Logf("Starting server on %s ...", *config.Interface)
-	config.serve(*config.Interface, CreatePublicHandler(sc))
+	base.LogFatal("%v", server.Wait())
 }
 
 // for now  just cycle the logger to allow for log file rotation
@@ -476,12 +645,49 @@ func ReloadConf() {
 	if config.LogFilePath != nil {
 		base.UpdateLogger(*config.LogFilePath)
 	}
+	if config.AuditLogFilePath != nil {
+		base.UpdateAuditLogger(*config.AuditLogFilePath)
+	}
+	if runningServerContext != nil {
+		reloadChannelGrants(runningServerContext)
+	}
+}
+
+// Rereads the config files and reapplies the channel grants of the databases that are running.
+// Other changes to the files don't take effect until the server restarts.
+func reloadChannelGrants(sc *ServerContext) {
+	var newConfig *ServerConfig
+	for _, filename := range configFilePaths {
+		if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
+			continue
+		}
+		c, err := ReadServerConfigFromFile(filename)
+		if err != nil {
+			base.Warn("Couldn't reload config file %s: %v", filename, err)
+			return
+		}
+		if newConfig == nil {
+			newConfig = c
+		} else if err := newConfig.MergeWith(c); err != nil {
+			base.Warn("Couldn't reload config file %s: %v", filename, err)
+			return
+		}
+	}
+	if newConfig == nil {
+		return
+	}
+	for name, dbConfig := range newConfig.Databases {
+		if err := sc.UpdateChannelGrants(name, dbConfig.ChannelGrants); err != nil {
+			base.Warn("Database %q: couldn't apply channel grants: %v", name, err)
+		}
+	}
 }
 
 // Main entry point for a simple server; you can have your main() function just call this.
 // It parses command-line flags, reads the optional configuration file, then starts the server.
 func ServerMain() {
 	ParseCommandLine()
+	base.ParseLogFlags(config.Log)
 	ReloadConf()
 	RunServer(config)
 }
@@ -0,0 +1,139 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Replaces the values of secret config properties in GET /_config responses.
+const kRedactedValue = "xxxxx"
+
+// Where the value of a top-level ServerConfig property came from:
+const (
+	kConfigSourceFile     = "file"     // A config file (or URL)
+	kConfigSourceFlag     = "flag"     // A command-line flag
+	kConfigSourceDefault  = "default"  // Not configured; the built-in default
+	kConfigSourceHardened = "hardened" // Overridden by the hardened profile
+)
+
+// Records where a top-level config property's value came from, for GET /_config.
+// Properties without a recorded source came from the config file.
+func (config *ServerConfig) setSource(property string, source string) {
+	if config.sources == nil {
+		config.sources = map[string]string{}
+	}
+	config.sources[property] = source
+}
+
+// Effective values of ServerConfig properties that have defaults, used when they're not set.
+func serverConfigDefaults() map[string]interface{} {
+	return map[string]interface{}{
+		"Interface":               DefaultInterface,
+		"AdminInterface":          DefaultAdminInterface,
+		"MaxCouchbaseConnections": DefaultMaxCouchbaseConnections,
+		"MaxCouchbaseOverflow":    DefaultMaxCouchbaseOverflowConnections,
+		"MaxIncomingConnections":  DefaultMaxIncomingConnections,
+		"MaxFileDescriptors":      DefaultMaxFileDescriptors,
+		"MaxJSONDepth":            base.DefaultMaxJSONDepth,
+		"CompressResponses":       true,
+		"CompactRevTrees":         false,
+		"Hardened":                hardenedBuild,
+	}
+}
+
+// Returns the effective server configuration as a JSON-compatible map, with secrets redacted,
+// and a map from each property name to where its value came from.
+func (config *ServerConfig) introspect() (properties map[string]interface{}, sources map[string]string, err error) {
+	properties, err = redactedConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	sources = map[string]string{}
+	defaults := serverConfigDefaults()
+	for name, value := range properties {
+		source, recorded := config.sources[name]
+		if value == nil {
+			if defaultValue, ok := defaults[name]; ok {
+				properties[name] = defaultValue
+				if !recorded {
+					source = kConfigSourceDefault
+				}
+			} else if !recorded {
+				delete(properties, name) // not set, and there's nothing interesting to say
+				continue
+			}
+		} else if !recorded {
+			source = kConfigSourceFile
+		}
+		sources[name] = source
+	}
+	return properties, sources, nil
+}
+
+// Converts a config struct to a JSON-compatible map, replacing passwords and other secrets
+// (including passwords embedded in URLs) with "xxxxx".
+func redactedConfig(config interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var properties map[string]interface{}
+	if err = json.Unmarshal(data, &properties); err != nil {
+		return nil, err
+	}
+	redactJSON(properties)
+	return properties, nil
+}
+
+func redactJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			if str, ok := item.(string); ok && str != "" && isSecretProperty(key) {
+				value[key] = kRedactedValue
+			} else {
+				value[key] = redactJSON(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactJSON(item)
+		}
+	case string:
+		return redactURLPassword(value)
+	}
+	return value
+}
+
+func isSecretProperty(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "password") || strings.Contains(name, "secret") ||
+		strings.Contains(name, "token")
+}
+
+// If str is a URL with a password in it, returns it with the password redacted.
+func redactURLPassword(str string) string {
+	if !strings.Contains(str, "://") || !strings.Contains(str, "@") {
+		return str
+	}
+	u, err := url.Parse(str)
+	if err != nil || u.User == nil {
+		return str
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), kRedactedValue)
+	}
+	return u.String()
+}
@@ -0,0 +1,21 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+/*
+Package rest implements Sync Gateway's HTTP APIs on top of package db: the public REST API that
+clients replicate with (CreatePublicHandler) and the admin API (CreateAdminHandler), plus server
+configuration and startup (ServerMain, or NewServer to run several servers in one process).
+
+Request handlers go through db.Database's methods rather than the bucket, so authorization and
+validation apply; the admin-only bucket flush is the one exception. The server context, which
+opens and configures databases, does use the bucket directly for a few docs of its own: the
+database name (_sync:dbname, which is also updated when a database is renamed) and the channel
+grants last applied from the config (_sync:channel_grants).
+*/
+package rest
@@ -28,14 +28,15 @@ func (h *handler) handleGetDoc() error {
 
 	// What attachment bodies should be included?
 	var attachmentsSince []string = nil
-	if h.getBoolQuery("attachments") {
+	if h.getBoolQuery("attachments") || openRevs != "" {
 		atts := h.getQuery("atts_since")
 		if atts != "" {
 			err := json.Unmarshal([]byte(atts), &attachmentsSince)
 			if err != nil {
 				return base.HTTPErrorf(http.StatusBadRequest, "bad atts_since")
 			}
-		} else {
+		}
+		if attachmentsSince == nil {
 			attachmentsSince = []string{}
 		}
 	}
@@ -62,8 +63,9 @@ func (h *handler) handleGetDoc() error {
 			h.writeJSON(value)
 		}
 	} else {
+		// open_revs always includes attachment bodies, except those the client already has
+		// according to atts_since.
 		var revids []string
-		attachmentsSince = []string{}
 
 		if openRevs == "all" {
 			// open_revs=all
@@ -81,6 +83,14 @@ func (h *handler) handleGetDoc() error {
 			if err != nil {
 				return base.HTTPErrorf(http.StatusBadRequest, "bad open_revs")
 			}
+			if h.getBoolQuery("latest") {
+				// Replace each revision with the current leaf (or leaves) descended from it:
+				if revids, err = h.db.GetLatestRevIDs(docid, revids); err != nil {
+					return err
+				} else if revids == nil {
+					return kNotFoundError
+				}
+			}
 		}
 
 		if h.requestAccepts("multipart/") {
@@ -128,23 +138,42 @@ func (h *handler) handleGetAttachment() error {
 	}
 	if body == nil {
 		return kNotFoundError
+	} else if body["_removed"] != nil {
+		// GetRev redacts a specific revision the user can't access, rather than failing:
+		return base.HTTPErrorf(http.StatusForbidden, "forbidden")
 	}
 	meta, ok := db.BodyAttachments(body)[attachmentName].(map[string]interface{})
 	if !ok {
 		return base.HTTPErrorf(http.StatusNotFound, "missing attachment %s", attachmentName)
 	}
 	digest := meta["digest"].(string)
+
+	// Send encoded data as-is only to clients that can decode it:
+	encoding, _ := meta["encoding"].(string)
+	sendEncoded := encoding != "" && acceptsEncoding(h.rq, encoding)
+
+	// The data can't change without changing the digest, so it makes a good ETag:
+	etag := digest
+	if sendEncoded {
+		etag += "-" + encoding
+	}
+	if h.checkETag(etag) {
+		return nil
+	}
+
 	data, err := h.db.GetAttachment(db.AttachmentKey(digest))
 	if err != nil {
 		return err
 	}
-
-	h.setHeader("Etag", digest)
 	if contentType, ok := meta["content_type"].(string); ok {
 		h.setHeader("Content-Type", contentType)
 	}
-	if encoding, ok := meta["encoding"].(string); ok {
+	if sendEncoded {
 		h.setHeader("Content-Encoding", encoding)
+	} else if encoding != "" {
+		if data, err = db.DecodeAttachmentEncoding(data, encoding); err != nil {
+			return err
+		}
 	}
 	if h.privs == adminPrivs { // #720
 		h.setHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachmentName))
@@ -161,9 +190,9 @@ func (h *handler) handlePutAttachment() error {
 	if attachmentContentType == "" {
 		attachmentContentType = "application/octet-stream"
 	}
-	revid := h.getQuery("rev")
-	if revid == "" {
-		revid = h.rq.Header.Get("If-Match")
+	revid, err := h.getRevIDToReplace(nil)
+	if err != nil {
+		return err
 	}
 	attachmentData, err := h.readBody()
 	if err != nil {
@@ -203,7 +232,43 @@ func (h *handler) handlePutAttachment() error {
 	}
 	h.setHeader("Etag", newRev)
 
-	h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": docid, "rev": newRev})
+	h.writeJSONStatus(http.StatusCreated, newDocWriteResponse(docid, newRev))
+	return nil
+}
+
+// HTTP handler for a DELETE of an attachment
+func (h *handler) handleDeleteAttachment() error {
+	docid := h.PathVar("docid")
+	attachmentName := h.PathVar("attach")
+	revid, err := h.getRevIDToReplace(nil)
+	if err != nil {
+		return err
+	}
+
+	body, err := h.db.GetRev(docid, revid, false, nil)
+	if err != nil {
+		return err
+	} else if body == nil {
+		return kNotFoundError
+	}
+	body = body.ImmutableAttachmentsCopy() // don't modify the cached revision's attachments
+	attachments := db.BodyAttachments(body)
+	if _, exists := attachments[attachmentName]; !exists {
+		return base.HTTPErrorf(http.StatusNotFound, "missing attachment %s", attachmentName)
+	}
+
+	delete(attachments, attachmentName)
+	if len(attachments) == 0 {
+		delete(body, "_attachments")
+	}
+	body["_rev"] = revid
+
+	newRev, err := h.db.Put(docid, body)
+	if err != nil {
+		return err
+	}
+	h.setHeader("Etag", newRev)
+	h.writeJSON(newDocWriteResponse(docid, newRev))
 	return nil
 }
 
@@ -215,13 +280,15 @@ func (h *handler) handlePutDoc() error {
 		return err
 	}
 	var newRev string
+	status := http.StatusCreated
 
 	if h.getQuery("new_edits") != "false" {
 		// Regular PUT:
-		if oldRev := h.getQuery("rev"); oldRev != "" {
+		oldRev, err := h.getRevIDToReplace(body)
+		if err != nil {
+			return err
+		} else if oldRev != "" {
 			body["_rev"] = oldRev
-		} else if ifMatch := h.rq.Header.Get("If-Match"); ifMatch != "" {
-			body["_rev"] = ifMatch
 		}
 		newRev, err = h.db.Put(docid, body)
 		if err != nil {
@@ -234,16 +301,44 @@ func (h *handler) handlePutDoc() error {
 		if revisions == nil {
 			return base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
 		}
-		err = h.db.PutExistingRev(docid, body, revisions)
+		added, err := h.db.PutExistingRevIfNew(docid, body, revisions)
 		if err != nil {
 			return err
 		}
-		newRev = body["_rev"].(string)
+		newRev = revisions[0]
+		if !added {
+			status = http.StatusOK // Already had this revision, so nothing changed
+		}
 	}
-	h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": docid, "rev": newRev})
+	h.writeJSONStatus(status, newDocWriteResponse(docid, newRev))
 	return nil
 }
 
+// Returns the ID of the revision a PUT or DELETE replaces, which can be given by the "rev"
+// query param, the If-Match header, or the "_rev" property of the body (if body isn't nil.)
+// Any of them can be omitted, but if more than one is given they have to agree.
+func (h *handler) getRevIDToReplace(body db.Body) (string, error) {
+	revid := h.getQuery("rev")
+	if ifMatch := h.rq.Header.Get("If-Match"); ifMatch != "" {
+		if revid != "" && ifMatch != revid {
+			return "", base.HTTPErrorf(http.StatusBadRequest,
+				"Revision ID in If-Match header (%q) doesn't match 'rev' param (%q)", ifMatch, revid)
+		}
+		revid = ifMatch
+	}
+	if body != nil {
+		if bodyRev, ok := body["_rev"].(string); ok {
+			if revid != "" && bodyRev != revid {
+				return "", base.HTTPErrorf(http.StatusBadRequest,
+					"Revision ID in body (%q) doesn't match the one in the URL or If-Match header (%q)",
+					bodyRev, revid)
+			}
+			revid = bodyRev
+		}
+	}
+	return revid, nil
+}
+
 // HTTP handler for a POST to a database (creating a document)
 func (h *handler) handlePostDoc() error {
 	body, err := h.readDocument()
@@ -256,20 +351,20 @@ func (h *handler) handlePostDoc() error {
 	}
 	h.setHeader("Location", docid)
 	h.setHeader("Etag", newRev)
-	h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
+	h.writeJSON(newDocWriteResponse(docid, newRev))
 	return nil
 }
 
 // HTTP handler for a DELETE of a document
 func (h *handler) handleDeleteDoc() error {
 	docid := h.PathVar("docid")
-	revid := h.getQuery("rev")
-	if revid == "" {
-		revid = h.rq.Header.Get("If-Match")
+	revid, err := h.getRevIDToReplace(nil)
+	if err != nil {
+		return err
 	}
 	newRev, err := h.db.DeleteDoc(docid, revid)
 	if err == nil {
-		h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
+		h.writeJSON(newDocWriteResponse(docid, newRev))
 	}
 	return err
 }
@@ -301,7 +396,7 @@ func (h *handler) handlePutLocalDoc() error {
 		var revid string
 		revid, err = h.db.PutSpecial("local", docid, body)
 		if err == nil {
-			h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": "_local/" + docid, "rev": revid})
+			h.writeJSONStatus(http.StatusCreated, newDocWriteResponse("_local/"+docid, revid))
 		}
 	}
 	return err
@@ -312,3 +407,18 @@ func (h *handler) handleDelLocalDoc() error {
 	docid := h.PathVar("docid")
 	return h.db.DeleteSpecial("local", docid, h.getQuery("rev"))
 }
+
+// HTTP handler for GET _local_docs, which lists the database's _local documents (admin only)
+func (h *handler) handleAllLocalDocs() error {
+	docs, err := h.db.AllLocalDocIDs()
+	if err != nil {
+		return err
+	}
+	rows := make([]db.Body, 0, len(docs))
+	for _, doc := range docs {
+		id := "_local/" + doc.DocID
+		rows = append(rows, db.Body{"id": id, "key": id, "value": db.Body{"rev": doc.RevID}})
+	}
+	h.writeJSON(db.Body{"total_rows": len(rows), "rows": rows})
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"compress/gzip"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -21,13 +22,37 @@ type EncodedResponseWriter struct {
 
 // Creates a new EncodedResponseWriter, or returns nil if the request doesn't allow encoded responses.
 func NewEncodedResponseWriter(response http.ResponseWriter, rq *http.Request) *EncodedResponseWriter {
-	if !strings.Contains(rq.Header.Get("Accept-Encoding"), "gzip") ||
+	if !acceptsEncoding(rq, "gzip") ||
 		rq.Method == "HEAD" || rq.Method == "PUT" || rq.Method == "DELETE" {
 		return nil
 	}
 	return &EncodedResponseWriter{ResponseWriter: response}
 }
 
+// Returns true if a request's Accept-Encoding header allows a response with the given content
+// coding. An entry with a quality of 0 ("gzip;q=0") refuses it, and a specific entry overrides
+// a "*" wildcard, as in RFC 2616 sec. 14.3.
+func acceptsEncoding(rq *http.Request, encoding string) bool {
+	wildcard := false
+	for _, item := range strings.Split(rq.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted := true
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				quality, err := strconv.ParseFloat(q[2:], 64)
+				accepted = !(err == nil && quality <= 0)
+			}
+		}
+		if coding == encoding {
+			return accepted
+		} else if coding == "*" {
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
+
 func (w *EncodedResponseWriter) WriteHeader(status int) {
 	w.status = status
 	w.sniff(nil) // Must do it now because headers can't be changed after WriteHeader call
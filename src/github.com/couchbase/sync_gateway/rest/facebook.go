@@ -48,7 +48,7 @@ func (h *handler) handleFacebookPOST() error {
 	}
 
 	createUserIfNeeded := h.server.config.Facebook.Register
-	return h.makeSessionFromNameAndEmail(facebookResponse.Id, facebookResponse.Email, createUserIfNeeded)
+	return h.makeSessionFromNameAndEmail(facebookResponse.Id, facebookResponse.Email, true, createUserIfNeeded)
 
 }
 
@@ -12,7 +12,9 @@ package rest
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"expvar"
 	"fmt"
@@ -35,7 +37,7 @@ import (
 	"github.com/couchbase/sync_gateway/db"
 )
 
-// If set to true, JSON output will be pretty-printed.
+// If set to true, JSON output will be pretty-printed. (ServerConfig.Pretty does this per server.)
 var PrettyPrint bool = false
 
 // If set to true, diagnostic data will be dumped if there's a problem with MIME multipart data
@@ -67,6 +69,10 @@ type handler struct {
 	startTime      time.Time
 	serialNumber   uint64
 	loggedDuration bool
+	authMethod     string // How the request's credentials were given, if it had any (for auditing)
+	authName       string // User name the request tried to authenticate as, if known
+
+	middlewareContext *RequestContext // Passed to Middleware hooks; created on demand
 }
 
 type handlerPrivs int
@@ -85,6 +91,7 @@ func makeHandler(server *ServerContext, privs handlerPrivs, method handlerMethod
 		h := newHandler(server, privs, r, rq)
 		err := h.invoke(method)
 		h.writeError(err)
+		h.auditRequest()
 		h.logDuration(true)
 	})
 }
@@ -138,12 +145,29 @@ func (h *handler) invoke(method handlerMethod) error {
 		}
 	}
 
+	// Limit the request rate of the client, then of the user once authenticated:
+	if err = h.checkRateLimit("", ""); err != nil {
+		h.logRequestLine()
+		return err
+	}
+
+	if err = h.runPreAuthMiddleware(); err != nil {
+		h.logRequestLine()
+		return err
+	}
+
 	// Authenticate, if not on admin port:
 	if h.privs != adminPrivs {
 		if err = h.checkAuth(dbContext); err != nil {
 			h.logRequestLine()
 			return err
 		}
+		if h.user != nil && h.user.Name() != "" {
+			if err = h.checkRateLimit(dbContext.Name, h.user.Name()); err != nil {
+				h.logRequestLine()
+				return err
+			}
+		}
 	}
 
 	h.logRequestLine()
@@ -154,6 +178,18 @@ func (h *handler) invoke(method handlerMethod) error {
 		if err != nil {
 			return err
 		}
+		h.db.SetClientIP(h.server.clientIP(h.rq))
+		if h.privs == adminPrivs {
+			h.db.SetAdminRequest()
+		}
+		switch h.authMethod {
+		case "proxy", "client_cert", "bearer", "api_key":
+			h.db.IgnorePasswordChanges() // these credentials don't depend on the password
+		}
+	}
+
+	if err = h.runPostAuthMiddleware(); err != nil {
+		return err
 	}
 
 	return method(h) // Call the actual handler code
@@ -200,25 +236,78 @@ func (h *handler) logStatus(status int, message string) {
 	h.logDuration(false) // don't track actual time
 }
 
+// Value of the WWW-Authenticate header sent with 401 responses to database requests.
+const kBasicAuthChallenge = `Basic realm="Couchbase Sync Gateway"`
+
 func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	h.user = nil
 	if context == nil {
 		return nil
 	}
 
+	// A trusted reverse proxy may have authenticated the user already
+	var err error
+	if h.user, err = h.proxyAuthenticatedUser(context); err != nil || h.user != nil {
+		return err
+	}
+
+	// So may a verified TLS client certificate
+	if h.user, err = h.clientCertUser(context); err != nil || h.user != nil {
+		return err
+	}
+
 	// Check basic auth first
 	if userName, password := h.getBasicAuth(); userName != "" {
+		h.authMethod, h.authName = "basic", userName
+		if err := h.checkLoginThrottle(context.Name, userName); err != nil {
+			return err
+		}
 		h.user = context.Authenticator().AuthenticateUser(userName, password)
 		if h.user == nil {
 			base.Logf("HTTP auth failed for username=%q", userName)
-			h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
+			h.noteLoginFailure(context.Name, userName)
+			h.response.Header().Set("WWW-Authenticate", kBasicAuthChallenge)
 			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 		}
+		h.noteLoginSuccess(context.Name, userName)
+		return nil
+	}
+
+	// Check for an OpenID Connect token in the Authorization header
+	if token := bearerToken(h.rq); token != "" && len(h.server.config.OIDC) > 0 {
+		h.authMethod = "bearer"
+		if h.user, err = h.server.authenticateBearerToken(context, token); err != nil {
+			h.response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			return err
+		}
+		return nil
+	}
+
+	// Check for an API key in the Authorization header (used by backend services)
+	if auth.APIKeyFromHeader(h.rq) != "" {
+		h.authMethod = "api_key"
+		if h.user, err = context.Authenticator().AuthenticateAPIKey(h.rq); err != nil {
+			return err
+		} else if h.user == nil {
+			base.Logf("HTTP auth failed for API key")
+			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid or revoked API key")
+		}
+		return nil
+	}
+
+	// Check for a session ID in the Authorization header (used by clients without cookies)
+	if auth.SessionIDFromHeader(h.rq) != "" {
+		if h.user, err = context.Authenticator().AuthenticateSessionHeader(h.rq); err != nil {
+			return err
+		} else if h.user == nil {
+			base.Logf("HTTP auth failed for session header")
+			h.response.Header().Set("WWW-Authenticate", kBasicAuthChallenge)
+			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid or expired session")
+		}
 		return nil
 	}
 
 	// Check cookie
-	var err error
 	h.user, err = context.Authenticator().AuthenticateCookie(h.rq, h.response)
 	if err != nil {
 		return err
@@ -231,7 +320,7 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 		return err
 	}
 	if h.privs == regularPrivs && h.user.Disabled() {
-		h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
+		h.response.Header().Set("WWW-Authenticate", kBasicAuthChallenge)
 		return base.HTTPErrorf(http.StatusUnauthorized, "Login required")
 	}
 
@@ -338,9 +427,56 @@ func (h *handler) readDocument() (db.Body, error) {
 	}
 }
 
+// Returns true if the request's Accept header allows a response of the given MIME type. A type
+// ending in "/" (like "multipart/") matches any subtype. As in RFC 2616 sec. 14.1, the most
+// specific range that matches the type decides: "application/json" takes precedence over
+// "application/*", which takes precedence over "*/*"; and a quality of 0 ("text/html;q=0")
+// means the type isn't acceptable.
 func (h *handler) requestAccepts(mimetype string) bool {
 	accept := h.rq.Header.Get("Accept")
-	return accept == "" || strings.Contains(accept, mimetype) || strings.Contains(accept, "*/*")
+	if accept == "" {
+		return true
+	}
+	bestSpecificity := 0
+	accepted := false
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(params[0]))
+		specificity := 0
+		if mediaRange == mimetype {
+			specificity = 3
+		} else if strings.HasSuffix(mimetype, "/") && strings.HasPrefix(mediaRange, mimetype) {
+			specificity = 3
+		} else if strings.HasSuffix(mediaRange, "/*") &&
+			strings.HasPrefix(mimetype, mediaRange[:len(mediaRange)-1]) {
+			specificity = 2
+		} else if mediaRange == "*/*" {
+			specificity = 1
+		}
+		if specificity == 0 || specificity < bestSpecificity {
+			continue
+		}
+		rangeAccepted := true
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				quality, err := strconv.ParseFloat(q[2:], 64)
+				rangeAccepted = !(err == nil && quality <= 0)
+			}
+		}
+		if specificity > bestSpecificity {
+			bestSpecificity = specificity
+			accepted = rangeAccepted
+		} else {
+			accepted = accepted || rangeAccepted
+		}
+	}
+	return accepted
+}
+
+// Should JSON responses be pretty-printed? The "pretty" query parameter overrides the server's
+// configuration.
+func (h *handler) prettyPrint() bool {
+	return h.getOptBoolQuery("pretty", PrettyPrint || h.server.config.Pretty)
 }
 
 func (h *handler) getBasicAuth() (username string, password string) {
@@ -363,6 +499,39 @@ func (h *handler) setHeader(name string, value string) {
 	h.response.Header().Set(name, value)
 }
 
+// For GET responses that can't change unless the database does (like _all_docs or a one-shot
+// _changes feed), sets an ETag derived from the state of the changes cache and the user.
+// Returns true if the client already has this response; see checkETag.
+func (h *handler) checkSequenceETag() bool {
+	if h.rq.Method != "GET" && h.rq.Method != "HEAD" {
+		return false
+	}
+	tag := h.db.ChangesStateTag()
+	if h.user != nil {
+		// Different users see different results:
+		digest := sha1.Sum([]byte(h.user.Name()))
+		tag += "-" + hex.EncodeToString(digest[:6])
+	}
+	return h.checkETag(tag)
+}
+
+// Sets the response's ETag header to the (quoted) tag. If the request's If-None-Match header
+// matches it, writes a 304 status and returns true; the caller should then return without
+// writing a body.
+func (h *handler) checkETag(tag string) bool {
+	etag := strconv.Quote(tag)
+	h.setHeader("Etag", etag)
+	for _, match := range strings.Split(h.rq.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			h.response.WriteHeader(http.StatusNotModified)
+			h.setStatus(http.StatusNotModified, "Not Modified")
+			return true
+		}
+	}
+	return false
+}
+
 func (h *handler) setStatus(status int, message string) {
 	h.status = status
 	h.statusMessage = message
@@ -379,8 +548,10 @@ func (h *handler) disableResponseCompression() {
 // If status is nonzero, the header will be written with that status.
 func (h *handler) writeJSONStatus(status int, value interface{}) {
 	if !h.requestAccepts("application/json") {
-		base.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
-		h.writeStatus(http.StatusNotAcceptable, "only application/json available")
+		accept := h.rq.Header.Get("Accept")
+		base.Warn("Client won't accept JSON, only %s", accept)
+		h.writeStatus(http.StatusNotAcceptable, fmt.Sprintf(
+			"This response is only available as application/json, which the Accept header %q excludes", accept))
 		return
 	}
 
@@ -390,7 +561,7 @@ func (h *handler) writeJSONStatus(status int, value interface{}) {
 		h.writeStatus(http.StatusInternalServerError, "JSON serialization failed")
 		return
 	}
-	if PrettyPrint {
+	if h.prettyPrint() {
 		var buffer bytes.Buffer
 		json.Indent(&buffer, jsonOut, "", "  ")
 		jsonOut = append(buffer.Bytes(), '\n')
@@ -466,6 +637,11 @@ func (h *handler) flush() {
 func (h *handler) writeError(err error) {
 	if err != nil {
 		status, message := base.ErrorAsHTTPStatus(err)
+		if _, ok := err.(*base.AuthChallengeError); ok && h.privs != adminPrivs &&
+			h.response.Header().Get("WWW-Authenticate") == "" {
+			// e.g. the sync function threw {unauthorized:...}; prompt the client to log in
+			h.setHeader("WWW-Authenticate", kBasicAuthChallenge)
+		}
 		h.writeStatus(status, message)
 	}
 }
@@ -495,7 +671,7 @@ func (h *handler) writeStatus(status int, message string) {
 	h.setHeader("Content-Type", "application/json")
 	h.response.WriteHeader(status)
 	h.setStatus(status, message)
-	jsonOut, _ := json.Marshal(db.Body{"error": errorStr, "reason": message})
+	jsonOut, _ := json.Marshal(errorResponse{Error: errorStr, Reason: message})
 	h.response.Write(jsonOut)
 }
 
@@ -0,0 +1,198 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// The hardened profile is meant for security-sensitive deployments. It turns off everything on
+// the admin port that isn't needed to run replication -- the admin UI, the config, logging and
+// stats introspection handlers, the profiling, expvar and pprof handlers, and the raw doc,
+// access, view and channel dump handlers -- as well as the separate profile interface, stats
+// reporting and stats history, and keeps the admin API bound to the loopback interface. It's
+// enabled by the "Hardened" config property, or unconditionally by building with "-tags hardened".
+
+// Admin-port endpoints that aren't available in the hardened profile (for the startup log.)
+var kHardenedDisabledEndpoints = []string{
+	"/_admin/", "/_config", "/_logging", "/_profile", "/_heap", "/_stats", kDebugURLPathPrefix,
+	"/_debug/pprof/*", "/db/_config", "/db/_stats_history", "/db/_logging", "/db/_local_docs",
+	"/db/_raw/*", "/db/_user/*/_access/*", "/db/_user/*/_channel_history",
+	"/db/_role/*/_channel_history", "/db/_dump/*", "/db/_view/*", "/db/_dumpchannel/*",
+	"/db/_sync_debug/*",
+}
+
+func (config *ServerConfig) isHardened() bool {
+	return hardenedBuild || (config.Hardened != nil && *config.Hardened)
+}
+
+// Adjusts the config for the hardened profile: turns off the profile interface and rebinds the
+// admin interface to localhost if it was configured to listen on any other address.
+func (config *ServerConfig) applyHardening() {
+	if config.ProfileInterface != nil && *config.ProfileInterface != "" {
+		base.Warn("Hardened profile: ignoring profileInterface %q", *config.ProfileInterface)
+		config.setSource("ProfileInterface", kConfigSourceHardened)
+	}
+	config.ProfileInterface = nil
+
+	adminInterface := DefaultAdminInterface
+	if config.AdminInterface != nil {
+		adminInterface = *config.AdminInterface
+	}
+	if local := loopbackInterface(adminInterface); local != adminInterface {
+		base.Warn("Hardened profile: binding admin API to %s instead of %q", local, adminInterface)
+		adminInterface = local
+		config.setSource("AdminInterface", kConfigSourceHardened)
+	}
+	config.AdminInterface = &adminInterface
+}
+
+// Returns addr if its host is a loopback address, else the same port on 127.0.0.1.
+func loopbackInterface(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return DefaultAdminInterface
+	}
+	if host == "localhost" {
+		return addr
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// Checks that the admin API gets a listener of its own: the admin port skips authentication, so
+// if it could be reached through the public interface's address, the public port wouldn't be
+// unprivileged any more. (Port 0 is allowed for both, as each gets its own free port.) Also warns
+// if the admin API is reachable from other hosts.
+func (config *ServerConfig) checkInterfaces() error {
+	publicInterface, adminInterface := DefaultInterface, DefaultAdminInterface
+	if config.Interface != nil {
+		publicInterface = *config.Interface
+	}
+	if config.AdminInterface != nil {
+		adminInterface = *config.AdminInterface
+	}
+	publicHost, publicPort, err := net.SplitHostPort(publicInterface)
+	if err != nil {
+		return fmt.Errorf("Invalid interface %q: %v", publicInterface, err)
+	}
+	adminHost, adminPort, err := net.SplitHostPort(adminInterface)
+	if err != nil {
+		return fmt.Errorf("Invalid adminInterface %q: %v", adminInterface, err)
+	}
+	if adminPort == publicPort && adminPort != "0" && (adminHost == publicHost || adminHost == "" || publicHost == "") {
+		return fmt.Errorf("adminInterface %q must not use the same address as interface %q",
+			adminInterface, publicInterface)
+	}
+	if config.ClientCert != nil {
+		if config.SSLCert == nil {
+			return fmt.Errorf("ClientCert requires SSLCert and SSLKey")
+		} else if err := config.ClientCert.validate(); err != nil {
+			return fmt.Errorf("ClientCert: %v", err)
+		}
+	}
+	if err := config.IPFilter.validate(); err != nil {
+		return fmt.Errorf("IPFilter: %v", err)
+	}
+	if err := config.AdminIPFilter.validate(); err != nil {
+		return fmt.Errorf("AdminIPFilter: %v", err)
+	}
+	if config.RateLimit != nil {
+		if err := config.RateLimit.validate(); err != nil {
+			return fmt.Errorf("RateLimit: %v", err)
+		}
+	}
+	if loopbackInterface(adminInterface) != adminInterface && config.AdminIPFilter == nil {
+		base.Warn("Admin API is bound to %q, so other hosts can reach it without authenticating",
+			adminInterface)
+	}
+	return nil
+}
+
+// Logs a summary of what the server exposes to the network, so an operator can check it.
+func (sc *ServerContext) logAttackSurface() {
+	config := sc.config
+	scheme := "HTTP"
+	if config.SSLCert != nil {
+		scheme = "HTTPS"
+	}
+	base.Logf("Attack surface: public %s API on %s; admin API on %s",
+		scheme, *config.Interface, *config.AdminInterface)
+	if filter := config.IPFilter; filter != nil {
+		base.Logf("Attack surface: public API allows %s; denies %s",
+			describeIPRanges(filter.Allow, "all addresses"), describeIPRanges(filter.Deny, "none"))
+	}
+	if filter := config.AdminIPFilter; filter != nil {
+		base.Logf("Attack surface: admin API allows %s; denies %s",
+			describeIPRanges(filter.Allow, "all addresses"), describeIPRanges(filter.Deny, "none"))
+	}
+	if config.ProfileInterface != nil && *config.ProfileInterface != "" {
+		base.Logf("Attack surface: profile (pprof) server on %s", *config.ProfileInterface)
+	}
+	if config.CORS != nil && len(config.CORS.Origin) > 0 {
+		base.Logf("Attack surface: CORS allowed for origins %s", strings.Join(config.CORS.Origin, ", "))
+	}
+	if config.Persona != nil {
+		base.Logf("Attack surface: Persona login enabled")
+	}
+	if config.Facebook != nil {
+		base.Logf("Attack surface: Facebook login enabled")
+	}
+	for provider := range config.OAuth2 {
+		base.Logf("Attack surface: OAuth2 login enabled for %q", provider)
+	}
+	for provider := range config.OIDC {
+		base.Logf("Attack surface: OIDC bearer tokens accepted from %q", provider)
+	}
+	if config.LoginThrottle == nil {
+		base.Logf("Attack surface: failed password logins are not throttled")
+	}
+	if config.RateLimit == nil {
+		base.Logf("Attack surface: public API request rates are not limited")
+	}
+	if config.AuditLogFilePath == nil {
+		base.Logf("Attack surface: no security audit log (set AuditLogFilePath to record one)")
+	}
+	if cc := config.ClientCert; cc != nil {
+		required := "optional"
+		if cc.Required {
+			required = "required"
+		}
+		base.Logf("Attack surface: client certificates signed by CAs in %s log in by %s (%s)",
+			cc.CAFile, cc.usernameField(), required)
+	}
+	if proxy := config.TrustedProxy; proxy != nil {
+		base.Logf("Attack surface: %s header trusted from proxies at %s",
+			proxy.userHeader(), strings.Join(proxy.Addresses, ", "))
+		if invalid := proxy.invalidAddresses(); len(invalid) > 0 {
+			base.Warn("TrustedProxy: invalid addresses %s will be ignored", strings.Join(invalid, ", "))
+		}
+	}
+	for _, name := range sc.AllDatabaseNames() {
+		dbc, err := sc.GetDatabase(name)
+		if err != nil {
+			continue
+		}
+		if guest, _ := dbc.Authenticator().GetUser(""); guest != nil && !guest.Disabled() {
+			base.Logf("Attack surface: database %q allows unauthenticated (GUEST) access", name)
+		}
+	}
+	if config.isHardened() {
+		base.Logf("Attack surface: hardened profile; disabled admin endpoints: %s",
+			strings.Join(kHardenedDisabledEndpoints, " "))
+	} else {
+		base.Logf("Attack surface: admin UI, profiling and debug endpoints are enabled (set \"Hardened\" to disable)")
+	}
+}
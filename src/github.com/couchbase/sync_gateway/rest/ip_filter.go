@@ -0,0 +1,110 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Each listener can be limited to clients from certain networks, e.g. to keep the admin API
+// reachable only from a management subnet without needing a firewall in front of the gateway.
+// A request from a refused address gets a 403 before it's routed.
+
+// Configuration of which client addresses may use an interface; see ServerConfig.IPFilter and
+// ServerConfig.AdminIPFilter. Entries are IP addresses or CIDR ranges ("10.0.0.0/8").
+type IPFilterConfig struct {
+	Allow []string // If non-empty, only clients in these ranges are accepted
+	Deny  []string // Clients in these ranges are refused, even if they're in Allow
+}
+
+// A compiled IPFilterConfig.
+type ipFilter struct {
+	allow, deny []*net.IPNet
+}
+
+// Returns the filter for an interface's config, or nil if it has none (allowing everyone.)
+func newIPFilter(config *IPFilterConfig) *ipFilter {
+	if config == nil || (len(config.Allow) == 0 && len(config.Deny) == 0) {
+		return nil
+	}
+	allow, _ := parseIPRanges(config.Allow)
+	deny, _ := parseIPRanges(config.Deny)
+	return &ipFilter{allow: allow, deny: deny}
+}
+
+// Returns an error if any of the config's entries isn't an IP address or CIDR range.
+func (config *IPFilterConfig) validate() error {
+	if config == nil {
+		return nil
+	}
+	if _, err := parseIPRanges(config.Allow); err != nil {
+		return err
+	}
+	_, err := parseIPRanges(config.Deny)
+	return err
+}
+
+// Returns true if a client at this IP address may use the interface.
+func (filter *ipFilter) allows(ipString string) bool {
+	if filter == nil {
+		return true
+	}
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return false
+	}
+	for _, network := range filter.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(filter.allow) == 0 {
+		return true
+	}
+	for _, network := range filter.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func describeIPRanges(entries []string, ifEmpty string) string {
+	if len(entries) == 0 {
+		return ifEmpty
+	}
+	return strings.Join(entries, ", ")
+}
+
+// Parses IP addresses and CIDR ranges; a single address becomes a range containing only itself.
+// Invalid entries are skipped, and the first one is returned as an error.
+func parseIPRanges(entries []string) (networks []*net.IPNet, err error) {
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip)
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, 32
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		} else if _, network, parseErr := net.ParseCIDR(entry); parseErr == nil {
+			networks = append(networks, network)
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("Invalid IP address or range %q", entry)
+		}
+	}
+	return
+}
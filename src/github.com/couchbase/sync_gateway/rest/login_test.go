@@ -9,12 +9,29 @@
 package rest
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
 	"github.com/couchbaselabs/go.assert"
 	"github.com/tleyden/fakehttp"
 	"log"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestVerifyFacebook(t *testing.T) {
@@ -41,6 +58,139 @@ func TestVerifyFacebook(t *testing.T) {
 
 }
 
+func TestOAuth2Login(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		if rq.Header.Get("Authorization") != "Bearer good_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"id": 12345678901234, "name": "Alice", "email": "alice@dot.com", "email_verified": true, "aud": "`+rq.URL.Query().Get("client")+`"}`)
+	}))
+	defer provider.Close()
+
+	var rt restTester
+	rt.ServerContext().config.OAuth2 = OAuth2ConfigMap{
+		"example": &OAuth2Config{UserInfoURL: provider.URL + "?client=sg", ClientID: "sg", IDField: "id", Register: true},
+		"other":   &OAuth2Config{UserInfoURL: provider.URL + "?client=other", ClientID: "sg", IDField: "id", Register: true},
+	}
+	defer func() { rt.ServerContext().config.OAuth2 = nil }()
+
+	id, email, err := verifyOAuth2(rt.ServerContext().HTTPClient, rt.ServerContext().config.OAuth2["example"], "good_token")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, id, "12345678901234")
+	assert.Equals(t, email, "alice@dot.com")
+
+	// A token issued to a different client is rejected:
+	_, _, err = verifyOAuth2(rt.ServerContext().HTTPClient, rt.ServerContext().config.OAuth2["other"], "good_token")
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, 401)
+
+	assertStatus(t, rt.sendRequest("POST", "/db/_oauth2/example", `{"access_token":"bad_token"}`), 401)
+	assertStatus(t, rt.sendRequest("POST", "/db/_oauth2/nosuch", `{"access_token":"good_token"}`), 404)
+	assertStatus(t, rt.sendRequest("POST", "/db/_oauth2/example", `{}`), 400)
+
+	// An existing user with the same email, who signed up some other way:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"email":"alice@dot.com", "password":"letmein"}`), 201)
+
+	response := rt.sendRequest("POST", "/db/_oauth2/example", `{"access_token":"good_token"}`)
+	assertStatus(t, response, 200)
+	assert.True(t, response.Header().Get("Set-Cookie") != "")
+
+	// The user was registered, rather than logged in as the user with the same email:
+	user, err := rt.ServerContext().Database("db").Authenticator().GetUser("example_12345678901234")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, user.Email(), "alice@dot.com")
+	response = rt.sendRequestWithHeaders("GET", "/db/_session", "",
+		map[string]string{"Cookie": response.Header().Get("Set-Cookie")})
+	assertStatus(t, response, 200)
+	var session map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &session)
+	assert.Equals(t, session["userCtx"].(map[string]interface{})["name"], "example_12345678901234")
+}
+
+func TestOIDCBearerAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equals(t, err, nil)
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	// A fake provider with a discovery doc and a JWKS containing the key:
+	var providerURL string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		switch rq.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "jwks_uri": "%s/keys"}`, providerURL, providerURL)
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{
+				map[string]string{"kty": "RSA", "kid": "k1", "use": "sig",
+					"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())},
+			}})
+		default:
+			http.NotFound(w, rq)
+		}
+	}))
+	defer provider.Close()
+	providerURL = provider.URL
+
+	makeToken := func(kid string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return signed + "." + b64(signature)
+	}
+	now := time.Now().Unix()
+	claims := func(sub string, aud interface{}, exp int64) map[string]interface{} {
+		return map[string]interface{}{"iss": providerURL, "sub": sub, "aud": aud, "exp": exp,
+			"iat": now, "email": sub + "@example.com", "email_verified": true}
+	}
+	rt := restTester{noAdminParty: true}
+	rt.ServerContext().config.OIDC = OIDCConfigMap{
+		"acme": &OIDCConfig{Issuer: providerURL, ClientID: "sgw", Register: true},
+	}
+	defer func() { rt.ServerContext().config.OIDC = nil }()
+	sendWithToken := func(token string) *testResponse {
+		return rt.sendRequestWithHeaders("GET", "/db/_session", "", map[string]string{"Authorization": "Bearer " + token})
+	}
+
+	// A valid token logs in, registering the user:
+	response := sendWithToken(makeToken("k1", claims("alice", []string{"other", "sgw"}, now+600)))
+	assertStatus(t, response, 200)
+	var session map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &session)
+	assert.Equals(t, session["userCtx"].(map[string]interface{})["name"], "acme_alice")
+	response = rt.sendAdminRequest("GET", "/db/_user/acme_alice", "")
+	json.Unmarshal(response.Body.Bytes(), &session)
+	assert.Equals(t, session["email"], "alice@example.com")
+
+	// An unverified email isn't given to a registered user, or accepted as a username:
+	unverified := claims("carol", "sgw", now+600)
+	unverified["email_verified"] = false
+	assertStatus(t, sendWithToken(makeToken("k1", unverified)), 200)
+	response = rt.sendAdminRequest("GET", "/db/_user/acme_carol", "")
+	var carol map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &carol)
+	assert.Equals(t, carol["email"], nil)
+	rt.ServerContext().config.OIDC["acme"].UsernameClaim = "email"
+	assertStatus(t, sendWithToken(makeToken("k1", unverified)), 401)
+	assertStatus(t, sendWithToken(makeToken("k1", claims("carol", "sgw", now+600))), 200)
+	rt.ServerContext().config.OIDC["acme"].UsernameClaim = ""
+
+	// Invalid tokens don't:
+	assertStatus(t, sendWithToken(makeToken("k1", claims("alice", "wrong_audience", now+600))), 401)
+	assertStatus(t, sendWithToken(makeToken("k1", claims("alice", "sgw", now-3600))), 401)
+	assertStatus(t, sendWithToken(makeToken("nosuchkey", claims("alice", "sgw", now+600))), 401)
+	tampered := makeToken("k1", claims("alice", "sgw", now+600))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	assertStatus(t, sendWithToken(tampered), 401)
+	assertStatus(t, sendWithToken("not.a.jwt"), 401)
+
+	// Without registration, unknown users are rejected:
+	rt.ServerContext().config.OIDC["acme"].Register = false
+	assertStatus(t, sendWithToken(makeToken("k1", claims("bob", "sgw", now+600))), 401)
+	assertStatus(t, sendWithToken(makeToken("k1", claims("alice", "sgw", now+600))), 200)
+}
+
 // This test exists because there have been problems with builds of Go being unable to make HTTPS
 // connections due to the TLS package missing the Cgo bits needed to load system root certs.
 // This then breaks our Persona support.
@@ -50,3 +200,330 @@ func TestVerifyHTTPSSupport(t *testing.T) {
 		log.Panicf("Error making HTTPS connection: %v", err)
 	}
 }
+
+func TestLoginThrottle(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	maxFailures, maxPerIP := 3, 5
+	rt.ServerContext().config.LoginThrottle = &LoginThrottleConfig{
+		MaxFailures:      &maxFailures,
+		MaxFailuresPerIP: &maxPerIP,
+	}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	for i := 0; i < maxFailures; i++ {
+		response := rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "wrong")
+		assertStatus(t, response, 401)
+	}
+	// Now alice is locked out, even with the right password:
+	response := rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein")
+	assertStatus(t, response, 429)
+	assert.True(t, response.Header().Get("Retry-After") != "")
+	assertStatus(t, rt.sendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`), 429)
+
+	// ...but only from this client; she can still log in from elsewhere:
+	rq := request("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`)
+	rq.RemoteAddr = "10.3.3.3:5555"
+	assertStatus(t, rt.send(rq), 200)
+
+	// But bob isn't, and a successful login resets his count:
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "bob", "wrong"), 401)
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "bob", "letmein"), 200)
+
+	// Failures from the same client add up, until it's locked out:
+	assertStatus(t, rt.sendRequest("POST", "/db/_session", `{"name":"bob", "password":"wrong"}`), 401)
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "bob", "letmein"), 429)
+
+	assert.True(t, restExpvars.Get("login_lockouts") != nil)
+	assert.True(t, restExpvars.Get("logins_throttled") != nil)
+
+	// Without the config there's no throttling:
+	rt.ServerContext().config.LoginThrottle = nil
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), 200)
+}
+
+func TestTrustedProxyAuth(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	rt.ServerContext().config.TrustedProxy = &TrustedProxyConfig{Addresses: []string{"10.1.2.3", "192.168.0.0/16"}}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/carol", `{"password":"letmein", "disabled":true}`), 201)
+
+	sendFrom := func(remoteAddr string, userName string) *testResponse {
+		rq := request("GET", "/db/_session", "")
+		rq.RemoteAddr = remoteAddr
+		rq.Header.Set("X-Authenticated-User", userName)
+		return rt.send(rq)
+	}
+	var session struct {
+		UserCtx struct {
+			Name *string
+		}
+	}
+	response := sendFrom("10.1.2.3:5555", "alice")
+	assertStatus(t, response, 200)
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &session), nil)
+	assert.Equals(t, *session.UserCtx.Name, "alice")
+	response = sendFrom("192.168.7.8:5555", "alice")
+	assertStatus(t, response, 200)
+
+	assertStatus(t, sendFrom("10.1.2.3:5555", "nobody"), 401)
+	assertStatus(t, sendFrom("10.1.2.3:5555", "carol"), 401)
+
+	// The header is ignored from other addresses, leaving the request unauthenticated:
+	response = sendFrom("10.9.9.9:5555", "alice")
+	assertStatus(t, response, 200)
+	session.UserCtx.Name = nil
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &session), nil)
+	assert.True(t, session.UserCtx.Name == nil)
+
+	// A different header can be configured:
+	header := "X-Remote-User"
+	rt.ServerContext().config.TrustedProxy.UserHeader = &header
+	rq := request("GET", "/db/_session", "")
+	rq.RemoteAddr = "10.1.2.3:5555"
+	rq.Header.Set("X-Remote-User", "alice")
+	assertStatus(t, rt.send(rq), 200)
+
+	// The client's address is taken from X-Forwarded-For, but only when a trusted proxy sent it:
+	sc := rt.ServerContext()
+	rq = request("GET", "/db/", "")
+	rq.RemoteAddr = "10.1.2.3:5555"
+	rq.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.5, 192.168.1.1")
+	assert.Equals(t, sc.clientIP(rq), "203.0.113.5")
+	rq.RemoteAddr = "10.9.9.9:5555"
+	assert.Equals(t, sc.clientIP(rq), "10.9.9.9")
+}
+
+func TestIPFilter(t *testing.T) {
+	rt := restTester{}
+	config := rt.ServerContext().config
+	config.AdminIPFilter = &IPFilterConfig{Allow: []string{"127.0.0.1", "10.0.0.0/8"}, Deny: []string{"10.66.0.0/16"}}
+	config.IPFilter = &IPFilterConfig{Deny: []string{"192.0.2.0/24", "2001:db8::/32"}}
+
+	sendFrom := func(remoteAddr string, admin bool) *testResponse {
+		rq := request("GET", "/db/", "")
+		rq.RemoteAddr = remoteAddr
+		response := &testResponse{httptest.NewRecorder(), rq}
+		response.Code = 200
+		if admin {
+			CreateAdminHandler(rt.ServerContext()).ServeHTTP(response, rq)
+		} else {
+			CreatePublicHandler(rt.ServerContext()).ServeHTTP(response, rq)
+		}
+		return response
+	}
+	assertStatus(t, sendFrom("127.0.0.1:5555", true), 200)
+	assertStatus(t, sendFrom("10.1.2.3:5555", true), 200)
+	assertStatus(t, sendFrom("10.66.2.3:5555", true), 403)
+	assertStatus(t, sendFrom("192.168.1.1:5555", true), 403)
+	assertStatus(t, sendFrom("[::1]:5555", true), 403)
+
+	assertStatus(t, sendFrom("192.168.1.1:5555", false), 200)
+	assertStatus(t, sendFrom("[2001:db9::1]:5555", false), 200)
+	assertStatus(t, sendFrom("192.0.2.9:5555", false), 403)
+	assertStatus(t, sendFrom("[2001:db8::1]:5555", false), 403)
+
+	// Invalid entries are rejected when the server starts:
+	assert.True(t, config.AdminIPFilter.validate() == nil)
+	assert.True(t, (&IPFilterConfig{Deny: []string{"10.0.0.0/33"}}).validate() != nil)
+	assert.True(t, (&IPFilterConfig{Allow: []string{"localhost"}}).validate() != nil)
+}
+
+func TestRateLimit(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	rate, userBurst, ipBurst := 0.01, 2, 4
+	rt.ServerContext().config.RateLimit = &RateLimitConfig{
+		UserRequestsPerSec: &rate,
+		UserBurst:          &userBurst,
+		IPRequestsPerSec:   &rate,
+		IPBurst:            &ipBurst,
+	}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	sendFrom := func(remoteAddr, username string) *testResponse {
+		rq := request("GET", "/db/", "")
+		rq.RemoteAddr = remoteAddr
+		if username != "" {
+			rq.SetBasicAuth(username, "letmein")
+		}
+		return rt.send(rq)
+	}
+
+	// Alice uses up her burst, from two different addresses:
+	assertStatus(t, sendFrom("10.0.0.1:5555", "alice"), 200)
+	assertStatus(t, sendFrom("10.0.0.2:5555", "alice"), 200)
+	response := sendFrom("10.0.0.2:5555", "alice")
+	assertStatus(t, response, 429)
+	assert.Equals(t, response.Header().Get("Retry-After"), "100")
+
+	// Bob isn't affected, until his address uses up its burst:
+	assertStatus(t, sendFrom("10.0.0.2:5555", "bob"), 200)
+	assertStatus(t, sendFrom("10.0.0.2:5555", ""), 401)
+	assertStatus(t, sendFrom("10.0.0.2:5555", "bob"), 429)
+	assertStatus(t, sendFrom("10.0.0.3:5555", "bob"), 200)
+
+	// The admin API isn't limited:
+	for i := 0; i < ipBurst+1; i++ {
+		assertStatus(t, rt.sendAdminRequest("GET", "/db/", ""), 200)
+	}
+
+	zero := 0.0
+	assert.True(t, (&RateLimitConfig{IPRequestsPerSec: &zero}).validate() != nil)
+	assert.True(t, (&RateLimitConfig{UserRequestsPerSec: &rate, UserBurst: new(int)}).validate() != nil)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	config := &ClientCertConfig{CAFile: "ca.pem"}
+	rt.ServerContext().config.ClientCert = config
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	// The TLS listener has already verified the certificate by the time the handler sees it:
+	sendWithCert := func(cert *x509.Certificate) *testResponse {
+		rq := request("GET", "/db/_session", "")
+		rq.TLS = &tls.ConnectionState{HandshakeComplete: true}
+		if cert != nil {
+			rq.TLS.PeerCertificates = []*x509.Certificate{cert}
+			rq.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		return rt.send(rq)
+	}
+	sessionUser := func(response *testResponse) string {
+		var session struct{ UserCtx struct{ Name *string } }
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &session), nil)
+		if session.UserCtx.Name == nil {
+			return ""
+		}
+		return *session.UserCtx.Name
+	}
+
+	response := sendWithCert(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	assertStatus(t, response, 200)
+	assert.Equals(t, sessionUser(response), "alice")
+	assertStatus(t, sendWithCert(&x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}}), 401)
+	assertStatus(t, sendWithCert(&x509.Certificate{}), 401)
+
+	// Without a certificate, other authentication works as usual:
+	response = sendWithCert(nil)
+	assertStatus(t, response, 200)
+	assert.Equals(t, sessionUser(response), "")
+
+	// The username can come from a subject alternative name instead:
+	dns := "dns"
+	config.UsernameFrom = &dns
+	response = sendWithCert(&x509.Certificate{Subject: pkix.Name{CommonName: "x"}, DNSNames: []string{"alice"}})
+	assertStatus(t, response, 200)
+	assert.Equals(t, sessionUser(response), "alice")
+
+	assert.Equals(t, config.validate(), nil)
+	bad := "serial"
+	config.UsernameFrom = &bad
+	assert.True(t, config.validate() != nil)
+}
+
+func TestAPIKeys(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/svc", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_user/nobody/_api_key", ""), 404)
+
+	createKey := func(label string) (id, key string) {
+		response := rt.sendAdminRequest("POST", "/db/_user/svc/_api_key", `{"label":"`+label+`"}`)
+		assertStatus(t, response, 201)
+		var body db.Body
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &body), nil)
+		assert.Equals(t, body["label"], label)
+		return body["id"].(string), body["key"].(string)
+	}
+	sendWithKey := func(key string) *testResponse {
+		return rt.sendRequestWithHeaders("GET", "/db/", "", map[string]string{"Authorization": "APIKey " + key})
+	}
+	id1, key1 := createKey("backend")
+	id2, key2 := createKey("backup")
+	assertStatus(t, sendWithKey(key1), 200)
+	assertStatus(t, sendWithKey(key2), 200)
+	assertStatus(t, sendWithKey(id1+".wrong"), 401)
+	assertStatus(t, sendWithKey("garbage"), 401)
+
+	response := rt.sendAdminRequest("GET", "/db/_user/svc/_api_key", "")
+	assertStatus(t, response, 200)
+	assert.False(t, strings.Contains(response.Body.String(), "secret"))
+	var keys []auth.APIKey
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &keys), nil)
+	assert.Equals(t, len(keys), 2)
+	assert.Equals(t, keys[0].ID, id1)
+	assert.Equals(t, keys[1].ID, id2)
+	assert.Equals(t, keys[1].Label, "backup")
+
+	// Revoking one key leaves the other working:
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/svc/_api_key/"+id1, ""), 200)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/svc/_api_key/"+id1, ""), 404)
+	assertStatus(t, sendWithKey(key1), 401)
+	assertStatus(t, sendWithKey(key2), 200)
+
+	// Changing the password doesn't affect keys, but disabling or deleting the user does:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/svc", `{"password":"changed", "admin_channels":["*"]}`), 200)
+	assertStatus(t, sendWithKey(key2), 200)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/svc", `{"disabled":true, "admin_channels":["*"]}`), 200)
+	assertStatus(t, sendWithKey(key2), 401)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/svc", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/svc", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	assertStatus(t, sendWithKey(key2), 401)
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	base.SetAuditWriter(&buf)
+	defer base.SetAuditWriter(nil)
+	readEvents := func() []base.AuditEvent {
+		var events []base.AuditEvent
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if line != "" {
+				var event base.AuditEvent
+				assert.Equals(t, json.Unmarshal([]byte(line), &event), nil)
+				events = append(events, event)
+			}
+		}
+		buf.Reset()
+		return events
+	}
+
+	var rt restTester
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["alice"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/secret", `{"channels":["bob"]}`), 201)
+	events := readEvents()
+	assert.Equals(t, len(events), 2)
+	assert.Equals(t, events[0].Event, base.AuditAdminOperation)
+	assert.Equals(t, events[0].Path, "/db/_user/alice")
+	assert.Equals(t, events[0].Status, 201)
+	assert.True(t, events[0].Admin)
+	assert.Equals(t, events[1].DocID, "secret")
+
+	// Reads through the admin API aren't recorded:
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_user/alice", ""), 200)
+	assert.Equals(t, len(readEvents()), 0)
+
+	// Failed and successful logins:
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "wrong"), 401)
+	assertStatus(t, rt.sendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`), 200)
+	events = readEvents()
+	assert.Equals(t, len(events), 3)
+	assert.Equals(t, events[0].Event, base.AuditLoginFailure)
+	assert.Equals(t, events[0].User, "alice")
+	assert.Equals(t, events[0].DB, "db")
+	assert.Equals(t, events[0].Message, "basic")
+	assert.Equals(t, events[1].Event, base.AuditSessionCreated)
+	assert.Equals(t, events[1].User, "alice")
+	assert.Equals(t, events[2].Event, base.AuditLoginSuccess)
+	assert.Equals(t, events[2].Message, "password")
+
+	// Access denial:
+	assertStatus(t, rt.sendUserRequestWithHeaders("GET", "/db/secret", "", nil, "alice", "letmein"), 403)
+	events = readEvents()
+	assert.Equals(t, len(events), 2)
+	assert.Equals(t, events[0].Event, base.AuditLoginSuccess)
+	assert.Equals(t, events[1].Event, base.AuditAccessDenied)
+	assert.Equals(t, events[1].User, "alice")
+	assert.Equals(t, events[1].DocID, "secret")
+	assert.Equals(t, events[1].Status, 403)
+}
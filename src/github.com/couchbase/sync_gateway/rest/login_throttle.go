@@ -0,0 +1,215 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// To blunt password guessing and credential stuffing, failed password logins (basic auth or
+// POST /_session) are counted per username from each client IP address, and per client IP
+// address. Once either count reaches its limit within the window, further password logins as
+// that user from that address, or any logins from that address, are refused with a 429 status
+// until the lockout expires -- even with the right password, so that an attacker can't tell when
+// they've guessed it. A user's lockout is tied to the client's address so that an attacker can't
+// lock a legitimate user out just by failing to log in as them.
+
+// HTTP status for a client that's been rate-limited.
+const kStatusTooManyRequests = 429
+
+const (
+	kDefaultLoginMaxFailures      = 5
+	kDefaultLoginMaxFailuresPerIP = 20
+	kDefaultLoginWindowSecs       = 300
+	kDefaultLoginLockoutSecs      = 900
+)
+
+// Configuration for throttling failed logins; see ServerConfig.LoginThrottle.
+type LoginThrottleConfig struct {
+	MaxFailures      *int // Failed logins allowed per username & client IP within the window; default 5
+	MaxFailuresPerIP *int // Failed logins allowed per client IP within the window; default 20
+	WindowSecs       *int // Period over which failures are counted; default 300
+	LockoutSecs      *int // How long logins are refused once a limit is reached; default 900
+}
+
+func (config *LoginThrottleConfig) limits() (maxFailures, maxPerIP int, window, lockout time.Duration) {
+	intOr := func(value *int, defaultValue int) int {
+		if value != nil {
+			return *value
+		}
+		return defaultValue
+	}
+	return intOr(config.MaxFailures, kDefaultLoginMaxFailures),
+		intOr(config.MaxFailuresPerIP, kDefaultLoginMaxFailuresPerIP),
+		time.Duration(intOr(config.WindowSecs, kDefaultLoginWindowSecs)) * time.Second,
+		time.Duration(intOr(config.LockoutSecs, kDefaultLoginLockoutSecs)) * time.Second
+}
+
+// Tracks recent failed logins.
+type loginThrottle struct {
+	lock      sync.Mutex
+	users     map[string]*loginFailures // Keyed by userThrottleKey()
+	addresses map[string]*loginFailures // Keyed by client IP
+	lastPrune time.Time
+}
+
+type loginFailures struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// Counts a failure; returns true if this reached the limit and started a lockout.
+func (f *loginFailures) add(now time.Time, limit int, window, lockout time.Duration) bool {
+	if now.Sub(f.windowStart) > window {
+		f.count = 0
+		f.windowStart = now
+	}
+	f.count++
+	if limit > 0 && f.count >= limit && now.After(f.lockedUntil) {
+		f.lockedUntil = now.Add(lockout)
+		return true
+	}
+	return false
+}
+
+// Returns the IP address a request's connection came from.
+func peerIP(rq *http.Request) string {
+	host, _, err := net.SplitHostPort(rq.RemoteAddr)
+	if err != nil {
+		return rq.RemoteAddr
+	}
+	return host
+}
+
+// Returns the IP address of the client that made a request. If it came through a trusted proxy
+// (see ServerConfig.TrustedProxy) that's the last address in its X-Forwarded-For header that
+// isn't a trusted proxy too; otherwise it's the address the request came from.
+func (sc *ServerContext) clientIP(rq *http.Request) string {
+	ip := peerIP(rq)
+	proxy := sc.config.TrustedProxy
+	if proxy == nil || !proxy.trusts(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(rq.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break // can't trust anything before a garbled entry
+		}
+		ip = addr
+		if !proxy.trusts(addr) {
+			break
+		}
+	}
+	return ip
+}
+
+// Returns a 429 error if password logins as this user, or from this client, are locked out.
+func (h *handler) checkLoginThrottle(dbName, username string) error {
+	if h.server.config.LoginThrottle == nil {
+		return nil
+	}
+	ip := h.server.clientIP(h.rq)
+	t := &h.server.loginThrottle
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	lockedUntil := time.Time{}
+	if f := t.users[userThrottleKey(dbName, username, ip)]; f != nil && f.lockedUntil.After(lockedUntil) {
+		lockedUntil = f.lockedUntil
+	}
+	if f := t.addresses[ip]; f != nil && f.lockedUntil.After(lockedUntil) {
+		lockedUntil = f.lockedUntil
+	}
+	if !lockedUntil.After(now) {
+		return nil
+	}
+	restExpvars.Add("logins_throttled", 1)
+	retryAfter := int(lockedUntil.Sub(now)/time.Second) + 1
+	h.setHeader("Retry-After", strconv.Itoa(retryAfter))
+	return base.HTTPErrorf(kStatusTooManyRequests,
+		"Too many failed logins; try again in %d seconds", retryAfter)
+}
+
+// Records a failed password login.
+func (h *handler) noteLoginFailure(dbName, username string) {
+	restExpvars.Add("login_failures", 1)
+	config := h.server.config.LoginThrottle
+	if config == nil {
+		return
+	}
+	maxFailures, maxPerIP, window, lockout := config.limits()
+	ip := h.server.clientIP(h.rq)
+	t := &h.server.loginThrottle
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if t.users == nil {
+		t.users = map[string]*loginFailures{}
+		t.addresses = map[string]*loginFailures{}
+		t.lastPrune = now
+	} else if now.Sub(t.lastPrune) > window {
+		t.prune(now, window)
+	}
+
+	key := userThrottleKey(dbName, username, ip)
+	if t.users[key] == nil {
+		t.users[key] = &loginFailures{windowStart: now}
+	}
+	if t.users[key].add(now, maxFailures, window, lockout) {
+		base.Warn("Too many failed logins for user %q in db %q from %s; locked out for %v",
+			username, dbName, ip, lockout)
+		restExpvars.Add("login_lockouts", 1)
+	}
+	if t.addresses[ip] == nil {
+		t.addresses[ip] = &loginFailures{windowStart: now}
+	}
+	if t.addresses[ip].add(now, maxPerIP, window, lockout) {
+		base.Warn("Too many failed logins from %s; locked out for %v", ip, lockout)
+		restExpvars.Add("login_lockouts", 1)
+	}
+}
+
+// Clears a user's failure count from this client after a successful login.
+func (h *handler) noteLoginSuccess(dbName, username string) {
+	if h.server.config.LoginThrottle == nil {
+		return
+	}
+	ip := h.server.clientIP(h.rq)
+	t := &h.server.loginThrottle
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.users, userThrottleKey(dbName, username, ip))
+}
+
+// The key of a user's failure record in loginThrottle.users.
+func userThrottleKey(dbName, username, ip string) string {
+	return dbName + "/" + username + "@" + ip
+}
+
+// Forgets records whose window and lockout have both expired. Must be called with the lock held.
+func (t *loginThrottle) prune(now time.Time, window time.Duration) {
+	for _, records := range []map[string]*loginFailures{t.users, t.addresses} {
+		for key, f := range records {
+			if now.Sub(f.windowStart) > window && now.After(f.lockedUntil) {
+				delete(records, key)
+			}
+		}
+	}
+	t.lastPrune = now
+}
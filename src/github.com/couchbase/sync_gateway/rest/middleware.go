@@ -0,0 +1,125 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Code embedding the gateway can add behavior to every request -- a quota system, say, or a scan
+// of document bodies for data that mustn't be stored -- by registering a Middleware with the
+// ServerContext, instead of patching the REST handlers.
+
+// Hooks called at points in the handling of each API request. An error returned by a hook fails
+// the request; if it's not an HTTPError the status will be 500. Embed BaseMiddleware to get
+// no-op implementations of the hooks you don't need.
+type Middleware interface {
+	// Called before the request is authenticated (so rc.User is nil.)
+	PreAuth(rc *RequestContext) error
+
+	// Called after the request is authenticated, before the handler runs.
+	PostAuth(rc *RequestContext) error
+
+	// Called before a document revision is saved, as db.WriteHooks.BeforeWrite.
+	PreWrite(rc *RequestContext, docid string, body db.Body) error
+
+	// Called after a document revision is saved.
+	PostWrite(rc *RequestContext, docid string, revid string, body db.Body)
+}
+
+// A Middleware whose hooks do nothing.
+type BaseMiddleware struct{}
+
+func (BaseMiddleware) PreAuth(rc *RequestContext) error                                { return nil }
+func (BaseMiddleware) PostAuth(rc *RequestContext) error                               { return nil }
+func (BaseMiddleware) PreWrite(rc *RequestContext, docid string, body db.Body) error   { return nil }
+func (BaseMiddleware) PostWrite(rc *RequestContext, docid, revid string, body db.Body) {}
+
+// The request being handled, as seen by a Middleware's hooks.
+type RequestContext struct {
+	Request        *http.Request
+	ResponseHeader http.Header            // Headers of the response, which hooks may add to
+	DBName         string                 // Name of the database, if the request is for one
+	User           auth.User              // Authenticated user; nil before auth or on the admin API
+	Admin          bool                   // True if the request came through the admin API
+	ClientIP       string                 // Address of the client
+	Values         map[string]interface{} // For hooks to pass data to later hooks of the request
+}
+
+// Registers a Middleware, whose hooks will be called after those of any registered earlier.
+// Must be called before the server starts handling requests.
+func (sc *ServerContext) AddMiddleware(m Middleware) {
+	sc.middleware = append(sc.middleware, m)
+}
+
+func (h *handler) requestContext() *RequestContext {
+	if h.middlewareContext == nil {
+		h.middlewareContext = &RequestContext{
+			Request:        h.rq,
+			ResponseHeader: h.response.Header(),
+			DBName:         h.PathVar("db"),
+			Admin:          h.privs == adminPrivs,
+			ClientIP:       h.server.clientIP(h.rq),
+			Values:         map[string]interface{}{},
+		}
+	}
+	return h.middlewareContext
+}
+
+func (h *handler) runPreAuthMiddleware() error {
+	for _, m := range h.server.middleware {
+		if err := m.PreAuth(h.requestContext()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs the PostAuth hooks, then installs the write hooks in the request's Database.
+func (h *handler) runPostAuthMiddleware() error {
+	if len(h.server.middleware) == 0 {
+		return nil
+	}
+	rc := h.requestContext()
+	rc.User = h.user
+	for _, m := range h.server.middleware {
+		if err := m.PostAuth(rc); err != nil {
+			return err
+		}
+	}
+	if h.db != nil {
+		h.db.SetWriteHooks(middlewareWriteHooks{h.server.middleware, rc})
+	}
+	return nil
+}
+
+// Adapts a list of Middleware to db.WriteHooks.
+type middlewareWriteHooks struct {
+	middleware []Middleware
+	rc         *RequestContext
+}
+
+func (hooks middlewareWriteHooks) BeforeWrite(docid string, body db.Body) error {
+	for _, m := range hooks.middleware {
+		if err := m.PreWrite(hooks.rc, docid, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hooks middlewareWriteHooks) AfterWrite(docid string, revid string, body db.Body) {
+	for _, m := range hooks.middleware {
+		m.PostWrite(hooks.rc, docid, revid, body)
+	}
+}
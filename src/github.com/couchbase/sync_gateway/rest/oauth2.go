@@ -0,0 +1,133 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// POST /_oauth2/{provider} exchanges an OAuth2 access token from a configured provider for a
+// login session, like POST /_facebook does for Facebook tokens.
+func (h *handler) handleOAuth2POST() error {
+	// CORS not allowed for login #115 #762
+	originHeader := h.rq.Header["Origin"]
+	if len(originHeader) > 0 {
+		var loginOrigins []string
+		if h.server.config.CORS != nil {
+			loginOrigins = h.server.config.CORS.LoginOrigin
+		}
+		if matchedOrigin(loginOrigins, originHeader) == "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "No CORS")
+		}
+	}
+	providerName := h.PathVar("provider")
+	provider := h.server.config.OAuth2[providerName]
+	if provider == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Unknown OAuth2 provider")
+	}
+	var params struct {
+		AccessToken string `json:"access_token"`
+	}
+	err := h.readJSONInto(&params)
+	if err != nil {
+		return err
+	} else if params.AccessToken == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing access_token")
+	}
+
+	id, email, err := verifyOAuth2(h.server.HTTPClient, provider, params.AccessToken)
+	if err != nil {
+		return err
+	}
+	// Don't look the user up by email: that would let any configured provider log in as an
+	// existing user who signed up some other way with the same address.
+	return h.makeSessionFromNameAndEmail(providerName+"_"+id, email, false, provider.Register)
+}
+
+// Asks an OAuth2 provider who owns an access token, returning their ID and email. The token
+// must have been issued to the configured client, so that a token some other app obtained for
+// the user can't be used to log in as them. The email is only returned if the provider says
+// it's verified; otherwise it's "".
+func verifyOAuth2(client *http.Client, provider *OAuth2Config, accessToken string) (id string, email string, err error) {
+	if provider.ClientID == "" {
+		return "", "", base.HTTPErrorf(http.StatusInternalServerError,
+			"OAuth2 provider has no ClientID configured")
+	}
+	rq, err := http.NewRequest("GET", provider.UserInfoURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	rq.Header.Set("Authorization", "Bearer "+accessToken)
+	rq.Header.Set("Accept", "application/json")
+	res, err := client.Do(rq)
+	if err != nil {
+		return "", "", base.HTTPErrorf(http.StatusBadGateway, "Can't reach OAuth2 provider: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return "", "", base.HTTPErrorf(http.StatusUnauthorized,
+			"OAuth2 verification server status %d", res.StatusCode)
+	}
+
+	var profile map[string]interface{}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber() // Some providers' IDs are large numbers
+	if err = decoder.Decode(&profile); err != nil {
+		return "", "", base.HTTPErrorf(http.StatusBadGateway, "Invalid response from OAuth2 provider")
+	}
+
+	idField, emailField := provider.IDField, provider.EmailField
+	if idField == "" {
+		idField = "sub"
+	}
+	if emailField == "" {
+		emailField = "email"
+	}
+	switch value := profile[idField].(type) {
+	case string:
+		id = value
+	case json.Number:
+		id = value.String()
+	}
+	if id == "" {
+		return "", "", base.HTTPErrorf(http.StatusBadGateway,
+			"OAuth2 provider's response has no %q", idField)
+	}
+	if !oauth2ClientMatches(profile, provider.ClientID) {
+		return "", "", base.HTTPErrorf(http.StatusUnauthorized,
+			"OAuth2 token was not issued to this client")
+	}
+	if verified := profile["email_verified"]; verified == true || verified == "true" {
+		email, _ = profile[emailField].(string)
+	}
+	return id, email, nil
+}
+
+// Returns true if a token profile's "aud" (a string or array) or "azp" is the client ID.
+func oauth2ClientMatches(profile map[string]interface{}, clientID string) bool {
+	if profile["azp"] == clientID {
+		return true
+	}
+	switch aud := profile["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, item := range aud {
+			if item == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
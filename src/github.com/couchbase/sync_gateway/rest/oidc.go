@@ -0,0 +1,385 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Requests can authenticate with an OpenID Connect ID token (a JWT) in an "Authorization: Bearer"
+// header. The token has to be signed by one of the providers in the "OIDC" config, with a key
+// from that provider's JWKS (fetched from its discovery document unless configured), and its
+// issuer, audience and validity period are checked. The username comes from one of its claims.
+
+// Default value of OIDCConfig.ClockSkew, in seconds.
+const DefaultOIDCClockSkew = 60
+
+// How long a provider's signing keys are used before they're fetched again, and the minimum
+// time between fetches caused by tokens signed with a key that isn't known (yet.)
+const kOIDCKeysMaxAge = time.Hour
+const kOIDCKeysMinRefresh = time.Minute
+
+// Signing keys fetched from the OIDC providers.
+type oidcKeyCache struct {
+	lock     sync.Mutex
+	sets     map[string]*oidcKeySet // Keyed by provider name
+	fetching map[string]bool        // Providers whose keys are being fetched
+}
+
+type oidcKeySet struct {
+	keys      map[string]crypto.PublicKey // Keyed by "kid"
+	fetchedAt time.Time
+}
+
+// The standard claims of an ID token that are checked.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	Expires   int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	IssuedAt  int64       `json:"iat"`
+}
+
+// The "aud" claim can be a string or an array of strings.
+type jwtAudience []string
+
+func (aud *jwtAudience) UnmarshalJSON(data []byte) error {
+	var str string
+	if json.Unmarshal(data, &str) == nil {
+		*aud = jwtAudience{str}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+func (aud jwtAudience) contains(clientID string) bool {
+	for _, item := range aud {
+		if item == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the token from an "Authorization: Bearer" header, or "" if there isn't one.
+func bearerToken(rq *http.Request) string {
+	header := rq.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Authenticates a request's bearer token, returning the user it identifies. If the user doesn't
+// exist yet it's created, if the provider is configured to register users.
+func (sc *ServerContext) authenticateBearerToken(context *db.DatabaseContext, token string) (auth.User, error) {
+	invalid := base.HTTPErrorf(http.StatusUnauthorized, "Invalid bearer token")
+	providerName, provider, claims, err := sc.verifyJWT(token, time.Now())
+	if err != nil {
+		base.Logf("Bearer token auth failed: %v", err)
+		return nil, invalid
+	}
+
+	// Anyone can put any address in the email claim, so it's ignored unless the provider says
+	// it's verified:
+	var email string
+	if verified := claims["email_verified"]; verified == true || verified == "true" {
+		email, _ = claims["email"].(string)
+	}
+
+	usernameClaim := provider.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	claimValue, _ := claims[usernameClaim].(string)
+	if usernameClaim == "email" && email == "" {
+		base.Logf("Bearer token auth failed: email %q isn't verified", claims["email"])
+		return nil, invalid
+	}
+	prefix := providerName + "_"
+	if provider.UsernamePrefix != nil {
+		prefix = *provider.UsernamePrefix
+	}
+	username := prefix + claimValue
+	if claimValue == "" || !auth.IsValidPrincipalName(username) {
+		base.Logf("Bearer token auth failed: invalid %q claim %q", usernameClaim, claims[usernameClaim])
+		return nil, invalid
+	}
+
+	authenticator := context.Authenticator()
+	user, err := authenticator.GetUser(username)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		if !provider.Register {
+			base.Logf("Bearer token auth failed: no user %q", username)
+			return nil, invalid
+		}
+		if user, err = authenticator.RegisterNewUser(username, email); err != nil {
+			return nil, err
+		}
+		base.Logf("Registered new user %q from OIDC provider %q", username, providerName)
+	}
+	if user.Disabled() {
+		base.Logf("Bearer token auth failed: user %q is disabled", username)
+		return nil, invalid
+	}
+	return user, nil
+}
+
+// Checks a JWT's signature and standard claims, returning the provider that issued it and all
+// of its claims.
+func (sc *ServerContext) verifyJWT(token string, now time.Time) (providerName string, provider *OIDCConfig, claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, nil, fmt.Errorf("token isn't a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var standard jwtClaims
+	if err = decodeJWTPart(parts[0], &header); err != nil {
+		return "", nil, nil, err
+	} else if err = decodeJWTPart(parts[1], &standard); err != nil {
+		return "", nil, nil, err
+	} else if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return "", nil, nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid signature encoding")
+	}
+
+	for name, p := range sc.config.OIDC {
+		if p.Issuer == standard.Issuer {
+			providerName, provider = name, p
+			break
+		}
+	}
+	if provider == nil {
+		return "", nil, nil, fmt.Errorf("unknown issuer %q", standard.Issuer)
+	}
+
+	key, err := sc.oidcSigningKey(providerName, provider, header.Kid)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", nil, nil, err
+	}
+
+	skew := int64(DefaultOIDCClockSkew)
+	if provider.ClockSkew != nil {
+		skew = int64(*provider.ClockSkew)
+	}
+	nowSecs := now.Unix()
+	if !standard.Audience.contains(provider.ClientID) {
+		return "", nil, nil, fmt.Errorf("audience %v doesn't include %q", standard.Audience, provider.ClientID)
+	} else if standard.Expires == 0 || nowSecs > standard.Expires+skew {
+		return "", nil, nil, fmt.Errorf("token has expired")
+	} else if nowSecs < standard.NotBefore-skew || nowSecs < standard.IssuedAt-skew {
+		return "", nil, nil, fmt.Errorf("token isn't valid yet")
+	}
+	return providerName, provider, claims, nil
+}
+
+func decodeJWTPart(part string, into interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return fmt.Errorf("invalid JWT encoding")
+	}
+	if err = json.Unmarshal(data, into); err != nil {
+		return fmt.Errorf("invalid JWT JSON: %v", err)
+	}
+	return nil
+}
+
+// Checks a JWT signature. Only RS256 and ES256 are supported (and "none" never is.)
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+				return fmt.Errorf("invalid signature")
+			}
+			return nil
+		}
+	case "ES256":
+		if ecKey, ok := key.(*ecdsa.PublicKey); ok {
+			if len(signature) != 64 {
+				return fmt.Errorf("invalid signature")
+			}
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if !ecdsa.Verify(ecKey, digest[:], r, s) {
+				return fmt.Errorf("invalid signature")
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	return fmt.Errorf("key doesn't match signing algorithm %q", alg)
+}
+
+// Returns a provider's signing key with the given ID (or its only key, if the ID is empty),
+// fetching the provider's keys if they haven't been yet, are too old, or don't include it. The
+// cache isn't locked during the fetch, so a slow provider doesn't hold up other requests; while
+// one request is refreshing a provider's keys, others keep using the ones it already has.
+func (sc *ServerContext) oidcSigningKey(providerName string, provider *OIDCConfig, kid string) (crypto.PublicKey, error) {
+	cache := &sc.oidcKeys
+	cache.lock.Lock()
+	set := cache.sets[providerName]
+	needsFetch := set == nil || time.Since(set.fetchedAt) > kOIDCKeysMaxAge ||
+		(set.lookup(kid) == nil && time.Since(set.fetchedAt) > kOIDCKeysMinRefresh)
+	if needsFetch && (set == nil || !cache.fetching[providerName]) {
+		if cache.fetching == nil {
+			cache.fetching = map[string]bool{}
+		}
+		cache.fetching[providerName] = true
+		cache.lock.Unlock()
+
+		newSet, err := sc.fetchOIDCKeys(provider)
+
+		cache.lock.Lock()
+		delete(cache.fetching, providerName)
+		set = cache.sets[providerName]
+		if err != nil {
+			if set == nil {
+				cache.lock.Unlock()
+				return nil, err
+			}
+			// Keep using the keys we have; try again after kOIDCKeysMinRefresh:
+			base.Warn("Couldn't refresh signing keys of OIDC provider %q: %v", providerName, err)
+			set.fetchedAt = time.Now().Add(kOIDCKeysMinRefresh - kOIDCKeysMaxAge)
+		} else {
+			if cache.sets == nil {
+				cache.sets = map[string]*oidcKeySet{}
+			}
+			cache.sets[providerName] = newSet
+			set = newSet
+		}
+	}
+	key := set.lookup(kid)
+	cache.lock.Unlock()
+
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (set *oidcKeySet) lookup(kid string) crypto.PublicKey {
+	if kid == "" && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			return key
+		}
+	}
+	return set.keys[kid]
+}
+
+// Fetches a provider's signing keys from its JWKS URL, or from the URL given in its discovery
+// document if the config doesn't specify one.
+func (sc *ServerContext) fetchOIDCKeys(provider *OIDCConfig) (*oidcKeySet, error) {
+	jwksURL := provider.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		discoveryURL := strings.TrimRight(provider.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := sc.getJSON(discoveryURL, &discovery); err != nil {
+			return nil, err
+		} else if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("%s has no jwks_uri", discoveryURL)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := sc.getJSON(jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	set := &oidcKeySet{keys: map[string]crypto.PublicKey{}, fetchedAt: time.Now()}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := decodeJWKInt(jwk.N)
+			e, errE := decodeJWKInt(jwk.E)
+			if errN == nil && errE == nil && e.IsInt64() {
+				set.keys[jwk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			}
+		case "EC":
+			x, errX := decodeJWKInt(jwk.X)
+			y, errY := decodeJWKInt(jwk.Y)
+			if jwk.Crv == "P-256" && errX == nil && errY == nil {
+				set.keys[jwk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+			}
+		}
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("%s has no usable signing keys", jwksURL)
+	}
+	return set, nil
+}
+
+func decodeJWKInt(str string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid JWK number")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (sc *ServerContext) getJSON(url string, into interface{}) error {
+	res, err := sc.HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", url, res.StatusCode)
+	}
+	if err = json.NewDecoder(res.Body).Decode(into); err != nil {
+		return fmt.Errorf("invalid JSON from %s: %v", url, err)
+	}
+	return nil
+}
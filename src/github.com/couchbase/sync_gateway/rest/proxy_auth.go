@@ -0,0 +1,100 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// A deployment behind an SSO gateway can let the gateway do the authenticating: the proxy puts the
+// name of the user it's logged in into a request header, and requests that come directly from one
+// of the proxy's addresses are treated as coming from that user, with no password. The header is
+// ignored in requests from any other address, since anyone could send it.
+
+// Default header a trusted proxy puts the authenticated user's name in.
+const kDefaultProxyUserHeader = "X-Authenticated-User"
+
+// Configuration for trusting a reverse proxy's authentication; see ServerConfig.TrustedProxy.
+type TrustedProxyConfig struct {
+	Addresses  []string // IP addresses or CIDR ranges ("10.0.0.0/8") of the trusted proxies
+	UserHeader *string  // Header with the authenticated user's name; default "X-Authenticated-User"
+}
+
+func (config *TrustedProxyConfig) userHeader() string {
+	if config.UserHeader != nil && *config.UserHeader != "" {
+		return *config.UserHeader
+	}
+	return kDefaultProxyUserHeader
+}
+
+// Returns true if the IP address is one of the trusted proxies'.
+func (config *TrustedProxyConfig) trusts(ipString string) bool {
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return false
+	}
+	for _, address := range config.Addresses {
+		if strings.Contains(address, "/") {
+			if _, network, err := net.ParseCIDR(address); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if trusted := net.ParseIP(address); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the addresses in the config that aren't valid IP addresses or CIDR ranges.
+func (config *TrustedProxyConfig) invalidAddresses() (invalid []string) {
+	for _, address := range config.Addresses {
+		if _, _, err := net.ParseCIDR(address); err == nil {
+			continue
+		} else if net.ParseIP(address) == nil {
+			invalid = append(invalid, address)
+		}
+	}
+	return
+}
+
+// If the request came from a trusted proxy and names a user in the proxy's header, returns that
+// user (or a 401 error if there's no such user, or it's disabled). Otherwise returns nil.
+func (h *handler) proxyAuthenticatedUser(context *db.DatabaseContext) (auth.User, error) {
+	config := h.server.config.TrustedProxy
+	if config == nil {
+		return nil, nil
+	}
+	userName := h.rq.Header.Get(config.userHeader())
+	if userName == "" {
+		return nil, nil
+	}
+	if ip := peerIP(h.rq); !config.trusts(ip) {
+		// Any client can send the header, so this isn't worth a warning every time; it's counted:
+		restExpvars.Add("proxy_headers_ignored", 1)
+		base.LogTo("HTTP+", "#%03d: Ignoring %s header in request from untrusted address %s",
+			h.serialNumber, config.userHeader(), ip)
+		return nil, nil
+	}
+	h.authMethod, h.authName = "proxy", userName
+	user, err := context.Authenticator().GetUser(userName)
+	if err != nil {
+		return nil, err
+	} else if user == nil || user.Disabled() {
+		base.Logf("Proxy auth failed for username=%q", userName)
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Unknown or disabled user")
+	}
+	return user, nil
+}
@@ -0,0 +1,180 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// So that one misbehaving client can't starve everyone else of the bucket, requests to the public
+// API can be rate-limited per client IP address and per authenticated user. Each client gets a
+// "token bucket" that refills at the configured rate and holds up to the burst size; a request
+// takes a token, and one that finds the bucket empty fails with a 429 status and a Retry-After
+// header. The admin API isn't limited.
+
+// How often idle rate limiter state is forgotten.
+const kRateLimitPruneInterval = time.Minute
+
+// Configuration for rate-limiting requests; see ServerConfig.RateLimit. A nil rate means no limit.
+type RateLimitConfig struct {
+	UserRequestsPerSec *float64 // Sustained request rate allowed per user (per database)
+	UserBurst          *int     // Requests a user can make at once; default is the rate, rounded up
+	IPRequestsPerSec   *float64 // Sustained request rate allowed per client IP
+	IPBurst            *int     // Requests a client IP can make at once; default is the rate, rounded up
+}
+
+// Returns an error if the limits aren't usable.
+func (config *RateLimitConfig) validate() error {
+	for _, limit := range []struct {
+		name  string
+		rate  *float64
+		burst *int
+	}{
+		{"User", config.UserRequestsPerSec, config.UserBurst},
+		{"IP", config.IPRequestsPerSec, config.IPBurst},
+	} {
+		if limit.rate != nil && !(*limit.rate > 0) {
+			return fmt.Errorf("%sRequestsPerSec must be positive", limit.name)
+		}
+		if limit.burst != nil && *limit.burst < 1 {
+			return fmt.Errorf("%sBurst must be at least 1", limit.name)
+		}
+	}
+	return nil
+}
+
+// Returns a rate and burst size; a zero rate means no limit.
+func rateLimit(rate *float64, burst *int) (float64, float64) {
+	if rate == nil {
+		return 0, 0
+	}
+	if burst != nil {
+		return *rate, float64(*burst)
+	}
+	return *rate, math.Max(1, math.Ceil(*rate))
+}
+
+func (config *RateLimitConfig) userLimit() (float64, float64) {
+	return rateLimit(config.UserRequestsPerSec, config.UserBurst)
+}
+
+func (config *RateLimitConfig) ipLimit() (float64, float64) {
+	return rateLimit(config.IPRequestsPerSec, config.IPBurst)
+}
+
+// A token bucket.
+type requestTokens struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Takes a token if there is one; else returns how long until there will be.
+func (b *requestTokens) take(now time.Time, rate, burst float64) (ok bool, wait time.Duration) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Tracks the token buckets of recent clients.
+type rateLimiter struct {
+	lock      sync.Mutex
+	users     map[string]*requestTokens // Keyed by "db/username"
+	addresses map[string]*requestTokens // Keyed by client IP
+	lastPrune time.Time
+}
+
+// Takes a token from the bucket with the given key, creating a full one if necessary.
+func (l *rateLimiter) take(buckets map[string]*requestTokens, key string, now time.Time, rate, burst float64) (bool, time.Duration) {
+	b := buckets[key]
+	if b == nil {
+		b = &requestTokens{tokens: burst, updated: now}
+		buckets[key] = b
+	}
+	return b.take(now, rate, burst)
+}
+
+// Forgets buckets that have refilled, since a new bucket would be the same. Must be called with
+// the lock held.
+func (l *rateLimiter) prune(now time.Time, config *RateLimitConfig) {
+	userRate, userBurst := config.userLimit()
+	ipRate, ipBurst := config.ipLimit()
+	for _, records := range []struct {
+		buckets     map[string]*requestTokens
+		rate, burst float64
+	}{
+		{l.users, userRate, userBurst},
+		{l.addresses, ipRate, ipBurst},
+	} {
+		for key, b := range records.buckets {
+			if records.rate == 0 || b.tokens+now.Sub(b.updated).Seconds()*records.rate >= records.burst {
+				delete(records.buckets, key)
+			}
+		}
+	}
+	l.lastPrune = now
+}
+
+// Counts a request against the client IP's limit (if user is "") or else the user's. Returns a
+// 429 error if the limit's been reached.
+func (h *handler) checkRateLimit(dbName, username string) error {
+	config := h.server.config.RateLimit
+	if config == nil || h.privs == adminPrivs {
+		return nil
+	}
+	var rate, burst float64
+	if username == "" {
+		rate, burst = config.ipLimit()
+	} else {
+		rate, burst = config.userLimit()
+	}
+	if rate == 0 {
+		return nil
+	}
+
+	l := &h.server.rateLimiter
+	l.lock.Lock()
+	now := time.Now()
+	if l.users == nil {
+		l.users = map[string]*requestTokens{}
+		l.addresses = map[string]*requestTokens{}
+		l.lastPrune = now
+	} else if now.Sub(l.lastPrune) > kRateLimitPruneInterval {
+		l.prune(now, config)
+	}
+	var ok bool
+	var wait time.Duration
+	if username == "" {
+		ok, wait = l.take(l.addresses, h.server.clientIP(h.rq), now, rate, burst)
+	} else {
+		ok, wait = l.take(l.users, dbName+"/"+username, now, rate, burst)
+	}
+	l.lock.Unlock()
+	if ok {
+		return nil
+	}
+
+	restExpvars.Add("requests_throttled", 1)
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	h.setHeader("Retry-After", strconv.Itoa(retryAfter))
+	if username == "" {
+		return base.HTTPErrorf(kStatusTooManyRequests, "Too many requests from this address")
+	}
+	return base.HTTPErrorf(kStatusTooManyRequests, "Too many requests from this user")
+}
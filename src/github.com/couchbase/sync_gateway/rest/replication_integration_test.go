@@ -0,0 +1,144 @@
+// +build integration
+
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// End-to-end replication tests against real CouchDB and PouchDB replicators.
+// These only build with the "integration" tag, and each peer is skipped unless its URL is set:
+//
+//   SG_TEST_COUCHDB_URL=http://localhost:5984 SG_TEST_POUCHDB_URL=http://localhost:5985 \
+//     ./test.sh -tags integration -run Integration
+//
+// PouchDB is driven through pouchdb-server, which exposes the same HTTP API as CouchDB.
+// The gateway under test listens on a loopback port, so the peers must run on this host.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/db"
+)
+
+func TestIntegrationCouchDBReplication(t *testing.T) {
+	testPeerReplication(t, "SG_TEST_COUCHDB_URL")
+}
+
+func TestIntegrationPouchDBReplication(t *testing.T) {
+	testPeerReplication(t, "SG_TEST_POUCHDB_URL")
+}
+
+// Replicates in both directions between the gateway and a peer server, then verifies that both
+// sides agree on every document's current revision, history and attachments.
+func testPeerReplication(t *testing.T, urlEnvVar string) {
+	peerURL := os.Getenv(urlEnvVar)
+	if peerURL == "" {
+		t.Skipf("%s not set; skipping", urlEnvVar)
+	}
+
+	var rt restTester
+	gateway := httptest.NewServer(CreatePublicHandler(rt.ServerContext()))
+	defer gateway.Close()
+	gatewayDB := gateway.URL + "/db"
+	peerDB := fmt.Sprintf("%s/sg_integration_%d", peerURL, time.Now().UnixNano())
+
+	peerRequest(t, "PUT", peerDB, nil)
+	defer peerRequest(t, "DELETE", peerDB, nil)
+
+	// Docs originating on the gateway, one with an attachment and one with a later revision:
+	revid := rt.createDoc(t, "sg_doc1")
+	response := rt.sendRequestWithHeaders("PUT", "/db/sg_doc1/att?rev="+revid, "gateway attachment",
+		map[string]string{"Content-Type": "text/plain"})
+	assertStatus(t, response, 201)
+	revid = rt.createDoc(t, "sg_doc2")
+	assertStatus(t, rt.sendRequest("PUT", "/db/sg_doc2", `{"_rev":"`+revid+`","n":2}`), 201)
+
+	// Docs originating on the peer, including a deletion and an inline attachment:
+	peerRequest(t, "PUT", peerDB+"/peer_doc1", db.Body{"n": 1,
+		"_attachments": db.Body{"att": db.Body{"content_type": "text/plain", "data": "cGVlciBhdHRhY2htZW50"}}})
+	created := peerRequest(t, "PUT", peerDB+"/peer_doc2", db.Body{"n": 1})
+	peerRequest(t, "DELETE", fmt.Sprintf("%s/peer_doc2?rev=%s", peerDB, created["rev"]), nil)
+
+	// The peer's replicator does the work in both directions:
+	replicate(t, peerURL, gatewayDB, peerDB)
+	replicate(t, peerURL, peerDB, gatewayDB)
+
+	for _, docid := range []string{"sg_doc1", "sg_doc2", "peer_doc1", "peer_doc2"} {
+		query := "?revs=true&attachments=true"
+		if docid == "peer_doc2" {
+			query += "&open_revs=all"
+		}
+		assert.DeepEquals(t,
+			normalizeReplicatedDoc(peerRequest(t, "GET", gatewayDB+"/"+docid+query, nil)),
+			normalizeReplicatedDoc(peerRequest(t, "GET", peerDB+"/"+docid+query, nil)))
+	}
+}
+
+// Asks the peer at serverURL to replicate source to target, and waits for it to finish.
+func replicate(t *testing.T, serverURL, source, target string) {
+	result := peerRequest(t, "POST", serverURL+"/_replicate", db.Body{"source": source, "target": target})
+	if result["ok"] != true {
+		t.Fatalf("Replication %s -> %s failed: %v", source, target, result)
+	}
+}
+
+// Sends a JSON request to a peer server and returns the parsed response, failing on HTTP errors.
+func peerRequest(t *testing.T, method, url string, body db.Body) db.Body {
+	var input []byte
+	if body != nil {
+		input, _ = json.Marshal(body)
+	}
+	rq, _ := http.NewRequest(method, url, bytes.NewReader(input))
+	rq.Header.Set("Content-Type", "application/json")
+	rq.Header.Set("Accept", "application/json")
+	response, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode >= 300 {
+		t.Fatalf("%s %s returned %d: %s", method, url, response.StatusCode, data)
+	}
+	var result db.Body
+	if len(data) > 0 && data[0] == '[' {
+		// open_revs responses are arrays; wrap them so callers always get a Body
+		var revs []interface{}
+		json.Unmarshal(data, &revs)
+		result = db.Body{"open_revs": revs}
+	} else {
+		json.Unmarshal(data, &result)
+	}
+	return result
+}
+
+// Strips the properties that legitimately differ between servers, so replicated docs compare equal.
+func normalizeReplicatedDoc(body db.Body) db.Body {
+	if atts, ok := body["_attachments"].(map[string]interface{}); ok {
+		for _, att := range atts {
+			meta := att.(map[string]interface{})
+			// Servers disagree on whether these are reported, but not on the content itself:
+			delete(meta, "encoding")
+			delete(meta, "encoded_length")
+			delete(meta, "revpos")
+			delete(meta, "length")
+		}
+	}
+	return body
+}
@@ -0,0 +1,128 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Bodies of the common REST responses. These are structs, not db.Body maps, so that every
+// response of a kind has the same properties in the same order. The policy is:
+// * A property that always applies to a kind of response is always present. Lists and sets
+//   are written as empty arrays, never null, when there's nothing in them.
+// * A property that only applies sometimes (like "error" in a bulk_docs result, or "email" for
+//   a user who has none) is omitted when it doesn't apply, rather than being null.
+// The one deliberate null is userCtx.name for the guest user, which is how CouchDB reports it.
+
+// Response to a successful PUT, POST or DELETE of a document.
+type docWriteResponse struct {
+	OK  bool   `json:"ok"`
+	ID  string `json:"id"`
+	Rev string `json:"rev"`
+}
+
+func newDocWriteResponse(docid, revid string) docWriteResponse {
+	return docWriteResponse{OK: true, ID: docid, Rev: revid}
+}
+
+// One item of a _bulk_docs response. It has either a Rev or an Error, Reason and Status.
+type bulkDocsResult struct {
+	ID     string `json:"id,omitempty"` // Missing only if a new doc failed before getting an ID
+	Rev    string `json:"rev,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// Body of an error response.
+type errorResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// Response to GET /db/.
+type databaseInfo struct {
+	DBName             string      `json:"db_name"`
+	DBUUID             string      `json:"db_uuid"`
+	Epoch              uint64      `json:"epoch"`
+	UpdateSeq          uint64      `json:"update_seq"`
+	CommittedUpdateSeq uint64      `json:"committed_update_seq"`
+	InstanceStartTime  json.Number `json:"instance_start_time"`
+	CompactRunning     bool        `json:"compact_running"`
+	PurgeSeq           uint64      `json:"purge_seq"`
+	DiskFormatVersion  int         `json:"disk_format_version"`
+}
+
+// Response to GET /db/_session, and to logins.
+type sessionResponse struct {
+	OK                     bool        `json:"ok"`
+	UserCtx                userContext `json:"userCtx"`
+	AuthenticationHandlers []string    `json:"authentication_handlers"`
+	SessionID              string      `json:"session_id,omitempty"` // Only after a login
+	Expires                *time.Time  `json:"expires,omitempty"`    // Only after a login
+}
+
+type userContext struct {
+	Name     *string           `json:"name"` // nil for the guest user
+	Channels channels.TimedSet `json:"channels"`
+	Roles    []string          `json:"roles"`
+}
+
+// Response to GET /db/_role/{name}.
+type roleInfo struct {
+	Name          string   `json:"name"`
+	AdminChannels []string `json:"admin_channels"`
+	AllChannels   []string `json:"all_channels"`
+}
+
+// Response to GET /db/_user/{name}.
+type userInfo struct {
+	roleInfo
+	Email      string   `json:"email,omitempty"`
+	Disabled   bool     `json:"disabled,omitempty"`
+	AdminRoles []string `json:"admin_roles"`
+	Roles      []string `json:"roles"`
+}
+
+// Returns the response body describing a user or role.
+func principalResponse(princ auth.Principal) interface{} {
+	info := roleInfo{
+		Name:          externalUserName(princ.Name()),
+		AdminChannels: sortedNames(princ.ExplicitChannels()),
+	}
+	user, ok := princ.(auth.User)
+	if !ok {
+		info.AllChannels = sortedNames(princ.Channels())
+		return info
+	}
+	info.AllChannels = sortedNames(user.InheritedChannels())
+	return userInfo{
+		roleInfo:   info,
+		Email:      user.Email(),
+		Disabled:   user.Disabled(),
+		AdminRoles: sortedNames(user.ExplicitRoles()),
+		Roles:      sortedNames(user.RoleNames()),
+	}
+}
+
+// Returns the names in a TimedSet as a sorted array, which is empty (not nil) if there are none.
+func sortedNames(set channels.TimedSet) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,93 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Returns the keys of a JSON object, in the order they appear, failing if any value is null.
+// (Only suitable for objects whose keys don't also appear in nested objects.)
+func jsonKeys(t *testing.T, data []byte) []string {
+	var object map[string]json.RawMessage
+	assert.Equals(t, json.Unmarshal(data, &object), nil)
+	keys := make([]string, 0, len(object))
+	for key, value := range object {
+		if string(value) == "null" {
+			t.Errorf("Property %q of %s is null", key, data)
+		}
+		keys = append(keys, key)
+	}
+	position := func(key string) int {
+		return bytes.Index(data, []byte(`"`+key+`":`))
+	}
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && position(keys[j]) < position(keys[j-1]); j-- {
+			keys[j], keys[j-1] = keys[j-1], keys[j]
+		}
+	}
+	return keys
+}
+
+// Checks the exact set and order of properties in each kind of response, since strict client
+// parsers depend on them.
+func TestResponseContracts(t *testing.T) {
+	var rt restTester
+
+	response := rt.sendRequest("PUT", "/db/doc1", `{}`)
+	assertStatus(t, response, 201)
+	assert.DeepEquals(t, jsonKeys(t, response.Body.Bytes()), []string{"ok", "id", "rev"})
+
+	response = rt.sendRequest("GET", "/db/nosuchdoc", "")
+	assertStatus(t, response, 404)
+	assert.DeepEquals(t, jsonKeys(t, response.Body.Bytes()), []string{"error", "reason"})
+
+	response = rt.sendRequest("POST", "/db/_bulk_docs", `{"docs": [{"_id": "bulk1"}, {"_id": "doc1"}]}`)
+	assertStatus(t, response, 201)
+	var results []json.RawMessage
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &results), nil)
+	assert.Equals(t, len(results), 2)
+	assert.DeepEquals(t, jsonKeys(t, results[0]), []string{"id", "rev"})
+	assert.DeepEquals(t, jsonKeys(t, results[1]), []string{"id", "error", "reason", "status"})
+
+	response = rt.sendRequest("GET", "/db/", "")
+	assertStatus(t, response, 200)
+	assert.DeepEquals(t, jsonKeys(t, response.Body.Bytes()), []string{"db_name", "db_uuid", "epoch",
+		"update_seq", "committed_update_seq", "instance_start_time", "compact_running",
+		"purge_seq", "disk_format_version"})
+
+	// The guest's session; its userCtx.name is null, as in CouchDB, but nothing else is:
+	response = rt.sendRequest("GET", "/db/_session", "")
+	assertStatus(t, response, 200)
+	var session struct {
+		UserCtx map[string]json.RawMessage
+	}
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &session), nil)
+	assert.DeepEquals(t, jsonKeys(t, response.Body.Bytes()), []string{"ok", "userCtx", "authentication_handlers"})
+	assert.Equals(t, string(session.UserCtx["name"]), "null")
+	assert.Equals(t, string(session.UserCtx["roles"]), "[]")
+
+	// A user and a role with no channels or roles have empty arrays, not nulls or missing keys:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/bare", `{"password":"letmein"}`), 201)
+	response = rt.sendAdminRequest("GET", "/db/_user/bare", "")
+	assertStatus(t, response, 200)
+	assert.DeepEquals(t, jsonKeys(t, response.Body.Bytes()),
+		[]string{"name", "admin_channels", "all_channels", "admin_roles", "roles"})
+	assert.Equals(t, response.Header().Get("Content-Type"), "application/json")
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/bare", `{}`), 201)
+	response = rt.sendAdminRequest("GET", "/db/_role/bare", "")
+	assertStatus(t, response, 200)
+	assert.DeepEquals(t, jsonKeys(t, response.Body.Bytes()), []string{"name", "admin_channels", "all_channels"})
+}
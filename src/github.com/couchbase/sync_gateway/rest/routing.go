@@ -39,6 +39,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	r.StrictSlash(true)
 	// Global operations:
 	r.Handle("/", makeHandler(sc, privs, (*handler).handleRoot)).Methods("GET", "HEAD")
+	r.Handle("/_uuids", makeHandler(sc, privs, (*handler).handleUUIDs)).Methods("GET", "HEAD")
 
 	// Operations on databases:
 	r.Handle("/{db:"+dbRegex+"}/", makeHandler(sc, privs, (*handler).handleGetDB)).Methods("GET", "HEAD")
@@ -69,6 +70,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handleGetAttachment)).Methods("GET", "HEAD")
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handlePutAttachment)).Methods("PUT")
+	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handleDeleteAttachment)).Methods("DELETE")
 
 	// Session/login URLs are per-database (unlike in CouchDB)
 	// These have public privileges so that they can be called without being logged in already
@@ -81,6 +83,10 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 		dbr.Handle("/_facebook", makeHandler(sc, publicPrivs,
 			(*handler).handleFacebookPOST)).Methods("POST")
 	}
+	if len(sc.config.OAuth2) > 0 {
+		dbr.Handle("/_oauth2/{provider}", makeHandler(sc, publicPrivs,
+			(*handler).handleOAuth2POST)).Methods("POST")
+	}
 
 	return r, dbr
 }
@@ -94,9 +100,11 @@ func CreatePublicHandler(sc *ServerContext) http.Handler {
 		(*handler).handleSessionDELETE)).Methods("DELETE")
 	// The routine below is part of the CouchDB REST API, users can't create DB's via the pblic API
 	// but if the client set the 'createTarget' property of the Replicatior SG should return HTTP status 412
-	// if the db exists, and 403 if it doesn't.
+	// if the db exists, and 403 if it doesn't. Deleting a DB via the public API is always a 403.
 	r.Handle("/{targetdb:"+dbRegex+"}/",
 		makeHandler(sc, publicPrivs, (*handler).handleCreateTarget)).Methods("PUT")
+	r.Handle("/{targetdb:"+dbRegex+"}/",
+		makeHandler(sc, publicPrivs, (*handler).handleDeleteTarget)).Methods("DELETE")
 	return wrapRouter(sc, regularPrivs, r)
 }
 
@@ -106,13 +114,17 @@ func CreatePublicHandler(sc *ServerContext) http.Handler {
 func CreateAdminHandler(sc *ServerContext) http.Handler {
 	r, dbr := createHandler(sc, adminPrivs)
 
-	r.PathPrefix("/_admin/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if sc.config.AdminUI != nil {
-			http.ServeFile(w, r, *sc.config.AdminUI)
-		} else {
-			w.Write(sync_gateway_admin_ui.Admin_bundle_html())
-		}
-	})
+	hardened := sc.config.isHardened()
+
+	if !hardened {
+		r.PathPrefix("/_admin/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sc.config.AdminUI != nil {
+				http.ServeFile(w, r, *sc.config.AdminUI)
+			} else {
+				w.Write(sync_gateway_admin_ui.Admin_bundle_html())
+			}
+		})
+	}
 
 	dbr.Handle("/_session",
 		makeHandler(sc, adminPrivs, (*handler).createUserSession)).Methods("POST")
@@ -123,13 +135,12 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 	dbr.Handle("/_session/{sessionid}",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
 
-	dbr.Handle("/_raw/{docid:"+docRegex+"}",
-		makeHandler(sc, adminPrivs, (*handler).handleGetRawDoc)).Methods("GET", "HEAD")
-
 	dbr.Handle("/_user/",
 		makeHandler(sc, adminPrivs, (*handler).getUsers)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/",
 		makeHandler(sc, adminPrivs, (*handler).putUser)).Methods("POST")
+	dbr.Handle("/_user/_bulk_patch",
+		makeHandler(sc, adminPrivs, (*handler).bulkPatchUsers)).Methods("POST")
 	dbr.Handle("/_user/{name}",
 		makeHandler(sc, adminPrivs, (*handler).getUserInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/{name}",
@@ -139,6 +150,12 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 
 	dbr.Handle("/_user/{name}/_session",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSessions)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_api_key",
+		makeHandler(sc, adminPrivs, (*handler).getUserAPIKeys)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_api_key",
+		makeHandler(sc, adminPrivs, (*handler).createUserAPIKey)).Methods("POST")
+	dbr.Handle("/_user/{name}/_api_key/{id}",
+		makeHandler(sc, adminPrivs, (*handler).revokeUserAPIKey)).Methods("DELETE")
 	dbr.Handle("/_user/{name}/_session/{sessionid}",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
 
@@ -146,6 +163,8 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 		makeHandler(sc, adminPrivs, (*handler).getRoles)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/",
 		makeHandler(sc, adminPrivs, (*handler).putRole)).Methods("POST")
+	dbr.Handle("/_role/_bulk_patch",
+		makeHandler(sc, adminPrivs, (*handler).bulkPatchRoles)).Methods("POST")
 	dbr.Handle("/_role/{name}",
 		makeHandler(sc, adminPrivs, (*handler).getRoleInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/{name}",
@@ -153,52 +172,97 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 	dbr.Handle("/_role/{name}",
 		makeHandler(sc, adminPrivs, (*handler).deleteRole)).Methods("DELETE")
 
-	r.Handle("/_logging",
-		makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET")
-	r.Handle("/_logging",
-		makeHandler(sc, adminPrivs, (*handler).handleSetLogging)).Methods("PUT", "POST")
-	r.Handle("/_profile/{name}",
-		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
-	r.Handle("/_profile",
-		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
-	r.Handle("/_heap",
-		makeHandler(sc, adminPrivs, (*handler).handleHeapProfiling)).Methods("POST")
-	r.Handle("/_stats",
-		makeHandler(sc, adminPrivs, (*handler).handleStats)).Methods("GET")
-	r.Handle(kDebugURLPathPrefix,
-		makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
-
-	// Debugging handlers
-	r.Handle("/_debug/pprof/goroutine",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofGoroutine)).Methods("GET", "POST")
-	r.Handle("/_debug/pprof/cmdline",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofCmdline)).Methods("GET", "POST")
-	r.Handle("/_debug/pprof/symbol",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofSymbol)).Methods("GET", "POST")
-	r.Handle("/_debug/pprof/heap",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofHeap)).Methods("GET", "POST")
-	r.Handle("/_debug/pprof/profile",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofProfile)).Methods("GET", "POST")
-	r.Handle("/_debug/pprof/block",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofBlock)).Methods("GET", "POST")
-	r.Handle("/_debug/pprof/threadcreate",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofThreadcreate)).Methods("GET", "POST")
+	// Introspection, profiling & debugging handlers aren't available in the hardened profile:
+	if !hardened {
+		r.Handle("/_config",
+			makeHandler(sc, adminPrivs, (*handler).handleGetServerConfig)).Methods("GET")
+		r.Handle("/_logging",
+			makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET")
+		r.Handle("/_logging",
+			makeHandler(sc, adminPrivs, (*handler).handleSetLogging)).Methods("PUT", "POST")
+		r.Handle("/_profile/{name}",
+			makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
+		r.Handle("/_profile",
+			makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
+		r.Handle("/_heap",
+			makeHandler(sc, adminPrivs, (*handler).handleHeapProfiling)).Methods("POST")
+		r.Handle("/_stats",
+			makeHandler(sc, adminPrivs, (*handler).handleStats)).Methods("GET")
+		r.Handle(kDebugURLPathPrefix,
+			makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
+
+		// Debugging handlers
+		r.Handle("/_debug/pprof/goroutine",
+			makeHandler(sc, adminPrivs, (*handler).handlePprofGoroutine)).Methods("GET", "POST")
+		r.Handle("/_debug/pprof/cmdline",
+			makeHandler(sc, adminPrivs, (*handler).handlePprofCmdline)).Methods("GET", "POST")
+		r.Handle("/_debug/pprof/symbol",
+			makeHandler(sc, adminPrivs, (*handler).handlePprofSymbol)).Methods("GET", "POST")
+		r.Handle("/_debug/pprof/heap",
+			makeHandler(sc, adminPrivs, (*handler).handlePprofHeap)).Methods("GET", "POST")
+		r.Handle("/_debug/pprof/profile",
+			makeHandler(sc, adminPrivs, (*handler).handlePprofProfile)).Methods("GET", "POST")
+		r.Handle("/_debug/pprof/block",
+			makeHandler(sc, adminPrivs, (*handler).handlePprofBlock)).Methods("GET", "POST")
+		r.Handle("/_debug/pprof/threadcreate",
+			makeHandler(sc, adminPrivs, (*handler).handlePprofThreadcreate)).Methods("GET", "POST")
+	}
 
 	// Database-relative handlers:
-	dbr.Handle("/_config",
-		makeHandler(sc, adminPrivs, (*handler).handleGetDbConfig)).Methods("GET")
+	dbr.Handle("/_status",
+		makeHandler(sc, adminPrivs, (*handler).handleGetDbStatus)).Methods("GET")
+	dbr.Handle("/_rename",
+		makeHandler(sc, adminPrivs, (*handler).handleRenameDB)).Methods("POST")
 	dbr.Handle("/_resync",
 		makeHandler(sc, adminPrivs, (*handler).handleResync)).Methods("POST")
+	dbr.Handle("/_sync_function/history",
+		makeHandler(sc, adminPrivs, (*handler).handleGetSyncFunHistory)).Methods("GET")
+	dbr.Handle("/_sync_function/rollback",
+		makeHandler(sc, adminPrivs, (*handler).handleRollBackSyncFun)).Methods("POST")
 	dbr.Handle("/_vacuum",
 		makeHandler(sc, adminPrivs, (*handler).handleVacuum)).Methods("POST")
+	dbr.Handle("/_rebuild_indexes",
+		makeHandler(sc, adminPrivs, (*handler).handleGetIndexRebuild)).Methods("GET")
+	dbr.Handle("/_rebuild_indexes",
+		makeHandler(sc, adminPrivs, (*handler).handleStartIndexRebuild)).Methods("POST")
+	dbr.Handle("/_rebuild_indexes",
+		makeHandler(sc, adminPrivs, (*handler).handleStopIndexRebuild)).Methods("DELETE")
 	dbr.Handle("/_flush",
 		makeHandler(sc, adminPrivs, (*handler).handleFlush)).Methods("POST")
-	dbr.Handle("/_dump/{view}",
-		makeHandler(sc, adminPrivs, (*handler).handleDump)).Methods("GET")
-	dbr.Handle("/_view/{view}", // redundant; just for backward compatibility with 1.0
-		makeHandler(sc, adminPrivs, (*handler).handleView)).Methods("GET")
-	dbr.Handle("/_dumpchannel/{channel}",
-		makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
+	dbr.Handle("/_freeze",
+		makeHandler(sc, adminPrivs, (*handler).handleGetWriteFreeze)).Methods("GET")
+	dbr.Handle("/_freeze",
+		makeHandler(sc, adminPrivs, (*handler).handleFreezeWrites)).Methods("PUT", "POST")
+	dbr.Handle("/_freeze",
+		makeHandler(sc, adminPrivs, (*handler).handleUnfreezeWrites)).Methods("DELETE")
+	if !hardened {
+		dbr.Handle("/_config",
+			makeHandler(sc, adminPrivs, (*handler).handleGetDbConfig)).Methods("GET")
+		dbr.Handle("/_stats_history",
+			makeHandler(sc, adminPrivs, (*handler).handleGetStatsHistory)).Methods("GET")
+		dbr.Handle("/_logging",
+			makeHandler(sc, adminPrivs, (*handler).handleGetDbLogging)).Methods("GET")
+		dbr.Handle("/_logging",
+			makeHandler(sc, adminPrivs, (*handler).handleSetDbLogging)).Methods("PUT", "POST")
+		dbr.Handle("/_local_docs",
+			makeHandler(sc, adminPrivs, (*handler).handleAllLocalDocs)).Methods("GET")
+		dbr.Handle("/_raw/{docid:"+docRegex+"}",
+			makeHandler(sc, adminPrivs, (*handler).handleGetRawDoc)).Methods("GET", "HEAD")
+		dbr.Handle("/_user/{name}/_access/{docid:"+docRegex+"}",
+			makeHandler(sc, adminPrivs, (*handler).getUserDocAccess)).Methods("GET", "HEAD")
+		dbr.Handle("/_user/{name}/_channel_history",
+			makeHandler(sc, adminPrivs, (*handler).getUserChannelHistory)).Methods("GET", "HEAD")
+		dbr.Handle("/_role/{name}/_channel_history",
+			makeHandler(sc, adminPrivs, (*handler).getRoleChannelHistory)).Methods("GET", "HEAD")
+		dbr.Handle("/_dump/{view}",
+			makeHandler(sc, adminPrivs, (*handler).handleDump)).Methods("GET")
+		dbr.Handle("/_view/{view}", // redundant; just for backward compatibility with 1.0
+			makeHandler(sc, adminPrivs, (*handler).handleView)).Methods("GET")
+		dbr.Handle("/_dumpchannel/{channel}",
+			makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
+		dbr.Handle("/_sync_debug/{docid:"+docRegex+"}",
+			makeHandler(sc, adminPrivs, (*handler).handleSyncFnDryRun)).Methods("GET", "POST")
+	}
 
 	// The routes below are part of the CouchDB REST API but should only be available to admins,
 	// so the handlers are moved to the admin port.
@@ -219,10 +283,26 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 // match anything -- it handles the OPTIONS method as well as returning either a 404 or 405
 // for URLs that don't match a route.
 func wrapRouter(sc *ServerContext, privs handlerPrivs, router *mux.Router) http.Handler {
+	filterConfig := sc.config.IPFilter
+	if privs == adminPrivs {
+		filterConfig = sc.config.AdminIPFilter
+	}
+	filter := newIPFilter(filterConfig)
+
 	return http.HandlerFunc(func(response http.ResponseWriter, rq *http.Request) {
 		fixQuotedSlashes(rq)
 		var match mux.RouteMatch
 
+		// Refuse clients the interface's IP filter doesn't allow:
+		if !filter.allows(sc.clientIP(rq)) {
+			h := newHandler(sc, privs, response, rq)
+			h.logRequestLine()
+			h.writeStatus(http.StatusForbidden, "Access denied from this address")
+			h.logDuration(true)
+			h.auditRequest()
+			return
+		}
+
 		// Inject CORS if enabled and requested and not admin port
 		originHeader := rq.Header["Origin"]
 		if privs != adminPrivs && sc.config.CORS != nil && len(originHeader) > 0 {
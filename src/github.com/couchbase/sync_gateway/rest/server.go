@@ -0,0 +1,177 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A gateway server: a ServerContext together with the HTTP listeners for its public, admin and
+// (optional) profile interfaces. RunServer uses one for the life of the process, but a Server
+// keeps all its state to itself, so a test can start several in one process -- each with its own
+// config, ports and buckets -- to exercise cluster behavior, and shut them down afterwards.
+// (Logging, expvars and the go-couchbase connection pool settings are still process-wide.)
+type Server struct {
+	config    *ServerConfig
+	context   *ServerContext
+	lock      sync.Mutex
+	listeners map[string]net.Listener // Keyed by "public", "admin", "profile"
+	closed    bool
+	errors    chan error
+}
+
+// Creates a server from a config, opening its databases, but doesn't start listening yet.
+func NewServer(config *ServerConfig) (*Server, error) {
+	if config.isHardened() {
+		config.applyHardening()
+	}
+	if config.Interface == nil {
+		config.Interface = &DefaultInterface
+	}
+	if config.AdminInterface == nil {
+		config.AdminInterface = &DefaultAdminInterface
+	}
+	if err := config.checkInterfaces(); err != nil {
+		return nil, err
+	}
+	sc := NewServerContext(config)
+	for _, dbConfig := range config.Databases {
+		if _, err := sc.AddDatabaseFromConfig(dbConfig); err != nil {
+			sc.Close()
+			return nil, fmt.Errorf("Error opening database %q: %v", dbConfig.Name, err)
+		}
+	}
+	return &Server{
+		config:    config,
+		context:   sc,
+		listeners: map[string]net.Listener{},
+		errors:    make(chan error, 3),
+	}, nil
+}
+
+func (s *Server) ServerContext() *ServerContext {
+	return s.context
+}
+
+// Opens the server's listeners and starts serving requests on them in the background. An
+// interface address with port 0 listens on a free port; use PublicAddr and AdminAddr to find out
+// which.
+func (s *Server) Start() error {
+	maxConns := DefaultMaxIncomingConnections
+	if s.config.MaxIncomingConnections != nil {
+		maxConns = *s.config.MaxIncomingConnections
+	}
+	var clientCAFile string
+	var requireClientCert bool
+	if cc := s.config.ClientCert; cc != nil {
+		clientCAFile, requireClientCert = cc.CAFile, cc.Required
+	}
+	interfaces := []struct {
+		name              string
+		addr              string
+		handler           http.Handler
+		clientCAFile      string
+		requireClientCert bool
+	}{
+		{"admin", *s.config.AdminInterface, CreateAdminHandler(s.context), "", false},
+		{"public", *s.config.Interface, CreatePublicHandler(s.context), clientCAFile, requireClientCert},
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf("Server is closed")
+	}
+	for _, iface := range interfaces {
+		listener, err := base.ListenHTTPWithClientCerts(iface.addr, maxConns, s.config.SSLCert,
+			s.config.SSLKey, iface.clientCAFile, iface.requireClientCert)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Failed to start HTTP server on %s: %v", iface.addr, err)
+		}
+		s.listeners[iface.name] = listener
+		base.Logf("Starting %s server on %s", iface.name, listener.Addr())
+		go s.serve(listener, iface.handler)
+	}
+	if s.config.ProfileInterface != nil {
+		//runtime.MemProfileRate = 10 * 1024
+		listener, err := net.Listen("tcp", *s.config.ProfileInterface)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Failed to start profile server on %s: %v", *s.config.ProfileInterface, err)
+		}
+		s.listeners["profile"] = listener
+		base.Logf("Starting profile server on %s", listener.Addr())
+		// The profiling handlers register themselves with the default mux (see Go docs):
+		go http.Serve(listener, http.DefaultServeMux)
+	}
+	return nil
+}
+
+func (s *Server) serve(listener net.Listener, handler http.Handler) {
+	err := base.ServeHTTP(listener, handler, s.config.ServerReadTimeout, s.config.ServerWriteTimeout)
+	s.lock.Lock()
+	closed := s.closed
+	s.lock.Unlock()
+	if !closed {
+		s.errors <- fmt.Errorf("HTTP server on %s failed: %v", listener.Addr(), err)
+	}
+}
+
+// Blocks until one of the server's listeners fails, and returns the error.
+func (s *Server) Wait() error {
+	return <-s.errors
+}
+
+// The address the public API is being served on, or "" if the server hasn't started.
+func (s *Server) PublicAddr() string {
+	return s.listenerAddr("public")
+}
+
+// The address the admin API is being served on, or "" if the server hasn't started.
+func (s *Server) AdminAddr() string {
+	return s.listenerAddr("admin")
+}
+
+func (s *Server) listenerAddr(name string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if listener := s.listeners[name]; listener != nil {
+		return listener.Addr().String()
+	}
+	return ""
+}
+
+// Stops listening and closes the server's databases. Requests already in progress aren't
+// interrupted, but will fail if they go on to use a database.
+func (s *Server) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.closeListeners()
+	s.lock.Unlock()
+	s.context.Close()
+}
+
+// Must be called with the lock held.
+func (s *Server) closeListeners() {
+	for name, listener := range s.listeners {
+		listener.Close()
+		delete(s.listeners, name)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/couchbaselabs/go-couchbase"
 
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 )
 
@@ -38,18 +39,77 @@ const kDefaultSlowServerCallWarningThreshold = 200 // ms
 // This struct is accessed from HTTP handlers running on multiple goroutines, so it needs to
 // be thread-safe.
 type ServerContext struct {
-	config      *ServerConfig
-	databases_  map[string]*db.DatabaseContext
-	lock        sync.RWMutex
-	statsTicker *time.Ticker
-	HTTPClient  *http.Client
+	config        *ServerConfig
+	databases_    map[string]*db.DatabaseContext
+	lock          sync.RWMutex
+	statsTicker   *time.Ticker
+	HTTPClient    *http.Client
+	uuidGenerator base.UUIDGenerator     // Source of IDs returned by /_uuids
+	oidcKeys      oidcKeyCache           // Signing keys of the OIDC providers
+	loginThrottle loginThrottle          // Recent failed logins, for config.LoginThrottle
+	rateLimiter   rateLimiter            // Recent request rates, for config.RateLimit
+	dbTombstones  map[string]dbTombstone // Recently deleted or renamed databases
+	flushedEpochs map[string]uint64      // Epochs to resume from, for databases being re-added after a flush
+	middleware    []Middleware           // Registered with AddMiddleware
 }
 
+// How long the name of a deleted database stays reserved. Meanwhile requests to it fail with a
+// 410 status that says what happened to it, rather than a 404.
+var DatabaseTombstoneTTL = 5 * time.Minute
+
+// Records that a database name was recently deleted, or renamed.
+type dbTombstone struct {
+	removedAt time.Time
+	renamedTo string // New name, if it was renamed
+}
+
+// Returns a 410 error if a database of this name was recently deleted or renamed.
+// Must be called with the lock held.
+func (sc *ServerContext) checkDbTombstone(name string) error {
+	tombstone, found := sc.dbTombstones[name]
+	if !found {
+		return nil
+	} else if time.Since(tombstone.removedAt) > DatabaseTombstoneTTL {
+		return nil
+	} else if tombstone.renamedTo != "" {
+		return base.HTTPErrorf(http.StatusGone, "Database %q has been renamed to %q", name, tombstone.renamedTo)
+	}
+	return base.HTTPErrorf(http.StatusGone, "Database %q has been deleted", name)
+}
+
+// Records a tombstone for a database name, and forgets expired ones.
+// Must be called with the lock held.
+func (sc *ServerContext) addDbTombstone(name string, renamedTo string) {
+	if sc.dbTombstones == nil {
+		sc.dbTombstones = map[string]dbTombstone{}
+	}
+	for oldName, tombstone := range sc.dbTombstones {
+		if time.Since(tombstone.removedAt) > DatabaseTombstoneTTL {
+			delete(sc.dbTombstones, oldName)
+		}
+	}
+	sc.dbTombstones[name] = dbTombstone{removedAt: time.Now(), renamedTo: renamedTo}
+}
+
+// Records the epoch a database's identity should resume from when it's next added, after its
+// bucket has been flushed.
+func (sc *ServerContext) setFlushedEpoch(name string, epoch uint64) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.flushedEpochs == nil {
+		sc.flushedEpochs = map[string]uint64{}
+	}
+	sc.flushedEpochs[name] = epoch
+}
+
+// Timeout of requests the server makes to other services (OIDC providers, the config server...)
+const kHTTPClientTimeout = 30 * time.Second
+
 func NewServerContext(config *ServerConfig) *ServerContext {
 	sc := &ServerContext{
 		config:     config,
 		databases_: map[string]*db.DatabaseContext{},
-		HTTPClient: http.DefaultClient,
+		HTTPClient: &http.Client{Timeout: kHTTPClientTimeout},
 	}
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
@@ -71,8 +131,31 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 	}
 	couchbase.SlowServerCallWarningThreshold = time.Duration(slow) * time.Millisecond
 
+	base.RequestJSONLimits = base.JSONLimits{MaxDepth: base.DefaultMaxJSONDepth}
+	if config.MaxJSONDepth != nil {
+		base.RequestJSONLimits.MaxDepth = *config.MaxJSONDepth
+	}
+	if config.MaxJSONElements != nil {
+		base.RequestJSONLimits.MaxElements = *config.MaxJSONElements
+	}
+
+	db.CompactRevTrees = config.CompactRevTrees != nil && *config.CompactRevTrees
+
+	sc.uuidGenerator = base.CreateUUID
+	if config.UUIDAlgorithm != nil {
+		if generator, err := base.NewUUIDGenerator(*config.UUIDAlgorithm); err != nil {
+			base.Warn("%v; /_uuids will use %q", err, base.UUIDRandom)
+		} else {
+			sc.uuidGenerator = generator
+		}
+	}
+
 	if config.DeploymentID != nil {
-		sc.startStatsReporter()
+		if config.isHardened() {
+			base.Warn("Hardened profile: not reporting stats for deploymentId")
+		} else {
+			sc.startStatsReporter()
+		}
 	}
 	return sc
 }
@@ -92,9 +175,15 @@ func (sc *ServerContext) Close() {
 func (sc *ServerContext) GetDatabase(name string) (*db.DatabaseContext, error) {
 	sc.lock.RLock()
 	dbc := sc.databases_[name]
+	var tombstoneErr error
+	if dbc == nil {
+		tombstoneErr = sc.checkDbTombstone(name)
+	}
 	sc.lock.RUnlock()
 	if dbc != nil {
 		return dbc, nil
+	} else if tombstoneErr != nil {
+		return nil, tombstoneErr
 	} else if db.ValidateDatabaseName(name) != nil {
 		return nil, base.HTTPErrorf(http.StatusBadRequest, "invalid database name %q", name)
 	} else if sc.config.ConfigServer == nil {
@@ -165,6 +254,9 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 			return nil, base.HTTPErrorf(http.StatusPreconditionFailed, // what CouchDB returns
 				"Duplicate database name %q", dbName)
 		}
+	} else if err := sc.checkDbTombstone(dbName); err != nil {
+		return nil, base.HTTPErrorf(http.StatusPreconditionFailed,
+			"Database name %q was in use recently; it can be reused after %v", dbName, DatabaseTombstoneTTL)
 	}
 
 	base.Logf("Opening db /%s as bucket %q, pool %q, server <%s>",
@@ -186,6 +278,17 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 		return nil, fmt.Errorf("Unrecognized value for ImportDocs: %#v", config.ImportDocs)
 	}
 
+	var importFilter *db.ImportFilterFunction
+	if config.ImportFilter != nil && *config.ImportFilter != "" {
+		if !importDocs {
+			base.Warn("Database %q has an import_filter but doesn't import docs", dbName)
+		}
+		var err error
+		if importFilter, err = db.NewImportFilterFunction(*config.ImportFilter); err != nil {
+			return nil, err
+		}
+	}
+
 	feedType := strings.ToLower(config.FeedType)
 
 	// Connect to the bucket and add the database:
@@ -211,6 +314,19 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 		if config.CacheConfig.CacheSkippedSeqMaxWait != nil && *config.CacheConfig.CacheSkippedSeqMaxWait > 0 {
 			cacheOptions.CacheSkippedSeqMaxWait = time.Duration(*config.CacheConfig.CacheSkippedSeqMaxWait) * time.Millisecond
 		}
+		if config.CacheConfig.ChannelCacheMinLength != nil && *config.CacheConfig.ChannelCacheMinLength > 0 {
+			cacheOptions.ChannelCacheMinLength = *config.CacheConfig.ChannelCacheMinLength
+		}
+		if config.CacheConfig.ChannelCacheMaxLength != nil && *config.CacheConfig.ChannelCacheMaxLength > 0 {
+			cacheOptions.ChannelCacheMaxLength = *config.CacheConfig.ChannelCacheMaxLength
+		}
+		if config.CacheConfig.ChannelCacheAge != nil && *config.CacheConfig.ChannelCacheAge > 0 {
+			cacheOptions.ChannelCacheAge = time.Duration(*config.CacheConfig.ChannelCacheAge) * time.Second
+		}
+		if cacheOptions.ChannelCacheMinLength > 0 && cacheOptions.ChannelCacheMaxLength > 0 &&
+			cacheOptions.ChannelCacheMinLength > cacheOptions.ChannelCacheMaxLength {
+			return nil, fmt.Errorf("channel_cache_min_length can't be greater than channel_cache_max_length")
+		}
 		// set EnableStarChannelLog directly here (instead of via NewDatabaseContext), so that it's set when we create the channels view in ConnectToBucket
 		if config.CacheConfig.EnableStarChannel != nil {
 			db.EnableStarChannelLog = *config.CacheConfig.EnableStarChannel
@@ -222,9 +338,49 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 		return nil, err
 	}
 
-	dbcontext, err := db.NewDatabaseContext(dbName, bucket, autoImport, cacheOptions)
+	// If the database has been renamed (see RenameDatabase) open it under its new name:
+	if renamed := loadDbName(bucket); renamed != "" && renamed != dbName {
+		if sc.databases_[renamed] != nil {
+			bucket.Close()
+			return nil, base.HTTPErrorf(http.StatusPreconditionFailed,
+				"Database %q was renamed to %q, which is already in use", dbName, renamed)
+		}
+		base.Logf("Database /%s was renamed to /%s; opening it under that name", dbName, renamed)
+		if config.Bucket == nil {
+			config.Bucket = &bucketName
+		}
+		config.Name = renamed
+		dbName = renamed
+	}
+
+	docShards := -1 // use whatever key scheme the database already has
+	if config.DocShards != nil {
+		docShards = *config.DocShards
+	}
+	dbcontext, err := db.NewImportingDatabaseContext(dbName, bucket, autoImport, importFilter, docShards, cacheOptions)
 	if err != nil {
 		return nil, err
+	} else if _, err := dbcontext.InitIdentity(sc.flushedEpochs[dbName]); err != nil {
+		return nil, err
+	}
+	delete(sc.flushedEpochs, dbName)
+
+	if options := config.SyncOptions; options != nil {
+		if options.TimeoutMs != nil {
+			dbcontext.SyncFnLimits.Timeout = time.Duration(*options.TimeoutMs) * time.Millisecond
+		}
+		if options.MaxInputSize != nil {
+			dbcontext.SyncFnLimits.MaxInputSize = *options.MaxInputSize
+		}
+		if options.Runtimes != nil {
+			if *options.Runtimes < 1 {
+				return nil, fmt.Errorf("sync_options.runtimes must be at least 1")
+			}
+			dbcontext.SyncFnLimits.Runtimes = *options.Runtimes
+		}
+		if err := dbcontext.SetSyncFnErrorPolicy(options.OnError, options.ErrorChannel); err != nil {
+			return nil, err
+		}
 	}
 
 	syncFn := ""
@@ -235,6 +391,18 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 		return nil, err
 	}
 
+	if config.ValidateDocUpdate != nil && *config.ValidateDocUpdate != "" {
+		if dbcontext.Validator, err = channels.NewDocValidator(*config.ValidateDocUpdate); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.OnCreate != nil && *config.OnCreate != "" {
+		if dbcontext.OnCreate, err = db.NewOnCreateFunction(*config.OnCreate); err != nil {
+			return nil, err
+		}
+	}
+
 	if importDocs {
 		db, _ := db.GetDatabase(dbcontext, nil)
 		if _, err := db.UpdateAllDocChannels(false, true); err != nil {
@@ -247,6 +415,67 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 	}
 
 	dbcontext.AllowEmptyPassword = config.AllowEmptyPassword
+	dbcontext.GuestReadOnly = config.GuestReadOnly
+	dbcontext.ImmutableFields = config.ImmutableFields
+	dbcontext.TagWrites = config.TagWrites
+	dbcontext.PlainSequences = config.SequenceTokens != nil && !*config.SequenceTokens
+
+	if config.TombstoneRetention != nil {
+		dbcontext.TombstoneRetention = time.Duration(*config.TombstoneRetention) * 24 * time.Hour
+	}
+	dbcontext.ExternalBodySize = config.ExternalBodySize
+
+	if config.WriteLog != nil {
+		if dbcontext.WriteLog, err = db.OpenWriteLog(config.WriteLog.Path, config.WriteLog.MaxSize); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ConflictResolution != nil {
+		policy := config.ConflictResolution
+		if dbcontext.ConflictResolver, err = db.NewConflictResolver(policy.Policy, policy.Function); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Attachments != nil {
+		dbcontext.Attachments = db.AttachmentRestrictions{
+			AllowedContentTypes: config.Attachments.AllowedTypes,
+			MaxCount:            config.Attachments.MaxCount,
+			Compress:            config.Attachments.Compress,
+		}
+		if dbcontext.AttachmentStore, err = db.NewAttachmentStore(config.Attachments.Store, bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Session != nil {
+		if config.Session.TTL != nil && *config.Session.TTL > 0 {
+			dbcontext.SessionOptions.TTL = time.Duration(*config.Session.TTL) * time.Second
+		}
+		if config.Session.IdleTimeout != nil {
+			dbcontext.SessionOptions.IdleTimeout = time.Duration(*config.Session.IdleTimeout) * time.Second
+		}
+		if config.Session.Sliding != nil {
+			dbcontext.SessionOptions.Sliding = *config.Session.Sliding
+		}
+	}
+
+	if config.ViewQueryTimeout != nil {
+		dbcontext.ViewQueryTimeout = time.Duration(*config.ViewQueryTimeout) * time.Second
+	}
+	if config.FetchConcurrency != nil {
+		if *config.FetchConcurrency < 1 {
+			return nil, fmt.Errorf("fetch_concurrency must be at least 1")
+		}
+		dbcontext.FetchConcurrency = *config.FetchConcurrency
+	}
+
+	if config.DocIDAlgorithm != "" {
+		if dbcontext.GenerateDocID, err = base.NewUUIDGenerator(config.DocIDAlgorithm); err != nil {
+			return nil, err
+		}
+	}
 
 	if dbcontext.ChannelMapper == nil {
 		base.Logf("Using default sync function 'channel(doc.channels)' for database %q", dbName)
@@ -257,6 +486,8 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 		return nil, err
 	} else if err := sc.installPrincipals(dbcontext, config.Users, "user"); err != nil {
 		return nil, err
+	} else if err := applyChannelGrants(dbcontext, config.ChannelGrants); err != nil {
+		return nil, err
 	}
 
 	// Install bucket-shadower if any:
@@ -285,6 +516,25 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 		dbcontext.EventMgr.Start(config.EventHandlers.MaxEventProc, int(customWaitTime))
 	}
 
+	// Check the bucket's design docs & metadata, so problems show up now rather than later:
+	if report := dbcontext.RunSelfCheck(); !report.OK {
+		base.Warn("Database %q failed some self-checks; see GET /%s/_status", dbName, dbName)
+	}
+
+	if config.StatsHistory != nil && sc.config.isHardened() {
+		base.Warn("Hardened profile: not recording stats history of database %q", dbName)
+	} else if config.StatsHistory != nil {
+		interval := db.DefaultStatsHistoryInterval
+		if config.StatsHistory.Interval != nil && *config.StatsHistory.Interval > 0 {
+			interval = time.Duration(*config.StatsHistory.Interval) * time.Second
+		}
+		retentionDays := db.DefaultStatsHistoryRetentionDays
+		if config.StatsHistory.RetentionDays != nil && *config.StatsHistory.RetentionDays > 0 {
+			retentionDays = int(*config.StatsHistory.RetentionDays)
+		}
+		dbcontext.StartStatsHistory(interval, retentionDays)
+	}
+
 	// Register it so HTTP handlers can find it:
 	sc.databases_[dbcontext.Name] = dbcontext
 
@@ -319,7 +569,7 @@ func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eve
 }
 
 func (sc *ServerContext) applySyncFunction(dbcontext *db.DatabaseContext, syncFn string) error {
-	changed, err := dbcontext.UpdateSyncFun(syncFn)
+	changed, err := dbcontext.UpdateSyncFunFromConfig(syncFn)
 	if err != nil || !changed {
 		return err
 	}
@@ -373,20 +623,115 @@ func (sc *ServerContext) startShadowing(dbcontext *db.DatabaseContext, shadow *S
 	return nil
 }
 
+// Removes a database and closes it. Its name stays reserved for DatabaseTombstoneTTL, during which
+// requests to it fail with a 410 status.
 func (sc *ServerContext) RemoveDatabase(dbName string) bool {
-	sc.lock.Lock()
-	defer sc.lock.Unlock()
+	return sc.removeDatabase(dbName, true)
+}
 
+func (sc *ServerContext) removeDatabase(dbName string, tombstone bool) bool {
+	sc.lock.Lock()
 	context := sc.databases_[dbName]
 	if context == nil {
+		sc.lock.Unlock()
 		return false
 	}
+	delete(sc.databases_, dbName)
+	delete(sc.config.Databases, dbName)
+	if tombstone {
+		sc.addDbTombstone(dbName, "")
+	}
+	sc.lock.Unlock()
+
+	// Handlers that already looked up the database may still be using it, so wait for their
+	// writes to finish (and refuse any more) before closing it:
+	context.MarkDeleted()
 	base.Logf("Closing db /%s (bucket %q)", context.Name, context.Bucket.GetName())
 	context.Close()
-	delete(sc.databases_, dbName)
 	return true
 }
 
+// Renames a database. Its old name stays reserved for DatabaseTombstoneTTL, during which requests
+// to it fail with a 410 status giving the new name. The new name is saved in the bucket, so the
+// database keeps it when the gateway restarts with its old config. (The tombstone is only kept
+// in this node's memory, though; other nodes don't reserve the old name, but they'll open the
+// database under its new name once they reload it.)
+func (sc *ServerContext) RenameDatabase(oldName, newName string) error {
+	if err := db.ValidateDatabaseName(newName); err != nil {
+		return err
+	}
+	sc.lock.Lock()
+	context := sc.databases_[oldName]
+	config := sc.config.Databases[oldName]
+	var err error
+	if context == nil {
+		err = base.HTTPErrorf(http.StatusNotFound, "no such database %q", oldName)
+	} else if config == nil {
+		err = base.HTTPErrorf(http.StatusInternalServerError, "No config for database %q", oldName)
+	} else if sc.databases_[newName] != nil {
+		err = base.HTTPErrorf(http.StatusPreconditionFailed, "Duplicate database name %q", newName)
+	} else if sc.checkDbTombstone(newName) != nil {
+		err = base.HTTPErrorf(http.StatusPreconditionFailed,
+			"Database name %q was in use recently; it can be reused after %v", newName, DatabaseTombstoneTTL)
+	}
+	sc.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Handlers that already looked up the database may still be using it under its old name, so
+	// rather than renaming it in place, open it under the new one, and only then remove the old
+	// one. The new name has to be saved first, or it'd be opened under the one in the bucket.
+	base.Logf("Renaming db /%s to /%s", oldName, newName)
+	prevSavedName := loadDbName(context.Bucket)
+	if err := saveDbName(context.Bucket, newName); err != nil {
+		return err
+	}
+	newConfig := *config
+	newConfig.Name = newName
+	if newConfig.Bucket == nil {
+		bucketName := context.Bucket.GetName()
+		newConfig.Bucket = &bucketName
+	}
+	if _, err := sc.getOrAddDatabaseFromConfig(&newConfig, false); err != nil {
+		base.Warn("Couldn't reopen db /%s as /%s: %v", oldName, newName, err)
+		if prevSavedName != "" {
+			saveDbName(context.Bucket, prevSavedName)
+		} else {
+			context.Bucket.Delete(kDbNameKey)
+		}
+		return err
+	}
+
+	sc.lock.Lock()
+	delete(sc.databases_, oldName)
+	delete(sc.config.Databases, oldName)
+	sc.addDbTombstone(oldName, newName)
+	sc.lock.Unlock()
+	context.MarkDeleted()
+	context.Close()
+	return nil
+}
+
+// Key of the bucket doc recording the name a database was renamed to.
+const kDbNameKey = "_sync:dbname"
+
+// Returns the name a bucket's database was renamed to, or "" if it hasn't been.
+func loadDbName(bucket base.Bucket) string {
+	var info struct {
+		Name string `json:"name"`
+	}
+	if err := bucket.Get(kDbNameKey, &info); err != nil {
+		return ""
+	}
+	return info.Name
+}
+
+// Records the new name of a bucket's database.
+func saveDbName(bucket base.Bucket, name string) error {
+	return bucket.Set(kDbNameKey, 0, db.Body{"name": name})
+}
+
 func (sc *ServerContext) installPrincipals(context *db.DatabaseContext, spec map[string]*db.PrincipalConfig, what string) error {
 	for name, princ := range spec {
 		isGuest := name == "GUEST"
@@ -411,6 +756,95 @@ func (sc *ServerContext) installPrincipals(context *db.DatabaseContext, spec map
 	return nil
 }
 
+// Key of the bucket doc recording the config channel grants last applied to a database.
+const kChannelGrantsKey = "_sync:channel_grants"
+
+// Makes the channels granted by a database config's "channel_grants" match newGrants, given
+// the grants that were applied before (if any), which are recorded in the bucket so that grants
+// taken out of the config while the database was offline still get revoked. Channels are only
+// added to (or removed from) the principals' admin channels, so grants made through the admin
+// API are left alone, unless they were also in the config and have been taken out of it since.
+func applyChannelGrants(context *db.DatabaseContext, newGrants map[string][]string) error {
+	var oldGrants map[string][]string
+	if err := context.Bucket.Get(kChannelGrantsKey, &oldGrants); err != nil && !base.IsDocNotFoundError(err) {
+		return fmt.Errorf("Couldn't read the channel grants applied before: %v", err)
+	}
+	names := map[string]bool{}
+	for name := range oldGrants {
+		names[name] = true
+	}
+	for name := range newGrants {
+		names[name] = true
+	}
+	for name := range names {
+		isUser := true
+		principalName := name
+		if strings.HasPrefix(name, "role:") {
+			isUser = false
+			principalName = name[len("role:"):]
+		}
+		granted := base.SetFromArray(newGrants[name])
+		var removed []string
+		for _, channel := range oldGrants[name] {
+			if !granted.Contains(channel) {
+				removed = append(removed, channel)
+			}
+		}
+		ops := []db.PrincipalPatchOp{}
+		if len(removed) > 0 {
+			ops = append(ops, db.PrincipalPatchOp{Op: "remove", Path: "/admin_channels",
+				Value: stringsToInterfaces(removed)})
+		}
+		if len(newGrants[name]) > 0 {
+			ops = append(ops, db.PrincipalPatchOp{Op: "add", Path: "/admin_channels",
+				Value: stringsToInterfaces(newGrants[name])})
+		}
+		if len(ops) == 0 {
+			continue
+		}
+		changed, err := context.PatchPrincipal(principalName, isUser, ops)
+		if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
+			base.Warn("Database %q: can't grant channels to nonexistent %q", context.Name, name)
+		} else if err != nil {
+			return fmt.Errorf("Couldn't grant channels to %q: %v", name, err)
+		} else if changed {
+			base.Logf("    Updated channels granted to %q", name)
+		}
+	}
+	if len(newGrants) == 0 {
+		if err := context.Bucket.Delete(kChannelGrantsKey); err != nil && !base.IsDocNotFoundError(err) {
+			return err
+		}
+		return nil
+	}
+	return context.Bucket.Set(kChannelGrantsKey, 0, newGrants)
+}
+
+func stringsToInterfaces(strs []string) []interface{} {
+	result := make([]interface{}, len(strs))
+	for i, str := range strs {
+		result[i] = str
+	}
+	return result
+}
+
+// Applies a new set of config channel grants to a running database, replacing the ones last
+// applied to it. Does nothing if the database isn't loaded.
+func (sc *ServerContext) UpdateChannelGrants(dbName string, grants map[string][]string) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	dbcontext := sc.databases_[dbName]
+	config := sc.config.Databases[dbName]
+	if dbcontext == nil || config == nil {
+		return nil
+	}
+	if err := applyChannelGrants(dbcontext, grants); err != nil {
+		return err
+	}
+	config.ChannelGrants = grants
+	return nil
+}
+
 // Fetch a configuration for a database from the ConfigServer
 func (sc *ServerContext) getDbConfigFromServer(dbName string) (*DbConfig, error) {
 	if sc.config.ConfigServer == nil {
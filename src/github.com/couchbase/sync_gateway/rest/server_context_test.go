@@ -15,8 +15,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
 )
 
 // Tests the ConfigServer feature.
@@ -49,6 +54,59 @@ func TestConfigServer(t *testing.T) {
 	rt.bucket() // no-op that just keeps rt from being GC'd/finalized (bug CBL-9)
 }
 
+// Tests the hardened profile's restrictions on the admin API.
+func TestHardenedProfile(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendAdminRequest("GET", "/_expvar", ""), 200)
+
+	hardened := true
+	rt.ServerContext().config.Hardened = &hardened
+	assertStatus(t, rt.sendAdminRequest("GET", "/_expvar", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/_debug/pprof/goroutine", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/_admin/", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_dumpchannel/foo", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/_config", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/_logging", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_config", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_stats_history", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_raw/doc", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_user/snej/_channel_history", ""), 404)
+	// Replication-related admin APIs are still available:
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/snej", `{"password":"letmein"}`), 201)
+
+	assert.Equals(t, loopbackInterface("127.0.0.1:4985"), "127.0.0.1:4985")
+	assert.Equals(t, loopbackInterface("localhost:4985"), "localhost:4985")
+	assert.Equals(t, loopbackInterface("[::1]:4985"), "[::1]:4985")
+	assert.Equals(t, loopbackInterface(":4985"), "127.0.0.1:4985")
+	assert.Equals(t, loopbackInterface("10.0.0.5:9000"), "127.0.0.1:9000")
+
+	config := &ServerConfig{Hardened: &hardened, AdminInterface: &DefaultInterface}
+	config.applyHardening()
+	assert.Equals(t, *config.AdminInterface, "127.0.0.1:4984")
+	assert.True(t, config.ProfileInterface == nil)
+}
+
+// Tests that privileged operations are only on the admin listener, which needs its own address.
+func TestAdminListener(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/snej", `{"password":"letmein"}`), 201)
+	assertStatus(t, rt.sendRequest("GET", "/db/_user/snej", ""), 404)
+	assertStatus(t, rt.sendRequest("GET", "/db/_raw/doc", ""), 404)
+	assertStatus(t, rt.sendRequest("DELETE", "/db/", ""), 405)
+
+	checkInterfaces := func(public, admin string) error {
+		config := &ServerConfig{Interface: &public, AdminInterface: &admin}
+		return config.checkInterfaces()
+	}
+	assert.Equals(t, checkInterfaces(":4984", "127.0.0.1:4985"), nil)
+	assert.Equals(t, checkInterfaces("10.0.0.5:4984", "127.0.0.1:4984"), nil)
+	assert.True(t, checkInterfaces(":4984", "127.0.0.1:4984") != nil)
+	assert.True(t, checkInterfaces("127.0.0.1:4984", ":4984") != nil)
+	assert.True(t, checkInterfaces("127.0.0.1:4984", "127.0.0.1:4984") != nil)
+	assert.True(t, checkInterfaces(":4984", "nonsense") != nil)
+}
+
 //////// MOCK HTTP CLIENT: (TODO: Move this into a separate package)
 
 // Creates a filled-in http.Response from minimal details
@@ -97,3 +155,123 @@ func (client *MockClient) RespondToGET(url string, response *http.Response) {
 	tripper := client.Transport.(*mockTripper)
 	tripper.getURLs[url] = response
 }
+
+// Tests the "channel_grants" database config property, and reapplying it on reload.
+func TestConfigChannelGrants(t *testing.T) {
+	server := "walrus:"
+	bucketName := "sync_gateway_test_grants"
+	password := "letmein"
+	sc := NewServerContext(&ServerConfig{})
+	defer func() { sc.Close() }()
+	_, err := sc.AddDatabaseFromConfig(&DbConfig{
+		Server: &server,
+		Bucket: &bucketName,
+		Name:   "db",
+		Users: map[string]*db.PrincipalConfig{
+			"alice": &db.PrincipalConfig{ExplicitChannels: base.SetOf("own"), Password: &password},
+		},
+		Roles: map[string]*db.PrincipalConfig{"editor": &db.PrincipalConfig{}},
+		ChannelGrants: map[string][]string{
+			"alice":       {"news", "sports"},
+			"role:editor": {"drafts"},
+			"nobody":      {"news"},
+		},
+	})
+	assert.Equals(t, err, nil)
+	dbc := sc.Database("db")
+
+	alice, _ := dbc.GetPrincipal("alice", true)
+	assert.DeepEquals(t, alice.ExplicitChannels, base.SetOf("own", "news", "sports"))
+	editor, _ := dbc.GetPrincipal("editor", false)
+	assert.DeepEquals(t, editor.ExplicitChannels, base.SetOf("drafts"))
+
+	// Reapplying is a no-op; taking a channel out of the config revokes it, leaving the others:
+	assert.Equals(t, sc.UpdateChannelGrants("db", sc.GetDatabaseConfig("db").ChannelGrants), nil)
+	assert.Equals(t, sc.UpdateChannelGrants("db", map[string][]string{"alice": {"news"}}), nil)
+	alice, _ = dbc.GetPrincipal("alice", true)
+	assert.DeepEquals(t, alice.ExplicitChannels, base.SetOf("own", "news"))
+	editor, _ = dbc.GetPrincipal("editor", false)
+	assert.Equals(t, len(editor.ExplicitChannels), 0)
+
+	// Unknown databases are ignored:
+	assert.Equals(t, sc.UpdateChannelGrants("nosuchdb", map[string][]string{"alice": {"x"}}), nil)
+
+	// A grant taken out of the config while the server was down is revoked when it restarts:
+	config := *sc.GetDatabaseConfig("db")
+	config.ChannelGrants = nil
+	sc.Close()
+	sc = NewServerContext(&ServerConfig{})
+	dbc, err = sc.AddDatabaseFromConfig(&config)
+	assert.Equals(t, err, nil)
+	alice, _ = dbc.GetPrincipal("alice", true)
+	assert.DeepEquals(t, alice.ExplicitChannels, base.SetOf("own"))
+}
+
+// A session TTL of 0 in the config means the default.
+func TestConfigSessionTTLZero(t *testing.T) {
+	server := "walrus:"
+	bucketName := "sync_gateway_test_session_ttl"
+	ttl := uint32(0)
+	sc := NewServerContext(&ServerConfig{})
+	defer sc.Close()
+	dbc, err := sc.AddDatabaseFromConfig(&DbConfig{
+		Server:  &server,
+		Bucket:  &bucketName,
+		Name:    "db",
+		Session: &SessionConfig{TTL: &ttl},
+	})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, dbc.SessionOptions.TTL, auth.DefaultSessionOptions.TTL)
+}
+
+func TestDatabaseTombstones(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc", `{}`), 201)
+	database, _ := db.GetDatabase(rt.ServerContext().Database("db"), nil)
+
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/", ""), 200)
+	response := rt.sendRequest("GET", "/db/doc", "")
+	assertStatus(t, response, 410)
+	assert.True(t, bytes.Contains(response.Body.Bytes(), []byte("has been deleted")))
+
+	// A handler still holding the database can't write to it:
+	_, err := database.Put("doc2", db.Body{})
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, 410)
+
+	// The name can't be reused until the tombstone expires:
+	walrusConfig := `{"server": "walrus:", "bucket": "tombstone_test"}`
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/", walrusConfig), 412)
+	defer func(ttl time.Duration) { DatabaseTombstoneTTL = ttl }(DatabaseTombstoneTTL)
+	DatabaseTombstoneTTL = 0
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/", walrusConfig), 201)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/", ""), 200)
+}
+
+func TestRenameDatabase(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc", `{}`), 201)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_rename", `{"new_name": "Bad Name"}`), 400)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_rename", `{}`), 400)
+
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_rename", `{"new_name": "renamed"}`), 200)
+	assertStatus(t, rt.sendRequest("GET", "/renamed/doc", ""), 200)
+	response := rt.sendAdminRequest("GET", "/renamed/", "")
+	assertStatus(t, response, 200)
+	assert.True(t, bytes.Contains(response.Body.Bytes(), []byte(`"db_name":"renamed"`)))
+	assert.True(t, rt.ServerContext().GetDatabaseConfig("renamed") != nil)
+
+	response = rt.sendRequest("GET", "/db/doc", "")
+	assertStatus(t, response, 410)
+	assert.True(t, bytes.Contains(response.Body.Bytes(), []byte(`renamed to \"renamed\"`)))
+
+	// After a restart with the original config, the database still has its new name:
+	config := *rt.ServerContext().GetDatabaseConfig("renamed")
+	config.Name = "db"
+	sc := NewServerContext(&ServerConfig{})
+	defer sc.Close()
+	dbcontext, err := sc.AddDatabaseFromConfig(&config)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, dbcontext.Name, "renamed")
+	assert.True(t, sc.GetDatabaseConfig("renamed") != nil)
+}
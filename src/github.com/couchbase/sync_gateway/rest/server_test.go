@@ -0,0 +1,95 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Starts a server on free local ports, with a database "db" in its own walrus bucket.
+func startTestServer(t *testing.T) *Server {
+	walrus := "walrus:"
+	bucketName := fmt.Sprintf("sync_gateway_test_%d", gBucketCounter)
+	gBucketCounter++
+	publicAddr, adminAddr := "127.0.0.1:0", "127.0.0.1:0"
+	server, err := NewServer(&ServerConfig{
+		Interface:      &publicAddr,
+		AdminInterface: &adminAddr,
+		Databases: DbConfigMap{
+			"db": {Name: "db", Server: &walrus, Bucket: &bucketName},
+		},
+	})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, server.Start(), nil)
+	return server
+}
+
+func TestMultipleServers(t *testing.T) {
+	server1 := startTestServer(t)
+	server2 := startTestServer(t)
+	assert.True(t, server1.AdminAddr() != server2.AdminAddr())
+	assert.True(t, server1.PublicAddr() != server1.AdminAddr())
+
+	request := func(method, addr, path, body string) int {
+		rq, _ := http.NewRequest(method, "http://"+addr+path, bytes.NewBufferString(body))
+		response, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			return 0
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	// Each server has its own database:
+	assert.Equals(t, request("PUT", server1.AdminAddr(), "/db/doc", `{"n": 1}`), 201)
+	assert.Equals(t, request("GET", server1.AdminAddr(), "/db/doc", ""), 200)
+	assert.Equals(t, request("GET", server2.AdminAddr(), "/db/doc", ""), 404)
+	assert.Equals(t, request("GET", server2.PublicAddr(), "/db/", ""), 401)
+
+	// Closing one leaves the other running:
+	addr1 := server1.AdminAddr()
+	server1.Close()
+	assert.Equals(t, request("GET", addr1, "/db/doc", ""), 0)
+	assert.Equals(t, request("GET", server2.AdminAddr(), "/", ""), 200)
+	server2.Close()
+}
+
+func TestParseCommandLineArgs(t *testing.T) {
+	config, paths, err := ParseCommandLineArgs([]string{"-interface", "127.0.0.1:4000", "-bucket", "b", "-pretty"})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(paths), 0)
+	assert.Equals(t, *config.Interface, "127.0.0.1:4000")
+	assert.Equals(t, *config.AdminInterface, DefaultAdminInterface)
+	assert.True(t, config.Pretty)
+	assert.Equals(t, *config.Databases["b"].Bucket, "b")
+	assert.DeepEquals(t, config.Log, []string{"HTTP"})
+
+	// Log flags are returned in the config, not applied:
+	config, _, err = ParseCommandLineArgs([]string{"-verbose", "-log", "ParseTest1,ParseTest2+"})
+	assert.Equals(t, err, nil)
+	assert.DeepEquals(t, config.Log, []string{"HTTP", "HTTP+", "ParseTest1", "ParseTest2+"})
+	assert.False(t, base.LogKeys["ParseTest1"])
+
+	// Parsing again starts afresh:
+	config, _, err = ParseCommandLineArgs([]string{})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, *config.Interface, DefaultInterface)
+	assert.False(t, config.Pretty)
+
+	_, _, err = ParseCommandLineArgs([]string{"-nosuchflag"})
+	assert.True(t, err != nil)
+}
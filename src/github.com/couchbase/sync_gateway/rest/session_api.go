@@ -16,11 +16,8 @@ import (
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
-	"github.com/couchbase/sync_gateway/db"
 )
 
-const kDefaultSessionTTL = 24 * time.Hour
-
 // Respond with a JSON struct containing info about the current login session
 func (h *handler) respondWithSessionInfo() error {
 
@@ -54,6 +51,10 @@ func (h *handler) handleSessionPOST() error {
 	if err != nil {
 		return err
 	}
+	h.authMethod, h.authName = "password", params.Name
+	if err = h.checkLoginThrottle(h.db.Name, params.Name); err != nil {
+		return err
+	}
 	var user auth.User
 	user, err = h.db.Authenticator().GetUser(params.Name)
 	if err != nil {
@@ -63,6 +64,11 @@ func (h *handler) handleSessionPOST() error {
 	if user != nil && !user.Authenticate(params.Password) {
 		user = nil
 	}
+	if user == nil {
+		h.noteLoginFailure(h.db.Name, params.Name)
+	} else {
+		h.noteLoginSuccess(h.db.Name, params.Name)
+	}
 	return h.makeSession(user)
 }
 
@@ -72,6 +78,9 @@ func (h *handler) handleSessionDELETE() error {
 		// CORS not allowed for login #115
 		return base.HTTPErrorf(http.StatusBadRequest, "No CORS")
 	}
+	if sessionID := auth.SessionIDFromHeader(h.rq); sessionID != "" {
+		return h.db.Authenticator().DeleteSession(sessionID)
+	}
 	cookie := h.db.Authenticator().DeleteSessionForCookie(h.rq)
 	if cookie == nil {
 		return base.HTTPErrorf(http.StatusNotFound, "no session")
@@ -86,14 +95,22 @@ func (h *handler) makeSession(user auth.User) error {
 	}
 	h.user = user
 	auth := h.db.Authenticator()
-	session, err := auth.CreateSession(user.Name(), kDefaultSessionTTL)
+	session, err := auth.CreateSessionWithOptions(user.Name(), h.db.SessionOptions)
 	if err != nil {
 		return err
 	}
 	cookie := auth.MakeSessionCookie(session)
 	cookie.Path = "/" + h.db.Name + "/"
 	http.SetCookie(h.response, cookie)
-	return h.respondWithSessionInfo()
+	h.auditSession(session)
+
+	// Also return the session ID in the body, for clients that would rather send it in an
+	// Authorization header than manage cookies:
+	response := h.formatSessionResponse(h.user)
+	response.SessionID = session.ID
+	response.Expires = &session.Expiration
+	h.writeJSON(response)
+	return nil
 }
 
 func (h *handler) makeSessionFromEmail(email string, createUserIfNeeded bool) error {
@@ -124,9 +141,9 @@ func (h *handler) makeSessionFromEmail(email string, createUserIfNeeded bool) er
 }
 
 // MakeSessionFromUserAndEmail first attempts to find the user by username.  If found, updates the users's
-// email if different. If no match for username, attempts to find by the user by email.
+// email if different. If no match for username, and matchEmail=true, attempts to find by the user by email.
 // If not found, and createUserIfNeeded=true, creates a new user based on username, email.
-func (h *handler) makeSessionFromNameAndEmail(username, email string, createUserIfNeeded bool) error {
+func (h *handler) makeSessionFromNameAndEmail(username, email string, matchEmail, createUserIfNeeded bool) error {
 
 	// Username and email are verified. Look up the user and make a login session for her - first
 	// attempt lookup by name
@@ -138,12 +155,12 @@ func (h *handler) makeSessionFromNameAndEmail(username, email string, createUser
 	// If user found, check whether the email needs to be updated (e.g. user has changed email in
 	// external auth system)
 	if user != nil {
-		if email != user.Email() {
+		if email != "" && email != user.Email() {
 			if err := user.SetEmail(email); err == nil {
 				h.db.Authenticator().Save(user)
 			}
 		}
-	} else {
+	} else if email != "" && matchEmail {
 		// User not found by name.  Attempt user lookup by email.  This provides backward
 		// compatibility for users that were originally created with id = email
 		user, err = h.db.Authenticator().GetUserByEmail(email)
@@ -177,7 +194,7 @@ func (h *handler) createUserSession() error {
 		Name string `json:"name"`
 		TTL  int    `json:"ttl"`
 	}
-	params.TTL = int(kDefaultSessionTTL / time.Second)
+	params.TTL = int(h.db.SessionOptions.TTL / time.Second)
 	err := h.readJSONInto(&params)
 	if err != nil {
 		return err
@@ -194,10 +211,13 @@ func (h *handler) createUserSession() error {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid or missing ttl")
 	}
 
-	session, err := h.db.Authenticator().CreateSession(params.Name, ttl)
+	options := h.db.SessionOptions
+	options.TTL = ttl
+	session, err := h.db.Authenticator().CreateSessionWithOptions(params.Name, options)
 	if err != nil {
 		return err
 	}
+	h.auditSession(session)
 	var response struct {
 		SessionID  string    `json:"session_id"`
 		Expires    time.Time `json:"expires"`
@@ -281,34 +301,29 @@ func (h *handler) respondWithSessionInfoForSession(session *auth.LoginSession) e
 		return err
 	}
 
-	response := h.formatSessionResponse(user)
-	if response != nil {
-		h.writeJSON(response)
-	}
+	h.writeJSON(h.formatSessionResponse(user))
 	return nil
 }
 
 // Formats session response similar to what is returned by CouchDB
-func (h *handler) formatSessionResponse(user auth.User) db.Body {
-
-	var name *string
-	allChannels := channels.TimedSet{}
-
+func (h *handler) formatSessionResponse(user auth.User) sessionResponse {
+	userCtx := userContext{Channels: channels.TimedSet{}, Roles: []string{}}
 	if user != nil {
 		userName := user.Name()
 		if userName != "" {
-			name = &userName
+			userCtx.Name = &userName
 		}
-		allChannels = user.Channels()
+		// Include channels inherited from roles, since those are also readable:
+		if allChannels := user.InheritedChannels(); allChannels != nil {
+			userCtx.Channels = allChannels
+		}
+		userCtx.Roles = sortedNames(user.RoleNames())
 	}
 
 	// Return a JSON struct similar to what CouchDB returns:
-	userCtx := db.Body{"name": name, "channels": allChannels}
 	handlers := []string{"default", "cookie"}
 	if h.PersonaEnabled() {
 		handlers = append(handlers, "persona")
 	}
-	response := db.Body{"ok": true, "userCtx": userCtx, "authentication_handlers": handlers}
-	return response
-
+	return sessionResponse{OK: true, UserCtx: userCtx, AuthenticationHandlers: handlers}
 }